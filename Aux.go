@@ -0,0 +1,67 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrAuxNotSupported is returned by the CredentaDB functions that need to keep auxiliary records, such as indexes,
+// when the Store does not implement AuxStore.
+var ErrAuxNotSupported = errors.New("store does not support auxiliary records")
+
+// auxKeySeparator separates the parts of an auxiliary record key, see auxKey.
+const auxKeySeparator = "\x1f"
+
+// AuxStore is implemented by Store that is able to keep auxiliary records besides users and groups, such as the
+// secondary indexes. An auxiliary record is an opaque value identified by a bucket and a key. Keys are made of parts
+// joined by the unit separator character (0x1F), which must not appear within the parts. Values must not be empty.
+// Implementations must return an error that satisfy errors.Is(err, ErrNotFound) when a record is not exist.
+type AuxStore interface {
+	// GetAux load the value of the record with specified key in the bucket.
+	GetAux(ctx context.Context, bucket, key string) ([]byte, error)
+	// PutAux create or replace the value of the record with specified key in the bucket.
+	PutAux(ctx context.Context, bucket, key string, value []byte) error
+	// DeleteAux remove the record with specified key from the bucket.
+	DeleteAux(ctx context.Context, bucket, key string) error
+	// ScanAux call fn for every record in the bucket whose key starts with prefix, in ascending key order.
+	// Scanning stops at the first error returned by fn, which is returned as is.
+	ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error
+}
+
+// auxBuckets are all the auxiliary record buckets used by CredentaDB, every key of them starts with the realm.
+var auxBuckets = []string{auxIndexBucket, auxMemberBucket, auxChildBucket, auxTrashBucket, auxHistoryBucket}
+
+// auxKey joins the parts into an auxiliary record key.
+func auxKey(parts ...string) string {
+	return strings.Join(parts, auxKeySeparator)
+}
+
+// auxPrefix returns the prefix of every auxiliary record key that starts with the parts.
+func auxPrefix(parts ...string) string {
+	return auxKey(parts...) + auxKeySeparator
+}
+
+// splitAuxKey split an auxiliary record key into its parts.
+func splitAuxKey(key string) []string {
+	return strings.Split(key, auxKeySeparator)
+}
+
+// auxStore returns the Store as AuxStore sealing the values of the trash and history (see EnableEncryption),
+// or ErrAuxNotSupported.
+func (store *CredentaDB) auxStore() (AuxStore, error) {
+	aux, err := store.rawAuxStore()
+	if err != nil {
+		return nil, err
+	}
+	return &sealingAuxStore{AuxStore: aux, keys: store.keys}, nil
+}
+
+// rawAuxStore returns the Store as AuxStore, with the values as they are stored, or ErrAuxNotSupported.
+func (store *CredentaDB) rawAuxStore() (AuxStore, error) {
+	aux, ok := store.Store.(AuxStore)
+	if !ok {
+		return nil, ErrAuxNotSupported
+	}
+	return aux, nil
+}
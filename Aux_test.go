@@ -0,0 +1,75 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newTestStores creates an empty store of every backend, they are closed when the test ends.
+func newTestStores(t *testing.T) map[string]Store {
+	ss, err := NewSQLiteStore(t.TempDir() + "/credenta.db")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ss.Close() })
+	bs, err := NewBoltStore(t.TempDir() + "/credenta.bolt")
+	assert.NoError(t, err)
+	t.Cleanup(func() { bs.Close() })
+	return map[string]Store{
+		"FILE":    newTestFileStore(t),
+		"SHARDED": newTestShardedFileStore(t, 1),
+		"SQLITE":  ss,
+		"BOLT":    bs,
+		"MEMORY":  NewMemoryStore(),
+	}
+}
+
+func TestAuxStore(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			aux := store.(AuxStore)
+			ctx := context.Background()
+
+			_, err := aux.GetAux(ctx, "b", auxKey("R", "x"))
+			assert.True(t, errors.Is(err, ErrNotFound))
+			assert.True(t, errors.Is(aux.DeleteAux(ctx, "b", auxKey("R", "x")), ErrNotFound))
+
+			for _, key := range []string{auxKey("R", "b", "2"), auxKey("R", "a.b@c", "1"), auxKey("R", "b"), auxKey("R2", "a"), auxKey("R", "a")} {
+				assert.NoError(t, aux.PutAux(ctx, "b", key, []byte(key)))
+			}
+			assert.NoError(t, aux.PutAux(ctx, "other", auxKey("R", "a"), []byte("other")))
+			assert.NoError(t, aux.PutAux(ctx, "b", auxKey("R", "a"), []byte("replaced")))
+
+			value, err := aux.GetAux(ctx, "b", auxKey("R", "a"))
+			assert.NoError(t, err)
+			assert.Equal(t, "replaced", string(value))
+
+			keys := make([]string, 0)
+			assert.NoError(t, aux.ScanAux(ctx, "b", auxPrefix("R"), func(key string, _ []byte) error {
+				keys = append(keys, key)
+				return nil
+			}))
+			assert.Equal(t, []string{auxKey("R", "a"), auxKey("R", "a.b@c", "1"), auxKey("R", "b"), auxKey("R", "b", "2")}, keys)
+
+			keys = keys[:0]
+			assert.NoError(t, aux.ScanAux(ctx, "b", auxPrefix("R", "a.b@c"), func(key string, value []byte) error {
+				assert.Equal(t, key, string(value))
+				keys = append(keys, key)
+				return nil
+			}))
+			assert.Equal(t, []string{auxKey("R", "a.b@c", "1")}, keys)
+
+			assert.NoError(t, aux.DeleteAux(ctx, "b", auxKey("R", "a.b@c", "1")))
+			count := 0
+			assert.NoError(t, aux.ScanAux(ctx, "b", "", func(key string, _ []byte) error {
+				count++
+				return nil
+			}))
+			assert.Equal(t, 4, count)
+			assert.NoError(t, aux.ScanAux(ctx, "missing", "", func(key string, _ []byte) error {
+				t.Fail()
+				return nil
+			}))
+		})
+	}
+}
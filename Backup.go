@@ -0,0 +1,389 @@
+package credenta
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// BackupFormat identifies a credenta backup archive.
+	BackupFormat = "credenta-backup"
+	// BackupVersion is the version of the archive written by Backup. Restore reads archives up to this version.
+	BackupVersion = 1
+
+	backupHeader  = "header"
+	backupUser    = "user"
+	backupGroup   = "group"
+	backupAux     = "aux"
+	backupTrailer = "trailer"
+)
+
+// ErrInvalidBackup is returned (possibly wrapped) by Restore when the archive is not a valid credenta backup, is
+// truncated, or does not match its checksums.
+var ErrInvalidBackup = errors.New("invalid backup archive")
+
+// BackupManifest describe a backup archive.
+type BackupManifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy"`
+	// Realms are the realms in the archive, sorted.
+	Realms []string `json:"realms"`
+	// RealmFilter are the realms requested when the archive was made, empty for every realm.
+	RealmFilter []string `json:"realmFilter,omitempty"`
+	Users       int      `json:"users"`
+	Groups      int      `json:"groups"`
+	// AuxRecords are the auxiliary records, such as indexes, history and trash, when the Store implements AuxStore.
+	AuxRecords int `json:"auxRecords"`
+	// Checksum is the SHA-256 of the checksums of every record, in archive order.
+	Checksum string `json:"checksum"`
+}
+
+// backupEntry is a line of the archive. The first line is the header and the last one the trailer, both holding the
+// manifest, every line in between is a record.
+type backupEntry struct {
+	Kind     string          `json:"kind"`
+	Manifest *BackupManifest `json:"manifest,omitempty"`
+	Realm    string          `json:"realm,omitempty"`
+	Bucket   string          `json:"bucket,omitempty"`
+	Key      string          `json:"key,omitempty"`
+	Data     []byte          `json:"data,omitempty"`
+	Checksum string          `json:"checksum,omitempty"`
+}
+
+// checksum returns the SHA-256 of the record, including where it belongs.
+func (entry *backupEntry) checksum() string {
+	hasher := sha256.New()
+	hasher.Write([]byte(auxKey(entry.Kind, entry.Realm, entry.Bucket, entry.Key)))
+	hasher.Write([]byte(auxKeySeparator))
+	hasher.Write(entry.Data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Backup writes every user, group and auxiliary record of the specified realms, or of every realm if none is
+// specified, into w as a single gzip compressed archive. Roles are kept within the users' and groups' role masks.
+// Records changed while the backup runs may or may not be included.
+func (store *CredentaDB) Backup(ctx context.Context, w io.Writer, realms ...string) (*BackupManifest, error) {
+	manifest := &BackupManifest{
+		Format:      BackupFormat,
+		Version:     BackupVersion,
+		CreatedAt:   time.Now(),
+		CreatedBy:   ctx.Value(ETX_USER).(string),
+		RealmFilter: realms,
+	}
+	zw := gzip.NewWriter(w)
+	buffered := bufio.NewWriter(zw)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(&backupEntry{Kind: backupHeader, Manifest: manifest}); err != nil {
+		return nil, fmt.Errorf("in Backup function. error writing header: %w", err)
+	}
+
+	found := make(map[string]bool)
+	summer := sha256.New()
+	write := func(entry *backupEntry) error {
+		entry.Checksum = entry.checksum()
+		summer.Write([]byte(entry.Checksum))
+		found[entry.Realm] = true
+		return encoder.Encode(entry)
+	}
+
+	err := store.WalkUserIDs(ctx, func(realm, id string) error {
+		if len(realms) > 0 && !containsString(realms, realm) {
+			return nil
+		}
+		user, err := store.Store.GetUser(ctx, realm, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		manifest.Users++
+		return write(&backupEntry{Kind: backupUser, Realm: realm, Key: id, Data: data})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in Backup function. error writing users: %w", err)
+	}
+	err = store.WalkGroupNames(ctx, func(realm, name string) error {
+		if len(realms) > 0 && !containsString(realms, realm) {
+			return nil
+		}
+		group, err := store.Store.GetGroup(ctx, realm, name)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		manifest.Groups++
+		return write(&backupEntry{Kind: backupGroup, Realm: realm, Key: name, Data: data})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in Backup function. error writing groups: %w", err)
+	}
+	if aux, err := store.rawAuxStore(); err == nil {
+		for _, bucket := range auxBuckets {
+			err := aux.ScanAux(ctx, bucket, "", func(key string, value []byte) error {
+				realm := splitAuxKey(key)[0]
+				if len(realms) > 0 && !containsString(realms, realm) {
+					return nil
+				}
+				manifest.AuxRecords++
+				return write(&backupEntry{Kind: backupAux, Realm: realm, Bucket: bucket, Key: key, Data: value})
+			})
+			if err != nil {
+				return nil, fmt.Errorf("in Backup function. error writing %s records: %w", bucket, err)
+			}
+		}
+	}
+
+	manifest.Realms = sortedKeys(found)
+	manifest.Checksum = hex.EncodeToString(summer.Sum(nil))
+	if err := encoder.Encode(&backupEntry{Kind: backupTrailer, Manifest: manifest}); err != nil {
+		return nil, fmt.Errorf("in Backup function. error writing trailer: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return nil, fmt.Errorf("in Backup function. error writing archive: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("in Backup function. error writing archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// Restore replace the content of the specified realms, or of every realm in the archive if none is specified, by the
+// content of the archive made by Backup. Users, groups and auxiliary records of those realms that are not in the
+// archive are removed. The whole archive is read and verified before anything is written, so an invalid archive
+// leaves the Store untouched. Records are written as they were, with their versions, so the Store should not be used
+// while restoring.
+func (store *CredentaDB) Restore(ctx context.Context, r io.Reader, realms ...string) (*BackupManifest, error) {
+	manifest, entries, err := readBackup(r)
+	if err != nil {
+		return nil, fmt.Errorf("in Restore function. %w", err)
+	}
+	for _, realm := range realms {
+		if !containsString(manifest.Realms, realm) && (len(manifest.RealmFilter) == 0 || !containsString(manifest.RealmFilter, realm)) {
+			return nil, fmt.Errorf("in Restore function. realm %s is not in the archive", realm)
+		}
+	}
+	if len(realms) == 0 {
+		realms = manifest.Realms
+	}
+	aux, auxErr := store.rawAuxStore()
+	if manifest.AuxRecords > 0 && auxErr != nil {
+		return nil, fmt.Errorf("in Restore function. archive has auxiliary records: %w", auxErr)
+	}
+
+	// what the archive holds, to know what to remove afterward.
+	keep := make(map[string]bool)
+	for _, entry := range entries {
+		if !containsString(realms, entry.Realm) {
+			continue
+		}
+		keep[auxKey(entry.Kind, entry.Bucket, entry.Key, entry.Realm)] = true
+		switch entry.Kind {
+		case backupUser:
+			user := &CUser{}
+			if err := json.Unmarshal(entry.Data, user); err != nil {
+				return nil, err
+			}
+			if err := store.restoreRecord(ctx, RecordUser, user.Realm, user.Id, func() error { return store.Store.PutUser(ctx, user) }); err != nil {
+				return nil, fmt.Errorf("in Restore function. error writing user %s: %w", user.Id, err)
+			}
+		case backupGroup:
+			group := &CGroup{}
+			if err := json.Unmarshal(entry.Data, group); err != nil {
+				return nil, err
+			}
+			if err := store.restoreRecord(ctx, RecordGroup, group.Realm, group.Name, func() error { return store.Store.PutGroup(ctx, group) }); err != nil {
+				return nil, fmt.Errorf("in Restore function. error writing group %s: %w", group.Name, err)
+			}
+		case backupAux:
+			if err := aux.PutAux(ctx, entry.Bucket, entry.Key, entry.Data); err != nil {
+				return nil, fmt.Errorf("in Restore function. error writing %s record: %w", entry.Bucket, err)
+			}
+		}
+	}
+
+	stale := make([]*backupEntry, 0)
+	err = store.WalkUserIDs(ctx, func(realm, id string) error {
+		if containsString(realms, realm) && !keep[auxKey(backupUser, "", id, realm)] {
+			stale = append(stale, &backupEntry{Kind: backupUser, Realm: realm, Key: id})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in Restore function. error listing users: %w", err)
+	}
+	err = store.WalkGroupNames(ctx, func(realm, name string) error {
+		if containsString(realms, realm) && !keep[auxKey(backupGroup, "", name, realm)] {
+			stale = append(stale, &backupEntry{Kind: backupGroup, Realm: realm, Key: name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in Restore function. error listing groups: %w", err)
+	}
+	if auxErr == nil {
+		for _, bucket := range auxBuckets {
+			for _, realm := range realms {
+				err := aux.ScanAux(ctx, bucket, auxPrefix(realm), func(key string, _ []byte) error {
+					if !keep[auxKey(backupAux, bucket, key, realm)] {
+						stale = append(stale, &backupEntry{Kind: backupAux, Realm: realm, Bucket: bucket, Key: key})
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, fmt.Errorf("in Restore function. error listing %s records: %w", bucket, err)
+				}
+			}
+		}
+	}
+	for _, entry := range stale {
+		var err error
+		switch entry.Kind {
+		case backupUser:
+			err = store.restoreRecord(ctx, RecordUser, entry.Realm, entry.Key, func() error { return store.Store.DeleteUser(ctx, entry.Realm, entry.Key) })
+		case backupGroup:
+			err = store.restoreRecord(ctx, RecordGroup, entry.Realm, entry.Key, func() error { return store.Store.DeleteGroup(ctx, entry.Realm, entry.Key) })
+		case backupAux:
+			err = aux.DeleteAux(ctx, entry.Bucket, entry.Key)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("in Restore function. error removing %s %s: %w", entry.Kind, entry.Key, err)
+		}
+	}
+	store.InvalidateCache()
+	return manifest, nil
+}
+
+// restoreRecord call fn while holding the lock of the user or group.
+func (store *CredentaDB) restoreRecord(ctx context.Context, kind RecordKind, realm, key string, fn func() error) error {
+	lock := store.lockUser
+	if kind == RecordGroup {
+		lock = store.lockGroup
+	}
+	unlock, err := lock(ctx, realm, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// VerifyBackup reads the whole archive made by Backup and check it against its checksums, without restoring it.
+func VerifyBackup(r io.Reader) (*BackupManifest, error) {
+	manifest, _, err := readBackup(r)
+	if err != nil {
+		return nil, fmt.Errorf("in VerifyBackup function. %w", err)
+	}
+	return manifest, nil
+}
+
+// readBackup reads and verify the archive, returning its manifest and records.
+func readBackup(r io.Reader) (*BackupManifest, []*backupEntry, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer zr.Close()
+	decoder := json.NewDecoder(zr)
+
+	header := &backupEntry{}
+	if err := decoder.Decode(header); err != nil || header.Kind != backupHeader || header.Manifest == nil {
+		return nil, nil, fmt.Errorf("%w: missing header", ErrInvalidBackup)
+	}
+	if header.Manifest.Format != BackupFormat {
+		return nil, nil, fmt.Errorf("%w: unknown format %q", ErrInvalidBackup, header.Manifest.Format)
+	}
+	if header.Manifest.Version > BackupVersion {
+		return nil, nil, fmt.Errorf("%w: version %d is newer than supported version %d", ErrInvalidBackup, header.Manifest.Version, BackupVersion)
+	}
+
+	entries := make([]*backupEntry, 0)
+	counts := make(map[string]int)
+	found := make(map[string]bool)
+	summer := sha256.New()
+	var trailer *BackupManifest
+	for {
+		entry := &backupEntry{}
+		if err := decoder.Decode(entry); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, nil, fmt.Errorf("%w: archive is truncated", ErrInvalidBackup)
+			}
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if entry.Kind == backupTrailer {
+			if trailer = entry.Manifest; trailer == nil {
+				return nil, nil, fmt.Errorf("%w: missing trailer", ErrInvalidBackup)
+			}
+			break
+		}
+		if err := verifyBackupEntry(entry); err != nil {
+			return nil, nil, err
+		}
+		summer.Write([]byte(entry.Checksum))
+		counts[entry.Kind]++
+		found[entry.Realm] = true
+		entries = append(entries, entry)
+	}
+	if trailer.Checksum != hex.EncodeToString(summer.Sum(nil)) {
+		return nil, nil, fmt.Errorf("%w: archive checksum does not match", ErrInvalidBackup)
+	}
+	if trailer.Users != counts[backupUser] || trailer.Groups != counts[backupGroup] || trailer.AuxRecords != counts[backupAux] {
+		return nil, nil, fmt.Errorf("%w: record counts do not match", ErrInvalidBackup)
+	}
+	realms := sortedKeys(found)
+	sort.Strings(trailer.Realms)
+	if fmt.Sprint(realms) != fmt.Sprint(trailer.Realms) {
+		return nil, nil, fmt.Errorf("%w: realms do not match", ErrInvalidBackup)
+	}
+	return trailer, entries, nil
+}
+
+// verifyBackupEntry check the record against its checksum, and that users and groups are where they belong.
+func verifyBackupEntry(entry *backupEntry) error {
+	if entry.Realm == "" || entry.Key == "" || len(entry.Data) == 0 {
+		return fmt.Errorf("%w: incomplete %s record", ErrInvalidBackup, entry.Kind)
+	}
+	if entry.Checksum != entry.checksum() {
+		return fmt.Errorf("%w: checksum of %s %s in realm %s does not match", ErrInvalidBackup, entry.Kind, entry.Key, entry.Realm)
+	}
+	switch entry.Kind {
+	case backupUser:
+		user := &CUser{}
+		if err := json.Unmarshal(entry.Data, user); err != nil || user.Realm != entry.Realm || user.Id != entry.Key {
+			return fmt.Errorf("%w: user %s in realm %s is not valid", ErrInvalidBackup, entry.Key, entry.Realm)
+		}
+	case backupGroup:
+		group := &CGroup{}
+		if err := json.Unmarshal(entry.Data, group); err != nil || group.Realm != entry.Realm || group.Name != entry.Key {
+			return fmt.Errorf("%w: group %s in realm %s is not valid", ErrInvalidBackup, entry.Key, entry.Realm)
+		}
+	case backupAux:
+		if entry.Bucket == "" || splitAuxKey(entry.Key)[0] != entry.Realm {
+			return fmt.Errorf("%w: auxiliary record %q is not valid", ErrInvalidBackup, entry.Key)
+		}
+	default:
+		return fmt.Errorf("%w: unknown record kind %q", ErrInvalidBackup, entry.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package credenta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+// newBackupSource creates a CredentaDB with users and groups in the realms RA and RB.
+func newBackupSource(t *testing.T, ctx context.Context) *CredentaDB {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	assert.NoError(t, cDB.EnableHistory())
+	for _, realm := range []string{"RA", "RB"} {
+		group, err := cDB.NewGroup(ctx, realm, "Admin", nil)
+		assert.NoError(t, err)
+		group.AddRole(5)
+		assert.NoError(t, group.StoreOrSaveToFile(ctx))
+		for _, id := range []string{"john", "jane"} {
+			user, err := cDB.NewUser(ctx, realm, id, "password", []string{"Admin"}, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+		}
+	}
+	return cDB
+}
+
+func TestCredentaDB_BackupRestore(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	source := newBackupSource(t, ctx)
+	archive := &bytes.Buffer{}
+	manifest, err := source.Backup(ctx, archive)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"RA", "RB"}, manifest.Realms)
+	assert.Equal(t, 4, manifest.Users)
+	assert.Equal(t, 2, manifest.Groups)
+	assert.NotZero(t, manifest.AuxRecords)
+
+	verified, err := VerifyBackup(bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Checksum, verified.Checksum)
+
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			target := NewCredentaDBWithStore(dataStore)
+			// records not in the archive are removed from the restored realms only.
+			for _, realm := range []string{"RA", "RC"} {
+				stale, err := target.NewUser(ctx, realm, "stale", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+				assert.NoError(t, err)
+				assert.NoError(t, stale.StoreOrSaveToFile(ctx))
+			}
+
+			_, err := target.Restore(ctx, bytes.NewReader(archive.Bytes()))
+			assert.NoError(t, err)
+			users, err := target.ListUserIDs(ctx)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"john", "jane"}, users["RA"])
+			assert.ElementsMatch(t, []string{"john", "jane"}, users["RB"])
+			assert.Equal(t, []string{"stale"}, users["RC"])
+
+			john, err := target.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint64(1), john.Version)
+				assert.True(t, MatchVerification(john.VerificationMethod, "password", john.VerificationHash))
+			}
+			assert.True(t, IsRoleFlagOn(target.GetRoleMasksOfGroups(ctx, "RA", "Admin"), 5))
+			members, err := target.ListGroupMembers(ctx, "RA", "Admin", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"jane", "john"}, members)
+			history, err := target.ListHistory(ctx, RecordUser, "RB", "jane")
+			assert.NoError(t, err)
+			assert.Len(t, history, 1)
+		})
+	}
+}
+
+func TestCredentaDB_BackupRealmFilter(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	source := newBackupSource(t, ctx)
+	archive := &bytes.Buffer{}
+	manifest, err := source.Backup(ctx, archive, "RB")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"RB"}, manifest.Realms)
+	assert.Equal(t, 2, manifest.Users)
+
+	target := NewCredentaDBWithStore(NewMemoryStore())
+	_, err = target.Restore(ctx, bytes.NewReader(archive.Bytes()), "RA")
+	assert.Error(t, err)
+	_, err = target.Restore(ctx, bytes.NewReader(archive.Bytes()), "RB")
+	assert.NoError(t, err)
+	users, err := target.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	assert.Len(t, users["RB"], 2)
+}
+
+func TestCredentaDB_RestoreInvalid(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	archive := &bytes.Buffer{}
+	_, err := newBackupSource(t, ctx).Backup(ctx, archive)
+	assert.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(plain)), "\n")
+
+	compress := func(lines []string) io.Reader {
+		buffer := &bytes.Buffer{}
+		zw := gzip.NewWriter(buffer)
+		zw.Write([]byte(strings.Join(lines, "\n")))
+		zw.Close()
+		return buffer
+	}
+	tampered := append([]string{}, lines...)
+	tampered[1] = strings.Replace(tampered[1], `"data":"`, `"data":"AA`, 1)
+
+	for name, reader := range map[string]io.Reader{
+		"NOT_GZIP":  strings.NewReader("not an archive"),
+		"TRUNCATED": compress(lines[:len(lines)-1]),
+		"TAMPERED":  compress(tampered),
+		"DROPPED":   compress(append(append([]string{}, lines[:1]...), lines[2:]...)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			target := NewCredentaDBWithStore(NewMemoryStore())
+			user, err := target.NewUser(ctx, "RA", "kept", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+			_, err = target.Restore(ctx, reader)
+			assert.True(t, errors.Is(err, ErrInvalidBackup))
+			// nothing was touched.
+			users, err := target.ListUserIDs(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]string{"RA": {"kept"}}, users)
+		})
+	}
+}
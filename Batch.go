@@ -0,0 +1,173 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Batch is a set of writes applied by Batcher at once. Every record appears at most once within a batch, so the
+// writes may be applied in any order.
+type Batch struct {
+	// Users are the users to create or replace.
+	Users []*CUser `json:"users,omitempty"`
+	// Groups are the groups to create or replace.
+	Groups []*CGroup `json:"groups,omitempty"`
+	// DeletedUsers are the realm and id of the users to remove.
+	DeletedUsers []RecordRef `json:"deletedUsers,omitempty"`
+	// DeletedGroups are the realm and name of the groups to remove.
+	DeletedGroups []RecordRef `json:"deletedGroups,omitempty"`
+	// Aux are the auxiliary records to create or replace, or to remove when their Value is nil.
+	Aux []*AuxRecord `json:"aux,omitempty"`
+	// expected are the versions of the records the writes expect, 0 when the record does not exist, set by a Tx for
+	// the Stores implementing CheckedWriter.
+	expected map[txRead]uint64
+	// unique are the unique values claimed by the written users, see CheckedWriter.
+	unique map[recordKey][]UniqueValue
+}
+
+// RecordRef identify a user by its realm and id, or a group by its realm and name.
+type RecordRef struct {
+	Realm string `json:"realm"`
+	Key   string `json:"key"`
+}
+
+// AuxRecord is an auxiliary record of a Batch, see AuxStore.
+type AuxRecord struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Value  []byte `json:"value"`
+}
+
+// Batcher is implemented by Store that is able to apply a Batch atomically, either every write is applied or none.
+type Batcher interface {
+	// WriteBatch applies every write of the batch, or none of them. Removing a record that does not exist is not
+	// an error.
+	WriteBatch(ctx context.Context, batch *Batch) error
+}
+
+// isEmpty returns true if the batch has no write.
+func (batch *Batch) isEmpty() bool {
+	return len(batch.Users) == 0 && len(batch.Groups) == 0 && len(batch.DeletedUsers) == 0 && len(batch.DeletedGroups) == 0 && len(batch.Aux) == 0
+}
+
+// expectedVersion returns the version the batch expects for the record, and false when it is not checked.
+func (batch *Batch) expectedVersion(kind RecordKind, realm, key string) (uint64, bool) {
+	version, ok := batch.expected[txRead{kind: kind, realm: realm, key: key}]
+	return version, ok
+}
+
+// writeBatch applies the batch using the Batcher of the Store. A Store that does not implement Batcher gets the
+// writes one by one, and the writes already applied are reverted when one of them fails.
+func writeBatch(ctx context.Context, dataStore Store, batch *Batch) error {
+	if batcher, ok := dataStore.(Batcher); ok {
+		return batcher.WriteBatch(ctx, batch)
+	}
+	undo := &Batch{}
+	if err := applyBatch(ctx, dataStore, batch, undo); err != nil {
+		if undoErr := applyBatch(ctx, dataStore, undo, nil); undoErr != nil {
+			return fmt.Errorf("%w, and reverting the applied writes failed: %v", err, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// applyBatch applies the writes of the batch one by one. When undo is not nil, the writes reverting every applied
+// write are added into it.
+func applyBatch(ctx context.Context, dataStore Store, batch *Batch, undo *Batch) error {
+	for _, user := range batch.Users {
+		if undo != nil {
+			if err := undoUser(ctx, dataStore, user.Realm, user.Id, undo); err != nil {
+				return err
+			}
+		}
+		if err := dataStore.PutUser(ctx, user); err != nil {
+			return err
+		}
+	}
+	for _, ref := range batch.DeletedUsers {
+		if undo != nil {
+			if err := undoUser(ctx, dataStore, ref.Realm, ref.Key, undo); err != nil {
+				return err
+			}
+		}
+		if err := dataStore.DeleteUser(ctx, ref.Realm, ref.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	for _, group := range batch.Groups {
+		if undo != nil {
+			if err := undoGroup(ctx, dataStore, group.Realm, group.Name, undo); err != nil {
+				return err
+			}
+		}
+		if err := dataStore.PutGroup(ctx, group); err != nil {
+			return err
+		}
+	}
+	for _, ref := range batch.DeletedGroups {
+		if undo != nil {
+			if err := undoGroup(ctx, dataStore, ref.Realm, ref.Key, undo); err != nil {
+				return err
+			}
+		}
+		if err := dataStore.DeleteGroup(ctx, ref.Realm, ref.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	if len(batch.Aux) == 0 {
+		return nil
+	}
+	aux, ok := dataStore.(AuxStore)
+	if !ok {
+		return ErrAuxNotSupported
+	}
+	for _, record := range batch.Aux {
+		if undo != nil {
+			value, err := aux.GetAux(ctx, record.Bucket, record.Key)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			undo.Aux = append(undo.Aux, &AuxRecord{Bucket: record.Bucket, Key: record.Key, Value: value})
+		}
+		var err error
+		if record.Value == nil {
+			err = aux.DeleteAux(ctx, record.Bucket, record.Key)
+		} else {
+			err = aux.PutAux(ctx, record.Bucket, record.Key, record.Value)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// undoUser adds the write that restores the user as it is now into undo.
+func undoUser(ctx context.Context, dataStore Store, realm, id string, undo *Batch) error {
+	user, err := dataStore.GetUser(ctx, realm, id)
+	if errors.Is(err, ErrNotFound) {
+		undo.DeletedUsers = append(undo.DeletedUsers, RecordRef{Realm: realm, Key: id})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	undo.Users = append(undo.Users, user)
+	return nil
+}
+
+// undoGroup adds the write that restores the group as it is now into undo.
+func undoGroup(ctx context.Context, dataStore Store, realm, name string, undo *Batch) error {
+	group, err := dataStore.GetGroup(ctx, realm, name)
+	if errors.Is(err, ErrNotFound) {
+		undo.DeletedGroups = append(undo.DeletedGroups, RecordRef{Realm: realm, Key: name})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	undo.Groups = append(undo.Groups, group)
+	return nil
+}
@@ -0,0 +1,308 @@
+package credenta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	boltUserPrefix  = "user/"
+	boltGroupPrefix = "group/"
+	// boltAuxBucket is the top level bucket holding a nested bucket for every auxiliary record bucket. It starts
+	// with a NUL byte so it never clash with a realm bucket.
+	boltAuxBucket = "\x00aux"
+)
+
+// NewBoltStore opens (or creates) the bbolt database file in the specified path.
+// It will wait at most 5 seconds for other process that still holding the database file.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("in NewBoltStore function, error opening database %s: %w", path, err)
+	}
+	return &BoltStore{
+		Path: path,
+		db:   db,
+	}, nil
+}
+
+// BoltStore is a Store implementation that keep all users and groups in a single bbolt key-value database file.
+// Each realm have its own bucket, in which users are keyed `user/ID` and groups are keyed `group/NAME`.
+// Auxiliary records are kept in nested buckets of a separate top level bucket.
+// Every write is done in a bbolt transaction, so a crash will never leave a half-written record.
+// The database file is locked exclusively while open, so a BoltStore is limited to a single process. The versions
+// and unique values are only checked by the CredentaDB of that process.
+type BoltStore struct {
+	Path string `json:"path"`
+
+	db *bolt.DB
+}
+
+// Close closes the underlying database.
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+func (bs *BoltStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	user := &CUser{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, realm, boltUserPrefix+id, user)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in GetUser function, user %s in realm %s: %w", id, realm, err)
+	}
+	return user, nil
+}
+
+func (bs *BoltStore) PutUser(ctx context.Context, user *CUser) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, user.Realm, boltUserPrefix+user.Id, user)
+	})
+}
+
+func (bs *BoltStore) DeleteUser(ctx context.Context, realm, id string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, realm, boltUserPrefix+id)
+	})
+	if err != nil {
+		return fmt.Errorf("in DeleteUser function, user %s in realm %s: %w", id, realm, err)
+	}
+	return nil
+}
+
+func (bs *BoltStore) ListUserIDs(ctx context.Context) (map[string][]string, error) {
+	return bs.listKeys(boltUserPrefix)
+}
+
+func (bs *BoltStore) GetGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	group := &CGroup{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, realm, boltGroupPrefix+name, group)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in GetGroup function, group %s in realm %s: %w", name, realm, err)
+	}
+	return group, nil
+}
+
+func (bs *BoltStore) PutGroup(ctx context.Context, group *CGroup) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, group.Realm, boltGroupPrefix+group.Name, group)
+	})
+}
+
+func (bs *BoltStore) DeleteGroup(ctx context.Context, realm, name string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, realm, boltGroupPrefix+name)
+	})
+	if err != nil {
+		return fmt.Errorf("in DeleteGroup function, group %s in realm %s: %w", name, realm, err)
+	}
+	return nil
+}
+
+func (bs *BoltStore) ListGroupNames(ctx context.Context) (map[string][]string, error) {
+	return bs.listKeys(boltGroupPrefix)
+}
+
+func (bs *BoltStore) GetAux(ctx context.Context, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		auxBucket := boltAux(tx, bucket)
+		if auxBucket == nil || auxBucket.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		value = append([]byte{}, auxBucket.Get([]byte(key))...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in GetAux function, %s in bucket %s: %w", key, bucket, err)
+	}
+	return value, nil
+}
+
+func (bs *BoltStore) PutAux(ctx context.Context, bucket, key string, value []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return boltPutAux(tx, bucket, key, value)
+	})
+}
+
+func (bs *BoltStore) DeleteAux(ctx context.Context, bucket, key string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteAux(tx, bucket, key)
+	})
+	if err != nil {
+		return fmt.Errorf("in DeleteAux function, %s in bucket %s: %w", key, bucket, err)
+	}
+	return nil
+}
+
+func (bs *BoltStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		auxBucket := boltAux(tx, bucket)
+		if auxBucket == nil {
+			return nil
+		}
+		return boltScan(auxBucket, prefix, func(key string, value []byte) error {
+			keys = append(keys, prefix+key)
+			values = append(values, append([]byte{}, value...))
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("in ScanAux function, error scanning bucket %s: %w", bucket, err)
+	}
+	// fn is called outside of the transaction, so it is free to write into the database.
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBatch applies every write of the batch within a single bbolt transaction.
+func (bs *BoltStore) WriteBatch(ctx context.Context, batch *Batch) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		for _, user := range batch.Users {
+			if err := boltPut(tx, user.Realm, boltUserPrefix+user.Id, user); err != nil {
+				return err
+			}
+		}
+		for _, ref := range batch.DeletedUsers {
+			if err := boltDelete(tx, ref.Realm, boltUserPrefix+ref.Key); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		for _, group := range batch.Groups {
+			if err := boltPut(tx, group.Realm, boltGroupPrefix+group.Name, group); err != nil {
+				return err
+			}
+		}
+		for _, ref := range batch.DeletedGroups {
+			if err := boltDelete(tx, ref.Realm, boltGroupPrefix+ref.Key); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		for _, record := range batch.Aux {
+			var err error
+			if record.Value == nil {
+				err = boltDeleteAux(tx, record.Bucket, record.Key)
+			} else {
+				err = boltPutAux(tx, record.Bucket, record.Key, record.Value)
+			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("in WriteBatch function, error writing batch: %w", err)
+	}
+	return nil
+}
+
+// listKeys scan every realm bucket for keys with the specified prefix, and returns map of realm to the keys
+// without the prefix.
+func (bs *BoltStore) listKeys(prefix string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(realm []byte, bucket *bolt.Bucket) error {
+			if string(realm) == boltAuxBucket {
+				return nil
+			}
+			return boltScan(bucket, prefix, func(key string, _ []byte) error {
+				appendToRealm(ret, string(realm), key)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in listKeys function, error scanning database: %w", err)
+	}
+	return ret, nil
+}
+
+// boltScan call fn for every key in the bucket that starts with prefix. The key passed to fn have the prefix removed.
+func boltScan(bucket *bolt.Bucket, prefix string, fn func(key string, value []byte) error) error {
+	p := []byte(prefix)
+	c := bucket.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if err := fn(string(k[len(p):]), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltGet(tx *bolt.Tx, realm, key string, target interface{}) error {
+	bucket := tx.Bucket([]byte(realm))
+	if bucket == nil {
+		return ErrNotFound
+	}
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("error unmarshaling %s: %w", key, err)
+	}
+	return nil
+}
+
+func boltPut(tx *bolt.Tx, realm, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("in boltPut function, error marshalling %s: %w", key, err)
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(realm))
+	if err != nil {
+		return fmt.Errorf("in boltPut function, error creating bucket for realm %s: %w", realm, err)
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+func boltDelete(tx *bolt.Tx, realm, key string) error {
+	bucket := tx.Bucket([]byte(realm))
+	if bucket == nil || bucket.Get([]byte(key)) == nil {
+		return ErrNotFound
+	}
+	return bucket.Delete([]byte(key))
+}
+
+// boltAux returns the nested bucket of the auxiliary record bucket, nil if not exist.
+func boltAux(tx *bolt.Tx, bucket string) *bolt.Bucket {
+	auxBuckets := tx.Bucket([]byte(boltAuxBucket))
+	if auxBuckets == nil {
+		return nil
+	}
+	return auxBuckets.Bucket([]byte(bucket))
+}
+
+func boltPutAux(tx *bolt.Tx, bucket, key string, value []byte) error {
+	auxBuckets, err := tx.CreateBucketIfNotExists([]byte(boltAuxBucket))
+	if err != nil {
+		return fmt.Errorf("in boltPutAux function, error creating auxiliary bucket: %w", err)
+	}
+	auxBucket, err := auxBuckets.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("in boltPutAux function, error creating bucket %s: %w", bucket, err)
+	}
+	return auxBucket.Put([]byte(key), value)
+}
+
+func boltDeleteAux(tx *bolt.Tx, bucket, key string) error {
+	auxBucket := boltAux(tx, bucket)
+	if auxBucket == nil || auxBucket.Get([]byte(key)) == nil {
+		return ErrNotFound
+	}
+	return auxBucket.Delete([]byte(key))
+}
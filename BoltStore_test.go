@@ -0,0 +1,49 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBoltStore_CredentaDB(t *testing.T) {
+	bs, err := NewBoltStore(t.TempDir() + "/credenta.bolt")
+	assert.NoError(t, err)
+	defer bs.Close()
+
+	cDB := NewCredentaDBWithStore(bs)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	elder, err := cDB.NewGroup(ctx, "RA", "GroupElder", nil)
+	assert.NoError(t, err)
+	elder.AddRole(0)
+	assert.NoError(t, elder.StoreOrSaveToFile(ctx))
+
+	son, err := cDB.NewGroup(ctx, "RA", "GroupSon", []string{"GroupElder"})
+	assert.NoError(t, err)
+	son.AddRole(1)
+	assert.NoError(t, son.StoreOrSaveToFile(ctx))
+
+	roles := cDB.GetRoleMasksOfGroups(ctx, "RA", "GroupSon")
+	assert.True(t, IsRoleFlagOn(roles, 0))
+	assert.True(t, IsRoleFlagOn(roles, 1))
+
+	for _, realm := range []string{"RA", "RB"} {
+		usr, err := cDB.NewUser(ctx, realm, "USERA", "password", []string{"GroupSon"}, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, usr.StoreOrSaveToFile(ctx))
+	}
+
+	ids, err := cDB.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"RA": {"USERA"}, "RB": {"USERA"}}, ids)
+	names, err := cDB.ListGroupNames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"RA": {"GroupElder", "GroupSon"}}, names)
+
+	assert.NoError(t, cDB.DeleteUser(ctx, "RB", "USERA"))
+	_, err = cDB.GetUser(ctx, "RB", "USERA")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, errors.Is(cDB.DeleteGroup(ctx, "RB", "GroupSon"), ErrNotFound))
+}
@@ -0,0 +1,854 @@
+package credenta
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatJSONLines is one JSON object per line, see UserRow and GroupRow for the field names.
+	FormatJSONLines BulkFormat = "JSONL"
+	// FormatCSV is comma separated values with a header line. Lists are comma separated within a column and every
+	// attribute has its own `attribute.<name>` column.
+	FormatCSV BulkFormat = "CSV"
+
+	// attributeColumnPrefix prefix the CSV column of an attribute.
+	attributeColumnPrefix = "attribute."
+)
+
+// BulkFormat specify the format of bulk import and export.
+type BulkFormat string
+
+// DefaultUserColumns are the CSV columns of ExportUsers when none are specified.
+var DefaultUserColumns = []string{"realm", "id", "idType", "method", "hash", "groups", "roles", "enable", "active"}
+
+// DefaultGroupColumns are the CSV columns of ExportGroups when none are specified.
+var DefaultGroupColumns = []string{"realm", "name", "parentGroups", "roles"}
+
+// UserRow is a user as imported or exported in bulk. On import, a field left out keeps the value of an existing
+// user, while an empty list clears it and an empty attribute value removes the attribute. A user is created with
+// either a plain Password, validated against the PassPolicy, or an already computed Hash and its Method. Exports
+// never contain a plain password.
+type UserRow struct {
+	Realm      string             `json:"realm,omitempty"`
+	Id         string             `json:"id"`
+	IDType     IdType             `json:"idType,omitempty"`
+	Password   string             `json:"password,omitempty"`
+	Hash       string             `json:"hash,omitempty"`
+	Method     VerificationMethod `json:"method,omitempty"`
+	Groups     []string           `json:"groups,omitempty"`
+	Roles      []int              `json:"roles,omitempty"`
+	Enable     *bool              `json:"enable,omitempty"`
+	Active     *bool              `json:"active,omitempty"`
+	Attributes map[string]string  `json:"attributes,omitempty"`
+}
+
+// GroupRow is a group as imported or exported in bulk. On import, a field left out keeps the value of an existing
+// group, while an empty list clears it and an empty attribute value removes the attribute.
+type GroupRow struct {
+	Realm        string            `json:"realm,omitempty"`
+	Name         string            `json:"name"`
+	ParentGroups []string          `json:"parentGroups,omitempty"`
+	Roles        []int             `json:"roles,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+}
+
+// ImportOptions configure ImportUsers and ImportGroups.
+type ImportOptions struct {
+	Format BulkFormat
+	// Realm is the realm of the rows without one, the DefaultRealm if empty.
+	Realm string
+	// Columns rename the CSV columns, or the JSON Lines fields, into the field names of UserRow or GroupRow, e.g.
+	// {"E-Mail": "attribute.email"}. Columns not in the map must have the field names.
+	Columns map[string]string
+	// Method is the verification method of plain passwords, VerificationMethodARGON if empty.
+	Method VerificationMethod
+	// DryRun only validates the rows and reports what would be done.
+	DryRun bool
+}
+
+// ImportReport tells what an import did, or would do on dry run.
+type ImportReport struct {
+	DryRun    bool `json:"dryRun"`
+	Rows      int  `json:"rows"`
+	Created   int  `json:"created"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	Failed    int  `json:"failed"`
+	// Errors are the rows that could not be imported, the other rows are imported regardless.
+	Errors []*RowError `json:"errors,omitempty"`
+}
+
+// RowError is the error of a single imported row.
+type RowError struct {
+	// Row is the line number of the row in the input, starting at 1.
+	Row int    `json:"row"`
+	Key string `json:"key,omitempty"`
+	Err error  `json:"-"`
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d %s: %v", e.Row, e.Key, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON include the error message.
+func (e *RowError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"row": e.Row, "key": e.Key, "error": e.Err.Error()})
+}
+
+// ExportOptions configure ExportUsers and ExportGroups.
+type ExportOptions struct {
+	Format BulkFormat
+	// Realms are the exported realms, every realm if empty.
+	Realms []string
+	// Columns are the CSV columns, DefaultUserColumns or DefaultGroupColumns if empty. Attributes are only exported
+	// into CSV when their `attribute.<name>` column is specified.
+	Columns []string
+}
+
+// ImportUsers creates or updates the users read from r, one row at a time. Importing the same rows again leaves the
+// users unchanged. Invalid rows are reported and skipped, the returned error is only about reading r.
+func (store *CredentaDB) ImportUsers(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	err := readRows(r, options, func(line int, row *UserRow, err error) {
+		report.Rows++
+		if err == nil {
+			err = store.importUser(ctx, row, options, report)
+		}
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, &RowError{Row: line, Key: row.Id, Err: err})
+		}
+	})
+	if err != nil {
+		return report, fmt.Errorf("in ImportUsers function. %w", err)
+	}
+	return report, nil
+}
+
+// ImportGroups creates or updates the groups read from r, one row at a time. Importing the same rows again leaves
+// the groups unchanged. Invalid rows are reported and skipped, the returned error is only about reading r.
+func (store *CredentaDB) ImportGroups(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	err := readRows(r, options, func(line int, row *GroupRow, err error) {
+		report.Rows++
+		if err == nil {
+			err = store.importGroup(ctx, row, options, report)
+		}
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, &RowError{Row: line, Key: row.Name, Err: err})
+		}
+	})
+	if err != nil {
+		return report, fmt.Errorf("in ImportGroups function. %w", err)
+	}
+	return report, nil
+}
+
+// importUser validates the row and creates or updates its user.
+func (store *CredentaDB) importUser(ctx context.Context, row *UserRow, options ImportOptions, report *ImportReport) error {
+	realm := firstNonEmpty(row.Realm, options.Realm, store.DefaultRealm)
+	if row.Id == "" {
+		return errors.New("id is required")
+	}
+	if err := row.validate(store.PassPolicy); err != nil {
+		return err
+	}
+	method := options.Method
+	if method == "" {
+		method = VerificationMethodARGON
+	}
+
+	existing, err := store.loadUser(ctx, realm, row.Id)
+	if errors.Is(err, ErrNotFound) {
+		if row.Password == "" && row.Hash == "" {
+			return errors.New("password or hash is required to create a user")
+		}
+		if err := store.checkNotTrashed(ctx, RecordUser, realm, row.Id); err != nil {
+			return err
+		}
+		if options.DryRun {
+			report.Created++
+			return nil
+		}
+		if err := row.hashPassword(method, store.peppers, store.hashParams); err != nil {
+			return err
+		}
+		user := &CUser{
+			db:                 store,
+			Realm:              realm,
+			Id:                 row.Id,
+			IDType:             IdTypeUserId,
+			Attributes:         make(map[string]*Attribute),
+			RoleMasks:          make([]uint64, RoleMaskCount),
+			VerificationMethod: row.Method,
+			VerificationHash:   row.Hash,
+			Enable:             true,
+			CreatedAt:          time.Now(),
+			CreatedBy:          ctx.Value(ETX_USER).(string),
+		}
+		row.apply(user)
+		if err := store.SaveUser(ctx, user); err != nil {
+			return err
+		}
+		report.Created++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the password is only changed when it does not match anymore, so importing again is a no-op.
+	if row.Password != "" && matchVerification(existing.VerificationMethod, row.Password, existing.VerificationHash, store.peppers) {
+		row.Password = ""
+	}
+	updated := existing.clone()
+	row.apply(updated)
+	if row.Password == "" && len(diffFields(userFields(existing), userFields(updated))) == 0 {
+		report.Unchanged++
+		return nil
+	}
+	if options.DryRun {
+		report.Updated++
+		return nil
+	}
+	if err := row.hashPassword(method, store.peppers, store.hashParams); err != nil {
+		return err
+	}
+	if err := store.Update(ctx, realm, row.Id, func(user *CUser) error {
+		row.apply(user)
+		return nil
+	}); err != nil {
+		return err
+	}
+	report.Updated++
+	return nil
+}
+
+// importGroup validates the row and creates or updates its group.
+func (store *CredentaDB) importGroup(ctx context.Context, row *GroupRow, options ImportOptions, report *ImportReport) error {
+	realm := firstNonEmpty(row.Realm, options.Realm, store.DefaultRealm)
+	if row.Name == "" {
+		return errors.New("name is required")
+	}
+	if err := validateRoles(row.Roles); err != nil {
+		return err
+	}
+
+	existing, err := store.loadGroup(ctx, realm, row.Name)
+	if errors.Is(err, ErrNotFound) {
+		if err := store.checkNotTrashed(ctx, RecordGroup, realm, row.Name); err != nil {
+			return err
+		}
+		if options.DryRun {
+			report.Created++
+			return nil
+		}
+		group := &CGroup{
+			db:         store,
+			Realm:      realm,
+			Name:       row.Name,
+			Attributes: make([]*Attribute, 0),
+			RoleMasks:  make([]uint64, RoleMaskCount),
+			CreatedAt:  time.Now(),
+			CreatedBy:  ctx.Value(ETX_USER).(string),
+		}
+		row.apply(group)
+		if err := store.SaveGroup(ctx, group); err != nil {
+			return err
+		}
+		report.Created++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	updated := existing.clone()
+	row.apply(updated)
+	if len(diffFields(groupFields(existing), groupFields(updated))) == 0 {
+		report.Unchanged++
+		return nil
+	}
+	if options.DryRun {
+		report.Updated++
+		return nil
+	}
+	if err := store.UpdateGroup(ctx, realm, row.Name, func(group *CGroup) error {
+		row.apply(group)
+		return nil
+	}); err != nil {
+		return err
+	}
+	report.Updated++
+	return nil
+}
+
+// ExportUsers writes the users of the specified realms into w, and returns how many were written. Rows are written
+// as the users are read, so the whole store is never held in memory.
+func (store *CredentaDB) ExportUsers(ctx context.Context, w io.Writer, options ExportOptions) (int, error) {
+	columns := options.Columns
+	if len(columns) == 0 {
+		columns = DefaultUserColumns
+	}
+	writer, err := newRowWriter(w, options.Format, columns)
+	if err != nil {
+		return 0, fmt.Errorf("in ExportUsers function. %w", err)
+	}
+	count := 0
+	err = store.WalkUserIDs(ctx, func(realm, id string) error {
+		if len(options.Realms) > 0 && !containsString(options.Realms, realm) {
+			return nil
+		}
+		user, err := store.loadUser(ctx, realm, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		return writer.write(newUserRow(user))
+	})
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		return count, fmt.Errorf("in ExportUsers function. %w", err)
+	}
+	return count, nil
+}
+
+// ExportGroups writes the groups of the specified realms into w, and returns how many were written.
+func (store *CredentaDB) ExportGroups(ctx context.Context, w io.Writer, options ExportOptions) (int, error) {
+	columns := options.Columns
+	if len(columns) == 0 {
+		columns = DefaultGroupColumns
+	}
+	writer, err := newRowWriter(w, options.Format, columns)
+	if err != nil {
+		return 0, fmt.Errorf("in ExportGroups function. %w", err)
+	}
+	count := 0
+	err = store.WalkGroupNames(ctx, func(realm, name string) error {
+		if len(options.Realms) > 0 && !containsString(options.Realms, realm) {
+			return nil
+		}
+		group, err := store.loadGroup(ctx, realm, name)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		return writer.write(newGroupRow(group))
+	})
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		return count, fmt.Errorf("in ExportGroups function. %w", err)
+	}
+	return count, nil
+}
+
+// bulkRow is implemented by UserRow and GroupRow to be read from and written into CSV columns.
+type bulkRow interface {
+	setField(field, value string) error
+	field(field string) string
+}
+
+// readRows reads every row of r and call fn with its line number and the row, or the error parsing it. The returned
+// error is about reading r itself, such as an invalid CSV header.
+func readRows[R any, P interface {
+	*R
+	bulkRow
+}](r io.Reader, options ImportOptions, fn func(line int, row P, err error)) error {
+	column := func(name string) string {
+		if field, ok := options.Columns[name]; ok {
+			return field
+		}
+		return name
+	}
+
+	switch options.Format {
+	case FormatJSONLines:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			row := P(new(R))
+			fn(line, row, decodeJSONRow(text, row, column))
+		}
+		return scanner.Err()
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("error reading CSV header: %w", err)
+		}
+		fields := make([]string, len(header))
+		for i, name := range header {
+			fields[i] = column(strings.TrimSpace(name))
+			if err := P(new(R)).setField(fields[i], ""); err != nil {
+				return fmt.Errorf("invalid CSV column %q: %w", name, err)
+			}
+		}
+		for {
+			record, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			row := P(new(R))
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				fn(parseErr.StartLine, row, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			line, _ := reader.FieldPos(0)
+			if len(record) != len(fields) {
+				fn(line, row, fmt.Errorf("expected %d columns, got %d", len(fields), len(record)))
+				continue
+			}
+			for i, value := range record {
+				if err = row.setField(fields[i], value); err != nil {
+					break
+				}
+			}
+			fn(line, row, err)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", options.Format)
+	}
+}
+
+// decodeJSONRow decodes a JSON Lines row, whose fields are renamed by column. Fields named `attribute.<name>`,
+// once renamed, are attributes of the row.
+func decodeJSONRow(text string, row bulkRow, column func(name string) string) error {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return err
+	}
+	renamed := make(map[string]json.RawMessage, len(fields))
+	attributes := make(map[string]string)
+	for name, value := range fields {
+		field := column(name)
+		if !strings.HasPrefix(field, attributeColumnPrefix) {
+			renamed[field] = value
+			continue
+		}
+		var attribute string
+		if err := json.Unmarshal(value, &attribute); err != nil {
+			return fmt.Errorf("invalid %s: %w", field, err)
+		}
+		attributes[field] = attribute
+	}
+	data, err := json.Marshal(renamed)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(row); err != nil {
+		return err
+	}
+	for _, field := range sortedMapKeys(attributes) {
+		if err := row.setField(field, attributes[field]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowWriter writes rows in a bulk format.
+type rowWriter struct {
+	columns []string
+	json    *json.Encoder
+	csv     *csv.Writer
+	buffer  *bufio.Writer
+}
+
+func newRowWriter(w io.Writer, format BulkFormat, columns []string) (*rowWriter, error) {
+	buffer := bufio.NewWriter(w)
+	switch format {
+	case FormatJSONLines:
+		return &rowWriter{json: json.NewEncoder(buffer), buffer: buffer}, nil
+	case FormatCSV:
+		writer := &rowWriter{columns: columns, csv: csv.NewWriter(buffer), buffer: buffer}
+		return writer, writer.csv.Write(columns)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func (writer *rowWriter) write(row bulkRow) error {
+	if writer.json != nil {
+		return writer.json.Encode(row)
+	}
+	record := make([]string, len(writer.columns))
+	for i, column := range writer.columns {
+		record[i] = row.field(column)
+	}
+	return writer.csv.Write(record)
+}
+
+func (writer *rowWriter) flush() error {
+	if writer.csv != nil {
+		writer.csv.Flush()
+		if err := writer.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return writer.buffer.Flush()
+}
+
+func newUserRow(user *CUser) *UserRow {
+	enable, active := user.Enable, user.Active
+	row := &UserRow{
+		Realm:      user.Realm,
+		Id:         user.Id,
+		IDType:     user.IDType,
+		Hash:       user.VerificationHash,
+		Method:     user.VerificationMethod,
+		Groups:     user.Groups,
+		Roles:      roleSequences(user.RoleMasks),
+		Enable:     &enable,
+		Active:     &active,
+		Attributes: make(map[string]string, len(user.Attributes)),
+	}
+	for name, attr := range user.Attributes {
+		row.Attributes[name] = attr.ValueString
+	}
+	return row
+}
+
+func newGroupRow(group *CGroup) *GroupRow {
+	row := &GroupRow{
+		Realm:        group.Realm,
+		Name:         group.Name,
+		ParentGroups: group.ParentGroups,
+		Roles:        roleSequences(group.RoleMasks),
+		Attributes:   make(map[string]string, len(group.Attributes)),
+	}
+	for _, attr := range group.Attributes {
+		row.Attributes[attr.Name] = attr.ValueString
+	}
+	return row
+}
+
+// validate check the row's values, and the plain password against the policy.
+func (row *UserRow) validate(policy *PassphrasePolicy) error {
+	switch row.IDType {
+	case "", IdTypeUserId, IdTypeUserEmail, IdTypeUserPhoneNo:
+	default:
+		return fmt.Errorf("unknown id type %q", row.IDType)
+	}
+	if row.Password != "" && row.Hash != "" {
+		return errors.New("only one of password and hash can be specified")
+	}
+	if row.Password != "" {
+		if _, err := policy.IsPasswordValid(row.Password); err != nil {
+			return err
+		}
+	}
+	if row.Hash != "" && !knownVerificationMethod(row.Method) {
+		return fmt.Errorf("unknown verification method %q of hash", row.Method)
+	}
+	if row.Hash != "" {
+		if err := checkHash(row.Method, row.Hash); err != nil {
+			return fmt.Errorf("invalid %s hash: %w", row.Method, err)
+		}
+	}
+	return validateRoles(row.Roles)
+}
+
+// hashPassword replace the plain password of the row by its hash made with params, peppered by peppers.
+func (row *UserRow) hashPassword(method VerificationMethod, peppers *PepperRing, params *HashParameters) error {
+	if row.Password == "" {
+		return nil
+	}
+	hash, err := makeVerification(method, row.Password, peppers, params)
+	if err != nil {
+		return err
+	}
+	row.Password, row.Hash, row.Method = "", hash, method
+	return nil
+}
+
+// apply set the fields specified by the row into the user, the plain password must be hashed already.
+func (row *UserRow) apply(user *CUser) {
+	if row.IDType != "" {
+		user.IDType = row.IDType
+	}
+	if row.Hash != "" {
+		user.VerificationHash, user.VerificationMethod = row.Hash, row.Method
+	}
+	if row.Groups != nil {
+		user.Groups = append([]string{}, row.Groups...)
+	}
+	if row.Roles != nil {
+		user.RoleMasks = roleMasksOf(row.Roles)
+	}
+	if row.Enable != nil {
+		user.Enable = *row.Enable
+	}
+	if row.Active != nil {
+		user.Active = *row.Active
+	}
+	for _, name := range sortedMapKeys(row.Attributes) {
+		value := row.Attributes[name]
+		switch attr, ok := user.Attributes[name]; {
+		case value == "":
+			user.RemoveAttribute(name)
+		case ok:
+			attr.ValueString = value
+		default:
+			user.SetAttribute(name, "string", value)
+		}
+	}
+}
+
+func (row *UserRow) setField(field, value string) error {
+	var err error
+	switch field {
+	case "realm":
+		row.Realm = value
+	case "id":
+		row.Id = value
+	case "idType":
+		row.IDType = IdType(value)
+	case "password":
+		row.Password = value
+	case "hash":
+		row.Hash = value
+	case "method":
+		row.Method = VerificationMethod(value)
+	case "groups":
+		row.Groups = splitList(value)
+	case "roles":
+		row.Roles, err = parseRoles(value)
+	case "enable":
+		row.Enable, err = parseOptionalBool(value)
+	case "active":
+		row.Active, err = parseOptionalBool(value)
+	default:
+		name, ok := strings.CutPrefix(field, attributeColumnPrefix)
+		if !ok || name == "" {
+			return fmt.Errorf("unknown user field %q", field)
+		}
+		if row.Attributes == nil {
+			row.Attributes = make(map[string]string)
+		}
+		row.Attributes[name] = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", field, err)
+	}
+	return nil
+}
+
+func (row *UserRow) field(field string) string {
+	switch field {
+	case "realm":
+		return row.Realm
+	case "id":
+		return row.Id
+	case "idType":
+		return string(row.IDType)
+	case "hash":
+		return row.Hash
+	case "method":
+		return string(row.Method)
+	case "groups":
+		return strings.Join(row.Groups, ",")
+	case "roles":
+		return formatRoles(row.Roles)
+	case "enable":
+		return formatOptionalBool(row.Enable)
+	case "active":
+		return formatOptionalBool(row.Active)
+	default:
+		return row.Attributes[strings.TrimPrefix(field, attributeColumnPrefix)]
+	}
+}
+
+// apply set the fields specified by the row into the group.
+func (row *GroupRow) apply(group *CGroup) {
+	if row.ParentGroups != nil {
+		group.ParentGroups = append([]string{}, row.ParentGroups...)
+	}
+	if row.Roles != nil {
+		group.RoleMasks = roleMasksOf(row.Roles)
+	}
+	for _, name := range sortedMapKeys(row.Attributes) {
+		value := row.Attributes[name]
+		group.RemoveAttribute(name)
+		if value != "" {
+			group.SetAttribute(name, "string", value)
+		}
+	}
+}
+
+func (row *GroupRow) setField(field, value string) error {
+	var err error
+	switch field {
+	case "realm":
+		row.Realm = value
+	case "name":
+		row.Name = value
+	case "parentGroups":
+		row.ParentGroups = splitList(value)
+	case "roles":
+		row.Roles, err = parseRoles(value)
+	default:
+		name, ok := strings.CutPrefix(field, attributeColumnPrefix)
+		if !ok || name == "" {
+			return fmt.Errorf("unknown group field %q", field)
+		}
+		if row.Attributes == nil {
+			row.Attributes = make(map[string]string)
+		}
+		row.Attributes[name] = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", field, err)
+	}
+	return nil
+}
+
+func (row *GroupRow) field(field string) string {
+	switch field {
+	case "realm":
+		return row.Realm
+	case "name":
+		return row.Name
+	case "parentGroups":
+		return strings.Join(row.ParentGroups, ",")
+	case "roles":
+		return formatRoles(row.Roles)
+	default:
+		return row.Attributes[strings.TrimPrefix(field, attributeColumnPrefix)]
+	}
+}
+
+func validateRoles(roles []int) error {
+	for _, role := range roles {
+		if role < 0 || role >= RoleMaskCount*64 {
+			return fmt.Errorf("role %d is out of range", role)
+		}
+	}
+	return nil
+}
+
+// roleSequences returns the sequences of the roles that are on.
+func roleSequences(masks []uint64) []int {
+	roles := make([]int, 0)
+	for seq, mask := range masks {
+		for bit := 0; bit < 64; bit++ {
+			if isBitFlagOn(mask, bit) {
+				roles = append(roles, seq*64+bit)
+			}
+		}
+	}
+	return roles
+}
+
+// roleMasksOf returns the role masks having the roles on, the roles must be in range.
+func roleMasksOf(roles []int) []uint64 {
+	masks := make([]uint64, RoleMaskCount)
+	for _, role := range roles {
+		seq, bit := toUint64ByBit(role)
+		masks[seq] = setBitFlagOn(masks[seq], bit)
+	}
+	return masks
+}
+
+// splitList split a comma separated list, an empty string is an empty list.
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseRoles(value string) ([]int, error) {
+	roles := make([]int, 0)
+	for _, item := range splitList(value) {
+		role, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func formatRoles(roles []int) string {
+	items := make([]string, len(roles))
+	for i, role := range roles {
+		items[i] = strconv.Itoa(role)
+	}
+	return strings.Join(items, ",")
+}
+
+// parseOptionalBool returns nil for an empty value, so the field is left as is.
+func parseOptionalBool(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func formatOptionalBool(value *bool) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*value)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func sortedMapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
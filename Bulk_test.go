@@ -0,0 +1,215 @@
+package credenta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCredentaDB_ImportUsersCSV(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	cDB.PassPolicy = SimplePasswordPolicy()
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	sha, err := MakeVerification(VerificationMethodSHA256, "hashedPassword")
+	assert.NoError(t, err)
+
+	input := "Login,Secret,hash,method,groups,roles,active,E-Mail\n" +
+		"john,password,,,\"Admin,Staff\",\"1,70\",true,john@mail.com\n" +
+		"jane,," + sha + ",SHA256,Staff,,,jane@mail.com\n" +
+		"bad,x,,,,,,\n" +
+		"nopass,,,,,,,\n" +
+		"roles,password,,,,999,,\n"
+	options := ImportOptions{
+		Format:  FormatCSV,
+		Realm:   "RA",
+		Columns: map[string]string{"Login": "id", "Secret": "password", "E-Mail": "attribute.email"},
+		Method:  VerificationMethodPLAIN,
+	}
+
+	options.DryRun = true
+	report, err := cDB.ImportUsers(ctx, strings.NewReader(input), options)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Rows)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 3, report.Failed)
+	users, err := cDB.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+
+	options.DryRun = false
+	report, err = cDB.ImportUsers(ctx, strings.NewReader(input), options)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Created)
+	if assert.Len(t, report.Errors, 3) {
+		assert.Equal(t, 4, report.Errors[0].Row)
+		assert.Equal(t, "bad", report.Errors[0].Key)
+		assert.Equal(t, 5, report.Errors[1].Row)
+		assert.Equal(t, 6, report.Errors[2].Row)
+	}
+
+	john, err := cDB.GetUser(ctx, "RA", "john")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"Admin", "Staff"}, john.Groups)
+		assert.True(t, john.HasRole(1))
+		assert.True(t, john.HasRole(70))
+		assert.True(t, john.Active)
+		assert.True(t, john.Enable)
+		_, email, _ := john.GetAttribute("email")
+		assert.Equal(t, "john@mail.com", email)
+		assert.True(t, MatchVerification(john.VerificationMethod, "password", john.VerificationHash))
+	}
+	jane, err := cDB.GetUser(ctx, "RA", "jane")
+	if assert.NoError(t, err) {
+		assert.Equal(t, VerificationMethodSHA256, jane.VerificationMethod)
+		assert.True(t, MatchVerification(jane.VerificationMethod, "hashedPassword", jane.VerificationHash))
+	}
+
+	// importing again changes nothing.
+	report, err = cDB.ImportUsers(ctx, strings.NewReader(input), options)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Created)
+	assert.Equal(t, 0, report.Updated)
+	assert.Equal(t, 2, report.Unchanged)
+	john, err = cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), john.Version)
+
+	// only the specified columns are updated.
+	report, err = cDB.ImportUsers(ctx, strings.NewReader("id,groups\njohn,Staff\n"), ImportOptions{Format: FormatCSV, Realm: "RA"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Updated)
+	john, err = cDB.GetUser(ctx, "RA", "john")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"Staff"}, john.Groups)
+		assert.True(t, john.HasRole(70))
+	}
+
+	_, err = cDB.ImportUsers(ctx, strings.NewReader("id,unknown\njohn,x\n"), ImportOptions{Format: FormatCSV})
+	assert.Error(t, err)
+}
+
+func TestCredentaDB_ImportUsersJSONLines(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	input := `{"realm": "RA", "id": "john", "password": "password", "groups": ["Admin"], "attributes": {"dept": "sales"}}
+{"realm": "RA", "login": "jane", "password": "password", "email": "jane@mail.com", "enable": false}
+
+{"realm": "RA", "id": "bad", "password": "password", "unknown": 1}
+not json
+`
+	options := ImportOptions{
+		Format:  FormatJSONLines,
+		Columns: map[string]string{"login": "id", "email": "attribute.email"},
+		Method:  VerificationMethodPLAIN,
+	}
+	report, err := cDB.ImportUsers(ctx, strings.NewReader(input), options)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Created)
+	if assert.Len(t, report.Errors, 2) {
+		assert.Equal(t, 4, report.Errors[0].Row)
+		assert.Equal(t, 5, report.Errors[1].Row)
+	}
+	jane, err := cDB.GetUser(ctx, "RA", "jane")
+	if assert.NoError(t, err) {
+		assert.False(t, jane.Enable)
+		_, email, _ := jane.GetAttribute("email")
+		assert.Equal(t, "jane@mail.com", email)
+	}
+
+	// a new password is stored, the same password is not.
+	report, err = cDB.ImportUsers(ctx, strings.NewReader(`{"realm": "RA", "id": "john", "password": "password"}
+{"realm": "RA", "id": "jane", "password": "newPassword", "attributes": {"email": ""}}`), options)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Unchanged)
+	assert.Equal(t, 1, report.Updated)
+	jane, err = cDB.GetUser(ctx, "RA", "jane")
+	if assert.NoError(t, err) {
+		assert.True(t, MatchVerification(jane.VerificationMethod, "newPassword", jane.VerificationHash))
+		assert.False(t, jane.HasAttribute("email"))
+	}
+
+	// trashed ids are reported.
+	assert.NoError(t, cDB.EnableTrash(time.Hour))
+	assert.NoError(t, cDB.DeleteUser(ctx, "RA", "john"))
+	report, err = cDB.ImportUsers(ctx, strings.NewReader(`{"realm": "RA", "id": "john", "password": "password"}`), options)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Errors, 1) {
+		assert.True(t, errors.Is(report.Errors[0], ErrTrashed))
+	}
+}
+
+func TestCredentaDB_ImportUsersHashLimits(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	salt, key := "MDEyMzQ1Njc4OWFiY2RlZg", "DYW+LTZG5wxyiFLYdBb4Li7HX4c5gzYk0Q6GPLyzn3A"
+	input := `{"realm": "RA", "id": "scrypt", "hash": "$scrypt$ln=15,r=8,p=1$` + salt + `$` + key + `", "method": "SCRYPT"}
+{"realm": "RA", "id": "pbkdf2", "hash": "$pbkdf2-sha256$i=1000$` + salt + `$` + key + `", "method": "PBKDF2"}
+{"realm": "RA", "id": "hugeLogN", "hash": "$scrypt$ln=30,r=8,p=1$` + salt + `$` + key + `", "method": "SCRYPT"}
+{"realm": "RA", "id": "hugeR", "hash": "$scrypt$ln=15,r=1000000,p=1$` + salt + `$` + key + `", "method": "SCRYPT"}
+{"realm": "RA", "id": "hugeP", "hash": "$scrypt$ln=15,r=8,p=100000$` + salt + `$` + key + `", "method": "SCRYPT"}
+{"realm": "RA", "id": "hugeIterations", "hash": "$pbkdf2-sha256$i=2000000000$` + salt + `$` + key + `", "method": "PBKDF2"}
+{"realm": "RA", "id": "hugeMemory", "hash": "$argon2id$v=19$m=4194304,t=1,p=2$` + salt + `$` + key + `", "method": "ARGON"}
+{"realm": "RA", "id": "malformed", "hash": "$2a$10$short", "method": "BCRYPT"}
+`
+	report, err := cDB.ImportUsers(ctx, strings.NewReader(input), ImportOptions{Format: FormatJSONLines})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Created)
+	keys := make([]string, 0, len(report.Errors))
+	for _, rowErr := range report.Errors {
+		keys = append(keys, rowErr.Key)
+	}
+	assert.Equal(t, []string{"hugeLogN", "hugeR", "hugeP", "hugeIterations", "hugeMemory", "malformed"}, keys)
+	ids, err := cDB.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pbkdf2", "scrypt"}, ids["RA"])
+}
+
+func TestCredentaDB_ExportImport(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	source := newBackupSource(t, ctx)
+	assert.NoError(t, source.Update(ctx, "RA", "john", func(user *CUser) error {
+		user.AddRole(9)
+		return user.SetAttribute("email", "string", "john@mail.com")
+	}))
+
+	for _, format := range []BulkFormat{FormatJSONLines, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			options := ExportOptions{Format: format, Realms: []string{"RA"}}
+			if format == FormatCSV {
+				options.Columns = append(append([]string{}, DefaultUserColumns...), "attribute.email")
+			}
+			users, groups := &bytes.Buffer{}, &bytes.Buffer{}
+			count, err := source.ExportUsers(ctx, users, options)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, count)
+			assert.NotContains(t, users.String(), `"password":`)
+			options.Columns = nil
+			count, err = source.ExportGroups(ctx, groups, options)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			target := NewCredentaDBWithStore(NewMemoryStore())
+			report, err := target.ImportGroups(ctx, groups, ImportOptions{Format: format})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, report.Created)
+			report, err = target.ImportUsers(ctx, users, ImportOptions{Format: format})
+			assert.NoError(t, err)
+			assert.Equal(t, 2, report.Created)
+			assert.Empty(t, report.Errors)
+
+			john, err := target.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.True(t, john.HasRole(9))
+				assert.Equal(t, []string{"Admin"}, john.Groups)
+				_, email, _ := john.GetAttribute("email")
+				assert.Equal(t, "john@mail.com", email)
+				assert.True(t, MatchVerification(john.VerificationMethod, "password", john.VerificationHash))
+			}
+			assert.True(t, IsRoleFlagOn(target.GetRoleMasksOfGroups(ctx, "RA", "Admin"), 5))
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package credenta
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCacheConfig returns a cache configuration suitable for about 10k users.
+func DefaultCacheConfig() *CacheConfig {
+	return &CacheConfig{
+		MaxUsers:     10000,
+		UserTTL:      5 * time.Minute,
+		MaxGroups:    1000,
+		GroupTTL:     5 * time.Minute,
+		MaxRoleMasks: 1000,
+		RoleMaskTTL:  5 * time.Minute,
+	}
+}
+
+// CacheConfig configure the read-through cache of CredentaDB. Each kind of entry have its own LRU cache with
+// maximum number of entries and time to live. A zero maximum disable caching of that kind, a zero time to live
+// means entries never expire (they are still evicted and invalidated).
+type CacheConfig struct {
+	MaxUsers     int           `json:"maxUsers"`
+	UserTTL      time.Duration `json:"userTTL"`
+	MaxGroups    int           `json:"maxGroups"`
+	GroupTTL     time.Duration `json:"groupTTL"`
+	MaxRoleMasks int           `json:"maxRoleMasks"`
+	RoleMaskTTL  time.Duration `json:"roleMaskTTL"`
+}
+
+// CacheStats are the hit and miss counters of the CredentaDB cache since it was enabled.
+type CacheStats struct {
+	UserHits       uint64 `json:"userHits"`
+	UserMisses     uint64 `json:"userMisses"`
+	GroupHits      uint64 `json:"groupHits"`
+	GroupMisses    uint64 `json:"groupMisses"`
+	RoleMaskHits   uint64 `json:"roleMaskHits"`
+	RoleMaskMisses uint64 `json:"roleMaskMisses"`
+}
+
+// credentaCache holds the caches of a CredentaDB.
+type credentaCache struct {
+	users     *lruCache[*CUser]
+	groups    *lruCache[*CGroup]
+	roleMasks *lruCache[[]uint64]
+}
+
+// EnableCache turn on the read-through cache for users, groups and the effective role masks of groups,
+// replacing the existing cache if any. It should be called before the CredentaDB is used concurrently.
+// The cache is invalidated whenever a user or group is saved or deleted through this CredentaDB, changes made
+// by other processes are only seen once the entry expires or InvalidateCache is called.
+func (store *CredentaDB) EnableCache(config *CacheConfig) {
+	store.cache = &credentaCache{
+		users:     newLRUCache[*CUser](config.MaxUsers, config.UserTTL),
+		groups:    newLRUCache[*CGroup](config.MaxGroups, config.GroupTTL),
+		roleMasks: newLRUCache[[]uint64](config.MaxRoleMasks, config.RoleMaskTTL),
+	}
+}
+
+// DisableCache turn off the cache and drop every cached entry.
+func (store *CredentaDB) DisableCache() {
+	store.cache = nil
+}
+
+// InvalidateCache drop every cached entry, the cache stays enabled.
+func (store *CredentaDB) InvalidateCache() {
+	if store.cache == nil {
+		return
+	}
+	store.cache.users.Clear()
+	store.cache.groups.Clear()
+	store.cache.roleMasks.Clear()
+}
+
+// CacheStats returns the cache hit and miss counters, all zero if cache is not enabled.
+func (store *CredentaDB) CacheStats() CacheStats {
+	if store.cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		UserHits:       store.cache.users.hits.Load(),
+		UserMisses:     store.cache.users.misses.Load(),
+		GroupHits:      store.cache.groups.hits.Load(),
+		GroupMisses:    store.cache.groups.misses.Load(),
+		RoleMaskHits:   store.cache.roleMasks.hits.Load(),
+		RoleMaskMisses: store.cache.roleMasks.misses.Load(),
+	}
+}
+
+// invalidateUser drop the cached user.
+func (store *CredentaDB) invalidateUser(realm, id string) {
+	if store.cache != nil {
+		store.cache.users.Remove(cacheKey(realm, id))
+	}
+}
+
+// invalidateGroup drop the cached group, and all the cached role masks since they might inherit from the group.
+func (store *CredentaDB) invalidateGroup(realm, name string) {
+	if store.cache != nil {
+		store.cache.groups.Remove(cacheKey(realm, name))
+		store.cache.roleMasks.Clear()
+	}
+}
+
+func cacheKey(realm, key string) string {
+	return realm + "\x00" + key
+}
+
+// newLRUCache creates a cache holding at most maxEntries, each entry expire after ttl (never if ttl is zero).
+func newLRUCache[V any](maxEntries int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// lruCache is a least recently used cache with optional time to live, safe for concurrent use.
+type lruCache[V any] struct {
+	mutex      sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type lruEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+// Get returns the cached value of the key, and false if it is not cached or has expired.
+func (c *lruCache[V]) Get(key string) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var zero V
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return zero, false
+	}
+	entry := element.Value.(*lruEntry[V])
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		c.misses.Add(1)
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return entry.value, true
+}
+
+// Put add or replace the value of the key, evicting the least recently used entry when the cache is full.
+func (c *lruCache[V]) Put(key string, value V) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expiresAt := time.Time{}
+	if c.ttl > 0 {
+		expiresAt = time.Now().Add(c.ttl)
+	}
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry[V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// Remove drop the key from the cache.
+func (c *lruCache[V]) Remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Clear drop every entry from the cache.
+func (c *lruCache[V]) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Len returns the number of entries in the cache, including the expired one not yet dropped.
+func (c *lruCache[V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,88 @@
+package credenta
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLRUCache_EvictAndExpire(t *testing.T) {
+	c := newLRUCache[int](2, 0)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	c.Put("c", 3)
+	_, ok = c.Get("b")
+	assert.False(t, ok, "b is the least recently used and must be evicted")
+	assert.Equal(t, 2, c.Len())
+
+	expiring := newLRUCache[int](2, time.Millisecond)
+	expiring.Put("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	_, ok = expiring.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, expiring.Len())
+
+	disabled := newLRUCache[int](0, 0)
+	disabled.Put("a", 1)
+	_, ok = disabled.Get("a")
+	assert.False(t, ok)
+}
+
+func TestCredentaDB_Cache(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	cDB.EnableCache(DefaultCacheConfig())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	elder, err := cDB.NewGroup(ctx, "RA", "GroupElder", nil)
+	assert.NoError(t, err)
+	elder.AddRole(0)
+	assert.NoError(t, elder.StoreOrSaveToFile(ctx))
+	son, err := cDB.NewGroup(ctx, "RA", "GroupSon", []string{"GroupElder"})
+	assert.NoError(t, err)
+	assert.NoError(t, son.StoreOrSaveToFile(ctx))
+
+	usr, err := cDB.NewUser(ctx, "RA", "USERA", "password", []string{"GroupSon"}, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	usr.Active = true
+	assert.NoError(t, usr.StoreOrSaveToFile(ctx))
+
+	_, roles, err := cDB.GetUserWithAuth(ctx, "RA", "USERA", "password")
+	assert.NoError(t, err)
+	assert.True(t, IsRoleFlagOn(roles, 0))
+	first := cDB.CacheStats()
+
+	user, roles, err := cDB.GetUserWithAuth(ctx, "RA", "USERA", "password")
+	assert.NoError(t, err)
+	assert.True(t, IsRoleFlagOn(roles, 0))
+	assert.False(t, user.HasRole(0), "group roles must not leak into the user's own role masks")
+	second := cDB.CacheStats()
+	assert.Equal(t, first.UserHits+1, second.UserHits)
+	assert.Equal(t, first.RoleMaskHits+1, second.RoleMaskHits)
+	assert.Equal(t, first.GroupMisses, second.GroupMisses, "effective role masks are cached, groups must not be read again")
+
+	// changing the parent group must invalidate the effective role masks of its children.
+	assert.NoError(t, cDB.UpdateGroup(ctx, "RA", "GroupElder", func(group *CGroup) error {
+		group.AddRole(7)
+		return nil
+	}))
+	_, roles, err = cDB.GetUserWithAuth(ctx, "RA", "USERA", "password")
+	assert.NoError(t, err)
+	assert.True(t, IsRoleFlagOn(roles, 7))
+
+	assert.NoError(t, cDB.Update(ctx, "RA", "USERA", func(user *CUser) error {
+		user.Enable = false
+		return nil
+	}))
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "USERA", "password")
+	assert.Error(t, err, "saved user must be invalidated from the cache")
+
+	assert.NoError(t, cDB.DeleteUser(ctx, "RA", "USERA"))
+	_, err = cDB.GetUser(ctx, "RA", "USERA")
+	assert.Error(t, err)
+
+	cDB.DisableCache()
+	assert.Equal(t, CacheStats{}, cDB.CacheStats())
+}
@@ -28,11 +28,75 @@ func getEnvVar(varName string, defaultValue string, options []string) string {
 	}
 }
 
+// NewCredentaDB creates a new CredentaDB using the Store selected by CREDENTA_STORE environment variable.
+//
+//   - FILE (default) store users and groups as JSON files. The folders are configured using CREDENTA_BASE_DIR,
+//     CREDENTA_USER_DIR and CREDENTA_GROUP_DIR environment variable.
+//   - SQLITE store users and groups in a single SQLite database file configured using CREDENTA_SQLITE_FILE.
+//   - BOLT store users and groups in a single bbolt key-value database file configured using CREDENTA_BOLT_FILE.
+//   - MEMORY store users and groups in memory, everything is lost when the process ends.
+//
+// Encryption at rest is enabled when the key ring is set in CREDENTA_KEK_FILE or CREDENTA_KEK, see LoadKeyRing, and
+// the digest verification methods are peppered when the peppers are set in CREDENTA_PEPPER_FILE or CREDENTA_PEPPER,
+// see LoadPepperRing.
 func NewCredentaDB() (*CredentaDB, error) {
+	storeType := getEnvVar("CREDENTA_STORE", "FILE", []string{"FILE", "SQLITE", "BOLT", "MEMORY"})
+
+	var cDB *CredentaDB
+	switch storeType {
+	case "SQLITE":
+		sqliteFile := getEnvVar("CREDENTA_SQLITE_FILE", "./data/credenta.db", nil)
+		sqliteStore, err := NewSQLiteStore(sqliteFile)
+		if err != nil {
+			return nil, err
+		}
+		cDB = NewCredentaDBWithStore(sqliteStore)
+	case "BOLT":
+		boltFile := getEnvVar("CREDENTA_BOLT_FILE", "./data/credenta.bolt", nil)
+		boltStore, err := NewBoltStore(boltFile)
+		if err != nil {
+			return nil, err
+		}
+		cDB = NewCredentaDBWithStore(boltStore)
+	case "MEMORY":
+		cDB = NewCredentaDBWithStore(NewMemoryStore())
+	default:
+		fileStore, err := NewFileStoreFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		cDB = NewCredentaDBWithStore(fileStore)
+		cDB.BaseFolder = fileStore.BaseFolder
+		cDB.UserFolder = fileStore.UserFolder
+		cDB.GroupFolder = fileStore.GroupFolder
+	}
 
-	baseFolder := getEnvVar("CREDENTA_BASE_DIR", ".", nil)
-	userFolder := getEnvVar("CREDENTA_USER_DIR", "/data/user", nil)
-	groupFolder := getEnvVar("CREDENTA_GROUP_DIR", "/data/group", nil)
+	keys, err := LoadKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		if err := cDB.EnableEncryption(keys); err != nil {
+			return nil, err
+		}
+	}
+	peppers, err := LoadPepperRing()
+	if err != nil {
+		return nil, err
+	}
+	if peppers != nil {
+		if err := cDB.EnablePepper(peppers); err != nil {
+			return nil, err
+		}
+	}
+	return cDB, nil
+}
+
+// NewCredentaDBWithStore creates a new CredentaDB that keep its users and groups in the supplied Store.
+// The default realm and password policy are configured using CREDENTA_REALM_DEFAULT and CREDENTA_PASS_POLICY
+// environment variable.
+func NewCredentaDBWithStore(dataStore Store) *CredentaDB {
 	defaultRealm := getEnvVar("CREDENTA_REALM_DEFAULT", "DEFAULT", nil)
 	passPolicy := getEnvVar("CREDENTA_PASS_POLICY", "SIMPLE", []string{"SIMPLE", "STRONG", "CLASSIC"})
 
@@ -49,23 +113,11 @@ func NewCredentaDB() (*CredentaDB, error) {
 		passphrasePolicy = SimplePasswordPolicy()
 	}
 
-	cDB := &CredentaDB{
+	return &CredentaDB{
 		DefaultRealm: defaultRealm,
 		PassPolicy:   passphrasePolicy,
-		BaseFolder:   baseFolder,
-		UserFolder:   userFolder,
-		GroupFolder:  groupFolder,
-	}
-
-	if _, err := os.Stat(fmt.Sprintf("%s%s", baseFolder, userFolder)); err != nil {
-		return nil, fmt.Errorf("could not find user directory \"%s%s\". Please create the directory or change the environment variable CREDENTA_BASE_DIR and/or CREDENTA_USER_DIR and try again ", baseFolder, userFolder)
-	}
-
-	if _, err := os.Stat(fmt.Sprintf("%s%s", baseFolder, groupFolder)); err != nil {
-		return nil, fmt.Errorf("could not find user directory \"%s%s\". Please create the directory or change the environment variable CREDENTA_BASE_DIR and/or CREDENTA_GROUP_DIR and try again ", baseFolder, groupFolder)
+		Store:        dataStore,
 	}
-
-	return cDB, nil
 }
 
 type CredentaDB struct {
@@ -74,27 +126,62 @@ type CredentaDB struct {
 	BaseFolder   string            `json:"baseFolder"`
 	UserFolder   string            `json:"userFolder"`
 	GroupFolder  string            `json:"groupFolder"`
+
+	// Store is where all the users and groups are persisted.
+	Store Store `json:"-"`
+
+	// recordLocks protect records of Store that does not implement Locker.
+	recordLocks keyedMutex
+	// cache is the read-through cache, nil when cache is not enabled. See EnableCache.
+	cache *credentaCache
+	// indexes are the declared secondary indexes of user attributes keyed by attribute name. See DeclareIndex.
+	indexes map[string]*UserIndex
+	// trashRetention is how long deleted records are kept in the trash, zero when trash is not enabled. See EnableTrash.
+	trashRetention time.Duration
+	// history is true when the change history is enabled. See EnableHistory.
+	history bool
+	// keys seal the stored records, nil when encryption is not enabled. See EnableEncryption.
+	keys *KeyRing
+	// peppers are mixed into the digest hashes, nil when pepper is not enabled. See EnablePepper.
+	peppers *PepperRing
+	// hashParams are the parameters of the new hashes, nil for the DefaultHashParameters. See SetHashParameters.
+	hashParams *HashParameters
+	// lockout is the account lockout policy, nil when lockout is not enabled. See EnableLockout.
+	lockout *LockoutPolicy
+	// preferredMethod is the verification method hashes are upgraded to on login, empty when rehash is not
+	// enabled. See EnableRehash.
+	preferredMethod VerificationMethod
+	// rehashHook is called after every hash upgrade. See EnableRehash.
+	rehashHook RehashHook
 }
 
+// GetRoleMasksOfGroups returns the effective role masks of a group, which is the group's own role masks combined
+// with the effective role masks of all its parent groups. The result is cached when cache is enabled.
 func (store *CredentaDB) GetRoleMasksOfGroups(ctx context.Context, realm, group string) []uint64 {
+	if store.cache != nil {
+		if masks, ok := store.cache.roleMasks.Get(cacheKey(realm, group)); ok {
+			return append([]uint64{}, masks...)
+		}
+	}
+
 	ret := make([]uint64, RoleMaskCount)
 	theGroup, err := store.GetGroup(ctx, realm, group)
 	if err != nil || theGroup == nil {
 		return ret
 	}
 
-	if theGroup.ParentGroups == nil || len(theGroup.ParentGroups) == 0 {
-		return theGroup.RoleMasks
-	} else {
-		ret = theGroup.RoleMasks
-		for _, parentGroupName := range theGroup.ParentGroups {
-			parentRoles := store.GetRoleMasksOfGroups(ctx, realm, parentGroupName)
-			for i, rete := range ret {
-				ret[i] = rete | parentRoles[i]
-			}
+	copy(ret, theGroup.RoleMasks)
+	for _, parentGroupName := range theGroup.ParentGroups {
+		parentRoles := store.GetRoleMasksOfGroups(ctx, realm, parentGroupName)
+		for i := range ret {
+			ret[i] = ret[i] | parentRoles[i]
 		}
-		return ret
 	}
+
+	if store.cache != nil {
+		store.cache.roleMasks.Put(cacheKey(realm, group), append([]uint64{}, ret...))
+	}
+	return ret
 }
 
 func (store *CredentaDB) NewDefaultGroup(ctx context.Context, name string, parentGroup []string) (*CGroup, error) {
@@ -106,14 +193,19 @@ func (store *CredentaDB) NewGroup(ctx context.Context, realm, name string, paren
 		return nil, errors.New("realm and name is required")
 	}
 
-	groupFileName := fmt.Sprintf("%s%s/%s_IN_%s.json", store.BaseFolder, store.GroupFolder, name, realm)
-	_, err := os.Stat(groupFileName)
+	_, err := store.Store.GetGroup(ctx, realm, name)
 	if err == nil {
-		return nil, errors.New("group already exists")
+		return nil, fmt.Errorf("in NewGroup function. group %s in realm %s: %w", name, realm, ErrAlreadyExists)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := store.checkNotTrashed(ctx, RecordGroup, realm, name); err != nil {
+		return nil, err
 	}
 
 	theGroup := &CGroup{
-		FilePath:     groupFileName,
+		db:           store,
 		Realm:        realm,
 		Name:         name,
 		ParentGroups: parentGroup,
@@ -129,25 +221,22 @@ func (store *CredentaDB) NewGroup(ctx context.Context, realm, name string, paren
 	return theGroup, nil
 }
 
+// ChangeUserPassword validate the password against the PassPolicy and store its verification hash into the user.
 func (store *CredentaDB) ChangeUserPassword(ctx context.Context, realm, user, password string, vMethod VerificationMethod) error {
-	theUser, err := store.GetUser(ctx, realm, user)
-	if err != nil {
-		return err
-	}
-	valid, err := store.PassPolicy.IsPasswordValid(password)
-	if err != nil || !valid {
-		return fmt.Errorf("invalid password format")
+	if _, err := store.PassPolicy.IsPasswordValid(password); err != nil {
+		return fmt.Errorf("in ChangeUserPassword function. %w", err)
 	}
 
-	hash, err := MakeVerification(vMethod, password)
+	hash, err := makeVerification(vMethod, password, store.peppers, store.hashParams)
 	if err != nil {
 		return err
 	}
 
-	theUser.VerificationHash = hash
-	theUser.VerificationMethod = vMethod
-
-	return nil
+	return store.Update(ctx, realm, user, func(theUser *CUser) error {
+		theUser.VerificationHash = hash
+		theUser.VerificationMethod = vMethod
+		return nil
+	})
 }
 
 func (store *CredentaDB) NewDefaultUser(ctx context.Context, id, password string, groups []string, idType IdType, vMethod VerificationMethod) (*CUser, error) {
@@ -159,24 +248,28 @@ func (store *CredentaDB) NewUser(ctx context.Context, realm, id, password string
 		return nil, fmt.Errorf("in NewUser function. realm, id and password is required")
 	}
 
-	valid, err := store.PassPolicy.IsPasswordValid(password)
-	if err != nil || !valid {
-		return nil, fmt.Errorf("invalid email password")
+	if _, err := store.PassPolicy.IsPasswordValid(password); err != nil {
+		return nil, fmt.Errorf("in NewUser function. %w", err)
 	}
 
-	hash, err := MakeVerification(vMethod, password)
+	hash, err := makeVerification(vMethod, password, store.peppers, store.hashParams)
 	if err != nil {
 		return nil, err
 	}
 
-	userFileName := fmt.Sprintf("%s%s/%s_IN_%s.json", store.BaseFolder, store.UserFolder, id, realm)
-	_, err = os.Stat(userFileName)
+	_, err = store.Store.GetUser(ctx, realm, id)
 	if err == nil {
-		return nil, errors.New("user already exists")
+		return nil, fmt.Errorf("in NewUser function. user %s in realm %s: %w", id, realm, ErrAlreadyExists)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := store.checkNotTrashed(ctx, RecordUser, realm, id); err != nil {
+		return nil, err
 	}
 
 	theUser := &CUser{
-		FilePath:           userFileName,
+		db:                 store,
 		Realm:              realm,
 		Id:                 id,
 		IDType:             idType,
@@ -206,14 +299,22 @@ func (store *CredentaDB) GetGroup(ctx context.Context, realm, name string) (*CGr
 		return nil, fmt.Errorf("in GetGroup function. realm and name are required")
 	}
 
-	theGroup := &CGroup{
-		FilePath: fmt.Sprintf("%s%s/%s_IN_%s.json", store.BaseFolder, store.GroupFolder, name, realm),
+	if store.cache != nil {
+		if cached, ok := store.cache.groups.Get(cacheKey(realm, name)); ok {
+			theGroup := cached.clone()
+			theGroup.db = store
+			return theGroup, nil
+		}
 	}
 
-	err := theGroup.ReloadFromFile(ctx)
+	theGroup, err := store.loadGroup(ctx, realm, name)
 	if err != nil {
 		return nil, err
 	}
+	if store.cache != nil {
+		store.cache.groups.Put(cacheKey(realm, name), theGroup.clone())
+	}
+	theGroup.db = store
 	return theGroup, nil
 }
 
@@ -226,14 +327,22 @@ func (store *CredentaDB) GetUser(ctx context.Context, realm, id string) (*CUser,
 		return nil, fmt.Errorf("in GetUser function. realm and id are required")
 	}
 
-	theUser := &CUser{
-		FilePath: fmt.Sprintf("%s%s/%s_IN_%s.json", store.BaseFolder, store.UserFolder, id, realm),
+	if store.cache != nil {
+		if cached, ok := store.cache.users.Get(cacheKey(realm, id)); ok {
+			theUser := cached.clone()
+			theUser.db = store
+			return theUser, nil
+		}
 	}
 
-	err := theUser.ReloadFromFile(ctx)
+	theUser, err := store.loadUser(ctx, realm, id)
 	if err != nil {
 		return nil, err
 	}
+	if store.cache != nil {
+		store.cache.users.Put(cacheKey(realm, id), theUser.clone())
+	}
+	theUser.db = store
 	return theUser, nil
 }
 
@@ -246,20 +355,42 @@ func (store *CredentaDB) GetUserWithAuth(ctx context.Context, realm, id, passwor
 		return nil, nil, errors.New("in GetUserWithAuth function. realm and id and password are required")
 	}
 	user, err := store.GetUser(ctx, realm, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, &CredentialsError{Realm: realm, Id: id, Cause: err}
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("in GetUserWithAuth function : %v", err)
+		return nil, nil, fmt.Errorf("in GetUserWithAuth function : %w", err)
+	}
+	// the password is verified even when locked out, so a locked user takes as long as a wrong password.
+	matched := matchVerification(user.VerificationMethod, password, user.VerificationHash, store.peppers)
+	if store.lockout != nil && user.IsLocked() {
+		return nil, nil, &CredentialsError{Realm: realm, Id: id, Cause: &LockedError{Realm: realm, Id: id, Until: user.LockedUntil}}
 	}
-	if MatchVerification(user.VerificationMethod, password, user.VerificationHash) {
+	if matched {
 		if !user.Active {
-			return nil, nil, errors.New("in GetUserWithAuth function. User is not activated")
+			return nil, nil, fmt.Errorf("in GetUserWithAuth function. %w", ErrUserNotActivated)
 		}
 		if !user.Enable {
-			return nil, nil, errors.New("in GetUserWithAuth function. User is disabled")
+			return nil, nil, fmt.Errorf("in GetUserWithAuth function. %w", ErrUserDisabled)
+		}
+		// the user is checked again while locked, a failed authentication might have locked it out meanwhile.
+		if store.lockout != nil {
+			if err := store.resetFailedAuth(ctx, realm, id, false); err != nil {
+				locked := &LockedError{}
+				if errors.As(err, &locked) {
+					return nil, nil, &CredentialsError{Realm: realm, Id: id, Cause: locked}
+				}
+				return nil, nil, fmt.Errorf("in GetUserWithAuth function : %w", err)
+			}
+		}
+		if store.preferredMethod != "" && needsRehash(user.VerificationMethod, user.VerificationHash, store.preferredMethod, store.peppers, store.hashParams) {
+			store.rehash(ctx, user, password)
 		}
 		if user.Groups == nil || len(user.Groups) == 0 {
 			return user, user.RoleMasks, nil
 		} else {
-			ret := user.RoleMasks
+			ret := make([]uint64, RoleMaskCount)
+			copy(ret, user.RoleMasks)
 			for _, grp := range user.Groups {
 				grpRoleMask := store.GetRoleMasksOfGroups(ctx, realm, grp)
 				for i := 0; i < RoleMaskCount; i++ {
@@ -269,67 +400,295 @@ func (store *CredentaDB) GetUserWithAuth(ctx context.Context, realm, id, passwor
 			return user, ret, nil
 		}
 	}
-	return nil, nil, fmt.Errorf("invalid authentication")
+	if store.lockout != nil {
+		if err := store.recordFailedAuth(ctx, realm, id); err != nil {
+			return nil, nil, fmt.Errorf("in GetUserWithAuth function : %w", err)
+		}
+	}
+	return nil, nil, &CredentialsError{Realm: realm, Id: id}
 }
 
-/*
-ListUserIDs will return a map of realm name to array of user id. The function will go to directory with format
-`BaseFolder/UserFolder` and look for file with `USERID_IN_REALM.json` name. It will return an error if no folder with
-that name is found. By default, the BaseFolder is "." which equals to the name of the project.
-*/
-func (store *CredentaDB) ListUserIDs(ctx context.Context) (map[string][]string, error) {
-	if !pathExists(fmt.Sprintf("%s%s", store.BaseFolder, store.UserFolder)) {
-		return nil, fmt.Errorf("in ListUserDataFiles function, folder %s%s not exists", store.BaseFolder, store.UserFolder)
+// SaveUser persist the supplied user into the Store, creating it if not yet exist.
+func (store *CredentaDB) SaveUser(ctx context.Context, user *CUser) error {
+	if user.Realm == "" || user.Id == "" {
+		return errors.New("in SaveUser function. realm and id are required")
 	}
-	entries, err := os.ReadDir(fmt.Sprintf("%s%s", store.BaseFolder, store.UserFolder))
+	unlock, err := store.lockUser(ctx, user.Realm, user.Id)
 	if err != nil {
-		return nil, fmt.Errorf("in ListUserDataFiles function, error reading directory %s%s: %w", store.BaseFolder, store.UserFolder, err)
+		return err
 	}
-	return store.listDataFiles(ctx, entries), nil
+	defer unlock()
+	return store.saveUser(ctx, user)
 }
 
-/*
-ListGroupNames will return a map of realm name to array of group name. The function will go to directory with format
-`BaseFolder/GroupFolder` and look for file with `NAME_IN_REALM.json` name. It will return an error if no folder with
-that name is found. By default, the BaseFolder is "." which equals to the name of the project.
-*/
-func (store *CredentaDB) ListGroupNames(ctx context.Context) (map[string][]string, error) {
-	if !pathExists(fmt.Sprintf("%s%s", store.BaseFolder, store.GroupFolder)) {
-		return nil, fmt.Errorf("in ListGroupDataFiles function, folder %s%s not exists", store.BaseFolder, store.GroupFolder)
+// saveUser persist the user into the Store, the caller must hold the user's lock.
+// The user's Version must match the stored one, and it will be increased once saved. The failed authentication
+// counters and lockout of an existing user are kept as stored, they are only changed by the authentication and
+// UnlockUser, which do not increase the Version, so a copy loaded before would otherwise put them back.
+func (store *CredentaDB) saveUser(ctx context.Context, user *CUser) error {
+	actual := uint64(0)
+	stored, err := store.loadUser(ctx, user.Realm, user.Id)
+	if err == nil {
+		actual = stored.Version
+		user.keepLockout(stored)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	} else if err := store.checkNotTrashed(ctx, RecordUser, user.Realm, user.Id); err != nil {
+		return err
 	}
-	entries, err := os.ReadDir(fmt.Sprintf("%s%s", store.BaseFolder, store.GroupFolder))
+	if actual != user.Version {
+		return &ConflictError{Kind: RecordUser, Realm: user.Realm, Key: user.Id, ExpectedVersion: user.Version, ActualVersion: actual}
+	}
+	if err := store.checkIndexedValues(user); err != nil {
+		return err
+	}
+	unlockValues, err := store.lockUniqueValues(ctx, []*CUser{user}, nil)
 	if err != nil {
-		return nil, fmt.Errorf("in ListGroupDataFiles function, error reading directory %s%s: %w", store.BaseFolder, store.GroupFolder, err)
-	}
-	return store.listDataFiles(ctx, entries), nil
-}
-
-/*
-listDataFiles return  list map of realm name to data string for each entries. This function will be called by
-ListUserDataFiles or ListGroupDataFiles function.
-*/
-func (store *CredentaDB) listDataFiles(ctx context.Context, entries []os.DirEntry) map[string][]string {
-	ret := make(map[string][]string)
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			n := strings.Split(entry.Name(), ".")
-			ne := strings.Split(n[0], "_IN_")
-			id := ne[0]
-			realm := ne[1]
-			if _, ok := ret[realm]; ok {
-				ret[realm] = append(ret[realm], id)
-			} else {
-				ret[realm] = make([]string, 0)
-				ret[realm] = append(ret[realm], id)
-			}
+		return err
+	}
+	defer unlockValues()
+
+	updatedAt, updatedBy := user.UpdatedAt, user.UpdatedBy
+	user.UpdatedBy = ctx.Value(ETX_USER).(string)
+	user.UpdatedAt = time.Now()
+	user.Version++
+	if err := store.putUserChecked(ctx, user, actual, true); err != nil {
+		user.UpdatedAt, user.UpdatedBy = updatedAt, updatedBy
+		user.Version--
+		return err
+	}
+	store.invalidateUser(user.Realm, user.Id)
+	user.db = store
+	if err := store.updateUserIndexes(ctx, stored, user); err != nil {
+		return err
+	}
+	return store.recordUserHistory(ctx, stored, user)
+}
+
+// Update loads the user with specified realm and id, pass it into fn for modification and then save it back.
+// The whole cycle is done while holding the user's lock, so concurrent updates of the same user, even from other
+// processes when the Store implements Locker, never overwrite each other. The user is not saved if fn returns error.
+func (store *CredentaDB) Update(ctx context.Context, realm, id string, fn func(user *CUser) error) error {
+	if realm == "" || id == "" {
+		return errors.New("in Update function. realm and id are required")
+	}
+	unlock, err := store.lockUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// read straight from the Store, a cached copy might be stale if the record was changed by other process.
+	user, err := store.loadUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	user.db = store
+	if err := fn(user); err != nil {
+		return err
+	}
+	return store.saveUser(ctx, user)
+}
+
+// DeleteUser remove the user with specified realm and id from the Store, into the trash when enabled (see EnableTrash).
+func (store *CredentaDB) DeleteUser(ctx context.Context, realm, id string) error {
+	if realm == "" || id == "" {
+		return errors.New("in DeleteUser function. realm and id are required")
+	}
+	unlock, err := store.lockUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	store.invalidateUser(realm, id)
+	var stored *CUser
+	if _, ok := store.Store.(AuxStore); ok {
+		// the stored user tells which index entries to remove.
+		if stored, err = store.loadUser(ctx, realm, id); err != nil {
+			return err
 		}
+		// deleting is a change too, the trash and history keep the user in its next version.
+		stored.Version++
 	}
-	return ret
+	if aux, ok := store.trashEnabled(); ok {
+		if err := store.moveToTrash(ctx, aux, &TrashEntry{Kind: RecordUser, Realm: realm, Key: id, User: stored}); err != nil {
+			return err
+		}
+	}
+	if err := store.Store.DeleteUser(ctx, realm, id); err != nil {
+		return err
+	}
+	if err := store.updateUserIndexes(ctx, stored, nil); err != nil {
+		return err
+	}
+	return store.recordUserHistory(ctx, stored, nil)
+}
+
+// SaveGroup persist the supplied group into the Store, creating it if not yet exist.
+func (store *CredentaDB) SaveGroup(ctx context.Context, group *CGroup) error {
+	if group.Realm == "" || group.Name == "" {
+		return errors.New("in SaveGroup function. realm and name are required")
+	}
+	unlock, err := store.lockGroup(ctx, group.Realm, group.Name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return store.saveGroup(ctx, group)
+}
+
+// saveGroup persist the group into the Store, the caller must hold the group's lock.
+// The group's Version must match the stored one, and it will be increased once saved.
+func (store *CredentaDB) saveGroup(ctx context.Context, group *CGroup) error {
+	actual := uint64(0)
+	stored, err := store.loadGroup(ctx, group.Realm, group.Name)
+	if err == nil {
+		actual = stored.Version
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	} else if err := store.checkNotTrashed(ctx, RecordGroup, group.Realm, group.Name); err != nil {
+		return err
+	}
+	if actual != group.Version {
+		return &ConflictError{Kind: RecordGroup, Realm: group.Realm, Key: group.Name, ExpectedVersion: group.Version, ActualVersion: actual}
+	}
+
+	updatedAt, updatedBy := group.UpdatedAt, group.UpdatedBy
+	group.UpdatedBy = ctx.Value(ETX_USER).(string)
+	group.UpdatedAt = time.Now()
+	group.Version++
+	if err := store.putGroupChecked(ctx, group, actual); err != nil {
+		group.UpdatedAt, group.UpdatedBy = updatedAt, updatedBy
+		group.Version--
+		return err
+	}
+	store.invalidateGroup(group.Realm, group.Name)
+	group.db = store
+	if err := store.updateGroupIndexes(ctx, stored, group); err != nil {
+		return err
+	}
+	return store.recordGroupHistory(ctx, stored, group)
+}
+
+// UpdateGroup loads the group with specified realm and name, pass it into fn for modification and then save it back
+// while holding the group's lock. The group is not saved if fn returns error.
+func (store *CredentaDB) UpdateGroup(ctx context.Context, realm, name string, fn func(group *CGroup) error) error {
+	if realm == "" || name == "" {
+		return errors.New("in UpdateGroup function. realm and name are required")
+	}
+	unlock, err := store.lockGroup(ctx, realm, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	group, err := store.loadGroup(ctx, realm, name)
+	if err != nil {
+		return err
+	}
+	group.db = store
+	if err := fn(group); err != nil {
+		return err
+	}
+	return store.saveGroup(ctx, group)
+}
+
+// DeleteGroup remove the group with specified realm and name from the Store, into the trash when enabled (see
+// EnableTrash).
+func (store *CredentaDB) DeleteGroup(ctx context.Context, realm, name string) error {
+	if realm == "" || name == "" {
+		return errors.New("in DeleteGroup function. realm and name are required")
+	}
+	unlock, err := store.lockGroup(ctx, realm, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	store.invalidateGroup(realm, name)
+	var stored *CGroup
+	if _, ok := store.Store.(AuxStore); ok {
+		// the stored group tells which index entries to remove.
+		if stored, err = store.loadGroup(ctx, realm, name); err != nil {
+			return err
+		}
+		// deleting is a change too, the trash and history keep the group in its next version.
+		stored.Version++
+	}
+	if aux, ok := store.trashEnabled(); ok {
+		if err := store.moveToTrash(ctx, aux, &TrashEntry{Kind: RecordGroup, Realm: realm, Key: name, Group: stored}); err != nil {
+			return err
+		}
+	}
+	if err := store.Store.DeleteGroup(ctx, realm, name); err != nil {
+		return err
+	}
+	if err := store.updateGroupIndexes(ctx, stored, nil); err != nil {
+		return err
+	}
+	return store.recordGroupHistory(ctx, stored, nil)
+}
+
+// lockUser acquire the lock of a user using the Store if it implements Locker, or a lock local to this CredentaDB.
+func (store *CredentaDB) lockUser(ctx context.Context, realm, id string) (func(), error) {
+	if locker, ok := store.Store.(Locker); ok {
+		return locker.LockUser(ctx, realm, id)
+	}
+	return store.recordLocks.Lock("user/" + realm + "/" + id), nil
+}
+
+// lockGroup acquire the lock of a group using the Store if it implements Locker, or a lock local to this CredentaDB.
+func (store *CredentaDB) lockGroup(ctx context.Context, realm, name string) (func(), error) {
+	if locker, ok := store.Store.(Locker); ok {
+		return locker.LockGroup(ctx, realm, name)
+	}
+	return store.recordLocks.Lock("group/" + realm + "/" + name), nil
 }
 
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+// ListUserIDs will return a map of realm name to array of user id as listed by the Store.
+func (store *CredentaDB) ListUserIDs(ctx context.Context) (map[string][]string, error) {
+	return store.Store.ListUserIDs(ctx)
+}
+
+// ListGroupNames will return a map of realm name to array of group name as listed by the Store.
+func (store *CredentaDB) ListGroupNames(ctx context.Context) (map[string][]string, error) {
+	return store.Store.ListGroupNames(ctx)
+}
+
+// WalkUserIDs call fn with the realm and id of every user, stopping at the first error returned by fn.
+// When the Store implements Walker the ids are streamed, otherwise they are listed using ListUserIDs first.
+func (store *CredentaDB) WalkUserIDs(ctx context.Context, fn func(realm, id string) error) error {
+	if walker, ok := store.Store.(Walker); ok {
+		return walker.WalkUserIDs(ctx, fn)
+	}
+	userIDs, err := store.Store.ListUserIDs(ctx)
+	if err != nil {
+		return err
+	}
+	return walkRealmMap(userIDs, fn)
+}
+
+// WalkGroupNames call fn with the realm and name of every group, stopping at the first error returned by fn.
+// When the Store implements Walker the names are streamed, otherwise they are listed using ListGroupNames first.
+func (store *CredentaDB) WalkGroupNames(ctx context.Context, fn func(realm, name string) error) error {
+	if walker, ok := store.Store.(Walker); ok {
+		return walker.WalkGroupNames(ctx, fn)
+	}
+	groupNames, err := store.Store.ListGroupNames(ctx)
+	if err != nil {
+		return err
+	}
+	return walkRealmMap(groupNames, fn)
+}
+
+func walkRealmMap(realmMap map[string][]string, fn func(realm, key string) error) error {
+	for realm, keys := range realmMap {
+		for _, key := range keys {
+			if err := fn(realm, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func IsRoleFlagOn(roles []uint64, roleSquence int) bool {
@@ -2,13 +2,13 @@ package credenta
 
 import (
 	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestCredentaDB_GetUser(t *testing.T) {
-	cDB, err := NewCredentaDB()
-	assert.NoError(t, err)
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
 
 	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
 
@@ -51,8 +51,7 @@ func TestCredentaDB_GetUser(t *testing.T) {
 }
 
 func TestCredentaDB_GetRoleMasksOfGroups(t *testing.T) {
-	cDB, err := NewCredentaDB()
-	assert.NoError(t, err)
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
 
 	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
 
@@ -89,3 +88,50 @@ func TestCredentaDB_GetRoleMasksOfGroups(t *testing.T) {
 	assert.NoError(t, grandson.DeleteFile(ctx))
 
 }
+
+func TestCredentaDB_VersionConflict(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	u, err := cDB.NewUser(ctx, "DEFAULT", "USERID", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.SaveUser(ctx, u))
+	assert.Equal(t, uint64(1), u.Version)
+	assert.Equal(t, `"1"`, u.ETag())
+
+	adminA, err := cDB.GetUser(ctx, "DEFAULT", "USERID")
+	assert.NoError(t, err)
+	adminB, err := cDB.GetUser(ctx, "DEFAULT", "USERID")
+	assert.NoError(t, err)
+
+	adminA.Active = true
+	assert.NoError(t, adminA.StoreOrSaveToFile(ctx))
+	assert.Equal(t, uint64(2), adminA.Version)
+
+	adminB.Enable = false
+	err = adminB.StoreOrSaveToFile(ctx)
+	assert.True(t, errors.Is(err, ErrConflict))
+	conflict := &ConflictError{}
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, uint64(1), conflict.ExpectedVersion)
+	assert.Equal(t, uint64(2), conflict.ActualVersion)
+	assert.Equal(t, uint64(1), adminB.Version, "failed save must not change the version")
+
+	// conditional update using the etag issued for adminA's save.
+	version, err := ParseETag(`W/"2"`)
+	assert.NoError(t, err)
+	adminB.Version = version
+	assert.NoError(t, adminB.StoreOrSaveToFile(ctx))
+	_, err = ParseETag("2")
+	assert.Error(t, err)
+
+	g, err := cDB.NewGroup(ctx, "DEFAULT", "GroupA", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, g.StoreOrSaveToFile(ctx))
+	stale := g.clone()
+	assert.NoError(t, cDB.UpdateGroup(ctx, "DEFAULT", "GroupA", func(group *CGroup) error {
+		group.AddRole(1)
+		return nil
+	}))
+	assert.True(t, errors.Is(cDB.SaveGroup(ctx, stale), ErrConflict))
+}
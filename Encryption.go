@@ -0,0 +1,612 @@
+package credenta
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// sealedValuePrefix starts every sealed auxiliary record value, followed by the JSON of its Envelope.
+const sealedValuePrefix = "credenta-sealed:"
+
+// sealedAuxBuckets are the auxiliary record buckets whose values hold copies of users and groups, they are sealed
+// along with the records when encryption is enabled.
+var sealedAuxBuckets = []string{auxTrashBucket, auxHistoryBucket}
+
+// ErrEncryptionKey is returned (possibly wrapped) when a sealed record can not be opened because encryption is not
+// enabled, or the key it was sealed with is not in the KeyRing.
+var ErrEncryptionKey = errors.New("encryption key not available")
+
+// Envelope is the encrypted part of a stored record. The record is encrypted with its own random data key using
+// AES-GCM, and the data key is encrypted (wrapped) with the key-encryption key identified by KeyID.
+type Envelope struct {
+	KeyID string `json:"keyId"`
+	// Key is the wrapped data key, the nonce followed by the ciphertext.
+	Key []byte `json:"key"`
+	// Data is the encrypted record, the nonce followed by the ciphertext.
+	Data []byte `json:"data"`
+}
+
+// sealedUser is the part of a user that is sealed into its Envelope.
+type sealedUser struct {
+	Hash       string                `json:"hash"`
+	Attributes map[string]*Attribute `json:"attributes"`
+}
+
+// sealedGroup is the part of a group that is sealed into its Envelope.
+type sealedGroup struct {
+	Attributes []*Attribute `json:"attributes"`
+}
+
+// KeyRing holds the key-encryption keys identified by their key id. New records are sealed with the primary key,
+// the other keys are only used to open records sealed before the primary key was rotated.
+type KeyRing struct {
+	primary string
+	keys    map[string]cipher.AEAD
+	// indexKeys are the HMAC keys of the index values derived from the key of the same id, see indexValues.
+	indexKeys map[string][]byte
+}
+
+// NewKeyRing creates a KeyRing with the primary key. The key must be 16, 24 or 32 bytes long to select AES-128,
+// AES-192 or AES-256.
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	keys := &KeyRing{primary: id, keys: make(map[string]cipher.AEAD), indexKeys: make(map[string][]byte)}
+	if err := keys.AddKey(id, key); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ParseKeyRing parse the keys separated by comma or new line, each of them is the key id and the base64 encoded key
+// separated by a colon, e.g. `2024:q83vEjRWeJCrze8SNFZ4kKvN7xI0VniQq83vEjRWeJA=`. Empty lines and lines starting with
+// `#` are ignored. The first key is the primary key.
+func ParseKeyRing(text string) (*KeyRing, error) {
+	var keys *KeyRing
+	err := parseKeyList("ParseKeyRing", text, func(id string, key []byte) error {
+		if keys != nil {
+			return keys.AddKey(id, key)
+		}
+		var err error
+		keys, err = NewKeyRing(id, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, errors.New("in ParseKeyRing function. no key found")
+	}
+	return keys, nil
+}
+
+// parseKeyList calls add with every key of the text in the format of ParseKeyRing, in order.
+func parseKeyList(function, text string, add func(id string, key []byte) error) error {
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("in %s function. key must be written as id:base64", function)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("in %s function. key %s is not valid base64: %w", function, id, err)
+		}
+		if err := add(strings.TrimSpace(id), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKeyRing loads the KeyRing from the file specified by CREDENTA_KEK_FILE environment variable, or from the
+// CREDENTA_KEK environment variable itself, both in the format of ParseKeyRing. It returns nil KeyRing without error
+// when neither is set.
+func LoadKeyRing() (*KeyRing, error) {
+	text, err := loadKeyText("LoadKeyRing", "CREDENTA_KEK")
+	if err != nil || text == "" {
+		return nil, err
+	}
+	return ParseKeyRing(text)
+}
+
+// loadKeyText returns the content of the file specified by the environment variable suffixed by _FILE, or the value
+// of the environment variable itself, or empty string when neither is set.
+func loadKeyText(function, envVar string) (string, error) {
+	if path, ok := os.LookupEnv(envVar + "_FILE"); ok && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("in %s function. error reading key file %s: %w", function, path, err)
+		}
+		return string(data), nil
+	}
+	return os.Getenv(envVar), nil
+}
+
+// AddKey adds a key that is able to open records sealed with the key id, replacing the existing key of the same id.
+func (keys *KeyRing) AddKey(id string, key []byte) error {
+	if id == "" {
+		return errors.New("in AddKey function. key id is required")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return fmt.Errorf("in AddKey function. invalid key %s: %w", id, err)
+	}
+	keys.keys[id] = aead
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("credenta index"))
+	keys.indexKeys[id] = mac.Sum(nil)
+	return nil
+}
+
+// PrimaryKeyID returns the id of the key new records are sealed with.
+func (keys *KeyRing) PrimaryKeyID() string {
+	return keys.primary
+}
+
+// indexValues returns the hex encoded HMAC of the index value keyed by every key of the ring, the primary key first,
+// so the value is not kept in clear within the index while it can still be found with a rotated key.
+func (keys *KeyRing) indexValues(value string) []string {
+	ids := make([]string, 0, len(keys.indexKeys))
+	for id := range keys.indexKeys {
+		if id != keys.primary {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	values := make([]string, 0, len(keys.indexKeys))
+	for _, id := range append([]string{keys.primary}, ids...) {
+		mac := hmac.New(sha256.New, keys.indexKeys[id])
+		mac.Write([]byte(value))
+		values = append(values, hex.EncodeToString(mac.Sum(nil)))
+	}
+	return values
+}
+
+// seal encrypts the plain text with a new data key wrapped by the primary key. The additional data is authenticated
+// but not encrypted, it binds the envelope to the record so it can not be moved into another record.
+func (keys *KeyRing) seal(plain, additional []byte) (*Envelope, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := sealAEAD(keys.keys[keys.primary], dataKey, []byte(keys.primary))
+	if err != nil {
+		return nil, err
+	}
+	data, err := sealAEAD(dataAEAD, plain, additional)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{KeyID: keys.primary, Key: wrapped, Data: data}, nil
+}
+
+// open decrypts the envelope sealed with the same additional data.
+func (keys *KeyRing) open(envelope *Envelope, additional []byte) ([]byte, error) {
+	kek, ok := keys.keys[envelope.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s: %w", envelope.KeyID, ErrEncryptionKey)
+	}
+	dataKey, err := openAEAD(kek, envelope.Key, []byte(envelope.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key with key %s: %w", envelope.KeyID, err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := openAEAD(dataAEAD, envelope.Data, additional)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting record: %w", err)
+	}
+	return plain, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts the plain text with a random nonce, and returns the nonce followed by the ciphertext.
+func sealAEAD(aead cipher.AEAD, plain, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+// openAEAD decrypts the nonce followed by the ciphertext made by sealAEAD.
+func openAEAD(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// EnableEncryption turn on encryption at rest. Once enabled, the verification hash and attributes of every user,
+// the attributes of every group, and the trash and history entries are sealed with the primary key of keys whenever
+// they are saved, and opened transparently when loaded. Records saved before are still readable, ReEncrypt seals them.
+// Attribute values of declared indexes are kept in the index as their HMAC keyed by a key derived from the primary key
+// (see DeclareIndex). It should be called before the CredentaDB is used concurrently.
+func (store *CredentaDB) EnableEncryption(keys *KeyRing) error {
+	if keys == nil || keys.keys[keys.primary] == nil {
+		return errors.New("in EnableEncryption function. key ring has no primary key")
+	}
+	store.keys = keys
+	return nil
+}
+
+// DisableEncryption turn off encryption at rest, records are saved in clear. Sealed records can no longer be loaded.
+func (store *CredentaDB) DisableEncryption() {
+	store.keys = nil
+}
+
+// ReEncrypt seals every user, group, trash and history entry that is not sealed with the primary key, such as
+// records saved before encryption was enabled or sealed with a rotated key, and returns how many were rewritten.
+// The index entries of the rewritten users are put again with the primary key.
+// The records keep their versions since their content does not change. Once done, the old keys may be removed.
+func (store *CredentaDB) ReEncrypt(ctx context.Context) (int, error) {
+	if store.keys == nil {
+		return 0, errors.New("in ReEncrypt function. encryption is not enabled")
+	}
+	count := 0
+	err := store.WalkUserIDs(ctx, func(realm, id string) error {
+		return store.restoreRecord(ctx, RecordUser, realm, id, func() error {
+			stored, err := store.Store.GetUser(ctx, realm, id)
+			if errors.Is(err, ErrNotFound) || (err == nil && !store.needsSealing(stored.Sealed)) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			user, err := store.openUser(stored)
+			if err != nil {
+				return err
+			}
+			count++
+			// the values are claimed again, as they are kept with the primary key.
+			if err := store.putUserChecked(ctx, user, user.Version, true); err != nil {
+				return err
+			}
+			// the index entries put in clear or with a rotated key are moved to the primary key.
+			if aux, err := store.auxStore(); err == nil {
+				return store.updateAttributeIndexes(ctx, aux, user, user)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return count, fmt.Errorf("in ReEncrypt function. error sealing users: %w", err)
+	}
+	err = store.WalkGroupNames(ctx, func(realm, name string) error {
+		return store.restoreRecord(ctx, RecordGroup, realm, name, func() error {
+			stored, err := store.Store.GetGroup(ctx, realm, name)
+			if errors.Is(err, ErrNotFound) || (err == nil && !store.needsSealing(stored.Sealed)) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			group, err := store.openGroup(stored)
+			if err != nil {
+				return err
+			}
+			count++
+			return store.putGroupChecked(ctx, group, group.Version)
+		})
+	})
+	if err != nil {
+		return count, fmt.Errorf("in ReEncrypt function. error sealing groups: %w", err)
+	}
+	aux, ok := store.Store.(AuxStore)
+	if !ok {
+		return count, nil
+	}
+	sealed := &sealingAuxStore{AuxStore: aux, keys: store.keys}
+	for _, bucket := range sealedAuxBuckets {
+		keys := make([]string, 0)
+		values := make(map[string][]byte)
+		err := aux.ScanAux(ctx, bucket, "", func(key string, value []byte) error {
+			envelope, err := parseSealedValue(value)
+			if err != nil {
+				return err
+			}
+			if store.needsSealing(envelope) {
+				keys = append(keys, key)
+				values[key] = value
+			}
+			return nil
+		})
+		if err != nil {
+			return count, fmt.Errorf("in ReEncrypt function. error listing %s records: %w", bucket, err)
+		}
+		for _, key := range keys {
+			plain, err := sealed.openValue(bucket, key, values[key])
+			if err != nil {
+				return count, fmt.Errorf("in ReEncrypt function. error opening %s record: %w", bucket, err)
+			}
+			if err := sealed.PutAux(ctx, bucket, key, plain); err != nil {
+				return count, fmt.Errorf("in ReEncrypt function. error sealing %s record: %w", bucket, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// needsSealing returns true if the envelope is not sealed with the primary key.
+func (store *CredentaDB) needsSealing(envelope *Envelope) bool {
+	return envelope == nil || envelope.KeyID != store.keys.primary
+}
+
+// loadUser gets the user from the Store and opens it.
+func (store *CredentaDB) loadUser(ctx context.Context, realm, id string) (*CUser, error) {
+	user, err := store.Store.GetUser(ctx, realm, id)
+	if err != nil {
+		return nil, err
+	}
+	return store.openUser(user)
+}
+
+// putUser seals the user when encryption is enabled and puts it into the Store. The user itself is not modified.
+func (store *CredentaDB) putUser(ctx context.Context, user *CUser) error {
+	sealed, err := store.sealUser(user)
+	if err != nil {
+		return err
+	}
+	return store.Store.PutUser(ctx, sealed)
+}
+
+// putUserChecked puts the user like putUser, through CheckedWriter when the Store implements it so the write fails
+// if the stored user does not have the expected Version anymore, even when written by another process. With claim,
+// the user claims its unique values within the same write.
+func (store *CredentaDB) putUserChecked(ctx context.Context, user *CUser, expected uint64, claim bool) error {
+	writer, ok := store.Store.(CheckedWriter)
+	if !ok {
+		return store.putUser(ctx, user)
+	}
+	sealed, err := store.sealUser(user)
+	if err != nil {
+		return err
+	}
+	var unique []UniqueValue
+	if claim {
+		unique = store.uniqueValues(user)
+	}
+	return store.checkedWriteError(writer.PutUserChecked(ctx, sealed, expected, unique), user)
+}
+
+// checkedWriteError returns the error of a checked write of the users, with the value of a *DuplicateValueError as
+// the users have it rather than as it is kept within the index.
+func (store *CredentaDB) checkedWriteError(err error, users ...*CUser) error {
+	var duplicate *DuplicateValueError
+	if !errors.As(err, &duplicate) {
+		return err
+	}
+	index, ok := store.indexes[duplicate.Attribute]
+	if !ok {
+		return err
+	}
+	for _, user := range users {
+		if value, ok := indexedValue(index, user); ok && user.Realm == duplicate.Realm && store.indexValues(value)[0] == duplicate.Value {
+			duplicate.Value = value
+			break
+		}
+	}
+	return err
+}
+
+// loadGroup gets the group from the Store and opens it.
+func (store *CredentaDB) loadGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	group, err := store.Store.GetGroup(ctx, realm, name)
+	if err != nil {
+		return nil, err
+	}
+	return store.openGroup(group)
+}
+
+// putGroup seals the group when encryption is enabled and puts it into the Store. The group itself is not modified.
+func (store *CredentaDB) putGroup(ctx context.Context, group *CGroup) error {
+	sealed, err := store.sealGroup(group)
+	if err != nil {
+		return err
+	}
+	return store.Store.PutGroup(ctx, sealed)
+}
+
+// putGroupChecked puts the group like putGroup, through CheckedWriter when the Store implements it so the write fails
+// if the stored group does not have the expected Version anymore.
+func (store *CredentaDB) putGroupChecked(ctx context.Context, group *CGroup, expected uint64) error {
+	writer, ok := store.Store.(CheckedWriter)
+	if !ok {
+		return store.putGroup(ctx, group)
+	}
+	sealed, err := store.sealGroup(group)
+	if err != nil {
+		return err
+	}
+	return writer.PutGroupChecked(ctx, sealed, expected)
+}
+
+// sealUser returns a copy of the user with its verification hash and attributes sealed, or the user itself when
+// encryption is not enabled.
+func (store *CredentaDB) sealUser(user *CUser) (*CUser, error) {
+	if store.keys == nil {
+		return user, nil
+	}
+	plain, err := json.Marshal(&sealedUser{Hash: user.VerificationHash, Attributes: user.Attributes})
+	if err != nil {
+		return nil, fmt.Errorf("in sealUser function. error marshalling user %s: %w", user.Id, err)
+	}
+	envelope, err := store.keys.seal(plain, []byte(auxKey(string(RecordUser), user.Realm, user.Id)))
+	if err != nil {
+		return nil, fmt.Errorf("in sealUser function. error sealing user %s: %w", user.Id, err)
+	}
+	sealed := user.clone()
+	sealed.VerificationHash = ""
+	sealed.Attributes = make(map[string]*Attribute)
+	sealed.Sealed = envelope
+	return sealed, nil
+}
+
+// openUser restores the verification hash and attributes of a sealed user.
+func (store *CredentaDB) openUser(user *CUser) (*CUser, error) {
+	if user.Sealed == nil {
+		return user, nil
+	}
+	if store.keys == nil {
+		return nil, fmt.Errorf("in openUser function. user %s in realm %s is sealed with key %s: %w", user.Id, user.Realm, user.Sealed.KeyID, ErrEncryptionKey)
+	}
+	plain, err := store.keys.open(user.Sealed, []byte(auxKey(string(RecordUser), user.Realm, user.Id)))
+	if err != nil {
+		return nil, fmt.Errorf("in openUser function. user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	opened := &sealedUser{}
+	if err := json.Unmarshal(plain, opened); err != nil {
+		return nil, fmt.Errorf("in openUser function. error unmarshalling user %s: %w", user.Id, err)
+	}
+	user.VerificationHash = opened.Hash
+	user.Attributes = opened.Attributes
+	if user.Attributes == nil {
+		user.Attributes = make(map[string]*Attribute)
+	}
+	user.Sealed = nil
+	return user, nil
+}
+
+// sealGroup returns a copy of the group with its attributes sealed, or the group itself when encryption is not enabled.
+func (store *CredentaDB) sealGroup(group *CGroup) (*CGroup, error) {
+	if store.keys == nil {
+		return group, nil
+	}
+	plain, err := json.Marshal(&sealedGroup{Attributes: group.Attributes})
+	if err != nil {
+		return nil, fmt.Errorf("in sealGroup function. error marshalling group %s: %w", group.Name, err)
+	}
+	envelope, err := store.keys.seal(plain, []byte(auxKey(string(RecordGroup), group.Realm, group.Name)))
+	if err != nil {
+		return nil, fmt.Errorf("in sealGroup function. error sealing group %s: %w", group.Name, err)
+	}
+	sealed := group.clone()
+	sealed.Attributes = nil
+	sealed.Sealed = envelope
+	return sealed, nil
+}
+
+// openGroup restores the attributes of a sealed group.
+func (store *CredentaDB) openGroup(group *CGroup) (*CGroup, error) {
+	if group.Sealed == nil {
+		return group, nil
+	}
+	if store.keys == nil {
+		return nil, fmt.Errorf("in openGroup function. group %s in realm %s is sealed with key %s: %w", group.Name, group.Realm, group.Sealed.KeyID, ErrEncryptionKey)
+	}
+	plain, err := store.keys.open(group.Sealed, []byte(auxKey(string(RecordGroup), group.Realm, group.Name)))
+	if err != nil {
+		return nil, fmt.Errorf("in openGroup function. group %s in realm %s: %w", group.Name, group.Realm, err)
+	}
+	opened := &sealedGroup{}
+	if err := json.Unmarshal(plain, opened); err != nil {
+		return nil, fmt.Errorf("in openGroup function. error unmarshalling group %s: %w", group.Name, err)
+	}
+	group.Attributes = opened.Attributes
+	group.Sealed = nil
+	return group, nil
+}
+
+// sealingAuxStore seals the values of sealedAuxBuckets when they are put with encryption enabled, and opens them
+// when they are read. Values put before encryption was enabled are read as they are.
+type sealingAuxStore struct {
+	AuxStore
+	keys *KeyRing
+}
+
+func (aux *sealingAuxStore) GetAux(ctx context.Context, bucket, key string) ([]byte, error) {
+	value, err := aux.AuxStore.GetAux(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return aux.openValue(bucket, key, value)
+}
+
+func (aux *sealingAuxStore) PutAux(ctx context.Context, bucket, key string, value []byte) error {
+	if aux.keys == nil || !containsString(sealedAuxBuckets, bucket) {
+		return aux.AuxStore.PutAux(ctx, bucket, key, value)
+	}
+	envelope, err := aux.keys.seal(value, []byte(auxKey(bucket, key)))
+	if err != nil {
+		return fmt.Errorf("in PutAux function. error sealing %s record: %w", bucket, err)
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("in PutAux function. error marshalling %s record: %w", bucket, err)
+	}
+	return aux.AuxStore.PutAux(ctx, bucket, key, append([]byte(sealedValuePrefix), data...))
+}
+
+func (aux *sealingAuxStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	var openErr error
+	err := aux.AuxStore.ScanAux(ctx, bucket, prefix, func(key string, value []byte) error {
+		plain, err := aux.openValue(bucket, key, value)
+		if err != nil {
+			openErr = err
+			return err
+		}
+		return fn(key, plain)
+	})
+	if openErr != nil {
+		return fmt.Errorf("in ScanAux function. %w", openErr)
+	}
+	return err
+}
+
+// openValue returns the value as it was put, opening it if it is sealed.
+func (aux *sealingAuxStore) openValue(bucket, key string, value []byte) ([]byte, error) {
+	envelope, err := parseSealedValue(value)
+	if err != nil || envelope == nil {
+		return value, err
+	}
+	if aux.keys == nil {
+		return nil, fmt.Errorf("%s record is sealed with key %s: %w", bucket, envelope.KeyID, ErrEncryptionKey)
+	}
+	plain, err := aux.keys.open(envelope, []byte(auxKey(bucket, key)))
+	if err != nil {
+		return nil, fmt.Errorf("%s record: %w", bucket, err)
+	}
+	return plain, nil
+}
+
+// parseSealedValue returns the Envelope of a sealed auxiliary record value, or nil if the value is not sealed.
+func parseSealedValue(value []byte) (*Envelope, error) {
+	if !bytes.HasPrefix(value, []byte(sealedValuePrefix)) {
+		return nil, nil
+	}
+	envelope := &Envelope{}
+	if err := json.Unmarshal(value[len(sealedValuePrefix):], envelope); err != nil {
+		return nil, fmt.Errorf("error unmarshalling sealed value: %w", err)
+	}
+	return envelope, nil
+}
@@ -0,0 +1,234 @@
+package credenta
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey returns a base64 encoded AES-256 key made of the byte b.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestCredentaDB_Encryption(t *testing.T) {
+	keys, err := ParseKeyRing("k1:" + testKey(1))
+	assert.NoError(t, err)
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			assert.NoError(t, cDB.EnableEncryption(keys))
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+			group, err := cDB.NewGroup(ctx, "RA", "Admin", nil)
+			assert.NoError(t, err)
+			assert.NoError(t, group.SetAttribute("secret", "string", "groupSecret"))
+			assert.NoError(t, group.StoreOrSaveToFile(ctx))
+			for _, id := range []string{"john", "jane"} {
+				user, err := cDB.NewUser(ctx, "RA", id, "password", []string{"Admin"}, IdTypeUserId, VerificationMethodPLAIN)
+				assert.NoError(t, err)
+				assert.NoError(t, user.SetAttribute("email", "string", id+"@mail.com"))
+				assert.NoError(t, user.StoreOrSaveToFile(ctx))
+				// the saved user itself is not sealed.
+				assert.Equal(t, "password", user.VerificationHash)
+				assert.Nil(t, user.Sealed)
+			}
+
+			raw, err := dataStore.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) && assert.NotNil(t, raw.Sealed) {
+				assert.Equal(t, "k1", raw.Sealed.KeyID)
+				assert.Empty(t, raw.VerificationHash)
+				assert.Empty(t, raw.Attributes)
+				data, _ := json.Marshal(raw)
+				assert.NotContains(t, string(data), "password")
+				assert.NotContains(t, string(data), "john@mail.com")
+			}
+			rawGroup, err := dataStore.GetGroup(ctx, "RA", "Admin")
+			if assert.NoError(t, err) && assert.NotNil(t, rawGroup.Sealed) {
+				assert.Empty(t, rawGroup.Attributes)
+			}
+
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.Nil(t, john.Sealed)
+				assert.True(t, MatchVerification(john.VerificationMethod, "password", john.VerificationHash))
+				_, email, _ := john.GetAttribute("email")
+				assert.Equal(t, "john@mail.com", email)
+			}
+			assert.NoError(t, cDB.Update(ctx, "RA", "john", func(user *CUser) error {
+				user.Active = true
+				return nil
+			}))
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+			admin, err := cDB.GetGroup(ctx, "RA", "Admin")
+			if assert.NoError(t, err) {
+				_, secret, _ := admin.GetAttribute("secret")
+				assert.Equal(t, "groupSecret", secret)
+			}
+
+			// a sealed record can not be moved into another record.
+			raw, err = dataStore.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			jane, err := dataStore.GetUser(ctx, "RA", "jane")
+			assert.NoError(t, err)
+			jane.Sealed = raw.Sealed
+			assert.NoError(t, dataStore.PutUser(ctx, jane))
+			_, err = cDB.GetUser(ctx, "RA", "jane")
+			assert.Error(t, err)
+
+			_, err = NewCredentaDBWithStore(dataStore).GetUser(ctx, "RA", "john")
+			assert.True(t, errors.Is(err, ErrEncryptionKey))
+			other, err := NewKeyRing("k2", bytes.Repeat([]byte{2}, 32))
+			assert.NoError(t, err)
+			withOther := NewCredentaDBWithStore(dataStore)
+			assert.NoError(t, withOther.EnableEncryption(other))
+			_, err = withOther.GetUser(ctx, "RA", "john")
+			assert.True(t, errors.Is(err, ErrEncryptionKey))
+		})
+	}
+}
+
+func TestCredentaDB_ReEncrypt(t *testing.T) {
+	memStore := NewMemoryStore()
+	cDB := NewCredentaDBWithStore(memStore)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	assert.NoError(t, cDB.EnableHistory())
+	assert.NoError(t, cDB.EnableTrash(time.Hour))
+	for _, id := range []string{"john", "jane"} {
+		user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	}
+	assert.NoError(t, cDB.DeleteUser(ctx, "RA", "jane"))
+	group, err := cDB.NewGroup(ctx, "RA", "Admin", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, group.StoreOrSaveToFile(ctx))
+
+	_, err = cDB.ReEncrypt(ctx)
+	assert.Error(t, err)
+
+	// records saved in clear are still readable, and sealed by ReEncrypt.
+	first, err := ParseKeyRing("k1:" + testKey(1))
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.EnableEncryption(first))
+	john, err := cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", john.VerificationHash)
+	count, err := cDB.ReEncrypt(ctx)
+	assert.NoError(t, err)
+	// john, Admin, jane in the trash and the 4 history entries.
+	assert.Equal(t, 7, count)
+	raw, err := memStore.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", raw.Sealed.KeyID)
+	assert.Equal(t, uint64(1), raw.Version)
+	assert.NoError(t, memStore.ScanAux(ctx, auxHistoryBucket, "", func(key string, value []byte) error {
+		assert.True(t, strings.HasPrefix(string(value), sealedValuePrefix))
+		return nil
+	}))
+	count, err = cDB.ReEncrypt(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// rotate the key.
+	rotated, err := ParseKeyRing("# rotated\nk2:" + testKey(2) + "\nk1:" + testKey(1))
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", rotated.PrimaryKeyID())
+	assert.NoError(t, cDB.EnableEncryption(rotated))
+	count, err = cDB.ReEncrypt(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	second, err := ParseKeyRing("k2:" + testKey(2))
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.EnableEncryption(second))
+	john, err = cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", john.VerificationHash)
+	entries, err := cDB.ListHistory(ctx, RecordUser, "RA", "jane")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	jane, err := cDB.RestoreUser(ctx, "RA", "jane")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "password", jane.VerificationHash)
+	}
+
+	cDB.DisableEncryption()
+	_, err = cDB.ListHistory(ctx, RecordUser, "RA", "jane")
+	assert.True(t, errors.Is(err, ErrEncryptionKey))
+}
+
+func TestCredentaDB_EncryptedIndex(t *testing.T) {
+	memStore := NewMemoryStore()
+	cDB := NewCredentaDBWithStore(memStore)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true, IgnoreCase: true}))
+	newUser := func(id, email string) error {
+		user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, user.SetAttribute("email", "string", email))
+		return user.StoreOrSaveToFile(ctx)
+	}
+	indexKeys := func() []string {
+		keys := make([]string, 0)
+		assert.NoError(t, memStore.ScanAux(ctx, auxIndexBucket, "", func(key string, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+	assert.NoError(t, newUser("john", "John@mail.com"))
+
+	// the entries put in clear are still found, and moved by ReEncrypt.
+	first, err := ParseKeyRing("k1:" + testKey(1))
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.EnableEncryption(first))
+	john, err := cDB.FindUserByAttribute(ctx, "RA", "email", "john@mail.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "john", john.Id)
+	}
+	_, err = cDB.ReEncrypt(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, newUser("jane", "jane@mail.com"))
+	keys := indexKeys()
+	assert.Len(t, keys, 2)
+	for _, key := range keys {
+		assert.NotContains(t, key, "mail.com")
+	}
+	assert.ErrorIs(t, newUser("jack", "JANE@mail.com"), ErrDuplicateValue)
+
+	// after a rotation, the entries put with the old key are still found, and moved by ReEncrypt.
+	rotated, err := ParseKeyRing("k2:" + testKey(2) + "\nk1:" + testKey(1))
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.EnableEncryption(rotated))
+	assert.ErrorIs(t, newUser("jack", "john@mail.com"), ErrDuplicateValue)
+	_, err = cDB.ReEncrypt(ctx)
+	assert.NoError(t, err)
+	second, err := ParseKeyRing("k2:" + testKey(2))
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.EnableEncryption(second))
+	for _, id := range []string{"john", "jane"} {
+		user, err := cDB.FindUserByAttribute(ctx, "RA", "email", id+"@mail.com")
+		if assert.NoError(t, err) {
+			assert.Equal(t, id, user.Id)
+		}
+	}
+	assert.Len(t, indexKeys(), 2)
+}
+
+func TestParseKeyRing(t *testing.T) {
+	for _, text := range []string{"", "# nothing", "k1", "k1:not base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), ":" + testKey(1)} {
+		_, err := ParseKeyRing(text)
+		assert.Error(t, err, text)
+	}
+	keys, err := ParseKeyRing(" k1 : " + testKey(1) + ", k2:" + testKey(2))
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", keys.PrimaryKeyID())
+}
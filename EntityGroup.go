@@ -1,8 +1,6 @@
 package credenta
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -16,6 +14,8 @@ import (
 type CGroup struct {
 	FilePath string `json:"-"`
 
+	db *CredentaDB
+
 	Realm        string       `json:"realm"`
 	Name         string       `json:"name"`
 	ParentGroups []string     `json:"parentGroups,omitempty"`
@@ -26,9 +26,23 @@ type CGroup struct {
 	CreatedBy string    `json:"createdBy"`
 	UpdatedAt time.Time `json:"updatedAt"`
 	UpdatedBy string    `json:"updatedBy"`
+
+	// Version is increased every time the group is saved through CredentaDB. Saving a group whose Version is
+	// not the same as the stored one fails with ErrConflict.
+	Version uint64 `json:"version"`
+
+	// Sealed holds the encrypted attributes of a stored group when encryption is enabled
+	// (see CredentaDB.EnableEncryption). It is always nil on groups loaded through CredentaDB.
+	Sealed *Envelope `json:"sealed,omitempty"`
 }
 
+// StoreOrSaveToFile persist the group. If the group were created or obtained through a CredentaDB, it will be saved
+// into the CredentaDB's Store, otherwise it will be written as JSON into FilePath.
 func (group *CGroup) StoreOrSaveToFile(ctx context.Context) error {
+	if group.db != nil {
+		return group.db.SaveGroup(ctx, group)
+	}
+
 	group.UpdatedBy = ctx.Value(ETX_USER).(string)
 	group.UpdatedAt = time.Now()
 
@@ -40,59 +54,21 @@ func (group *CGroup) StoreOrSaveToFile(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("in StoreOrSaveToFile function, error marshalling group: %w", err)
 	}
-	if _, err := os.Stat(group.FilePath); err == nil {
-		f, err := os.Open(group.FilePath)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error opening file %s: %w", group.FilePath, err)
-		}
-		defer f.Close()
-		err = f.Truncate(0)
-		if err != nil {
-			return fmt.Errorf("in writeDataToFile function. error truncate file %s: %w", group.FilePath, err)
-		}
-		_, err = f.Seek(0, 0)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error seek in file %s: %w", group.FilePath, err)
-		}
-		_, err = f.Write(data)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error writing into file %s: %w", group.FilePath, err)
-		}
-	} else if os.IsNotExist(err) {
-		file, err := os.Create(group.FilePath)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error creating file %s: %w", group.FilePath, err)
-		}
-		defer file.Close()
-		_, err = file.Write(data)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error writing data to file %s: %w", group.FilePath, err)
-		}
-	} else {
-		return fmt.Errorf("in StoreOrSaveToFile function. error obtaining stat of file %s: %w", group.FilePath, err)
-	}
-	return nil
+	return writeDataFile(group.FilePath, data)
 }
 
+// ReloadFromFile reload the group's data from the CredentaDB's Store it belongs to, or from FilePath if it
+// does not belong to any CredentaDB.
 func (group *CGroup) ReloadFromFile(ctx context.Context) error {
-	file, err := os.Open(group.FilePath)
-	if err != nil {
-		return fmt.Errorf("in ReloadFromFile function, error opening file %s: %w", group.FilePath, err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	buff := bytes.Buffer{}
-
-	for scanner.Scan() {
-		buff.Write(scanner.Bytes())
+	var nGroup *CGroup
+	var err error
+	if group.db != nil {
+		nGroup, err = group.db.loadGroup(ctx, group.Realm, group.Name)
+	} else {
+		nGroup, err = readGroupFile(group.FilePath)
 	}
-
-	nGroup := &CGroup{}
-
-	err = json.Unmarshal(buff.Bytes(), &nGroup)
 	if err != nil {
-		return fmt.Errorf("in ReloadFromFile function, error unmarshaling data into CGroup: %w", err)
+		return fmt.Errorf("in ReloadFromFile function, error loading group: %w", err)
 	}
 
 	group.Realm = nGroup.Realm
@@ -105,11 +81,18 @@ func (group *CGroup) ReloadFromFile(ctx context.Context) error {
 	group.CreatedBy = nGroup.CreatedBy
 	group.UpdatedAt = nGroup.UpdatedAt
 	group.UpdatedBy = nGroup.UpdatedBy
+	group.Version = nGroup.Version
 
 	return nil
 }
 
+// DeleteFile remove the group from the CredentaDB's Store it belongs to, or remove the FilePath if it
+// does not belong to any CredentaDB. When the CredentaDB has the trash enabled, the group can be restored using
+// RestoreGroup.
 func (group *CGroup) DeleteFile(ctx context.Context) error {
+	if group.db != nil {
+		return group.db.DeleteGroup(ctx, group.Realm, group.Name)
+	}
 	return os.Remove(group.FilePath)
 }
 
@@ -203,3 +186,28 @@ func (group *CGroup) SortAttributes() []*Attribute {
 	})
 	return copy
 }
+
+// ETag returns the group's Version as an HTTP entity tag, to be used for conditional update.
+// See ParseETag.
+func (group *CGroup) ETag() string {
+	return formatETag(group.Version)
+}
+
+// clone returns a deep copy of the group that does not share any slice with the original.
+func (group *CGroup) clone() *CGroup {
+	nGroup := *group
+	if group.ParentGroups != nil {
+		nGroup.ParentGroups = append([]string{}, group.ParentGroups...)
+	}
+	if group.RoleMasks != nil {
+		nGroup.RoleMasks = append([]uint64{}, group.RoleMasks...)
+	}
+	if group.Attributes != nil {
+		nGroup.Attributes = make([]*Attribute, len(group.Attributes))
+		for i, v := range group.Attributes {
+			attr := *v
+			nGroup.Attributes[i] = &attr
+		}
+	}
+	return &nGroup
+}
@@ -1,8 +1,6 @@
 package credenta
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -29,6 +27,8 @@ type IdType string
 type CUser struct {
 	FilePath string `json:"-"`
 
+	db *CredentaDB
+
 	Realm      string                `json:"realm"`
 	Id         string                `json:"id"`
 	IDType     IdType                `json:"idType"`
@@ -42,74 +42,61 @@ type CUser struct {
 	Enable bool `json:"enable"`
 	Active bool `json:"active"`
 
+	// FailedAttempts is the number of consecutive failed authentications since the last successful one or lockout,
+	// see CredentaDB.EnableLockout. It and the other lockout fields are kept as stored when the user is saved,
+	// directly or by committing a Tx, use CredentaDB.UnlockUser to clear them.
+	FailedAttempts int `json:"failedAttempts,omitempty"`
+	// Lockouts is the number of consecutive lockouts, it makes the lockout duration grow with an exponential policy.
+	Lockouts int `json:"lockouts,omitempty"`
+	// LastFailedAt is the time of the last failed authentication.
+	LastFailedAt time.Time `json:"lastFailedAt"`
+	// LockedUntil is the time until which authentication is refused, the user is not locked once it has passed.
+	LockedUntil time.Time `json:"lockedUntil"`
+
 	CreatedAt time.Time `json:"createdAt"`
 	CreatedBy string    `json:"createdBy"`
 	UpdatedAt time.Time `json:"updatedAt"`
 	UpdatedBy string    `json:"updatedBy"`
+
+	// Version is increased every time the user is saved through CredentaDB, or its verification hash is upgraded
+	// on login (see CredentaDB.EnableRehash). Saving a user whose Version is not the same as the stored one fails
+	// with ErrConflict.
+	Version uint64 `json:"version"`
+
+	// Sealed holds the encrypted verification hash and attributes of a stored user when encryption is enabled
+	// (see CredentaDB.EnableEncryption). It is always nil on users loaded through CredentaDB.
+	Sealed *Envelope `json:"sealed,omitempty"`
 }
 
+// StoreOrSaveToFile persist the user. If the user were created or obtained through a CredentaDB, it will be saved
+// into the CredentaDB's Store, otherwise it will be written as JSON into FilePath.
 func (user *CUser) StoreOrSaveToFile(ctx context.Context) error {
+	if user.db != nil {
+		return user.db.SaveUser(ctx, user)
+	}
+
 	user.UpdatedBy = ctx.Value(ETX_USER).(string)
 	user.UpdatedAt = time.Now()
 
 	data, err := json.Marshal(user)
-
 	if err != nil {
 		return fmt.Errorf("in StoreOrSaveToFile function, error marshalling user: %w", err)
 	}
-	if _, err := os.Stat(user.FilePath); err == nil {
-		f, err := os.Open(user.FilePath)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error opening file %s: %w", user.FilePath, err)
-		}
-		defer f.Close()
-		err = f.Truncate(0)
-		if err != nil {
-			return fmt.Errorf("in writeDataToFile function. error truncate file %s: %w", user.FilePath, err)
-		}
-		_, err = f.Seek(0, 0)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error seek in file %s: %w", user.FilePath, err)
-		}
-		_, err = f.Write(data)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error writing into file %s: %w", user.FilePath, err)
-		}
-	} else if os.IsNotExist(err) {
-		file, err := os.Create(user.FilePath)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error creating file %s: %w", user.FilePath, err)
-		}
-		defer file.Close()
-		_, err = file.Write(data)
-		if err != nil {
-			return fmt.Errorf("in StoreOrSaveToFile function. error writing data to file %s: %w", user.FilePath, err)
-		}
-	} else {
-		return fmt.Errorf("in StoreOrSaveToFile function. error obtaining stat of file %s: %w", user.FilePath, err)
-	}
-	return nil
+	return writeDataFile(user.FilePath, data)
 }
 
+// ReloadFromFile reload the user's data from the CredentaDB's Store it belongs to, or from FilePath if it
+// does not belong to any CredentaDB.
 func (user *CUser) ReloadFromFile(ctx context.Context) error {
-	file, err := os.Open(user.FilePath)
-	if err != nil {
-		return fmt.Errorf("in ReloadFromFile function, error opening file %s: %w", user.FilePath, err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	buff := bytes.Buffer{}
-
-	for scanner.Scan() {
-		buff.Write(scanner.Bytes())
+	var nUser *CUser
+	var err error
+	if user.db != nil {
+		nUser, err = user.db.loadUser(ctx, user.Realm, user.Id)
+	} else {
+		nUser, err = readUserFile(user.FilePath)
 	}
-
-	nUser := &CUser{}
-
-	err = json.Unmarshal(buff.Bytes(), &nUser)
 	if err != nil {
-		return fmt.Errorf("in ReloadFromFile function, error unmarshaling data into CUser: %w", err)
+		return fmt.Errorf("in ReloadFromFile function, error loading user: %w", err)
 	}
 
 	user.Realm = nUser.Realm
@@ -125,15 +112,27 @@ func (user *CUser) ReloadFromFile(ctx context.Context) error {
 	user.Enable = nUser.Enable
 	user.Active = nUser.Active
 
+	user.FailedAttempts = nUser.FailedAttempts
+	user.Lockouts = nUser.Lockouts
+	user.LastFailedAt = nUser.LastFailedAt
+	user.LockedUntil = nUser.LockedUntil
+
 	user.CreatedAt = nUser.CreatedAt
 	user.CreatedBy = nUser.CreatedBy
 	user.UpdatedAt = nUser.UpdatedAt
 	user.UpdatedBy = nUser.UpdatedBy
+	user.Version = nUser.Version
 
 	return nil
 }
 
+// DeleteFile remove the user from the CredentaDB's Store it belongs to, or remove the FilePath if it
+// does not belong to any CredentaDB. When the CredentaDB has the trash enabled, the user can be restored using
+// RestoreUser.
 func (user *CUser) DeleteFile(ctx context.Context) error {
+	if user.db != nil {
+		return user.db.DeleteUser(ctx, user.Realm, user.Id)
+	}
 	return os.Remove(user.FilePath)
 }
 
@@ -221,6 +220,31 @@ func (user *CUser) SetAttribute(attributeName, valueType, valueString string) er
 	return nil
 }
 
+// ETag returns the user's Version as an HTTP entity tag, to be used for conditional update.
+// See ParseETag.
+func (user *CUser) ETag() string {
+	return formatETag(user.Version)
+}
+
+// clone returns a deep copy of the user that does not share any slice or map with the original.
+func (user *CUser) clone() *CUser {
+	nUser := *user
+	if user.Groups != nil {
+		nUser.Groups = append([]string{}, user.Groups...)
+	}
+	if user.RoleMasks != nil {
+		nUser.RoleMasks = append([]uint64{}, user.RoleMasks...)
+	}
+	if user.Attributes != nil {
+		nUser.Attributes = make(map[string]*Attribute, len(user.Attributes))
+		for k, v := range user.Attributes {
+			attr := *v
+			nUser.Attributes[k] = &attr
+		}
+	}
+	return &nUser
+}
+
 func (user *CUser) String() string {
 	jsonBytes, err := json.Marshal(user)
 	if err != nil {
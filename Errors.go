@@ -0,0 +1,113 @@
+package credenta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The errors below are returned (possibly wrapped) by the authentication, user management and token functions, so
+// they can be told apart using errors.Is and errors.As. The errors of the Store are declared along with it, see
+// ErrNotFound and ErrConflict, and the lockout error along with the lockout, see ErrAccountLocked.
+var (
+	// ErrInvalidCredentials is returned by GetUserWithAuth when the user does not exist, the password does not
+	// match or the user is locked out. The returned error is a *CredentialsError.
+	ErrInvalidCredentials = errors.New("invalid authentication")
+	// ErrUserDisabled is returned by GetUserWithAuth when the user authenticated but its Enable flag is off.
+	ErrUserDisabled = errors.New("user is disabled")
+	// ErrUserNotActivated is returned by GetUserWithAuth when the user authenticated but it is not activated yet.
+	ErrUserNotActivated = errors.New("user is not activated")
+	// ErrAlreadyExists is returned when creating or restoring a user or group whose id or name is already used.
+	ErrAlreadyExists = errors.New("record already exists")
+	// ErrPasswordPolicy is returned when a password does not satisfy the PassphrasePolicy. The returned error is a
+	// *PolicyError.
+	ErrPasswordPolicy = errors.New("password does not satisfy the policy")
+	// ErrInvalidToken is returned by ReadJWTToken when the token is malformed, its signature is not valid or it is
+	// not yet valid.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned by ReadJWTToken when the token is expired.
+	ErrTokenExpired = errors.New("token is expired")
+	// ErrTokenType is returned by RefreshNewAccessToken when the supplied token is not a refresh token.
+	ErrTokenType = errors.New("token is not of the expected type")
+)
+
+// CredentialsError describe a failed authentication. Its message is the same whether the user does not exist, the
+// password does not match or the user is locked out, so it can be shown to the end users without revealing which
+// ids exist, while errors.Is(err, ErrNotFound) and errors.Is(err, ErrAccountLocked) tell them apart. It satisfies
+// errors.Is(err, ErrInvalidCredentials).
+type CredentialsError struct {
+	Realm string
+	Id    string
+	// Cause is the reason the user could not be found, a *LockedError when the user is locked out, or nil when the
+	// password does not match.
+	Cause error
+}
+
+func (e *CredentialsError) Error() string {
+	return ErrInvalidCredentials.Error()
+}
+
+// Is makes errors.Is(err, ErrInvalidCredentials) returns true.
+func (e *CredentialsError) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
+
+// Unwrap returns the Cause.
+func (e *CredentialsError) Unwrap() error {
+	return e.Cause
+}
+
+const (
+	// PolicyRuleSpaces is violated by a password with leading or trailing spaces.
+	PolicyRuleSpaces PolicyRule = "SPACES"
+	// PolicyRuleWordCount is violated by a password that does not have PassphrasePolicy.WordCount words.
+	PolicyRuleWordCount PolicyRule = "WORD_COUNT"
+	// PolicyRuleWordLength is violated by a password having a word shorter than PassphrasePolicy.LetterCountPerWord.
+	PolicyRuleWordLength PolicyRule = "WORD_LENGTH"
+	// PolicyRuleLength is violated by a password shorter than PassphrasePolicy.LetterCountMinimumTotal.
+	PolicyRuleLength PolicyRule = "LENGTH"
+	// PolicyRuleUpperAlphabet is violated by a password without upper case letter.
+	PolicyRuleUpperAlphabet PolicyRule = "UPPER_ALPHABET"
+	// PolicyRuleNumeric is violated by a password without number.
+	PolicyRuleNumeric PolicyRule = "NUMERIC"
+	// PolicyRuleSymbol is violated by a password without symbol.
+	PolicyRuleSymbol PolicyRule = "SYMBOL"
+)
+
+// PolicyRule identify a rule of the PassphrasePolicy.
+type PolicyRule string
+
+// PolicyViolation is a rule of the PassphrasePolicy a password does not satisfy.
+type PolicyViolation struct {
+	Rule    PolicyRule `json:"rule"`
+	Message string     `json:"message"`
+}
+
+// PolicyError lists every rule of the PassphrasePolicy a password does not satisfy. It satisfies
+// errors.Is(err, ErrPasswordPolicy).
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return fmt.Sprintf("%v: %s", ErrPasswordPolicy, strings.Join(messages, ", "))
+}
+
+// Is makes errors.Is(err, ErrPasswordPolicy) returns true.
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrPasswordPolicy
+}
+
+// Violates returns true if the password does not satisfy the rule.
+func (e *PolicyError) Violates(rule PolicyRule) bool {
+	for _, violation := range e.Violations {
+		if violation.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCredentaDB_AuthErrors(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+	// an unknown user and a wrong password can not be told apart by their message.
+	_, _, unknownErr := cDB.GetUserWithAuth(ctx, "RA", "jane", "password")
+	_, _, wrongErr := cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+	assert.True(t, errors.Is(unknownErr, ErrInvalidCredentials))
+	assert.True(t, errors.Is(wrongErr, ErrInvalidCredentials))
+	assert.Equal(t, wrongErr.Error(), unknownErr.Error())
+	assert.True(t, errors.Is(unknownErr, ErrNotFound))
+	assert.False(t, errors.Is(wrongErr, ErrNotFound))
+	credentialsErr := &CredentialsError{}
+	if assert.True(t, errors.As(wrongErr, &credentialsErr)) {
+		assert.Equal(t, "john", credentialsErr.Id)
+	}
+
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.True(t, errors.Is(err, ErrUserNotActivated))
+	assert.NoError(t, cDB.Update(ctx, "RA", "john", func(user *CUser) error {
+		user.Active = true
+		user.Enable = false
+		return nil
+	}))
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.True(t, errors.Is(err, ErrUserDisabled))
+
+	_, err = cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.True(t, errors.Is(err, ErrAlreadyExists))
+	group, err := cDB.NewGroup(ctx, "RA", "Admin", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, group.StoreOrSaveToFile(ctx))
+	_, err = cDB.NewGroup(ctx, "RA", "Admin", nil)
+	assert.True(t, errors.Is(err, ErrAlreadyExists))
+
+	_, err = cDB.NewUser(ctx, "RA", "jane", "short", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.True(t, errors.Is(err, ErrPasswordPolicy))
+	err = cDB.ChangeUserPassword(ctx, "RA", "john", " short", VerificationMethodPLAIN)
+	policyErr := &PolicyError{}
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.True(t, policyErr.Violates(PolicyRuleSpaces))
+		assert.True(t, policyErr.Violates(PolicyRuleLength))
+		assert.False(t, policyErr.Violates(PolicyRuleSymbol))
+	}
+}
+
+func TestPassphrasePolicy_Violations(t *testing.T) {
+	valid, err := ClassicPasswordPolicy().IsPasswordValid("password")
+	assert.False(t, valid)
+	policyErr := &PolicyError{}
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.Equal(t, []PolicyViolation{
+			{Rule: PolicyRuleUpperAlphabet, Message: "passphrase requires upper alphabet"},
+			{Rule: PolicyRuleNumeric, Message: "passphrase requires number"},
+			{Rule: PolicyRuleSymbol, Message: "passphrase requires symbol"},
+		}, policyErr.Violations)
+	}
+	assert.EqualError(t, err, "password does not satisfy the policy: passphrase requires upper alphabet, passphrase requires number, passphrase requires symbol")
+}
+
+func TestToken_Errors(t *testing.T) {
+	signMethod := crypto.SigningMethodRS256
+	issuedAt := time.Now().Add(-time.Hour)
+	expired, err := GenerateJWTToken("RA", "issuer", "subject", nil, RefreshTokenType, nil, issuedAt, issuedAt, issuedAt.Add(time.Minute), GetDefaultPrivateKey(), signMethod)
+	assert.NoError(t, err)
+	_, _, _, _, _, _, err = ReadJWTToken(expired, GetDefaultPublicKey(), signMethod)
+	assert.True(t, errors.Is(err, ErrTokenExpired))
+
+	_, _, _, _, _, _, err = ReadJWTToken("not a token", GetDefaultPublicKey(), signMethod)
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+
+	access, err := GenerateJWTToken("RA", "issuer", "subject", nil, AccessTokenType, nil, time.Now(), time.Now(), time.Now().Add(time.Minute), GetDefaultPrivateKey(), signMethod)
+	assert.NoError(t, err)
+	_, err = RefreshNewAccessToken(access, time.Minute, GetDefaultPublicKey(), GetDefaultPrivateKey(), signMethod)
+	assert.True(t, errors.Is(err, ErrTokenType))
+}
@@ -0,0 +1,146 @@
+package credenta
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// auxFileSuffix is the extension of every auxiliary record file.
+const auxFileSuffix = ".aux"
+
+// auxPath returns the path of the auxiliary record file. Every key part but the last becomes a directory, so
+// scanning the records of a prefix only reads the directories of that prefix.
+func (fs *FileStore) auxPath(bucket, key string) string {
+	parts := splitAuxKey(key)
+	elems := []string{fs.BaseFolder + fs.AuxFolder, encodeFileNamePart(bucket)}
+	for _, part := range parts[:len(parts)-1] {
+		elems = append(elems, encodeFileNamePart(part))
+	}
+	return strings.Join(append(elems, encodeFileNamePart(parts[len(parts)-1])+auxFileSuffix), "/")
+}
+
+// auxLockFolder is the folder, within the aux folder, of the files used for locking auxiliary record keys. Encoded
+// bucket names never start with '.', so it is never mistaken for a bucket.
+const auxLockFolder = "/.lock"
+
+// LockAux acquire an advisory file lock of the key in the bucket. The lock is honored by every process sharing the
+// same folder, see AuxLocker. The lock file is removed once the lock is released.
+func (fs *FileStore) LockAux(ctx context.Context, bucket, key string) (func(), error) {
+	dir := fs.BaseFolder + fs.AuxFolder + auxLockFolder
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("in LockAux function, error creating directory %s: %w", dir, err)
+	}
+	return lockFile(ctx, dir+"/"+encodeFileNamePart(auxKey(bucket, key))+lockFileSuffix)
+}
+
+func (fs *FileStore) GetAux(ctx context.Context, bucket, key string) ([]byte, error) {
+	data, err := readDataFile(fs.auxPath(bucket, key))
+	if err != nil {
+		return nil, fmt.Errorf("in GetAux function, %s in bucket %s: %w", key, bucket, err)
+	}
+	return data, nil
+}
+
+func (fs *FileStore) PutAux(ctx context.Context, bucket, key string, value []byte) error {
+	path := fs.auxPath(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("in PutAux function, error creating directory of %s: %w", path, err)
+	}
+	return writeDataFile(path, value)
+}
+
+func (fs *FileStore) DeleteAux(ctx context.Context, bucket, key string) error {
+	path := fs.auxPath(bucket, key)
+	if err := removeDataFile(path); err != nil {
+		return fmt.Errorf("in DeleteAux function, %s in bucket %s: %w", key, bucket, err)
+	}
+	// drop the directories left empty, up to the bucket directory.
+	bucketDir := filepath.Clean(fs.BaseFolder + fs.AuxFolder + "/" + encodeFileNamePart(bucket))
+	for dir := filepath.Dir(filepath.Clean(path)); dir != bucketDir && strings.HasPrefix(dir, bucketDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	parts := splitAuxKey(prefix)
+	dir := fs.BaseFolder + fs.AuxFolder + "/" + encodeFileNamePart(bucket)
+	for _, part := range parts[:len(parts)-1] {
+		dir = dir + "/" + encodeFileNamePart(part)
+	}
+	keyPrefix := strings.Join(parts[:len(parts)-1], auxKeySeparator)
+	err := scanAuxDir(ctx, dir, keyPrefix, parts[len(parts)-1], fn)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// scanAuxDir call fn for every auxiliary record within dir, whose key starts with keyPrefix and the next key part
+// starts with partPrefix. Records are visited in ascending key order.
+func scanAuxDir(ctx context.Context, dir, keyPrefix, partPrefix string, fn func(key string, value []byte) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type auxEntry struct {
+		part  string
+		path  string
+		isDir bool
+	}
+	matches := make([]auxEntry, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			if !strings.HasSuffix(name, auxFileSuffix) {
+				continue
+			}
+			name = strings.TrimSuffix(name, auxFileSuffix)
+		}
+		part, ok := decodeFileNamePart(name)
+		if !ok || !strings.HasPrefix(part, partPrefix) {
+			continue
+		}
+		matches = append(matches, auxEntry{part: part, path: filepath.Join(dir, entry.Name()), isDir: entry.IsDir()})
+	}
+	// a record comes before the records nested in the directory of the same name.
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].part != matches[j].part {
+			return matches[i].part < matches[j].part
+		}
+		return !matches[i].isDir
+	})
+
+	for _, match := range matches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := match.part
+		if keyPrefix != "" {
+			key = keyPrefix + auxKeySeparator + match.part
+		}
+		if match.isDir {
+			if err := scanAuxDir(ctx, match.path, key, "", fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		data, err := os.ReadFile(match.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("in ScanAux function, error reading %s: %w", match.path, err)
+		}
+		if err := fn(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
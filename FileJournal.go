@@ -0,0 +1,279 @@
+package credenta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// journalFileSuffix is the extension of every journal file.
+const journalFileSuffix = ".journal"
+
+// journalSequence makes the journal file names unique within the process.
+var journalSequence atomic.Uint64
+
+// fileJournal is the undo journal of a batch written by FileStore. It holds the content every file had before the
+// batch was applied and the content written by the batch, so an interrupted batch is rolled back by writing back the
+// files still holding what the batch wrote.
+type fileJournal struct {
+	Files []*journalFile `json:"files"`
+}
+
+// journalFile is the content of a file before and after a batch was applied.
+type journalFile struct {
+	// Kind, Realm and Key identify the user or group kept in the file, Kind is empty for an auxiliary record.
+	Kind  RecordKind `json:"kind,omitempty"`
+	Realm string     `json:"realm,omitempty"`
+	// Key is the id or name of the user or group, or the key of the auxiliary record.
+	Key string `json:"key,omitempty"`
+	// Bucket is the bucket of the auxiliary record, empty for a user or group.
+	Bucket string `json:"bucket,omitempty"`
+	// Path is the path of the file relative to the BaseFolder.
+	Path string `json:"path"`
+	// Data is the content of the file, nil when the file did not exist.
+	Data []byte `json:"data"`
+	// After is the content written by the batch, nil when the batch removes the file.
+	After []byte `json:"after"`
+}
+
+// WriteBatch applies every write of the batch, or none of them. The content of every file about to be written is
+// saved into a journal in `BaseFolder+JournalFolder` first, which is used to roll the batch back when a write
+// fails. If the process stops before the batch is complete, the journal is rolled back by the next recovery pass
+// (see Recover), which a running process may also call to roll back the batch of a stopped one. The caller should
+// hold the locks of every user and group of the batch, the auxiliary records are locked by WriteBatch.
+func (fs *FileStore) WriteBatch(ctx context.Context, batch *Batch) error {
+	journal := &fileJournal{Files: make([]*journalFile, 0)}
+	add := func(file *journalFile, path string, after []byte) error {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("in WriteBatch function, error reading %s: %w", path, err)
+		}
+		file.Path = strings.TrimPrefix(path, fs.BaseFolder)
+		file.Data = data
+		file.After = after
+		journal.Files = append(journal.Files, file)
+		return nil
+	}
+	for _, user := range batch.Users {
+		after, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("in WriteBatch function, error marshalling user: %w", err)
+		}
+		if err := add(&journalFile{Kind: RecordUser, Realm: user.Realm, Key: user.Id}, fs.UserFilePath(user.Realm, user.Id), after); err != nil {
+			return err
+		}
+	}
+	for _, ref := range batch.DeletedUsers {
+		if err := add(&journalFile{Kind: RecordUser, Realm: ref.Realm, Key: ref.Key}, fs.UserFilePath(ref.Realm, ref.Key), nil); err != nil {
+			return err
+		}
+	}
+	for _, group := range batch.Groups {
+		after, err := json.Marshal(group)
+		if err != nil {
+			return fmt.Errorf("in WriteBatch function, error marshalling group: %w", err)
+		}
+		if err := add(&journalFile{Kind: RecordGroup, Realm: group.Realm, Key: group.Name}, fs.GroupFilePath(group.Realm, group.Name), after); err != nil {
+			return err
+		}
+	}
+	for _, ref := range batch.DeletedGroups {
+		if err := add(&journalFile{Kind: RecordGroup, Realm: ref.Realm, Key: ref.Key}, fs.GroupFilePath(ref.Realm, ref.Key), nil); err != nil {
+			return err
+		}
+	}
+	auxFiles := make([]*journalFile, len(batch.Aux))
+	for i, record := range batch.Aux {
+		auxFiles[i] = &journalFile{Key: record.Key, Bucket: record.Bucket}
+	}
+	unlockAux, err := fs.lockAuxFiles(ctx, auxFiles)
+	if err != nil {
+		return err
+	}
+	defer unlockAux()
+	for i, record := range batch.Aux {
+		if err := add(auxFiles[i], fs.auxPath(record.Bucket, record.Key), record.Value); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("in WriteBatch function, error marshalling journal: %w", err)
+	}
+	dir := fs.BaseFolder + fs.JournalFolder
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("in WriteBatch function, error creating journal directory %s: %w", dir, err)
+	}
+	journalPath := fmt.Sprintf("%s/%020d-%d-%d%s", dir, time.Now().UnixNano(), os.Getpid(), journalSequence.Add(1), journalFileSuffix)
+	if err := writeDataFile(journalPath, data); err != nil {
+		return fmt.Errorf("in WriteBatch function, error writing journal: %w", err)
+	}
+
+	if err := applyBatch(ctx, fs, batch, nil); err != nil {
+		if rollbackErr := fs.rollBack(journal); rollbackErr != nil {
+			return fmt.Errorf("in WriteBatch function, error writing batch: %w, and rolling back failed, journal %s is kept for recovery: %v", err, journalPath, rollbackErr)
+		}
+		removeDataFile(journalPath)
+		return fmt.Errorf("in WriteBatch function, error writing batch: %w", err)
+	}
+	if err := removeDataFile(journalPath); err != nil {
+		return fmt.Errorf("in WriteBatch function, error removing journal: %w", err)
+	}
+	return nil
+}
+
+// rollBack writes back the content of every file of the journal that still holds what the batch wrote. A file that
+// does not is either not written yet, or was written again after the batch, and is left as it is.
+func (fs *FileStore) rollBack(journal *fileJournal) error {
+	for _, file := range journal.Files {
+		path := fs.BaseFolder + file.Path
+		current, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			current, err = nil, nil
+		}
+		if err != nil {
+			return fmt.Errorf("in rollBack function, error reading %s: %w", path, err)
+		}
+		if (current == nil) != (file.After == nil) || !bytes.Equal(current, file.After) {
+			continue
+		}
+		if file.Data == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("in rollBack function, error removing %s: %w", path, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("in rollBack function, error creating directory of %s: %w", path, err)
+		}
+		if err := writeDataFile(path, file.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollBackJournals rolls back every journal left by an interrupted WriteBatch, and returns their paths. A journal
+// is only rolled back once the locks of its users, groups and auxiliary records are acquired, so the batch of a live
+// process is never touched.
+func (fs *FileStore) rollBackJournals(ctx context.Context) ([]string, error) {
+	rolledBack := make([]string, 0)
+	dir := fs.BaseFolder + fs.JournalFolder
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return rolledBack, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("in rollBackJournals function, error reading directory %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), journalFileSuffix) {
+			continue
+		}
+		path := dir + "/" + entry.Name()
+		done, err := fs.rollBackJournal(ctx, path)
+		if err != nil {
+			return rolledBack, err
+		}
+		if done {
+			rolledBack = append(rolledBack, path)
+		}
+	}
+	return rolledBack, nil
+}
+
+// rollBackJournal rolls back the journal in path while holding the locks of its users, groups and auxiliary records. It returns false
+// if the journal was removed by its batch meanwhile.
+func (fs *FileStore) rollBackJournal(ctx context.Context, path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("in rollBackJournal function, error reading journal %s: %w", path, err)
+	}
+	journal := &fileJournal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return false, fmt.Errorf("in rollBackJournal function, error unmarshalling journal %s: %w", path, err)
+	}
+
+	records := make([]*journalFile, 0, len(journal.Files))
+	for _, file := range journal.Files {
+		if file.Kind != "" {
+			records = append(records, file)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return auxKey(string(records[i].Kind), records[i].Realm, records[i].Key) < auxKey(string(records[j].Kind), records[j].Realm, records[j].Key)
+	})
+	unlocks := make([]func(), 0, len(records))
+	defer func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}()
+	for _, record := range records {
+		lock := fs.LockUser
+		if record.Kind == RecordGroup {
+			lock = fs.LockGroup
+		}
+		unlock, err := lock(ctx, record.Realm, record.Key)
+		if err != nil {
+			return false, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	unlockAux, err := fs.lockAuxFiles(ctx, journal.Files)
+	if err != nil {
+		return false, err
+	}
+	unlocks = append(unlocks, unlockAux)
+
+	if !pathExists(path) {
+		return false, nil
+	}
+	if err := fs.rollBack(journal); err != nil {
+		return false, err
+	}
+	if err := removeDataFile(path); err != nil {
+		return false, fmt.Errorf("in rollBackJournal function, error removing journal %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// lockAuxFiles acquire the locks of the auxiliary records among the journal files, in key order, and returns the
+// function to release them.
+func (fs *FileStore) lockAuxFiles(ctx context.Context, files []*journalFile) (func(), error) {
+	records := make([]*journalFile, 0, len(files))
+	for _, file := range files {
+		if file.Kind == "" && file.Bucket != "" {
+			records = append(records, file)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return auxKey(records[i].Bucket, records[i].Key) < auxKey(records[j].Bucket, records[j].Key)
+	})
+	unlocks := make([]func(), 0, len(records))
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, record := range records {
+		unlock, err := fs.LockAux(ctx, record.Bucket, record.Key)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
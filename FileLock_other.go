@@ -0,0 +1,16 @@
+//go:build !unix
+
+package credenta
+
+import (
+	"context"
+)
+
+// fileLocks is used in place of flock on platforms without it, so records are only protected against
+// other goroutines of the same process.
+var fileLocks keyedMutex
+
+// lockFile acquire an exclusive lock for the path. On this platform the lock is only honored within the process.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	return fileLocks.Lock(path), nil
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile acquire an exclusive advisory lock (flock) on the file in path, creating the file if not exist.
+// The lock is honored by every process that lock the same path, and also by other goroutine in the same process.
+// It keeps retrying until the lock is acquired or the context is done. The file is removed when the lock is
+// released, so no lock file is left behind, a process that was waiting on the removed file locks the path again.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("in lockFile function, error opening lock file %s: %w", path, err)
+		}
+		for {
+			err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+				file.Close()
+				return nil, fmt.Errorf("in lockFile function, error locking file %s: %w", path, err)
+			}
+			select {
+			case <-ctx.Done():
+				file.Close()
+				return nil, fmt.Errorf("in lockFile function, waiting lock on file %s: %w", path, ctx.Err())
+			case <-time.After(lockRetryInterval):
+			}
+		}
+		if isLockedFile(file, path) {
+			return func() {
+				os.Remove(path)
+				syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+				file.Close()
+			}, nil
+		}
+		// the file was removed by its previous holder meanwhile.
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+// isLockedFile returns true if the path is still the opened file.
+func isLockedFile(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, current)
+}
@@ -0,0 +1,165 @@
+package credenta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// fileNameSeparator separates the encoded key and realm in a record file name.
+	fileNameSeparator = "_IN_"
+	// fileNameSuffix is the extension of every record file.
+	fileNameSuffix = ".json"
+)
+
+// encodeFileNamePart encode a realm, user id or group name so it can be safely used as part of a file name.
+// Letters, digits and '-' are kept as they are, any other byte is written as '%' followed by its two digit
+// uppercase hexadecimal value. Thus, `john.doe@mail.com` is encoded into `john%2Edoe%40mail%2Ecom`.
+// Since '_' and '.' are always encoded, the `_IN_` separator and the `.json` suffix are never ambiguous,
+// and names like `..` or `a/b` can never escape the folder.
+func encodeFileNamePart(s string) string {
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+// decodeFileNamePart reverse encodeFileNamePart. It returns false if s is not a validly encoded part.
+func decodeFileNamePart(s string) (string, bool) {
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-':
+			sb.WriteByte(c)
+		case c == '%' && i+2 < len(s) && isUpperHex(s[i+1]) && isUpperHex(s[i+2]):
+			sb.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			return "", false
+		}
+	}
+	return sb.String(), true
+}
+
+func isUpperHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	if c >= 'A' {
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// dataFileName returns the file name of a record with specified realm and key (user id or group name).
+func dataFileName(realm, key string) string {
+	return encodeFileNamePart(key) + fileNameSeparator + encodeFileNamePart(realm) + fileNameSuffix
+}
+
+// parseDataFileName returns the realm and key (user id or group name) of a record file named by dataFileName.
+// It returns false if the name is not a record file name, or not encoded properly.
+func parseDataFileName(name string) (realm, key string, ok bool) {
+	if !strings.HasSuffix(name, fileNameSuffix) {
+		return "", "", false
+	}
+	ne := strings.Split(strings.TrimSuffix(name, fileNameSuffix), fileNameSeparator)
+	if len(ne) != 2 || ne[0] == "" || ne[1] == "" {
+		return "", "", false
+	}
+	if key, ok = decodeFileNamePart(ne[0]); !ok {
+		return "", "", false
+	}
+	if realm, ok = decodeFileNamePart(ne[1]); !ok {
+		return "", "", false
+	}
+	return realm, key, true
+}
+
+// FileMigrationReport is the result of FileStore.MigrateFileNames and FileStore.MigrateLayout
+type FileMigrationReport struct {
+	// Renamed maps the old path into the new path of every renamed or moved record file.
+	Renamed map[string]string `json:"renamed"`
+	// Failed maps the path of every record file that could not be renamed or moved into the reason.
+	Failed map[string]string `json:"failed"`
+}
+
+// MigrateFileNames rename every record file that is not named by the current file name encoding, e.g. files created
+// by older version of credenta with ids containing '.' or '_'. The realm and key of each file are read from its JSON
+// content, not from its name. Files that could not be parsed, or whose new name is already taken, are left untouched
+// and reported as failed. When dryRun is true, nothing is renamed but the report still tells what would be renamed.
+func (fs *FileStore) MigrateFileNames(ctx context.Context, dryRun bool) (*FileMigrationReport, error) {
+	report := &FileMigrationReport{
+		Renamed: make(map[string]string),
+		Failed:  make(map[string]string),
+	}
+	for _, folder := range []string{fs.BaseFolder + fs.UserFolder, fs.BaseFolder + fs.GroupFolder} {
+		err := walkFiles(ctx, folder, true, func(oldPath string, entry os.DirEntry) error {
+			if !strings.HasSuffix(entry.Name(), fileNameSuffix) {
+				return nil
+			}
+			if _, _, ok := parseDataFileName(entry.Name()); ok {
+				return nil
+			}
+			data, err := os.ReadFile(oldPath)
+			if err != nil {
+				report.Failed[oldPath] = err.Error()
+				return nil
+			}
+			record := &struct {
+				Realm string `json:"realm"`
+				Id    string `json:"id"`
+				Name  string `json:"name"`
+			}{}
+			if err := json.Unmarshal(data, record); err != nil {
+				report.Failed[oldPath] = fmt.Sprintf("invalid record: %v", err)
+				return nil
+			}
+			key := record.Id
+			if folder == fs.BaseFolder+fs.GroupFolder {
+				key = record.Name
+			}
+			if record.Realm == "" || key == "" {
+				report.Failed[oldPath] = "record does not have realm or key"
+				return nil
+			}
+			newPath := filepath.Clean(fs.recordPath(folder, record.Realm, key))
+			if pathExists(newPath) {
+				report.Failed[oldPath] = fmt.Sprintf("target %s already exists", newPath)
+				return nil
+			}
+			if !dryRun {
+				if err := fs.ensureShardDir(newPath); err != nil {
+					report.Failed[oldPath] = err.Error()
+					return nil
+				}
+				if err := os.Rename(oldPath, newPath); err != nil {
+					report.Failed[oldPath] = err.Error()
+					return nil
+				}
+			}
+			report.Renamed[oldPath] = newPath
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("in MigrateFileNames function, error scanning directory %s: %w", folder, err)
+		}
+		if !dryRun {
+			if err := syncDir(folder); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
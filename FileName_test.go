@@ -0,0 +1,68 @@
+package credenta
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileName_RoundTrip(t *testing.T) {
+	for _, key := range []string{"john.doe@mail.com", "../x", "a_IN_b", "a/b", "ユーザー", "USER-1"} {
+		name := dataFileName("MY.REALM", key)
+		assert.NotContains(t, name, "/")
+		realm, decoded, ok := parseDataFileName(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, "MY.REALM", realm)
+		assert.Equal(t, key, decoded)
+	}
+	assert.Equal(t, "john%2Edoe%40mail%2Ecom_IN_DEFAULT.json", dataFileName("DEFAULT", "john.doe@mail.com"))
+
+	for _, name := range []string{"john.doe_IN_DEFAULT.json", "a_IN_b_IN_c.json", "a%2e_IN_R.json", "a%2_IN_R.json", "_IN_R.json", "a_IN_R.txt"} {
+		_, _, ok := parseDataFileName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestFileStore_DottedIDs(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.Background()
+
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "R.A", Id: "john.doe@mail.com", RoleMasks: make([]uint64, RoleMaskCount)}))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "R.A", Id: "a_IN_b", RoleMasks: make([]uint64, RoleMaskCount)}))
+
+	ids, err := fs.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"john.doe@mail.com", "a_IN_b"}, ids["R.A"])
+
+	user, err := fs.GetUser(ctx, "R.A", "john.doe@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@mail.com", user.Id)
+}
+
+func TestFileStore_MigrateFileNames(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.Background()
+
+	legacy := filepath.Join(fs.BaseFolder+fs.UserFolder, "john.doe@x.com_IN_DEFAULT.json")
+	assert.NoError(t, os.WriteFile(legacy, []byte(`{"id":"john.doe@x.com","realm":"DEFAULT"}`), 0644))
+	report, err := fs.Recover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{legacy}, report.LegacyFileNames)
+
+	migration, err := fs.MigrateFileNames(ctx, true)
+	assert.NoError(t, err)
+	assert.Len(t, migration.Renamed, 1)
+	assert.True(t, pathExists(legacy))
+
+	migration, err = fs.MigrateFileNames(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, fs.UserFilePath("DEFAULT", "john.doe@x.com"), migration.Renamed[legacy])
+	assert.Empty(t, migration.Failed)
+	assert.False(t, pathExists(legacy))
+
+	user, err := fs.GetUser(ctx, "DEFAULT", "john.doe@x.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@x.com", user.Id)
+}
@@ -0,0 +1,194 @@
+package credenta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxShardDepth is the maximum number of hash-prefix bucket levels of a sharded FileStore. Each level split the
+// records into 256 buckets.
+const MaxShardDepth = 4
+
+// recordPath returns the path of the record with specified realm and key within folder, according to the ShardDepth.
+func (fs *FileStore) recordPath(folder, realm, key string) string {
+	if fs.ShardDepth <= 0 {
+		return fmt.Sprintf("%s/%s", folder, dataFileName(realm, key))
+	}
+	sum := sha256.Sum256([]byte(key))
+	parts := []string{folder, encodeFileNamePart(realm)}
+	for i := 0; i < fs.ShardDepth; i++ {
+		parts = append(parts, hex.EncodeToString(sum[i:i+1]))
+	}
+	return strings.Join(append(parts, dataFileName(realm, key)), "/")
+}
+
+// ensureShardDir creates the shard directory of the record file path if the store is sharded.
+func (fs *FileStore) ensureShardDir(path string) error {
+	if fs.ShardDepth <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("in ensureShardDir function, error creating shard directory of %s: %w", path, err)
+	}
+	return nil
+}
+
+func samePath(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// walkFiles call fn for every file in folder, and every file in its subdirectories when recursive is true.
+// Directories are read one at a time, so a sharded folder is never loaded into memory at once.
+// It stops at the first error returned by fn, or when ctx is done.
+func walkFiles(ctx context.Context, folder string, recursive bool, fn func(path string, entry os.DirEntry) error) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(folder, entry.Name())
+		if entry.IsDir() {
+			if recursive {
+				if err := walkFiles(ctx, path, true, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := fn(path, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkUserIDs call fn with the realm and id of every stored user, reading one shard at a time. Walking stops at the
+// first error returned by fn, which is returned as is.
+func (fs *FileStore) WalkUserIDs(ctx context.Context, fn func(realm, id string) error) error {
+	return fs.walkRecords(ctx, "WalkUserIDs", fs.BaseFolder+fs.UserFolder, fn)
+}
+
+// WalkGroupNames call fn with the realm and name of every stored group, reading one shard at a time. Walking stops at
+// the first error returned by fn, which is returned as is.
+func (fs *FileStore) WalkGroupNames(ctx context.Context, fn func(realm, name string) error) error {
+	return fs.walkRecords(ctx, "WalkGroupNames", fs.BaseFolder+fs.GroupFolder, fn)
+}
+
+// walkRecords call fn for every record file located where the ShardDepth expects it, so every walked record can be
+// loaded. Misplaced and legacy named files are skipped, they are reported by Recover.
+func (fs *FileStore) walkRecords(ctx context.Context, function, folder string, fn func(realm, key string) error) error {
+	if !pathExists(folder) {
+		return fmt.Errorf("in %s function, folder %s not exists", function, folder)
+	}
+	var fnErr error
+	err := walkFiles(ctx, folder, fs.ShardDepth > 0, func(path string, entry os.DirEntry) error {
+		realm, key, ok := parseDataFileName(entry.Name())
+		if !ok || !samePath(path, fs.recordPath(folder, realm, key)) {
+			return nil
+		}
+		fnErr = fn(realm, key)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("in %s function, error reading directory %s: %w", function, folder, err)
+	}
+	return nil
+}
+
+// MigrateLayout move every record file into the location expected by shardDepth, e.g. from the flat layout into a
+// sharded one or back, and then set the ShardDepth of this store. Record files with legacy names must be renamed
+// using MigrateFileNames first, they are reported as failed. Empty shard directories left behind are removed.
+// The migration must run while no other process is using the folders. When dryRun is true, nothing is moved but the
+// report still tells what would be moved.
+func (fs *FileStore) MigrateLayout(ctx context.Context, shardDepth int, dryRun bool) (*FileMigrationReport, error) {
+	if shardDepth < 0 || shardDepth > MaxShardDepth {
+		return nil, fmt.Errorf("in MigrateLayout function, invalid shard depth %d, it must be between 0 and %d", shardDepth, MaxShardDepth)
+	}
+	target := &FileStore{BaseFolder: fs.BaseFolder, UserFolder: fs.UserFolder, GroupFolder: fs.GroupFolder, ShardDepth: shardDepth}
+	report := &FileMigrationReport{
+		Renamed: make(map[string]string),
+		Failed:  make(map[string]string),
+	}
+	for _, folder := range []string{fs.BaseFolder + fs.UserFolder, fs.BaseFolder + fs.GroupFolder} {
+		err := walkFiles(ctx, folder, true, func(oldPath string, entry os.DirEntry) error {
+			if !strings.HasSuffix(entry.Name(), fileNameSuffix) {
+				return nil
+			}
+			realm, key, ok := parseDataFileName(entry.Name())
+			if !ok {
+				report.Failed[oldPath] = "legacy file name, run MigrateFileNames first"
+				return nil
+			}
+			newPath := filepath.Clean(target.recordPath(folder, realm, key))
+			if samePath(oldPath, newPath) {
+				return nil
+			}
+			if pathExists(newPath) {
+				report.Failed[oldPath] = fmt.Sprintf("target %s already exists", newPath)
+				return nil
+			}
+			if !dryRun {
+				if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+					report.Failed[oldPath] = err.Error()
+					return nil
+				}
+				if err := os.Rename(oldPath, newPath); err != nil {
+					report.Failed[oldPath] = err.Error()
+					return nil
+				}
+				os.Remove(oldPath + lockFileSuffix)
+			}
+			report.Renamed[oldPath] = newPath
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("in MigrateLayout function, error scanning directory %s: %w", folder, err)
+		}
+		if !dryRun {
+			if err := removeEmptyDirs(folder); err != nil {
+				return nil, fmt.Errorf("in MigrateLayout function, error cleaning directory %s: %w", folder, err)
+			}
+			if err := syncDir(folder); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !dryRun {
+		fs.ShardDepth = shardDepth
+	}
+	return report, nil
+}
+
+// removeEmptyDirs remove every empty subdirectory of folder, deepest first. The folder itself is kept.
+func removeEmptyDirs(folder string) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(folder, entry.Name())
+		if err := removeEmptyDirs(dir); err != nil {
+			return err
+		}
+		if remaining, err := os.ReadDir(dir); err == nil && len(remaining) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShardedFileStore(t *testing.T, shardDepth int) *FileStore {
+	fs := newTestFileStore(t)
+	sharded, err := NewShardedFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder, shardDepth)
+	assert.NoError(t, err)
+	return sharded
+}
+
+func TestFileStore_Sharded(t *testing.T) {
+	fs := newTestShardedFileStore(t, 2)
+	ctx := context.Background()
+
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "USERA", RoleMasks: make([]uint64, RoleMaskCount)}))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RB", Id: "USERB", RoleMasks: make([]uint64, RoleMaskCount)}))
+	assert.NoError(t, fs.PutGroup(ctx, &CGroup{Realm: "RA", Name: "GroupA", RoleMasks: make([]uint64, RoleMaskCount)}))
+
+	rel, err := filepath.Rel(fs.BaseFolder+fs.UserFolder, fs.UserFilePath("RA", "USERA"))
+	assert.NoError(t, err)
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	assert.Len(t, parts, 4)
+	assert.Equal(t, "RA", parts[0])
+	assert.Len(t, parts[1], 2)
+	assert.Equal(t, "USERA_IN_RA.json", parts[3])
+	assert.FileExists(t, fs.UserFilePath("RA", "USERA"))
+
+	user, err := fs.GetUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	assert.Equal(t, "USERA", user.Id)
+
+	ids, err := fs.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"RA": {"USERA"}, "RB": {"USERB"}}, ids)
+	names, err := fs.ListGroupNames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"RA": {"GroupA"}}, names)
+
+	stop := errors.New("stop")
+	count := 0
+	err = fs.WalkUserIDs(ctx, func(realm, id string) error {
+		count++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, count)
+
+	unlock, err := fs.LockUser(ctx, "RC", "USERC")
+	assert.NoError(t, err)
+	unlock()
+
+	assert.NoError(t, fs.DeleteUser(ctx, "RA", "USERA"))
+	_, err = fs.GetUser(ctx, "RA", "USERA")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = NewShardedFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder, MaxShardDepth+1)
+	assert.Error(t, err)
+}
+
+func TestFileStore_MigrateLayout(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.Background()
+	for _, id := range []string{"USERA", "USERB", "john.doe@mail.com"} {
+		assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: id, RoleMasks: make([]uint64, RoleMaskCount)}))
+	}
+	assert.NoError(t, fs.PutGroup(ctx, &CGroup{Realm: "RA", Name: "GroupA", RoleMasks: make([]uint64, RoleMaskCount)}))
+
+	report, err := fs.MigrateLayout(ctx, 2, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Renamed, 4)
+	assert.Equal(t, 0, fs.ShardDepth)
+
+	report, err = fs.MigrateLayout(ctx, 2, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Renamed, 4)
+	assert.Empty(t, report.Failed)
+	assert.Equal(t, 2, fs.ShardDepth)
+
+	sharded, err := NewShardedFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, sharded.LastRecovery.MisplacedRecords)
+	ids, err := sharded.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"USERA", "USERB", "john.doe@mail.com"}, ids["RA"])
+
+	flat, err := NewFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder)
+	assert.NoError(t, err)
+	assert.Len(t, flat.LastRecovery.MisplacedRecords, 4)
+	ids, err = flat.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	report, err = sharded.MigrateLayout(ctx, 0, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Renamed, 4)
+	entries, err := os.ReadDir(fs.BaseFolder + fs.UserFolder)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	user, err := flat.GetUser(ctx, "RA", "john.doe@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@mail.com", user.Id)
+}
+
+func TestFileStore_WatchSharded(t *testing.T) {
+	fs := newTestShardedFileStore(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan ChangeEvent, 100)
+	assert.NoError(t, fs.Watch(ctx, func(event ChangeEvent) {
+		events <- event
+	}))
+
+	path := fs.UserFilePath("RA", "USERA")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(`{"id":"USERA","realm":"RA"}`), 0644))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, RecordUser, event.Kind)
+		assert.Equal(t, ChangeAdded, event.Op)
+		assert.Equal(t, "USERA", event.Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
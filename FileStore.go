@@ -0,0 +1,445 @@
+package credenta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tempFileMarker is the part of a temporary file name that marks it as a temporary file of an atomic write.
+	tempFileMarker = ".tmp-"
+	// tempFileGracePeriod is the age a temporary file must reach before the recovery pass consider it orphaned.
+	tempFileGracePeriod = time.Minute
+	// lockFileSuffix is appended into a record file path to get the path of the file used for locking the record.
+	lockFileSuffix = ".lock"
+)
+
+// NewFileStoreFromEnv creates a new FileStore using folders configured by CREDENTA_BASE_DIR, CREDENTA_USER_DIR,
+// CREDENTA_GROUP_DIR, CREDENTA_AUX_DIR and CREDENTA_JOURNAL_DIR environment variable, and the shard depth configured
+// by CREDENTA_SHARD_DEPTH.
+func NewFileStoreFromEnv() (*FileStore, error) {
+	baseFolder := getEnvVar("CREDENTA_BASE_DIR", ".", nil)
+	userFolder := getEnvVar("CREDENTA_USER_DIR", "/data/user", nil)
+	groupFolder := getEnvVar("CREDENTA_GROUP_DIR", "/data/group", nil)
+	shardDepth, err := strconv.Atoi(getEnvVar("CREDENTA_SHARD_DEPTH", "0", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CREDENTA_SHARD_DEPTH environment variable: %w", err)
+	}
+	fs, err := NewShardedFileStore(baseFolder, userFolder, groupFolder, shardDepth)
+	if err != nil {
+		return nil, err
+	}
+	fs.AuxFolder = getEnvVar("CREDENTA_AUX_DIR", fs.AuxFolder, nil)
+	if journalFolder := getEnvVar("CREDENTA_JOURNAL_DIR", fs.JournalFolder, nil); journalFolder != fs.JournalFolder {
+		// the recovery pass only looked into the default journal folder.
+		fs.JournalFolder = journalFolder
+		if fs.LastRecovery.RolledBackJournals, err = fs.rollBackJournals(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// NewFileStore creates a new Store that keeps every user and group as JSON file.
+// Users are stored in `baseFolder+userFolder` and groups are stored in `baseFolder+groupFolder`, each file
+// is named `ID_IN_REALM.json` where ID and REALM are encoded to be file name safe (see encodeFileNamePart).
+// It will return an error if any of the folder is not exist.
+// Before returning, the store runs a recovery pass (see FileStore.Recover) and log every corrupt record it found.
+func NewFileStore(baseFolder, userFolder, groupFolder string) (*FileStore, error) {
+	return NewShardedFileStore(baseFolder, userFolder, groupFolder, 0)
+}
+
+// NewShardedFileStore creates a new FileStore like NewFileStore, but with records spread into per-realm subdirectories
+// and shardDepth levels of hash-prefix buckets, see FileStore.ShardDepth. A shardDepth of zero keeps every record
+// directly in the user or group folder.
+func NewShardedFileStore(baseFolder, userFolder, groupFolder string, shardDepth int) (*FileStore, error) {
+	if shardDepth < 0 || shardDepth > MaxShardDepth {
+		return nil, fmt.Errorf("invalid shard depth %d, it must be between 0 and %d", shardDepth, MaxShardDepth)
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%s%s", baseFolder, userFolder)); err != nil {
+		return nil, fmt.Errorf("could not find user directory \"%s%s\". Please create the directory or change the environment variable CREDENTA_BASE_DIR and/or CREDENTA_USER_DIR and try again ", baseFolder, userFolder)
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%s%s", baseFolder, groupFolder)); err != nil {
+		return nil, fmt.Errorf("could not find user directory \"%s%s\". Please create the directory or change the environment variable CREDENTA_BASE_DIR and/or CREDENTA_GROUP_DIR and try again ", baseFolder, groupFolder)
+	}
+
+	fs := &FileStore{
+		BaseFolder:  baseFolder,
+		UserFolder:  userFolder,
+		GroupFolder: groupFolder,
+		ShardDepth:  shardDepth,
+		AuxFolder:   path.Join(path.Dir(userFolder), "aux"),
+
+		JournalFolder: path.Join(path.Dir(userFolder), "journal"),
+	}
+
+	report, err := fs.Recover(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for _, corrupt := range report.CorruptRecords {
+		log.Printf("credenta file store contains corrupt record %s\n", corrupt)
+	}
+	if len(report.LegacyFileNames) > 0 {
+		log.Printf("credenta file store contains %d record files with legacy name, they are not visible until renamed using MigrateFileNames\n", len(report.LegacyFileNames))
+	}
+	for _, journal := range report.RolledBackJournals {
+		log.Printf("credenta file store rolled back the interrupted batch of journal %s\n", journal)
+	}
+	if len(report.MisplacedRecords) > 0 {
+		log.Printf("credenta file store contains %d record files outside of their shard, they are not visible until moved using MigrateLayout\n", len(report.MisplacedRecords))
+	}
+	fs.LastRecovery = report
+
+	return fs, nil
+}
+
+// FileStore is a Store implementation that keep each user and group in its own JSON file.
+// Every write is atomic, a record is written into a temporary file and renamed over the old one.
+type FileStore struct {
+	BaseFolder  string `json:"baseFolder"`
+	UserFolder  string `json:"userFolder"`
+	GroupFolder string `json:"groupFolder"`
+	// ShardDepth is the number of hash-prefix bucket levels below the per-realm subdirectory. When it is zero, every
+	// record is kept directly in the user or group folder. Otherwise a record is kept in
+	// `Folder/REALM/ab/cd/ID_IN_REALM.json` where ab, cd are the first bytes of the SHA-256 of its id or name.
+	ShardDepth int `json:"shardDepth"`
+	// AuxFolder is where auxiliary records, such as indexes, are kept in `BaseFolder+AuxFolder`. It is created when
+	// needed, and defaults to the `aux` folder next to the user folder.
+	AuxFolder string `json:"auxFolder"`
+	// JournalFolder is where the journals of the batches being written are kept in `BaseFolder+JournalFolder`, see
+	// WriteBatch. It is created when needed, and defaults to the `journal` folder next to the user folder.
+	JournalFolder string `json:"journalFolder"`
+
+	// LastRecovery is the report of the recovery pass run when the store was created.
+	LastRecovery *FileRecoveryReport `json:"-"`
+
+	// watchMutex protect ownWrites and ownDeletes, both are nil unless the store is being watched.
+	watchMutex sync.Mutex
+	// ownWrites are the checksum of the last content written by this store into a path.
+	ownWrites map[string][sha256.Size]byte
+	// ownDeletes are the paths removed by this store whose removal has not been noticed by the watch.
+	ownDeletes map[string]struct{}
+}
+
+// FileRecoveryReport is the result of FileStore.Recover
+type FileRecoveryReport struct {
+	// RemovedTempFiles are the orphaned temporary files left by an interrupted write that have been removed.
+	RemovedTempFiles []string `json:"removedTempFiles"`
+	// CorruptRecords are the record files that could not be parsed as JSON. They are left untouched.
+	CorruptRecords []string `json:"corruptRecords"`
+	// LegacyFileNames are the record files not named using the current file name encoding. See MigrateFileNames.
+	LegacyFileNames []string `json:"legacyFileNames"`
+	// MisplacedRecords are the record files not located where the current ShardDepth expects. See MigrateLayout.
+	MisplacedRecords []string `json:"misplacedRecords"`
+	// RolledBackJournals are the journals of interrupted batches that have been rolled back. See WriteBatch.
+	RolledBackJournals []string `json:"rolledBackJournals"`
+}
+
+// Recover scan the user, group and auxiliary folders including their subdirectories, remove every orphaned temporary
+// file left by an interrupted write and report every record file that does not contain a valid JSON, or is not named or located as
+// expected. Temporary files younger than tempFileGracePeriod are kept, since they might belong to a write still in
+// progress in another process. Batches interrupted before they were complete are rolled back (see WriteBatch).
+func (fs *FileStore) Recover(ctx context.Context) (*FileRecoveryReport, error) {
+	report := &FileRecoveryReport{
+		RemovedTempFiles: make([]string, 0),
+		CorruptRecords:   make([]string, 0),
+		LegacyFileNames:  make([]string, 0),
+		MisplacedRecords: make([]string, 0),
+	}
+	rolledBack, err := fs.rollBackJournals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("in Recover function, %w", err)
+	}
+	report.RolledBackJournals = rolledBack
+	folders := []string{fs.BaseFolder + fs.UserFolder, fs.BaseFolder + fs.GroupFolder}
+	for _, folder := range []string{fs.AuxFolder, fs.JournalFolder} {
+		if folder != "" && pathExists(fs.BaseFolder+folder) {
+			folders = append(folders, fs.BaseFolder+folder)
+		}
+	}
+	for _, folder := range folders {
+		err := walkFiles(ctx, folder, true, func(path string, entry os.DirEntry) error {
+			if strings.Contains(entry.Name(), tempFileMarker) {
+				info, err := entry.Info()
+				if err != nil || time.Since(info.ModTime()) < tempFileGracePeriod {
+					return nil
+				}
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("error removing temporary file %s: %w", path, err)
+				}
+				report.RemovedTempFiles = append(report.RemovedTempFiles, path)
+			} else if strings.HasSuffix(entry.Name(), fileNameSuffix) {
+				data, err := os.ReadFile(path)
+				if err != nil || !json.Valid(data) {
+					report.CorruptRecords = append(report.CorruptRecords, path)
+				}
+				if realm, key, ok := parseDataFileName(entry.Name()); !ok {
+					report.LegacyFileNames = append(report.LegacyFileNames, path)
+				} else if !samePath(path, fs.recordPath(folder, realm, key)) {
+					report.MisplacedRecords = append(report.MisplacedRecords, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("in Recover function, error scanning directory %s: %w", folder, err)
+		}
+	}
+	return report, nil
+}
+
+// UserFilePath returns the path of the file where a user with specified realm and id is stored.
+func (fs *FileStore) UserFilePath(realm, id string) string {
+	return fs.recordPath(fs.BaseFolder+fs.UserFolder, realm, id)
+}
+
+// GroupFilePath returns the path of the file where a group with specified realm and name is stored.
+func (fs *FileStore) GroupFilePath(realm, name string) string {
+	return fs.recordPath(fs.BaseFolder+fs.GroupFolder, realm, name)
+}
+
+// LockUser acquire an advisory file lock of the user with specified realm and id. The lock is honored by every
+// process sharing the same folder, see Locker. The lock file is removed once the lock is released.
+func (fs *FileStore) LockUser(ctx context.Context, realm, id string) (func(), error) {
+	path := fs.UserFilePath(realm, id)
+	if err := fs.ensureShardDir(path); err != nil {
+		return nil, err
+	}
+	return lockFile(ctx, path+lockFileSuffix)
+}
+
+// LockGroup acquire an advisory file lock of the group with specified realm and name. The lock is honored by every
+// process sharing the same folder, see Locker. The lock file is removed once the lock is released.
+func (fs *FileStore) LockGroup(ctx context.Context, realm, name string) (func(), error) {
+	path := fs.GroupFilePath(realm, name)
+	if err := fs.ensureShardDir(path); err != nil {
+		return nil, err
+	}
+	return lockFile(ctx, path+lockFileSuffix)
+}
+
+func (fs *FileStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	user, err := readUserFile(fs.UserFilePath(realm, id))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (fs *FileStore) PutUser(ctx context.Context, user *CUser) error {
+	user.FilePath = fs.UserFilePath(user.Realm, user.Id)
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("in PutUser function, error marshalling user: %w", err)
+	}
+	return fs.writeRecord(user.FilePath, data)
+}
+
+func (fs *FileStore) DeleteUser(ctx context.Context, realm, id string) error {
+	return fs.removeRecord(fs.UserFilePath(realm, id))
+}
+
+/*
+ListUserIDs will return a map of realm name to array of user id. The function will go to directory with format
+`BaseFolder/UserFolder` and look for file with `USERID_IN_REALM.json` name, within every shard if the store is sharded.
+It will return an error if no folder with that name is found. By default, the BaseFolder is "." which equals to the
+name of the project. Use WalkUserIDs to avoid holding every id in memory.
+*/
+func (fs *FileStore) ListUserIDs(ctx context.Context) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	err := fs.WalkUserIDs(ctx, func(realm, id string) error {
+		appendToRealm(ret, realm, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (fs *FileStore) GetGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	group, err := readGroupFile(fs.GroupFilePath(realm, name))
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (fs *FileStore) PutGroup(ctx context.Context, group *CGroup) error {
+	group.FilePath = fs.GroupFilePath(group.Realm, group.Name)
+	data, err := json.Marshal(group)
+	if err != nil {
+		return fmt.Errorf("in PutGroup function, error marshalling group: %w", err)
+	}
+	return fs.writeRecord(group.FilePath, data)
+}
+
+func (fs *FileStore) DeleteGroup(ctx context.Context, realm, name string) error {
+	return fs.removeRecord(fs.GroupFilePath(realm, name))
+}
+
+/*
+ListGroupNames will return a map of realm name to array of group name. The function will go to directory with format
+`BaseFolder/GroupFolder` and look for file with `NAME_IN_REALM.json` name, within every shard if the store is sharded.
+It will return an error if no folder with that name is found. By default, the BaseFolder is "." which equals to the
+name of the project. Use WalkGroupNames to avoid holding every name in memory.
+*/
+func (fs *FileStore) ListGroupNames(ctx context.Context) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	err := fs.WalkGroupNames(ctx, func(realm, name string) error {
+		appendToRealm(ret, realm, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// writeRecord write the record file, remembering its content so the watch does not report it as outside change.
+func (fs *FileStore) writeRecord(path string, data []byte) error {
+	fs.watchMutex.Lock()
+	if fs.ownWrites != nil {
+		fs.ownWrites[filepath.Clean(path)] = sha256.Sum256(data)
+	}
+	fs.watchMutex.Unlock()
+	if err := fs.ensureShardDir(path); err != nil {
+		return err
+	}
+	return writeDataFile(path, data)
+}
+
+// removeRecord remove the record file, remembering the removal so the watch does not report it as outside change.
+func (fs *FileStore) removeRecord(path string) error {
+	fs.watchMutex.Lock()
+	if fs.ownDeletes != nil {
+		fs.ownDeletes[filepath.Clean(path)] = struct{}{}
+		delete(fs.ownWrites, filepath.Clean(path))
+	}
+	fs.watchMutex.Unlock()
+	return removeDataFile(path)
+}
+
+// readUserFile load a CUser from the JSON file in the specified path.
+func readUserFile(path string) (*CUser, error) {
+	data, err := readDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	user := &CUser{}
+	if err := json.Unmarshal(data, user); err != nil {
+		return nil, fmt.Errorf("in readUserFile function, error unmarshaling data into CUser: %w", err)
+	}
+	user.FilePath = path
+	return user, nil
+}
+
+// readGroupFile load a CGroup from the JSON file in the specified path.
+func readGroupFile(path string) (*CGroup, error) {
+	data, err := readDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	group := &CGroup{}
+	if err := json.Unmarshal(data, group); err != nil {
+		return nil, fmt.Errorf("in readGroupFile function, error unmarshaling data into CGroup: %w", err)
+	}
+	group.FilePath = path
+	return group, nil
+}
+
+func readDataFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("in readDataFile function, file %s: %w", path, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("in readDataFile function, error reading file %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// writeDataFile atomically replace the content of the file in path with data. The data is written into a temporary
+// file in the same directory, synced to disk and then renamed over the target, so a crash in the middle of writing
+// will leave either the old or the new content, never a partial one.
+func writeDataFile(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, base+tempFileMarker+"*")
+	if err != nil {
+		return fmt.Errorf("in writeDataFile function. error creating temporary file for %s: %w", path, err)
+	}
+	tempPath := file.Name()
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("in writeDataFile function. error writing into file %s: %w", tempPath, err)
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("in writeDataFile function. error syncing file %s: %w", tempPath, err)
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("in writeDataFile function. error closing file %s: %w", tempPath, err)
+	}
+	if err = os.Chmod(tempPath, 0644); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("in writeDataFile function. error changing mode of file %s: %w", tempPath, err)
+	}
+	if err = os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("in writeDataFile function. error renaming %s into %s: %w", tempPath, path, err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir flush the directory entry changes (create, rename, remove) of the directory into the disk.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// directories can not be opened for syncing on windows, rename is already durable there.
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("in syncDir function. error opening directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("in syncDir function. error syncing directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+func removeDataFile(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("in removeDataFile function, file %s: %w", path, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
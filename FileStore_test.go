@@ -0,0 +1,155 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T) *FileStore {
+	base := t.TempDir()
+	assert.NoError(t, os.MkdirAll(base+"/user", 0755))
+	assert.NoError(t, os.MkdirAll(base+"/group", 0755))
+	fs, err := NewFileStore(base, "/user", "/group")
+	assert.NoError(t, err)
+	return fs
+}
+
+func TestFileStore_UserRoundTrip(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.Background()
+
+	_, err := fs.GetUser(ctx, "RA", "USERA")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "USERA", RoleMasks: make([]uint64, RoleMaskCount)}))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "USERA", Active: true, RoleMasks: make([]uint64, RoleMaskCount)}))
+
+	user, err := fs.GetUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	assert.True(t, user.Active)
+	assert.Equal(t, fs.UserFilePath("RA", "USERA"), user.FilePath)
+
+	ids, err := fs.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"USERA"}, ids["RA"])
+
+	assert.NoError(t, fs.DeleteUser(ctx, "RA", "USERA"))
+	assert.True(t, errors.Is(fs.DeleteUser(ctx, "RA", "USERA"), ErrNotFound))
+}
+
+func TestFileStore_CredentaDB(t *testing.T) {
+	cDB := NewCredentaDBWithStore(newTestFileStore(t))
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	grp, err := cDB.NewGroup(ctx, "RA", "GroupA", nil)
+	assert.NoError(t, err)
+	grp.AddRole(3)
+	assert.NoError(t, grp.StoreOrSaveToFile(ctx))
+
+	usr, err := cDB.NewUser(ctx, "RA", "USERA", "password", []string{"GroupA"}, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	usr.Active = true
+	assert.NoError(t, usr.StoreOrSaveToFile(ctx))
+
+	_, roles, err := cDB.GetUserWithAuth(ctx, "RA", "USERA", "password")
+	assert.NoError(t, err)
+	assert.True(t, IsRoleFlagOn(roles, 3))
+
+	names, err := cDB.ListGroupNames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GroupA"}, names["RA"])
+
+	assert.NoError(t, usr.DeleteFile(ctx))
+	assert.NoError(t, grp.DeleteFile(ctx))
+	_, err = cDB.GetUser(ctx, "RA", "USERA")
+	assert.Error(t, err)
+}
+
+func TestFileStore_Recover(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.Background()
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "USERA"}))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "USERA", Active: true}))
+
+	entries, err := os.ReadDir(fs.BaseFolder + fs.UserFolder)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "atomic write must not leave any temporary file")
+
+	orphan := fs.UserFilePath("RA", "USERB") + tempFileMarker + "123"
+	assert.NoError(t, os.WriteFile(orphan, []byte(`{"realm":`), 0644))
+	old := time.Now().Add(-2 * tempFileGracePeriod)
+	assert.NoError(t, os.Chtimes(orphan, old, old))
+	fresh := fs.UserFilePath("RA", "USERC") + tempFileMarker + "456"
+	assert.NoError(t, os.WriteFile(fresh, []byte(`{"realm":`), 0644))
+	corrupt := fs.GroupFilePath("RA", "GroupA")
+	assert.NoError(t, os.WriteFile(corrupt, []byte(`{"realm":"RA","na`), 0644))
+
+	reopened, err := NewFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{orphan}, reopened.LastRecovery.RemovedTempFiles)
+	assert.Equal(t, []string{corrupt}, reopened.LastRecovery.CorruptRecords)
+	assert.False(t, pathExists(orphan))
+	assert.True(t, pathExists(fresh), "temporary file of a write in progress must be kept")
+	assert.True(t, pathExists(corrupt), "corrupt record must only be reported")
+
+	user, err := reopened.GetUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	assert.True(t, user.Active)
+}
+
+func TestFileStore_ConcurrentUpdate(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	// two CredentaDB sharing the same folder behave like two processes sharing CREDENTA_BASE_DIR.
+	otherFs, err := NewFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder)
+	assert.NoError(t, err)
+	dbs := []*CredentaDB{NewCredentaDBWithStore(fs), NewCredentaDBWithStore(otherFs)}
+
+	usr, err := dbs[0].NewUser(ctx, "RA", "USERA", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, usr.StoreOrSaveToFile(ctx))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := dbs[i%2].Update(ctx, "RA", "USERA", func(user *CUser) error {
+				user.Groups = append(user.Groups, fmt.Sprintf("Group%d", i))
+				return nil
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	loaded, err := dbs[0].GetUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	assert.Len(t, loaded.Groups, 20)
+
+	assert.NoError(t, dbs[1].ChangeUserPassword(ctx, "RA", "USERA", "newpassword", VerificationMethodPLAIN))
+	_, _, err = dbs[0].GetUserWithAuth(ctx, "RA", "USERA", "newpassword")
+	assert.True(t, errors.Is(err, ErrUserNotActivated))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	unlock, err := fs.LockUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	cancel()
+	_, err = otherFs.LockUser(cancelled, "RA", "USERA")
+	assert.ErrorIs(t, err, context.Canceled)
+	unlock()
+
+	// no lock file is left behind, even once the user is deleted.
+	assert.NoError(t, dbs[0].DeleteUser(ctx, "RA", "USERA"))
+	locks, err := filepath.Glob(fs.BaseFolder + fs.UserFolder + "/*" + lockFileSuffix)
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+}
@@ -0,0 +1,198 @@
+package credenta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Watch watches the user and group folders, including every shard directory, using the operating system file
+// notification (inotify on Linux), and call handler for every record file added, modified or deleted outside of this
+// FileStore, until the ctx is done. Added and modified records are re-validated, the event's Err is set when the file
+// does not contain a valid record. Temporary and lock files are ignored.
+func (fs *FileStore) Watch(ctx context.Context, handler func(event ChangeEvent)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("in Watch function, error creating watcher: %w", err)
+	}
+
+	folders := map[string]RecordKind{
+		filepath.Clean(fs.BaseFolder + fs.UserFolder):  RecordUser,
+		filepath.Clean(fs.BaseFolder + fs.GroupFolder): RecordGroup,
+	}
+	known := make(map[string]bool)
+	for folder := range folders {
+		files, err := fs.watchTree(watcher, folder)
+		if err != nil {
+			watcher.Close()
+			return fmt.Errorf("in Watch function, error watching folder %s: %w", folder, err)
+		}
+		for _, path := range files {
+			known[path] = true
+		}
+	}
+
+	fs.watchMutex.Lock()
+	if fs.ownWrites == nil {
+		fs.ownWrites = make(map[string][sha256.Size]byte)
+		fs.ownDeletes = make(map[string]struct{})
+	}
+	fs.watchMutex.Unlock()
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case fsEvent, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if info, err := os.Stat(fsEvent.Name); fs.ShardDepth > 0 && fsEvent.Has(fsnotify.Create) && err == nil && info.IsDir() {
+					// a new shard directory, records might have been written into it before it is watched.
+					files, err := fs.watchTree(watcher, fsEvent.Name)
+					if err != nil {
+						log.Printf("credenta file store watch error : %v\n", err)
+					}
+					for _, path := range files {
+						if event, ok := fs.toChangeEvent(fsnotify.Event{Name: path, Op: fsnotify.Create}, folders, known); ok {
+							handler(event)
+						}
+					}
+					continue
+				}
+				if event, ok := fs.toChangeEvent(fsEvent, folders, known); ok {
+					handler(event)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("credenta file store watch error : %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchTree add the folder into the watcher, and every shard directory within it if the store is sharded. It returns
+// the path of every file found in the watched directories.
+func (fs *FileStore) watchTree(watcher *fsnotify.Watcher, folder string) ([]string, error) {
+	if err := watcher.Add(folder); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0)
+	for _, entry := range entries {
+		path := filepath.Join(folder, entry.Name())
+		if !entry.IsDir() {
+			files = append(files, path)
+		} else if fs.ShardDepth > 0 {
+			shardFiles, err := fs.watchTree(watcher, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, shardFiles...)
+		}
+	}
+	return files, nil
+}
+
+// toChangeEvent translate the file notification into ChangeEvent. It returns false if the notification is not about
+// a record file located where this FileStore expects it, or it is caused by this FileStore itself.
+func (fs *FileStore) toChangeEvent(fsEvent fsnotify.Event, folders map[string]RecordKind, known map[string]bool) (ChangeEvent, bool) {
+	path := filepath.Clean(fsEvent.Name)
+	realm, key, ok := parseDataFileName(filepath.Base(path))
+	if !ok {
+		return ChangeEvent{}, false
+	}
+	kind := RecordKind("")
+	for folder, folderKind := range folders {
+		if samePath(path, fs.recordPath(folder, realm, key)) {
+			kind = folderKind
+		}
+	}
+	if kind == "" {
+		return ChangeEvent{}, false
+	}
+	event := ChangeEvent{
+		Kind:  kind,
+		Realm: realm,
+		Key:   key,
+		Path:  path,
+	}
+
+	switch {
+	case fsEvent.Has(fsnotify.Remove) || fsEvent.Has(fsnotify.Rename):
+		delete(known, path)
+		fs.watchMutex.Lock()
+		_, own := fs.ownDeletes[path]
+		delete(fs.ownDeletes, path)
+		fs.watchMutex.Unlock()
+		if own {
+			return ChangeEvent{}, false
+		}
+		event.Op = ChangeDeleted
+		return event, true
+	case fsEvent.Has(fsnotify.Create) || fsEvent.Has(fsnotify.Write):
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			// already removed again, the removal will be notified.
+			return ChangeEvent{}, false
+		}
+		wasKnown := known[path]
+		known[path] = true
+		if err == nil {
+			fs.watchMutex.Lock()
+			sum, own := fs.ownWrites[path]
+			fs.watchMutex.Unlock()
+			if own && sum == sha256.Sum256(data) {
+				return ChangeEvent{}, false
+			}
+		}
+		event.Op = ChangeModified
+		if !wasKnown {
+			event.Op = ChangeAdded
+		}
+		if err != nil {
+			event.Err = fmt.Errorf("error reading file %s: %w", path, err)
+		} else {
+			event.Err = validateRecord(kind, realm, key, data)
+		}
+		return event, true
+	default:
+		return ChangeEvent{}, false
+	}
+}
+
+// validateRecord check that data is a valid JSON of the record kind, and it belongs to the realm and key.
+func validateRecord(kind RecordKind, realm, key string, data []byte) error {
+	var dataRealm, dataKey string
+	switch kind {
+	case RecordUser:
+		user := &CUser{}
+		if err := json.Unmarshal(data, user); err != nil {
+			return fmt.Errorf("invalid user record: %w", err)
+		}
+		dataRealm, dataKey = user.Realm, user.Id
+	case RecordGroup:
+		group := &CGroup{}
+		if err := json.Unmarshal(data, group); err != nil {
+			return fmt.Errorf("invalid group record: %w", err)
+		}
+		dataRealm, dataKey = group.Realm, group.Name
+	}
+	if dataRealm != realm || dataKey != key {
+		return fmt.Errorf("record of %s %s in realm %s is stored as %s in realm %s", kind, dataKey, dataRealm, key, realm)
+	}
+	return nil
+}
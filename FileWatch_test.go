@@ -0,0 +1,80 @@
+package credenta
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileStore_Watch(t *testing.T) {
+	fs := newTestFileStore(t)
+	cDB := NewCredentaDBWithStore(fs)
+	cDB.EnableCache(DefaultCacheConfig())
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ETX_USER, "TestUser"))
+	defer cancel()
+
+	usr, err := cDB.NewUser(ctx, "RA", "USERA", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, usr.StoreOrSaveToFile(ctx))
+
+	events := make(chan ChangeEvent, 10)
+	assert.NoError(t, cDB.Watch(ctx, func(event ChangeEvent) {
+		events <- event
+	}))
+	// a single write might be notified more than once (create, truncate, write), wait for the expected one.
+	waitFor := func(kind RecordKind, op ChangeOp) ChangeEvent {
+		for {
+			select {
+			case event := <-events:
+				if event.Kind == kind && event.Op == op {
+					return event
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %s %s event", kind, op)
+				return ChangeEvent{}
+			}
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case <-events:
+			case <-time.After(200 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	// warm the cache, then change the file behind credenta's back.
+	_, err = cDB.GetUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	edited := usr.clone()
+	edited.Active = true
+	assert.NoError(t, os.WriteFile(fs.UserFilePath("RA", "USERA"), []byte(edited.String()), 0644))
+	event := waitFor(RecordUser, ChangeModified)
+	assert.Equal(t, "USERA", event.Key)
+	drain()
+	loaded, err := cDB.GetUser(ctx, "RA", "USERA")
+	assert.NoError(t, err)
+	assert.True(t, loaded.Active, "cached user must be invalidated")
+
+	assert.NoError(t, os.WriteFile(fs.GroupFilePath("RA", "GroupA"), []byte(`{"realm":"RA","na`), 0644))
+	event = waitFor(RecordGroup, ChangeAdded)
+	assert.Error(t, event.Err)
+	drain()
+
+	assert.NoError(t, os.Remove(fs.GroupFilePath("RA", "GroupA")))
+	event = waitFor(RecordGroup, ChangeDeleted)
+	assert.Equal(t, "GroupA", event.Key)
+
+	// changes made through credenta are not reported.
+	assert.NoError(t, loaded.StoreOrSaveToFile(ctx))
+	assert.NoError(t, cDB.DeleteUser(ctx, "RA", "USERA"))
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1,14 +1,24 @@
 package credenta
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -26,47 +36,289 @@ const (
 	// VerificationMethodARGON specifies if a password will be hashed using ARGON and this hash will be stored.
 	// ARGON is the current award wining hashing mechanism and once saved the password is NOT RECOVERABLE
 	VerificationMethodARGON VerificationMethod = "ARGON"
+	// VerificationMethodBCRYPT specifies if a password will be hashed using bcrypt with HashParameters.BcryptCost and
+	// this hash will be stored in the modular crypt format (`$2a$10$...`). Passwords longer than 72 bytes are rejected.
+	VerificationMethodBCRYPT VerificationMethod = "BCRYPT"
+	// VerificationMethodSCRYPT specifies if a password will be hashed using scrypt with HashParameters.Scrypt and this
+	// hash will be stored in the PHC string format (`$scrypt$ln=15,r=8,p=1$salt$key`).
+	VerificationMethodSCRYPT VerificationMethod = "SCRYPT"
+	// VerificationMethodPBKDF2 specifies if a password will be hashed using PBKDF2 with HashParameters.PBKDF2 and this
+	// hash will be stored in the PHC string format (`$pbkdf2-sha256$i=600000,l=32$salt$key`).
+	VerificationMethodPBKDF2 VerificationMethod = "PBKDF2"
 )
 
 // VerificationMethod specify on how a user's password were stored.
 type VerificationMethod string
 
-// MakeVerification will hash the supplied pass argument using the hashing mechanism.
+const (
+	// maxHashMemory caps the memory the verification of an argon2id or scrypt hash takes, in bytes.
+	maxHashMemory = 1 << 30
+	// maxArgonIterations caps the number of passes of an argon2id hash.
+	maxArgonIterations = 64
+	// maxScryptLogN caps the base 2 logarithm of the CPU/memory cost of a scrypt hash.
+	maxScryptLogN = 20
+	// maxScryptR caps the block size of a scrypt hash.
+	maxScryptR = 32
+	// maxScryptP caps the parallelization of a scrypt hash.
+	maxScryptP = 16
+	// maxPBKDF2Iterations caps the number of iterations of a PBKDF2 hash.
+	maxPBKDF2Iterations = 10000000
+	// maxHashKeyLength caps the length of the salt and of the key of a hash in bytes.
+	maxHashKeyLength = 128
+)
+
+// HashParameters are the parameters of the hashes made by the ARGON, BCRYPT, SCRYPT and PBKDF2 verification
+// methods, see CredentaDB.SetHashParameters. Hashes made with weaker parameters are reported by NeedsRehash.
+type HashParameters struct {
+	// Argon are the parameters of VerificationMethodARGON.
+	Argon argon2id.Params
+	// BcryptCost is the cost of VerificationMethodBCRYPT.
+	BcryptCost int
+	// Scrypt are the parameters of VerificationMethodSCRYPT.
+	Scrypt ScryptParameters
+	// PBKDF2 are the parameters of VerificationMethodPBKDF2.
+	PBKDF2 PBKDF2Parameters
+}
+
+// DefaultHashParameters returns the parameters used by MakeVerification and NeedsRehash, and by a CredentaDB until
+// SetHashParameters is called.
+func DefaultHashParameters() *HashParameters {
+	return &HashParameters{
+		Argon:      *argon2id.DefaultParams,
+		BcryptCost: bcrypt.DefaultCost,
+		Scrypt:     ScryptParameters{LogN: 15, R: 8, P: 1, SaltLength: 16, KeyLength: 32},
+		PBKDF2:     PBKDF2Parameters{Digest: DigestSHA256, Iterations: 600000, SaltLength: 16, KeyLength: 32},
+	}
+}
+
+// validate returns an error if a parameter is out of the range of its method.
+func (params *HashParameters) validate() error {
+	if err := checkARGON(&params.Argon); err != nil {
+		return err
+	}
+	if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be within %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if err := params.Scrypt.check(); err != nil {
+		return err
+	}
+	if _, err := pbkdf2Digest(params.PBKDF2.Digest); err != nil {
+		return err
+	}
+	if params.Scrypt.SaltLength == 0 || params.PBKDF2.SaltLength == 0 {
+		return errors.New("salt length must be positive")
+	}
+	return params.PBKDF2.check()
+}
+
+// checkHash returns an error if the hash made with method is malformed, or made with parameters out of the ranges
+// its verification is allowed to take. The digest and plain hashes are not checked.
+func checkHash(method VerificationMethod, hash string) error {
+	var err error
+	switch method {
+	case VerificationMethodARGON:
+		var params *argon2id.Params
+		if params, _, _, err = argon2id.DecodeHash(hash); err == nil {
+			err = checkARGON(params)
+		}
+	case VerificationMethodBCRYPT:
+		_, err = bcrypt.Cost([]byte(hash))
+	case VerificationMethodSCRYPT:
+		_, _, _, err = decodeSCRYPT(hash)
+	case VerificationMethodPBKDF2:
+		var params *PBKDF2Parameters
+		if params, _, _, err = decodePBKDF2(hash); err == nil {
+			_, err = pbkdf2Digest(params.Digest)
+		}
+	}
+	return err
+}
+
+// checkARGON returns an error if the argon2id parameters are not positive or exceed the caps.
+func checkARGON(params *argon2id.Params) error {
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 || params.SaltLength == 0 || params.KeyLength == 0 {
+		return errors.New("argon parameters must be positive")
+	}
+	if uint64(params.Memory)*1024 > maxHashMemory || params.Iterations > maxArgonIterations ||
+		params.SaltLength > maxHashKeyLength || params.KeyLength > maxHashKeyLength {
+		return errors.New("argon parameters exceed the allowed maximum")
+	}
+	return nil
+}
+
+// ScryptParameters are the parameters of scrypt.
+type ScryptParameters struct {
+	// LogN is the base 2 logarithm of the CPU/memory cost N.
+	LogN int
+	// R is the block size.
+	R int
+	// P is the parallelization.
+	P int
+	// SaltLength is the length of the random salt in bytes.
+	SaltLength int
+	// KeyLength is the length of the derived key in bytes.
+	KeyLength int
+}
+
+const (
+	// DigestSHA1 is the SHA1 digest of PBKDF2.
+	DigestSHA1 = "sha1"
+	// DigestSHA256 is the SHA256 digest of PBKDF2.
+	DigestSHA256 = "sha256"
+	// DigestSHA512 is the SHA512 digest of PBKDF2.
+	DigestSHA512 = "sha512"
+)
+
+// check returns an error if the parameters are not positive or exceed the caps.
+func (params *ScryptParameters) check() error {
+	if params.LogN <= 0 || params.R <= 0 || params.P <= 0 || params.SaltLength < 0 || params.KeyLength <= 0 {
+		return errors.New("invalid scrypt parameters")
+	}
+	if params.LogN > maxScryptLogN || params.R > maxScryptR || params.P > maxScryptP ||
+		uint64(128*params.R)<<params.LogN > maxHashMemory || params.SaltLength > maxHashKeyLength || params.KeyLength > maxHashKeyLength {
+		return errors.New("scrypt parameters exceed the allowed maximum")
+	}
+	return nil
+}
+
+// PBKDF2Parameters are the parameters of PBKDF2.
+type PBKDF2Parameters struct {
+	// Digest is the HMAC digest, one of DigestSHA1, DigestSHA256 or DigestSHA512.
+	Digest string
+	// Iterations is the number of iterations.
+	Iterations int
+	// SaltLength is the length of the random salt in bytes.
+	SaltLength int
+	// KeyLength is the length of the derived key in bytes.
+	KeyLength int
+}
+
+// MakeVerification will hash the supplied pass argument using the hashing mechanism, with the DefaultHashParameters.
+// The digest methods are not peppered, the CredentaDB hashes with its own peppers and parameters, see
+// CredentaDB.EnablePepper and CredentaDB.SetHashParameters.
 func MakeVerification(method VerificationMethod, pass string) (string, error) {
+	return makeVerification(method, pass, nil, nil)
+}
+
+// makeVerification is MakeVerification with the digest methods peppered by peppers, nil for no pepper, and the
+// params, nil for the DefaultHashParameters.
+func makeVerification(method VerificationMethod, pass string, peppers *PepperRing, params *HashParameters) (string, error) {
+	if params == nil {
+		params = DefaultHashParameters()
+	}
 	switch method {
 	case VerificationMethodPLAIN:
 		return makePlain(pass)
-	case VerificationMethodMD5:
-		return makeMD5(pass)
-	case VerificationMethodSHA1:
-		return makeSHA1(pass)
-	case VerificationMethodSHA256:
-		return makeSHA256(pass)
-	case VerificationMethodSHA512:
-		return makeSHA512(pass)
+	case VerificationMethodMD5, VerificationMethodSHA1, VerificationMethodSHA256, VerificationMethodSHA512:
+		return makeDigest(method, pass, peppers)
 	case VerificationMethodARGON:
-		return makeARGON(pass)
+		return makeARGON(pass, params.Argon)
+	case VerificationMethodBCRYPT:
+		return makeBCRYPT(pass, params.BcryptCost)
+	case VerificationMethodSCRYPT:
+		return makeSCRYPT(pass, params.Scrypt)
+	case VerificationMethodPBKDF2:
+		return makePBKDF2(pass, params.PBKDF2)
 	default:
 		return "", errors.New("unknown verification method")
 	}
 }
 
 // MatchVerification will return true if the hash of password match to the hashed password, depends on the hasing method
-// used when creating the password hash on the first place (MakeVerification)
+// used when creating the password hash on the first place (MakeVerification). Peppered digests never match.
 func MatchVerification(method VerificationMethod, pass, hash string) bool {
+	return matchVerification(method, pass, hash, nil)
+}
+
+// matchVerification is MatchVerification with the peppered digests verified by peppers, nil for no pepper.
+func matchVerification(method VerificationMethod, pass, hash string, peppers *PepperRing) bool {
 	switch method {
 	case VerificationMethodPLAIN:
 		return matchPLAIN(pass, hash)
-	case VerificationMethodMD5:
-		return matchMD5(pass, hash)
-	case VerificationMethodSHA1:
-		return matchSHA1(pass, hash)
-	case VerificationMethodSHA256:
-		return matchSHA256(pass, hash)
-	case VerificationMethodSHA512:
-		return matchSHA512(pass, hash)
+	case VerificationMethodMD5, VerificationMethodSHA1, VerificationMethodSHA256, VerificationMethodSHA512:
+		return matchDigest(method, pass, hash, peppers)
 	case VerificationMethodARGON:
 		return matchARGON(pass, hash)
+	case VerificationMethodBCRYPT:
+		return matchBCRYPT(pass, hash)
+	case VerificationMethodSCRYPT:
+		return matchSCRYPT(pass, hash)
+	case VerificationMethodPBKDF2:
+		return matchPBKDF2(pass, hash)
+	default:
+		return false
+	}
+}
+
+// NeedsRehash returns true if the hash made with method should be made again with the preferred method, because
+// the method is not the preferred one, its parameters are weaker than the DefaultHashParameters, or it is a digest in
+// the legacy format or peppered. The CredentaDB compares with its own parameters, and also reports the digests not
+// made with its primary pepper, see CredentaDB.SetHashParameters and CredentaDB.EnablePepper.
+func NeedsRehash(method VerificationMethod, hash string, preferred VerificationMethod) bool {
+	return needsRehash(method, hash, preferred, nil, nil)
+}
+
+// needsRehash is NeedsRehash with the digests expected to be made with the primary pepper of peppers, nil for no
+// pepper, and the hashes compared with params, nil for the DefaultHashParameters.
+func needsRehash(method VerificationMethod, hash string, preferred VerificationMethod, peppers *PepperRing, params *HashParameters) bool {
+	if method != preferred {
+		return true
+	}
+	if params == nil {
+		params = DefaultHashParameters()
+	}
+	switch method {
+	case VerificationMethodMD5, VerificationMethodSHA1, VerificationMethodSHA256, VerificationMethodSHA512:
+		id, _ := digestFunction(method)
+		values, _, _, err := decodePHC(hash, id)
+		if err != nil {
+			return true
+		}
+		primary := ""
+		if peppers != nil {
+			primary = peppers.primary
+		}
+		return values["k"] != primary
+	case VerificationMethodARGON:
+		hashParams, _, _, err := argon2id.DecodeHash(hash)
+		if err != nil || checkARGON(hashParams) != nil {
+			return true
+		}
+		argon := params.Argon
+		return hashParams.Memory < argon.Memory || hashParams.Iterations < argon.Iterations ||
+			hashParams.Parallelism < argon.Parallelism || hashParams.SaltLength < argon.SaltLength ||
+			hashParams.KeyLength < argon.KeyLength
+	case VerificationMethodBCRYPT:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < params.BcryptCost
+	case VerificationMethodSCRYPT:
+		hashParams, salt, key, err := decodeSCRYPT(hash)
+		if err != nil {
+			return true
+		}
+		scryptParams := params.Scrypt
+		return hashParams.LogN < scryptParams.LogN || hashParams.R < scryptParams.R || hashParams.P < scryptParams.P ||
+			len(salt) < scryptParams.SaltLength || len(key) < scryptParams.KeyLength
+	case VerificationMethodPBKDF2:
+		hashParams, salt, key, err := decodePBKDF2(hash)
+		if err != nil {
+			return true
+		}
+		pbkdf2Params := params.PBKDF2
+		return hashParams.Digest != pbkdf2Params.Digest || hashParams.Iterations < pbkdf2Params.Iterations ||
+			len(salt) < pbkdf2Params.SaltLength || len(key) < pbkdf2Params.KeyLength
+	default:
+		return false
+	}
+}
+
+// knownVerificationMethod returns true if the method is supported by MakeVerification.
+func knownVerificationMethod(method VerificationMethod) bool {
+	switch method {
+	case VerificationMethodPLAIN, VerificationMethodMD5, VerificationMethodSHA1, VerificationMethodSHA256,
+		VerificationMethodSHA512, VerificationMethodARGON, VerificationMethodBCRYPT, VerificationMethodSCRYPT,
+		VerificationMethodPBKDF2:
+		return true
 	default:
 		return false
 	}
@@ -83,86 +335,262 @@ func matchPLAIN(pass, hash string) bool {
 	return pass == hash
 }
 
-func makeMD5(pass string) (string, error) {
+// digestSaltLength is the length of the random salt of the digest verification methods in bytes.
+const digestSaltLength = 16
+
+// digestFunction returns the PHC id and the hash function of the digest verification method.
+func digestFunction(method VerificationMethod) (string, func() hash.Hash) {
+	switch method {
+	case VerificationMethodMD5:
+		return "md5", md5.New
+	case VerificationMethodSHA1:
+		return "sha1", sha1.New
+	case VerificationMethodSHA256:
+		return "sha256", sha256.New
+	default:
+		return "sha512", sha512.New
+	}
+}
+
+// makeDigest hashes the random salt followed by the pass with the digest of the method, or with its HMAC keyed by the
+// primary pepper of peppers when not nil, and returns it in the PHC string format, `$sha256$salt$hash` or
+// `$sha256$k=pepperid$salt$hash`.
+func makeDigest(method VerificationMethod, pass string, peppers *PepperRing) (string, error) {
 	if len(pass) == 0 {
 		return "", fmt.Errorf("password too short")
 	}
-	hasher := md5.New()
-	result := hasher.Sum([]byte(pass))
-	return hex.EncodeToString(result), nil
+	id, digest := digestFunction(method)
+	salt := make([]byte, digestSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	params := ""
+	hasher := digest()
+	if peppers != nil {
+		params = "$k=" + peppers.primary
+		hasher = hmac.New(digest, peppers.keys[peppers.primary])
+	}
+	hasher.Write(salt)
+	hasher.Write([]byte(pass))
+	return fmt.Sprintf("$%s%s$%s$%s", id, params, base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hasher.Sum(nil))), nil
 }
 
-func matchMD5(pass, hash string) bool {
-	hashed, err := makeMD5(pass)
+// matchDigest verifies the pass against a hash made by makeDigest, or against a hash in the legacy format made by
+// the older versions (see legacyDigest). Peppered hashes are verified with the pepper of the same id in peppers.
+func matchDigest(method VerificationMethod, pass, hash string, peppers *PepperRing) bool {
+	id, digest := digestFunction(method)
+	if !strings.HasPrefix(hash, "$") {
+		return len(pass) > 0 && subtle.ConstantTimeCompare([]byte(legacyDigest(digest, pass)), []byte(hash)) == 1
+	}
+	values, salt, key, err := decodePHC(hash, id)
 	if err != nil {
 		return false
 	}
-	return hashed == hash
+	hasher := digest()
+	if keyID, ok := values["k"]; ok {
+		if peppers == nil || peppers.keys[keyID] == nil {
+			return false
+		}
+		hasher = hmac.New(digest, peppers.keys[keyID])
+	}
+	hasher.Write(salt)
+	hasher.Write([]byte(pass))
+	return subtle.ConstantTimeCompare(hasher.Sum(nil), key) == 1
 }
 
-func makeSHA1(pass string) (string, error) {
-	if len(pass) == 0 {
-		return "", fmt.Errorf("password too short")
+// legacyDigest returns the hash of the digest methods made by the older versions. It is the hex encoding of the pass
+// followed by the digest of nothing, thus it is neither salted nor even a digest of the pass, and it is only kept to
+// verify the existing hashes until they are made again (see NeedsRehash).
+func legacyDigest(digest func() hash.Hash, pass string) string {
+	return hex.EncodeToString(digest().Sum([]byte(pass)))
+}
+
+func makeARGON(pass string, params argon2id.Params) (string, error) {
+	hash, err := argon2id.CreateHash(pass, &params)
+	if err != nil {
+		return "", err
 	}
-	hasher := sha1.New()
-	result := hasher.Sum([]byte(pass))
-	return hex.EncodeToString(result), nil
+	return hash, nil
 }
 
-func matchSHA1(pass, hash string) bool {
-	hashed, err := makeSHA1(pass)
+func matchARGON(pass, hash string) bool {
+	if checkHash(VerificationMethodARGON, hash) != nil {
+		return false
+	}
+	match, err := argon2id.ComparePasswordAndHash(pass, hash)
 	if err != nil {
 		return false
 	}
-	return hashed == hash
+	return match
+}
+
+func makeBCRYPT(pass string, cost int) (string, error) {
+	if len(pass) == 0 {
+		return "", fmt.Errorf("password too short")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func matchBCRYPT(pass, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
 }
 
-func makeSHA256(pass string) (string, error) {
+func makeSCRYPT(pass string, params ScryptParameters) (string, error) {
 	if len(pass) == 0 {
 		return "", fmt.Errorf("password too short")
 	}
-	hasher := sha256.New()
-	result := hasher.Sum([]byte(pass))
-	return hex.EncodeToString(result), nil
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(pass), salt, 1<<params.LogN, params.R, params.P, params.KeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", params.LogN, params.R, params.P,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
-func matchSHA256(pass, hash string) bool {
-	hashed, err := makeSHA256(pass)
+func matchSCRYPT(pass, hash string) bool {
+	params, salt, key, err := decodeSCRYPT(hash)
 	if err != nil {
 		return false
 	}
-	return hashed == hash
+	other, err := scrypt.Key([]byte(pass), salt, 1<<params.LogN, params.R, params.P, len(key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// decodeSCRYPT returns the parameters, salt and key of a scrypt hash in the PHC string format.
+func decodeSCRYPT(hash string) (*ScryptParameters, []byte, []byte, error) {
+	values, salt, key, err := decodePHC(hash, "scrypt")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	params := &ScryptParameters{LogN: phcInt(values, "ln"), R: phcInt(values, "r"), P: phcInt(values, "p"), SaltLength: len(salt), KeyLength: len(key)}
+	if err := params.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
 }
 
-func makeSHA512(pass string) (string, error) {
+func makePBKDF2(pass string, params PBKDF2Parameters) (string, error) {
 	if len(pass) == 0 {
 		return "", fmt.Errorf("password too short")
 	}
-	hasher := sha512.New()
-	result := hasher.Sum([]byte(pass))
-	return hex.EncodeToString(result), nil
+	digest, err := pbkdf2Digest(params.Digest)
+	if err != nil {
+		return "", err
+	}
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(pass), salt, params.Iterations, params.KeyLength, digest)
+	return fmt.Sprintf("$pbkdf2-%s$i=%d,l=%d$%s$%s", params.Digest, params.Iterations, params.KeyLength,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
-func matchSHA512(pass, hash string) bool {
-	hashed, err := makeSHA512(pass)
+func matchPBKDF2(pass, hash string) bool {
+	params, salt, key, err := decodePBKDF2(hash)
 	if err != nil {
 		return false
 	}
-	return hashed == hash
+	digest, err := pbkdf2Digest(params.Digest)
+	if err != nil {
+		return false
+	}
+	other := pbkdf2.Key([]byte(pass), salt, params.Iterations, len(key), digest)
+	return subtle.ConstantTimeCompare(key, other) == 1
 }
 
-func makeARGON(pass string) (string, error) {
-	hash, err := argon2id.CreateHash(pass, argon2id.DefaultParams)
+// decodePBKDF2 returns the parameters, salt and key of a PBKDF2 hash in the PHC string format.
+func decodePBKDF2(hash string) (*PBKDF2Parameters, []byte, []byte, error) {
+	parts := strings.SplitN(hash, "$", 3)
+	if len(parts) < 3 || !strings.HasPrefix(parts[1], "pbkdf2-") {
+		return nil, nil, nil, errors.New("invalid pbkdf2 hash")
+	}
+	digest := strings.TrimPrefix(parts[1], "pbkdf2-")
+	values, salt, key, err := decodePHC(hash, parts[1])
 	if err != nil {
-		return "", err
+		return nil, nil, nil, err
 	}
-	return hash, nil
+	params := &PBKDF2Parameters{Digest: digest, Iterations: phcInt(values, "i"), SaltLength: len(salt), KeyLength: len(key)}
+	if err := params.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
 }
 
-func matchARGON(pass, hash string) bool {
-	match, err := argon2id.ComparePasswordAndHash(pass, hash)
+// pbkdf2Digest returns the hash function of the PBKDF2 digest.
+func pbkdf2Digest(digest string) (func() hash.Hash, error) {
+	switch digest {
+	case DigestSHA1:
+		return sha1.New, nil
+	case DigestSHA256:
+		return sha256.New, nil
+	case DigestSHA512:
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unknown pbkdf2 digest %q", digest)
+	}
+}
+
+// check returns an error if the parameters are not positive or exceed the caps. The digest is not checked.
+func (params *PBKDF2Parameters) check() error {
+	if params.Iterations <= 0 || params.SaltLength < 0 || params.KeyLength <= 0 {
+		return errors.New("invalid pbkdf2 parameters")
+	}
+	if params.Iterations > maxPBKDF2Iterations || params.SaltLength > maxHashKeyLength || params.KeyLength > maxHashKeyLength {
+		return errors.New("pbkdf2 parameters exceed the allowed maximum")
+	}
+	return nil
+}
+
+// decodePHC decodes a hash in the PHC string format `$id[$v=version][$name=value,...]$salt$key`, whose salt and key
+// are base64 encoded without padding. The version, if any, is returned as the parameter `v`.
+func decodePHC(hash, id string) (map[string]string, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 4 || len(parts) > 6 || parts[0] != "" || parts[1] != id {
+		return nil, nil, nil, fmt.Errorf("invalid %s hash", id)
+	}
+	values := make(map[string]string)
+	fields := parts[2 : len(parts)-2]
+	if len(fields) == 2 && !strings.HasPrefix(fields[0], "v=") {
+		return nil, nil, nil, fmt.Errorf("invalid %s hash", id)
+	}
+	for _, field := range fields {
+		for _, param := range strings.Split(field, ",") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok || name == "" {
+				return nil, nil, nil, fmt.Errorf("invalid %s hash parameter %q", id, param)
+			}
+			values[name] = value
+		}
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[len(parts)-2])
 	if err != nil {
-		return false
+		return nil, nil, nil, fmt.Errorf("invalid %s hash salt: %w", id, err)
 	}
-	return match
+	key, err := base64.RawStdEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid %s hash key", id)
+	}
+	return values, salt, key, nil
+}
+
+// phcInt returns the integer value of the PHC parameter, or zero if it is missing or not an integer.
+func phcInt(values map[string]string, name string) int {
+	value, err := strconv.Atoi(values[name])
+	if err != nil {
+		return 0
+	}
+	return value
 }
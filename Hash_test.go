@@ -1,8 +1,12 @@
 package credenta
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -38,4 +42,204 @@ func TestMakeVerification(t *testing.T) {
 	assert.NoError(t, err)
 	fmt.Println(hash)
 	assert.True(t, MatchVerification(VerificationMethodARGON, pass, hash))
+
+	hash, err = MakeVerification(VerificationMethodBCRYPT, pass)
+	assert.NoError(t, err)
+	fmt.Println(hash)
+	assert.True(t, MatchVerification(VerificationMethodBCRYPT, pass, hash))
+	assert.False(t, MatchVerification(VerificationMethodBCRYPT, "wrong", hash))
+
+	hash, err = MakeVerification(VerificationMethodSCRYPT, pass)
+	assert.NoError(t, err)
+	fmt.Println(hash)
+	assert.True(t, MatchVerification(VerificationMethodSCRYPT, pass, hash))
+	assert.False(t, MatchVerification(VerificationMethodSCRYPT, "wrong", hash))
+
+	hash, err = MakeVerification(VerificationMethodPBKDF2, pass)
+	assert.NoError(t, err)
+	fmt.Println(hash)
+	assert.True(t, MatchVerification(VerificationMethodPBKDF2, pass, hash))
+	assert.False(t, MatchVerification(VerificationMethodPBKDF2, "wrong", hash))
+}
+
+func TestMatchVerification_ImportedHashes(t *testing.T) {
+	// hashes made by other implementations.
+	imported := map[string]VerificationMethod{
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW":                                  VerificationMethodBCRYPT,
+		"$scrypt$ln=10,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$ZEBCzLptWM7dhpNJDU2HbQ945ovKHmVEozHkePPbSqw":      VerificationMethodSCRYPT,
+		"$pbkdf2-sha1$i=1000,l=32$MDEyMzQ1Njc4OWFiY2RlZg$DYW+LTZG5wxyiF/qvsh40/+/hXltzAbMKUtORrf6q3M":   VerificationMethodPBKDF2,
+		"$pbkdf2-sha256$i=1000,l=32$MDEyMzQ1Njc4OWFiY2RlZg$hRRjgXWkW8ResfIvBP99J/T4vkgEmMRV/0tJTOjR59I": VerificationMethodPBKDF2,
+		"$pbkdf2-sha512$i=1000,l=32$MDEyMzQ1Njc4OWFiY2RlZg$38DzhdBT7fPaUGBlsh42VTuuKSFAIYGZJ7l6feCDLIk": VerificationMethodPBKDF2,
+	}
+	for hash, method := range imported {
+		pass := "password"
+		if method == VerificationMethodBCRYPT {
+			pass = "U*U"
+		}
+		assert.True(t, MatchVerification(method, pass, hash), hash)
+		assert.False(t, MatchVerification(method, "wrong", hash), hash)
+		assert.True(t, NeedsRehash(method, hash, method), "%s is weaker than the default parameters", hash)
+	}
+	assert.False(t, MatchVerification(VerificationMethodPBKDF2, "password", "$pbkdf2-md5$i=1000$MDEyMzQ1Njc4OWFiY2RlZg$DYW+LTZG5wxyiF"))
+	assert.False(t, MatchVerification(VerificationMethodSCRYPT, "password", "$scrypt$ln=10$bad"))
+}
+
+func TestMatchVerification_HashLimits(t *testing.T) {
+	salt, key := "MDEyMzQ1Njc4OWFiY2RlZg", "DYW+LTZG5wxyiFLYdBb4Li7HX4c5gzYk0Q6GPLyzn3A"
+	longKey := base64.RawStdEncoding.EncodeToString(make([]byte, maxHashKeyLength+1))
+	for method, hashes := range map[VerificationMethod][]string{
+		VerificationMethodSCRYPT: {
+			"$scrypt$ln=21,r=8,p=1$" + salt + "$" + key,
+			"$scrypt$ln=15,r=33,p=1$" + salt + "$" + key,
+			"$scrypt$ln=15,r=8,p=17$" + salt + "$" + key,
+			"$scrypt$ln=20,r=16,p=1$" + salt + "$" + key,
+			"$scrypt$ln=15,r=8,p=1$" + salt + "$" + longKey,
+		},
+		VerificationMethodPBKDF2: {
+			"$pbkdf2-sha256$i=10000001$" + salt + "$" + key,
+			"$pbkdf2-sha256$i=1000$" + salt + "$" + longKey,
+		},
+		VerificationMethodARGON: {
+			"$argon2id$v=19$m=2097152,t=1,p=2$" + salt + "$" + key,
+			"$argon2id$v=19$m=65536,t=65,p=2$" + salt + "$" + key,
+		},
+	} {
+		for _, hash := range hashes {
+			// the hash is rejected before deriving any key, so the test does not take the memory nor the time.
+			assert.Error(t, checkHash(method, hash), hash)
+			assert.False(t, MatchVerification(method, "password", hash), hash)
+			assert.True(t, NeedsRehash(method, hash, method), hash)
+		}
+	}
+	assert.NoError(t, checkHash(VerificationMethodSCRYPT, "$scrypt$ln=20,r=8,p=1$"+salt+"$"+key))
+	assert.NoError(t, checkHash(VerificationMethodPBKDF2, "$pbkdf2-sha256$i=10000000$"+salt+"$"+key))
+
+	params := DefaultHashParameters()
+	params.PBKDF2.Iterations = maxPBKDF2Iterations + 1
+	assert.Error(t, params.validate())
+	params = DefaultHashParameters()
+	params.Scrypt.LogN = maxScryptLogN + 1
+	assert.Error(t, params.validate())
+	params = DefaultHashParameters()
+	params.Argon.Memory = 4 << 20
+	assert.Error(t, params.validate())
+}
+
+func TestMakeVerification_Params(t *testing.T) {
+	params := DefaultHashParameters()
+	params.BcryptCost = 4
+	params.Scrypt = ScryptParameters{LogN: 10, R: 8, P: 1, SaltLength: 8, KeyLength: 16}
+	params.PBKDF2 = PBKDF2Parameters{Digest: DigestSHA512, Iterations: 1000, SaltLength: 8, KeyLength: 64}
+	for _, method := range []VerificationMethod{VerificationMethodBCRYPT, VerificationMethodSCRYPT, VerificationMethodPBKDF2} {
+		hash, err := makeVerification(method, "password", nil, params)
+		assert.NoError(t, err)
+		assert.True(t, MatchVerification(method, "password", hash))
+		assert.False(t, needsRehash(method, hash, method, nil, params))
+		assert.True(t, NeedsRehash(method, hash, method), "%s is weaker than the default parameters", hash)
+	}
+	hash, err := makeVerification(VerificationMethodPBKDF2, "password", nil, params)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$pbkdf2-sha512$i=1000,l=64$"))
+
+	// raising the parameters makes the existing hashes weaker.
+	params.PBKDF2.Digest = DigestSHA256
+	assert.True(t, needsRehash(VerificationMethodPBKDF2, hash, VerificationMethodPBKDF2, nil, params))
+	params.PBKDF2.Digest = "md5"
+	_, err = makeVerification(VerificationMethodPBKDF2, "password", nil, params)
+	assert.Error(t, err)
+	assert.Error(t, params.validate())
+
+	_, err = MakeVerification(VerificationMethodBCRYPT, strings.Repeat("x", 73))
+	assert.Error(t, err, "bcrypt rejects passwords longer than 72 bytes")
+}
+
+func TestMakeVerification_SaltedDigest(t *testing.T) {
+	first, err := MakeVerification(VerificationMethodSHA256, "password")
+	assert.NoError(t, err)
+	second, err := MakeVerification(VerificationMethodSHA256, "password")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second, "the same password must not give the same hash")
+
+	parts := strings.Split(first, "$")
+	if assert.Len(t, parts, 4) {
+		assert.Equal(t, "sha256", parts[1])
+		salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+		assert.NoError(t, err)
+		assert.Len(t, salt, 16)
+		digest := sha256.Sum256(append(salt, "password"...))
+		assert.Equal(t, base64.RawStdEncoding.EncodeToString(digest[:]), parts[3])
+	}
+	assert.True(t, MatchVerification(VerificationMethodSHA256, "password", first))
+	assert.False(t, MatchVerification(VerificationMethodSHA256, "wrong", first))
+	assert.False(t, MatchVerification(VerificationMethodSHA512, "password", first))
+	assert.False(t, NeedsRehash(VerificationMethodSHA256, first, VerificationMethodSHA256))
+
+	for _, method := range []VerificationMethod{VerificationMethodMD5, VerificationMethodSHA1, VerificationMethodSHA512} {
+		hash, err := MakeVerification(method, "password")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(hash, "$"+strings.ToLower(string(method))+"$"), hash)
+		assert.True(t, MatchVerification(method, "password", hash))
+		assert.False(t, MatchVerification(method, "wrong", hash))
+	}
+	for _, malformed := range []string{"$sha256$", "$sha256$salt", "$sha256$!!$!!", "$sha256$k=p1$x=1$c2FsdA$aGFzaA", "$md5$c2FsdA$aGFzaA"} {
+		assert.False(t, MatchVerification(VerificationMethodSHA256, "password", malformed), malformed)
+	}
+	_, err = MakeVerification(VerificationMethodSHA256, "")
+	assert.Error(t, err)
+}
+
+func TestMatchVerification_LegacyDigest(t *testing.T) {
+	// hashes made by the older versions, the hex of the password followed by the digest of nothing.
+	legacy := map[VerificationMethod]string{
+		VerificationMethodMD5:  "70617373776f7264d41d8cd98f00b204e9800998ecf8427e",
+		VerificationMethodSHA1: "70617373776f7264da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	}
+	for method, hash := range legacy {
+		assert.True(t, MatchVerification(method, "password", hash), hash)
+		assert.False(t, MatchVerification(method, "wrong", hash), hash)
+		assert.True(t, NeedsRehash(method, hash, method), "%s is in the legacy format", hash)
+	}
+}
+
+func TestMakeVerification_Pepper(t *testing.T) {
+	unpeppered, err := MakeVerification(VerificationMethodSHA256, "password")
+	assert.NoError(t, err)
+
+	peppers, err := ParsePepperRing("p1:" + testKey(1))
+	assert.NoError(t, err)
+	first, err := makeVerification(VerificationMethodSHA256, "password", peppers, nil)
+	assert.NoError(t, err)
+	parts := strings.Split(first, "$")
+	if assert.Len(t, parts, 5) {
+		assert.Equal(t, "k=p1", parts[2])
+		salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+		assert.NoError(t, err)
+		mac := hmac.New(sha256.New, []byte(strings.Repeat("\x01", 32)))
+		mac.Write(salt)
+		mac.Write([]byte("password"))
+		assert.Equal(t, base64.RawStdEncoding.EncodeToString(mac.Sum(nil)), parts[4])
+	}
+	assert.True(t, matchVerification(VerificationMethodSHA256, "password", first, peppers))
+	assert.False(t, matchVerification(VerificationMethodSHA256, "wrong", first, peppers))
+	assert.False(t, needsRehash(VerificationMethodSHA256, first, VerificationMethodSHA256, peppers, nil))
+	// the hashes made before the pepper was set are still verified, and made again.
+	assert.True(t, matchVerification(VerificationMethodSHA256, "password", unpeppered, peppers))
+	assert.True(t, needsRehash(VerificationMethodSHA256, unpeppered, VerificationMethodSHA256, peppers, nil))
+
+	// after a rotation, the hashes made with the old pepper are still verified, and made again.
+	peppers, err = ParsePepperRing("p2:" + testKey(2) + ",p1:" + testKey(1))
+	assert.NoError(t, err)
+	second, err := makeVerification(VerificationMethodSHA256, "password", peppers, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(second, "$sha256$k=p2$"))
+	assert.True(t, matchVerification(VerificationMethodSHA256, "password", first, peppers))
+	assert.True(t, needsRehash(VerificationMethodSHA256, first, VerificationMethodSHA256, peppers, nil))
+	assert.False(t, needsRehash(VerificationMethodSHA256, second, VerificationMethodSHA256, peppers, nil))
+
+	// without the pepper, the hash can not be verified.
+	peppers, err = ParsePepperRing("p2:" + testKey(2))
+	assert.NoError(t, err)
+	assert.False(t, matchVerification(VerificationMethodSHA256, "password", first, peppers))
+	assert.False(t, MatchVerification(VerificationMethodSHA256, "password", second))
+	assert.True(t, NeedsRehash(VerificationMethodSHA256, second, VerificationMethodSHA256))
 }
@@ -0,0 +1,322 @@
+package credenta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// auxHistoryBucket is the auxiliary record bucket of the change history, keyed `realm, kind, key, sequence` where
+	// the sequence is made of the change time and version, so entries are scanned in chronological order.
+	auxHistoryBucket = "history"
+	// redactedValue replace the value of sensitive fields in the history.
+	redactedValue = "[REDACTED]"
+)
+
+// HistoryEntry is a change of a user or group, saved or deleted through CredentaDB.
+type HistoryEntry struct {
+	Kind  RecordKind `json:"kind"`
+	Realm string     `json:"realm"`
+	// Key is the user id or the group name.
+	Key string `json:"key"`
+	// Version is the version of the record once changed.
+	Version   uint64         `json:"version"`
+	Op        ChangeOp       `json:"op"`
+	ChangedAt time.Time      `json:"changedAt"`
+	ChangedBy string         `json:"changedBy"`
+	Changes   []*FieldChange `json:"changes,omitempty"`
+	// User is the user once changed, without its verification hash. It is nil when the user was deleted.
+	User *CUser `json:"user,omitempty"`
+	// Group is the group once changed. It is nil when the group was deleted.
+	Group *CGroup `json:"group,omitempty"`
+}
+
+// FieldChange is the change of a single field of a record. Attributes are named `attribute.<name>`, roles are the
+// comma separated sequences of the roles that are on. Sensitive fields have their values redacted.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// EnableHistory turn on the change history. Once enabled, every save and delete of users and groups through this
+// CredentaDB append an entry to the history of the record, see ListHistory, GetUserAsOf and RevertUser.
+// It should be called before the CredentaDB is used concurrently. It returns ErrAuxNotSupported if the Store does
+// not implement AuxStore.
+func (store *CredentaDB) EnableHistory() error {
+	if _, err := store.auxStore(); err != nil {
+		return err
+	}
+	store.history = true
+	return nil
+}
+
+// DisableHistory turn off the change history, the recorded entries are kept.
+func (store *CredentaDB) DisableHistory() {
+	store.history = false
+}
+
+// ListHistory returns the history entries of a user (kind RecordUser, key is the id) or group (kind RecordGroup,
+// key is the name), oldest first.
+func (store *CredentaDB) ListHistory(ctx context.Context, kind RecordKind, realm, key string) ([]*HistoryEntry, error) {
+	if realm == "" || key == "" {
+		return nil, errors.New("in ListHistory function. realm and key are required")
+	}
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*HistoryEntry, 0)
+	err = aux.ScanAux(ctx, auxHistoryBucket, auxPrefix(realm, string(kind), key), func(auxKey string, data []byte) error {
+		entry := &HistoryEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return fmt.Errorf("error unmarshalling history entry %q: %w", auxKey, err)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in ListHistory function. error reading history of %s %s: %w", kind, key, err)
+	}
+	return entries, nil
+}
+
+// GetUserAsOf returns the user as it was at the specified time, without its verification hash. It returns an error
+// that satisfy errors.Is(err, ErrNotFound) if the user did not exist at that time, or if its history does not go
+// back that far.
+func (store *CredentaDB) GetUserAsOf(ctx context.Context, realm, id string, at time.Time) (*CUser, error) {
+	entry, err := store.historyAsOf(ctx, RecordUser, realm, id, at)
+	if err != nil {
+		return nil, fmt.Errorf("in GetUserAsOf function. %w", err)
+	}
+	return entry.User, nil
+}
+
+// GetGroupAsOf returns the group as it was at the specified time. It returns an error that satisfy
+// errors.Is(err, ErrNotFound) if the group did not exist at that time, or if its history does not go back that far.
+func (store *CredentaDB) GetGroupAsOf(ctx context.Context, realm, name string, at time.Time) (*CGroup, error) {
+	entry, err := store.historyAsOf(ctx, RecordGroup, realm, name, at)
+	if err != nil {
+		return nil, fmt.Errorf("in GetGroupAsOf function. %w", err)
+	}
+	return entry.Group, nil
+}
+
+// RevertUser save the user back as it was in the specified version, which becomes a new version. The verification
+// method and hash are not part of the history, so the current password is kept.
+func (store *CredentaDB) RevertUser(ctx context.Context, realm, id string, version uint64) (*CUser, error) {
+	entry, err := store.historyVersion(ctx, RecordUser, realm, id, version)
+	if err != nil {
+		return nil, fmt.Errorf("in RevertUser function. %w", err)
+	}
+	var reverted *CUser
+	err = store.Update(ctx, realm, id, func(user *CUser) error {
+		old := entry.User.clone()
+		user.IDType = old.IDType
+		user.Groups = old.Groups
+		user.Attributes = old.Attributes
+		user.RoleMasks = old.RoleMasks
+		user.Enable = old.Enable
+		user.Active = old.Active
+		reverted = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// RevertGroup save the group back as it was in the specified version, which becomes a new version.
+func (store *CredentaDB) RevertGroup(ctx context.Context, realm, name string, version uint64) (*CGroup, error) {
+	entry, err := store.historyVersion(ctx, RecordGroup, realm, name, version)
+	if err != nil {
+		return nil, fmt.Errorf("in RevertGroup function. %w", err)
+	}
+	var reverted *CGroup
+	err = store.UpdateGroup(ctx, realm, name, func(group *CGroup) error {
+		old := entry.Group.clone()
+		group.ParentGroups = old.ParentGroups
+		group.Attributes = old.Attributes
+		group.RoleMasks = old.RoleMasks
+		reverted = group
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// historyAsOf returns the latest history entry of the record changed at or before the specified time.
+func (store *CredentaDB) historyAsOf(ctx context.Context, kind RecordKind, realm, key string, at time.Time) (*HistoryEntry, error) {
+	entries, err := store.ListHistory(ctx, kind, realm, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ChangedAt.After(at) {
+			continue
+		}
+		if entries[i].Op == ChangeDeleted {
+			break
+		}
+		return entries[i], nil
+	}
+	return nil, fmt.Errorf("%s %s of realm %s as of %s: %w", kind, key, realm, at.Format(time.RFC3339), ErrNotFound)
+}
+
+// historyVersion returns the latest history entry of the record in the specified version, which is not a deletion.
+func (store *CredentaDB) historyVersion(ctx context.Context, kind RecordKind, realm, key string, version uint64) (*HistoryEntry, error) {
+	entries, err := store.ListHistory(ctx, kind, realm, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Version == version && entries[i].Op != ChangeDeleted {
+			return entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%s %s of realm %s version %d: %w", kind, key, realm, version, ErrNotFound)
+}
+
+// recordUserHistory append the history entry of the user changed from oldUser to newUser, either may be nil when
+// the user is created or deleted. Nothing is recorded if the history is not enabled.
+func (store *CredentaDB) recordUserHistory(ctx context.Context, oldUser, newUser *CUser) error {
+	if !store.history {
+		return nil
+	}
+	entry := &HistoryEntry{
+		Kind:      RecordUser,
+		ChangedBy: ctx.Value(ETX_USER).(string),
+		Changes:   diffFields(userFields(oldUser), userFields(newUser)),
+	}
+	if newUser == nil {
+		entry.Realm, entry.Key, entry.Version = oldUser.Realm, oldUser.Id, oldUser.Version
+		entry.Op, entry.ChangedAt = ChangeDeleted, time.Now()
+	} else {
+		entry.Realm, entry.Key, entry.Version = newUser.Realm, newUser.Id, newUser.Version
+		entry.Op, entry.ChangedAt = ChangeModified, newUser.UpdatedAt
+		if oldUser == nil {
+			entry.Op = ChangeAdded
+		}
+		entry.User = newUser.clone()
+		entry.User.VerificationHash = ""
+	}
+	return store.putHistory(ctx, entry)
+}
+
+// recordGroupHistory append the history entry of the group changed from oldGroup to newGroup, either may be nil
+// when the group is created or deleted. Nothing is recorded if the history is not enabled.
+func (store *CredentaDB) recordGroupHistory(ctx context.Context, oldGroup, newGroup *CGroup) error {
+	if !store.history {
+		return nil
+	}
+	entry := &HistoryEntry{
+		Kind:      RecordGroup,
+		ChangedBy: ctx.Value(ETX_USER).(string),
+		Changes:   diffFields(groupFields(oldGroup), groupFields(newGroup)),
+	}
+	if newGroup == nil {
+		entry.Realm, entry.Key, entry.Version = oldGroup.Realm, oldGroup.Name, oldGroup.Version
+		entry.Op, entry.ChangedAt = ChangeDeleted, time.Now()
+	} else {
+		entry.Realm, entry.Key, entry.Version = newGroup.Realm, newGroup.Name, newGroup.Version
+		entry.Op, entry.ChangedAt = ChangeModified, newGroup.UpdatedAt
+		if oldGroup == nil {
+			entry.Op = ChangeAdded
+		}
+		entry.Group = newGroup.clone()
+	}
+	return store.putHistory(ctx, entry)
+}
+
+func (store *CredentaDB) putHistory(ctx context.Context, entry *HistoryEntry) error {
+	aux, err := store.auxStore()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("in putHistory function. error marshalling history entry: %w", err)
+	}
+	sequence := fmt.Sprintf("%020d-%020d", entry.ChangedAt.UnixNano(), entry.Version)
+	if err := aux.PutAux(ctx, auxHistoryBucket, auxKey(entry.Realm, string(entry.Kind), entry.Key, sequence), data); err != nil {
+		return fmt.Errorf("in putHistory function. error writing history entry: %w", err)
+	}
+	return nil
+}
+
+// userFields returns the fields of the user tracked by the history, an empty map for nil.
+func userFields(user *CUser) map[string]string {
+	fields := make(map[string]string)
+	if user == nil {
+		return fields
+	}
+	groups := append([]string{}, user.Groups...)
+	sort.Strings(groups)
+	fields["idType"] = string(user.IDType)
+	fields["groups"] = strings.Join(groups, ",")
+	fields["roles"] = formatRoles(roleSequences(user.RoleMasks))
+	fields["enable"] = strconv.FormatBool(user.Enable)
+	fields["active"] = strconv.FormatBool(user.Active)
+	fields["method"] = string(user.VerificationMethod)
+	fields["hash"] = user.VerificationHash
+	for name, attr := range user.Attributes {
+		fields["attribute."+name] = attr.ValueString
+	}
+	return fields
+}
+
+// groupFields returns the fields of the group tracked by the history, an empty map for nil.
+func groupFields(group *CGroup) map[string]string {
+	fields := make(map[string]string)
+	if group == nil {
+		return fields
+	}
+	parents := append([]string{}, group.ParentGroups...)
+	sort.Strings(parents)
+	fields["parentGroups"] = strings.Join(parents, ",")
+	fields["roles"] = formatRoles(roleSequences(group.RoleMasks))
+	for _, attr := range group.Attributes {
+		fields["attribute."+attr.Name] = attr.ValueString
+	}
+	return fields
+}
+
+// diffFields returns the changes between the old and new fields, sorted by field name.
+func diffFields(oldFields, newFields map[string]string) []*FieldChange {
+	names := make(map[string]bool)
+	for name := range oldFields {
+		names[name] = true
+	}
+	for name := range newFields {
+		names[name] = true
+	}
+	changes := make([]*FieldChange, 0)
+	for _, name := range sortedKeys(names) {
+		oldValue, hadOld := oldFields[name]
+		newValue, hasNew := newFields[name]
+		if hadOld == hasNew && oldValue == newValue {
+			continue
+		}
+		if name == "hash" {
+			oldValue, newValue = redact(oldValue), redact(newValue)
+		}
+		changes = append(changes, &FieldChange{Field: name, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
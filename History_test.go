@@ -0,0 +1,123 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCredentaDB_UserHistory(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			assert.NoError(t, cDB.EnableHistory())
+
+			beforeCreate := time.Now()
+			user, err := cDB.NewUser(ctx, "RA", "john", "password", []string{"Staff"}, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			user.AddRole(3)
+			assert.NoError(t, user.SetAttribute("dept", "string", "sales"))
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+			afterCreate := time.Now()
+
+			assert.NoError(t, cDB.Update(context.WithValue(ctx, ETX_USER, "Admin"), "RA", "john", func(user *CUser) error {
+				user.Groups = []string{"Staff", "Admin"}
+				user.AddRole(70)
+				user.RemoveAttribute("dept")
+				user.Active = true
+				return nil
+			}))
+			assert.NoError(t, cDB.ChangeUserPassword(ctx, "RA", "john", "newPassword", VerificationMethodPLAIN))
+
+			entries, err := cDB.ListHistory(ctx, RecordUser, "RA", "john")
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 3) {
+				assert.Equal(t, ChangeAdded, entries[0].Op)
+				assert.Equal(t, uint64(1), entries[0].Version)
+				assert.Empty(t, entries[0].User.VerificationHash)
+
+				assert.Equal(t, ChangeModified, entries[1].Op)
+				assert.Equal(t, "Admin", entries[1].ChangedBy)
+				assert.Equal(t, []*FieldChange{
+					{Field: "active", Old: "false", New: "true"},
+					{Field: "attribute.dept", Old: "sales"},
+					{Field: "groups", Old: "Staff", New: "Admin,Staff"},
+					{Field: "roles", Old: "3", New: "3,70"},
+				}, entries[1].Changes)
+
+				// the password change is recorded, without the hashes.
+				assert.Equal(t, []*FieldChange{{Field: "hash", Old: redactedValue, New: redactedValue}}, entries[2].Changes)
+				assert.Empty(t, entries[2].User.VerificationHash)
+			}
+
+			_, err = cDB.GetUserAsOf(ctx, "RA", "john", beforeCreate)
+			assert.True(t, errors.Is(err, ErrNotFound))
+			old, err := cDB.GetUserAsOf(ctx, "RA", "john", afterCreate)
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{"Staff"}, old.Groups)
+				assert.False(t, old.Active)
+			}
+
+			reverted, err := cDB.RevertUser(ctx, "RA", "john", 1)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(4), reverted.Version)
+			current, err := cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{"Staff"}, current.Groups)
+				assert.True(t, current.HasRole(3))
+				assert.False(t, current.HasRole(70))
+				assert.True(t, current.HasAttribute("dept"))
+				// the password stays the one changed last.
+				assert.True(t, MatchVerification(current.VerificationMethod, "newPassword", current.VerificationHash))
+			}
+			_, err = cDB.RevertUser(ctx, "RA", "john", 42)
+			assert.True(t, errors.Is(err, ErrNotFound))
+
+			assert.NoError(t, cDB.DeleteUser(ctx, "RA", "john"))
+			entries, err = cDB.ListHistory(ctx, RecordUser, "RA", "john")
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 5) {
+				assert.Equal(t, ChangeDeleted, entries[4].Op)
+				assert.Equal(t, uint64(5), entries[4].Version)
+			}
+			_, err = cDB.GetUserAsOf(ctx, "RA", "john", time.Now())
+			assert.True(t, errors.Is(err, ErrNotFound))
+		})
+	}
+}
+
+func TestCredentaDB_GroupHistory(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	assert.NoError(t, cDB.EnableHistory())
+
+	group, err := cDB.NewGroup(ctx, "RA", "Son", []string{"Elder"})
+	assert.NoError(t, err)
+	assert.NoError(t, group.StoreOrSaveToFile(ctx))
+	afterCreate := time.Now()
+	assert.NoError(t, cDB.UpdateGroup(ctx, "RA", "Son", func(group *CGroup) error {
+		group.ParentGroups = nil
+		group.AddRole(1)
+		return nil
+	}))
+
+	old, err := cDB.GetGroupAsOf(ctx, "RA", "Son", afterCreate)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"Elder"}, old.ParentGroups)
+	}
+	entries, err := cDB.ListHistory(ctx, RecordGroup, "RA", "Son")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, []*FieldChange{{Field: "parentGroups", Old: "Elder"}, {Field: "roles", New: "1"}}, entries[1].Changes)
+	}
+
+	reverted, err := cDB.RevertGroup(ctx, "RA", "Son", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Elder"}, reverted.ParentGroups)
+	assert.False(t, reverted.HasRole(1))
+
+	assert.True(t, errors.Is(NewCredentaDBWithStore(&struct{ Store }{NewMemoryStore()}).EnableHistory(), ErrAuxNotSupported))
+}
@@ -0,0 +1,400 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// auxIndexBucket is the auxiliary record bucket holding the secondary index entries. Each entry is keyed
+// `realm, attribute, value, id`, so all the users having the same value are scanned at once.
+const auxIndexBucket = "index"
+
+// ErrNotIndexed is returned when looking up users by an attribute that has no declared index.
+var ErrNotIndexed = errors.New("attribute is not indexed")
+
+// ErrDuplicateValue is returned (possibly wrapped) when saving a user whose attribute value is already used by another
+// user of the same realm, and the attribute has a unique index. The returned error is a *DuplicateValueError.
+var ErrDuplicateValue = errors.New("duplicate value of unique attribute")
+
+// ErrInvalidIndexValue is returned (possibly wrapped) when saving a user whose value of an indexed attribute contains
+// the \x1f character, which separates the parts of the index entries so such a value can not be indexed.
+var ErrInvalidIndexValue = errors.New("value of indexed attribute contains the reserved \\x1f character")
+
+// DuplicateValueError describe a violation of a unique index, Value of Attribute is already used by ExistingID.
+// It satisfies errors.Is(err, ErrDuplicateValue).
+type DuplicateValueError struct {
+	Realm      string
+	Attribute  string
+	Value      string
+	ExistingID string
+}
+
+func (e *DuplicateValueError) Error() string {
+	return fmt.Sprintf("value %s of attribute %s is already used by user %s in realm %s: %v", e.Value, e.Attribute, e.ExistingID, e.Realm, ErrDuplicateValue)
+}
+
+// Is makes errors.Is(err, ErrDuplicateValue) returns true.
+func (e *DuplicateValueError) Is(target error) bool {
+	return target == ErrDuplicateValue
+}
+
+// UserIndex declare a secondary index on a user attribute.
+type UserIndex struct {
+	// Attribute is the name of the indexed user attribute.
+	Attribute string `json:"attribute"`
+	// Unique makes saving a user fail with ErrDuplicateValue when another user of the same realm has the same value.
+	Unique bool `json:"unique"`
+	// IgnoreCase makes the values compared case-insensitively, useful for email addresses.
+	IgnoreCase bool `json:"ignoreCase"`
+}
+
+// normalize returns the value as it is kept in the index.
+func (index *UserIndex) normalize(value string) string {
+	if index.IgnoreCase {
+		return strings.ToLower(value)
+	}
+	return value
+}
+
+// DeclareIndex declare a secondary index on a user attribute, so users can be found using FindUserByAttribute.
+// The index is maintained every time a user is saved or deleted through this CredentaDB, it should be declared before
+// the CredentaDB is used concurrently. Users with empty value are not indexed, and saving a user whose value contains
+// the \x1f character fails with ErrInvalidIndexValue. Declaring an index does not index the users already stored,
+// call RebuildIndex for that. It returns ErrAuxNotSupported if the Store does not implement AuxStore.
+func (store *CredentaDB) DeclareIndex(index UserIndex) error {
+	if _, err := store.auxStore(); err != nil {
+		return err
+	}
+	if index.Attribute == "" || strings.Contains(index.Attribute, auxKeySeparator) {
+		return fmt.Errorf("in DeclareIndex function. invalid attribute name %q", index.Attribute)
+	}
+	if store.indexes == nil {
+		store.indexes = make(map[string]*UserIndex)
+	}
+	store.indexes[index.Attribute] = &index
+	return nil
+}
+
+// RebuildIndex drop every entry of the index on the attribute and index all the stored users again. It is needed after
+// declaring an index on existing users, or after users were modified without the index declared. If the index is
+// unique, the first user of every duplicated value is indexed and the duplicates are returned as a joined error of
+// *DuplicateValueError.
+func (store *CredentaDB) RebuildIndex(ctx context.Context, attribute string) error {
+	index, ok := store.indexes[attribute]
+	if !ok {
+		return fmt.Errorf("in RebuildIndex function. %s: %w", attribute, ErrNotIndexed)
+	}
+	aux, err := store.auxStore()
+	if err != nil {
+		return err
+	}
+
+	stale := make([]string, 0)
+	err = aux.ScanAux(ctx, auxIndexBucket, "", func(key string, _ []byte) error {
+		if parts := splitAuxKey(key); len(parts) == 4 && parts[1] == attribute {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("in RebuildIndex function. error scanning index %s: %w", attribute, err)
+	}
+	for _, key := range stale {
+		if err := aux.DeleteAux(ctx, auxIndexBucket, key); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("in RebuildIndex function. error dropping index entry: %w", err)
+		}
+	}
+
+	duplicates := make([]error, 0)
+	err = store.WalkUserIDs(ctx, func(realm, id string) error {
+		user, err := store.loadUser(ctx, realm, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, ok := indexedValue(index, user)
+		if !ok {
+			return nil
+		}
+		if index.Unique {
+			existing, err := store.findIndexedIDs(ctx, aux, realm, attribute, value)
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				duplicates = append(duplicates, &DuplicateValueError{Realm: realm, Attribute: attribute, Value: value, ExistingID: existing[0]})
+				return nil
+			}
+		}
+		return aux.PutAux(ctx, auxIndexBucket, auxKey(realm, attribute, store.indexValues(value)[0], id), []byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("in RebuildIndex function. error indexing users: %w", err)
+	}
+	return errors.Join(duplicates...)
+}
+
+// FindUserByAttribute returns the only user of the realm whose indexed attribute has the value. It returns an error
+// that satisfy errors.Is(err, ErrNotFound) when there is no such user, or an error if more than one user is found.
+func (store *CredentaDB) FindUserByAttribute(ctx context.Context, realm, attribute, value string) (*CUser, error) {
+	users, err := store.FindUsersByAttribute(ctx, realm, attribute, value)
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, fmt.Errorf("in FindUserByAttribute function. user with %s %s in realm %s: %w", attribute, value, realm, ErrNotFound)
+	case 1:
+		return users[0], nil
+	default:
+		return nil, fmt.Errorf("in FindUserByAttribute function. %d users have %s %s in realm %s", len(users), attribute, value, realm)
+	}
+}
+
+// FindUsersByAttribute returns every user of the realm whose indexed attribute has the value, sorted by id.
+// It returns ErrNotIndexed if the attribute has no declared index.
+func (store *CredentaDB) FindUsersByAttribute(ctx context.Context, realm, attribute, value string) ([]*CUser, error) {
+	index, ok := store.indexes[attribute]
+	if !ok {
+		return nil, fmt.Errorf("in FindUsersByAttribute function. %s: %w", attribute, ErrNotIndexed)
+	}
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := store.findIndexedIDs(ctx, aux, realm, attribute, index.normalize(value))
+	if err != nil {
+		return nil, fmt.Errorf("in FindUsersByAttribute function. error reading index %s: %w", attribute, err)
+	}
+	users := make([]*CUser, 0, len(ids))
+	for _, id := range ids {
+		user, err := store.GetUser(ctx, realm, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the entry might be stale if the user was modified without the index, trust the user record.
+		if indexed, ok := indexedValue(index, user); ok && indexed == index.normalize(value) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// findIndexedIDs returns the ids of the index entries of the value, sorted.
+func (store *CredentaDB) findIndexedIDs(ctx context.Context, aux AuxStore, realm, attribute, value string) ([]string, error) {
+	found := make(map[string]bool)
+	for _, indexed := range store.indexValues(value) {
+		err := aux.ScanAux(ctx, auxIndexBucket, auxPrefix(realm, attribute, indexed), func(_ string, id []byte) error {
+			found[string(id)] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// indexValues returns the forms the normalized value is kept as within the index, the one new entries are put with
+// first. Without encryption it is the value itself. With encryption enabled it is the HMAC of the value keyed by every
+// key of the KeyRing (see KeyRing.indexValues), followed by the value itself for the entries put before encryption was
+// enabled, until ReEncrypt moves them.
+func (store *CredentaDB) indexValues(value string) []string {
+	if store.keys == nil {
+		return []string{value}
+	}
+	return append(store.keys.indexValues(value), value)
+}
+
+// uniqueValues returns the values of the user's unique indexes as they are kept within the index, sorted, or nil when
+// no unique index is declared so a CheckedWriter keeps the values claimed before.
+func (store *CredentaDB) uniqueValues(user *CUser) []UniqueValue {
+	var values []UniqueValue
+	for attribute, index := range store.indexes {
+		if !index.Unique {
+			continue
+		}
+		if values == nil {
+			values = make([]UniqueValue, 0)
+		}
+		if value, ok := indexedValue(index, user); ok {
+			values = append(values, UniqueValue{Attribute: attribute, Value: store.indexValues(value)[0]})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Attribute < values[j].Attribute
+	})
+	return values
+}
+
+// checkIndexedValues returns an error wrapping ErrInvalidIndexValue if a value of the user's indexed attributes can
+// not be indexed. indexedValue skips such values, a unique index would not be checked for them otherwise.
+func (store *CredentaDB) checkIndexedValues(user *CUser) error {
+	for attribute := range store.indexes {
+		if attr, ok := user.Attributes[attribute]; ok && strings.Contains(attr.ValueString, auxKeySeparator) {
+			return fmt.Errorf("attribute %s of user %s in realm %s: %w", attribute, user.Id, user.Realm, ErrInvalidIndexValue)
+		}
+	}
+	return nil
+}
+
+// indexedValue returns the normalized value of the user attribute, and false if the user should not be indexed.
+func indexedValue(index *UserIndex, user *CUser) (string, bool) {
+	if user == nil {
+		return "", false
+	}
+	attr, ok := user.Attributes[index.Attribute]
+	if !ok || attr.ValueString == "" || strings.Contains(attr.ValueString, auxKeySeparator) {
+		return "", false
+	}
+	return index.normalize(attr.ValueString), true
+}
+
+// lockUniqueValues check that the users do not violate any unique index, and lock the checked values until the
+// returned function is called so no other user can take them meanwhile. The caller must hold the lock of every user.
+// Other users found in the index are read from pending when there, nil meaning deleted, or else from the Store.
+func (store *CredentaDB) lockUniqueValues(ctx context.Context, users []*CUser, pending map[recordKey]*CUser) (func(), error) {
+	if len(store.indexes) == 0 {
+		return func() {}, nil
+	}
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil, err
+	}
+
+	type claim struct {
+		attribute string
+		value     string
+		user      *CUser
+	}
+	claims := make([]claim, 0)
+	for attribute, index := range store.indexes {
+		if !index.Unique {
+			continue
+		}
+		for _, user := range users {
+			if value, ok := indexedValue(index, user); ok {
+				claims = append(claims, claim{attribute: attribute, value: value, user: user})
+			}
+		}
+	}
+	// always lock in the same order, so two saves never wait for each other.
+	sort.Slice(claims, func(i, j int) bool {
+		return auxKey(claims[i].user.Realm, claims[i].attribute, claims[i].value) < auxKey(claims[j].user.Realm, claims[j].attribute, claims[j].value)
+	})
+
+	unlocks := make([]func(), 0)
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	locked := ""
+	for _, claim := range claims {
+		realm, attribute, value := claim.user.Realm, claim.attribute, claim.value
+		if key := auxKey(realm, attribute, value); key != locked {
+			unlock, err := store.lockIndexValue(ctx, realm, attribute, value)
+			if err != nil {
+				unlockAll()
+				return nil, err
+			}
+			unlocks = append(unlocks, unlock)
+			locked = key
+		}
+		ids, err := store.findIndexedIDs(ctx, aux, realm, attribute, value)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		for _, id := range ids {
+			if id == claim.user.Id {
+				continue
+			}
+			// the entry might be stale if the other user was modified without the index, trust the user record.
+			other, ok := pending[recordKey{realm, id}]
+			if !ok {
+				other, err = store.loadUser(ctx, realm, id)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					unlockAll()
+					return nil, err
+				}
+			}
+			if otherValue, ok := indexedValue(store.indexes[attribute], other); ok && otherValue == value {
+				unlockAll()
+				return nil, &DuplicateValueError{Realm: realm, Attribute: attribute, Value: value, ExistingID: id}
+			}
+		}
+	}
+	return unlockAll, nil
+}
+
+// lockIndexValue acquire the lock of a value of the attribute index using the Store if it implements AuxLocker, so the
+// value is locked for every process sharing the storage, or a lock local to this CredentaDB.
+func (store *CredentaDB) lockIndexValue(ctx context.Context, realm, attribute, value string) (func(), error) {
+	key := auxKey(realm, attribute, store.indexValues(value)[0])
+	if locker, ok := store.Store.(AuxLocker); ok {
+		return locker.LockAux(ctx, auxIndexBucket, key)
+	}
+	return store.recordLocks.Lock("index/" + key), nil
+}
+
+// updateUserIndexes bring every index entry of a user, attribute indexes and group member index, from its old version
+// up to the new one. Either may be nil, when the user is created or deleted. Nothing is indexed if the Store does not
+// implement AuxStore.
+func (store *CredentaDB) updateUserIndexes(ctx context.Context, oldUser, newUser *CUser) error {
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil
+	}
+	if err := store.updateAttributeIndexes(ctx, aux, oldUser, newUser); err != nil {
+		return err
+	}
+	return updateMemberIndex(ctx, aux, oldUser, newUser)
+}
+
+// updateAttributeIndexes bring the entries of every declared attribute index of a user from its old version up to
+// the new one. The entries of the old value put in another form, such as with a rotated key, are removed as well.
+func (store *CredentaDB) updateAttributeIndexes(ctx context.Context, aux AuxStore, oldUser, newUser *CUser) error {
+	for attribute, index := range store.indexes {
+		oldValue, hadOld := indexedValue(index, oldUser)
+		newValue, hasNew := indexedValue(index, newUser)
+		newIndexed := ""
+		if hasNew {
+			newIndexed = store.indexValues(newValue)[0]
+		}
+		if hadOld {
+			for _, oldIndexed := range store.indexValues(oldValue) {
+				if hasNew && oldIndexed == newIndexed {
+					continue
+				}
+				err := aux.DeleteAux(ctx, auxIndexBucket, auxKey(oldUser.Realm, attribute, oldIndexed, oldUser.Id))
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return fmt.Errorf("in updateAttributeIndexes function. error removing index entry of %s: %w", attribute, err)
+				}
+			}
+		}
+		if hasNew {
+			// always put, so an entry lost by an interrupted save is restored.
+			if err := aux.PutAux(ctx, auxIndexBucket, auxKey(newUser.Realm, attribute, newIndexed, newUser.Id), []byte(newUser.Id)); err != nil {
+				return fmt.Errorf("in updateAttributeIndexes function. error adding index entry of %s: %w", attribute, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestCredentaDB_Index(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true, IgnoreCase: true}))
+			assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "dept"}))
+
+			john, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			assert.NoError(t, john.SetAttribute("email", "string", "John.Doe@mail.com"))
+			assert.NoError(t, john.SetAttribute("dept", "string", "sales"))
+			assert.NoError(t, john.StoreOrSaveToFile(ctx))
+
+			jane, err := cDB.NewUser(ctx, "RA", "jane", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			assert.NoError(t, jane.SetAttribute("email", "string", "john.doe@MAIL.com"))
+			assert.NoError(t, jane.SetAttribute("dept", "string", "sales"))
+			err = jane.StoreOrSaveToFile(ctx)
+			assert.True(t, errors.Is(err, ErrDuplicateValue))
+			var dup *DuplicateValueError
+			assert.True(t, errors.As(err, &dup))
+			assert.Equal(t, "john", dup.ExistingID)
+
+			jane.RemoveAttribute("email")
+			assert.NoError(t, jane.SetAttribute("email", "string", "jane@mail.com"))
+			assert.NoError(t, jane.StoreOrSaveToFile(ctx))
+
+			// the same email in another realm is fine.
+			other, err := cDB.NewUser(ctx, "RB", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			assert.NoError(t, other.SetAttribute("email", "string", "john.doe@mail.com"))
+			assert.NoError(t, other.StoreOrSaveToFile(ctx))
+
+			found, err := cDB.FindUserByAttribute(ctx, "RA", "email", "JOHN.DOE@mail.com")
+			assert.NoError(t, err)
+			assert.Equal(t, "john", found.Id)
+			sales, err := cDB.FindUsersByAttribute(ctx, "RA", "dept", "sales")
+			assert.NoError(t, err)
+			assert.Len(t, sales, 2)
+			_, err = cDB.FindUserByAttribute(ctx, "RA", "phone", "123")
+			assert.True(t, errors.Is(err, ErrNotIndexed))
+
+			// changing the value moves the entry.
+			assert.NoError(t, cDB.Update(ctx, "RA", "john", func(user *CUser) error {
+				user.RemoveAttribute("email")
+				return user.SetAttribute("email", "string", "john@mail.com")
+			}))
+			_, err = cDB.FindUserByAttribute(ctx, "RA", "email", "john.doe@mail.com")
+			assert.True(t, errors.Is(err, ErrNotFound))
+			found, err = cDB.FindUserByAttribute(ctx, "RA", "email", "john@mail.com")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "john", found.Id)
+			}
+
+			assert.NoError(t, cDB.DeleteUser(ctx, "RA", "john"))
+			_, err = cDB.FindUserByAttribute(ctx, "RA", "email", "john@mail.com")
+			assert.True(t, errors.Is(err, ErrNotFound))
+			sales, err = cDB.FindUsersByAttribute(ctx, "RA", "dept", "sales")
+			assert.NoError(t, err)
+			assert.Len(t, sales, 1)
+		})
+	}
+}
+
+func TestCredentaDB_IndexReservedCharacter(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true}))
+	john, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, john.SetAttribute("email", "string", "john\x1f@mail.com"))
+	assert.NoError(t, john.SetAttribute("note", "string", "not\x1findexed"))
+
+	// the value can not be indexed, it would escape the uniqueness check.
+	assert.True(t, errors.Is(john.StoreOrSaveToFile(ctx), ErrInvalidIndexValue))
+	err = cDB.Tx(ctx, func(tx *Tx) error {
+		return tx.SaveUser(ctx, john)
+	})
+	assert.True(t, errors.Is(err, ErrInvalidIndexValue))
+	_, err = cDB.GetUser(ctx, "RA", "john")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// attributes without index are not restricted.
+	john.RemoveAttribute("email")
+	assert.NoError(t, john.StoreOrSaveToFile(ctx))
+}
+
+func TestCredentaDB_RebuildIndex(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	for _, id := range []string{"a", "b", "c"} {
+		user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		email := id + "@mail.com"
+		if id == "c" {
+			email = "a@mail.com"
+		}
+		assert.NoError(t, user.SetAttribute("email", "string", email))
+		assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	}
+
+	assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true}))
+	_, err := cDB.FindUserByAttribute(ctx, "RA", "email", "b@mail.com")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	err = cDB.RebuildIndex(ctx, "email")
+	assert.True(t, errors.Is(err, ErrDuplicateValue))
+	found, err := cDB.FindUserByAttribute(ctx, "RA", "email", "b@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", found.Id)
+
+	assert.True(t, errors.Is(NewCredentaDBWithStore(&struct{ Store }{NewMemoryStore()}).DeclareIndex(UserIndex{Attribute: "email"}), ErrAuxNotSupported))
+}
+
+func TestCredentaDB_IndexSharedFileStore(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	// two CredentaDB sharing the same folder behave like two processes sharing CREDENTA_BASE_DIR.
+	otherFs, err := NewFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder)
+	assert.NoError(t, err)
+	dbs := []*CredentaDB{NewCredentaDBWithStore(fs), NewCredentaDBWithStore(otherFs)}
+	for _, cDB := range dbs {
+		assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true}))
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := dbs[i%2].NewUser(ctx, "RA", fmt.Sprintf("user%d", i), "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			if err == nil {
+				err = user.SetAttribute("email", "string", "same@mail.com")
+			}
+			if err == nil {
+				err = user.StoreOrSaveToFile(ctx)
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	saved := 0
+	for _, err := range errs {
+		if err == nil {
+			saved++
+		} else {
+			assert.True(t, errors.Is(err, ErrDuplicateValue), "%v", err)
+		}
+	}
+	assert.Equal(t, 1, saved)
+	users, err := dbs[0].FindUsersByAttribute(ctx, "RA", "email", "same@mail.com")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+}
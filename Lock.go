@@ -0,0 +1,87 @@
+package credenta
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// lockRetryInterval is the wait between attempts of acquiring a lock held by someone else.
+const lockRetryInterval = 10 * time.Millisecond
+
+// Locker is implemented by a Store that is able to lock a single user or group against concurrent
+// modification, including modification made by other processes sharing the same storage.
+// Store that does not implement Locker are protected by CredentaDB within the process only.
+type Locker interface {
+	// LockUser acquire an exclusive lock of the user with specified realm and id, and returns the function to release it.
+	LockUser(ctx context.Context, realm, id string) (unlock func(), err error)
+	// LockGroup acquire an exclusive lock of the group with specified realm and name, and returns the function to release it.
+	LockGroup(ctx context.Context, realm, name string) (unlock func(), err error)
+}
+
+// AuxLocker is implemented by a Store that is able to lock an auxiliary record key, including against other processes
+// sharing the same storage. CredentaDB uses it to lock the values of the unique indexes while checking and claiming
+// them. Store that does not implement AuxLocker are protected by CredentaDB within the process only.
+type AuxLocker interface {
+	// LockAux acquire an exclusive lock of the key in the bucket, and returns the function to release it. The record
+	// does not need to exist.
+	LockAux(ctx context.Context, bucket, key string) (unlock func(), err error)
+}
+
+// CheckedWriter is implemented by a Store that checks the Version and the unique attribute values of a record within
+// the write itself, so a stale write fails with ErrConflict and a taken value with ErrDuplicateValue, even against
+// another process sharing the storage. CredentaDB writes users and groups through it when the Store implements it,
+// in addition to its own checks which, without Locker and AuxLocker, only hold within the process.
+type CheckedWriter interface {
+	// PutUserChecked puts the user if the stored one has the expected Version, or does not exist when expected is 0.
+	// A write that increases the Version keeps the failed authentication counters and lockout of the stored user,
+	// since only the writes keeping the Version change them. The user claims the unique values, releasing the ones
+	// it claimed before, or keeps its claims as they are when unique is nil.
+	PutUserChecked(ctx context.Context, user *CUser, expected uint64, unique []UniqueValue) error
+	// PutGroupChecked puts the group if the stored one has the expected Version, or does not exist when expected
+	// is 0.
+	PutGroupChecked(ctx context.Context, group *CGroup, expected uint64) error
+}
+
+// UniqueValue is a value of a unique index claimed by a user, as it is kept within the index.
+type UniqueValue struct {
+	Attribute string
+	Value     string
+}
+
+// keyedMutex is a set of mutexes identified by a string key. The zero value is ready to use.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+// Lock acquire the mutex of the key and returns the function to release it.
+func (km *keyedMutex) Lock(key string) func() {
+	km.mutex.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*keyedMutexEntry)
+	}
+	entry, ok := km.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		km.locks[key] = entry
+	}
+	entry.refs++
+	km.mutex.Unlock()
+
+	entry.mutex.Lock()
+	return func() {
+		entry.mutex.Unlock()
+		km.mutex.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mutex.Unlock()
+	}
+}
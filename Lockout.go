@@ -0,0 +1,191 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAccountLocked is matched by the error of GetUserWithAuth when the user is locked out after too many failed
+// authentications. The returned error is a *CredentialsError whose Cause is a *LockedError, so it reads the same as
+// an unknown user or a wrong password and does not reveal which ids exist.
+var ErrAccountLocked = errors.New("account is locked")
+
+// LockedError describe a refused authentication of a locked out user. It satisfies errors.Is(err, ErrAccountLocked).
+// Its message does not include the user nor the unlock time, use its fields to log them.
+type LockedError struct {
+	Realm string
+	Id    string
+	// Until is the time the user is automatically unlocked.
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return ErrAccountLocked.Error()
+}
+
+// Is makes errors.Is(err, ErrAccountLocked) returns true.
+func (e *LockedError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// LockoutPolicy specify when a user is locked out after failed authentications, and for how long.
+type LockoutPolicy struct {
+	// MaxAttempts is the number of consecutive failed authentications that locks the user out.
+	MaxAttempts int `json:"maxAttempts"`
+	// Duration is how long the user is locked out the first time.
+	Duration time.Duration `json:"duration"`
+	// Backoff multiply the duration of every consecutive lockout, the duration is fixed when it is 1 or less.
+	Backoff float64 `json:"backoff"`
+	// MaxDuration caps the duration of a lockout, zero for no cap.
+	MaxDuration time.Duration `json:"maxDuration"`
+	// ResetAfter forgets the failed authentications and lockouts of a user that had no failed authentication for
+	// this long, zero to only forget them on successful authentication.
+	ResetAfter time.Duration `json:"resetAfter"`
+}
+
+// FixedLockoutPolicy creates a LockoutPolicy that locks the user out for the same duration after every maxAttempts
+// consecutive failed authentications.
+func FixedLockoutPolicy(maxAttempts int, duration time.Duration) *LockoutPolicy {
+	return &LockoutPolicy{
+		MaxAttempts: maxAttempts,
+		Duration:    duration,
+		Backoff:     1,
+	}
+}
+
+// ExponentialLockoutPolicy creates a LockoutPolicy that locks the user out after every maxAttempts consecutive failed
+// authentications, doubling the duration of every consecutive lockout up to maxDuration.
+func ExponentialLockoutPolicy(maxAttempts int, duration, maxDuration time.Duration) *LockoutPolicy {
+	return &LockoutPolicy{
+		MaxAttempts: maxAttempts,
+		Duration:    duration,
+		Backoff:     2,
+		MaxDuration: maxDuration,
+	}
+}
+
+// lockDuration returns how long the user is locked out by its n-th consecutive lockout.
+func (policy *LockoutPolicy) lockDuration(lockouts int) time.Duration {
+	duration := policy.Duration
+	for i := 1; i < lockouts && policy.Backoff > 1; i++ {
+		duration = time.Duration(float64(duration) * policy.Backoff)
+		if policy.MaxDuration > 0 && duration >= policy.MaxDuration {
+			break
+		}
+	}
+	if policy.MaxDuration > 0 && duration > policy.MaxDuration {
+		return policy.MaxDuration
+	}
+	return duration
+}
+
+// IsLocked returns true if the user is locked out at the moment.
+func (user *CUser) IsLocked() bool {
+	return time.Now().Before(user.LockedUntil)
+}
+
+// EnableLockout turn on the account lockout. Once enabled, GetUserWithAuth counts the consecutive failed
+// authentications of every user, and refuses to authenticate a user for a while once the policy's MaxAttempts is
+// reached, see ErrAccountLocked. The user is unlocked automatically when the lockout expires, or by UnlockUser. It should
+// be called before the CredentaDB is used concurrently.
+func (store *CredentaDB) EnableLockout(policy *LockoutPolicy) error {
+	if policy == nil || policy.MaxAttempts <= 0 || policy.Duration <= 0 {
+		return errors.New("in EnableLockout function. policy must have positive MaxAttempts and Duration")
+	}
+	store.lockout = policy
+	return nil
+}
+
+// DisableLockout turn off the account lockout. The failed authentications are no longer counted and locked out users
+// are able to authenticate, their counters are kept until their next successful authentication.
+func (store *CredentaDB) DisableLockout() {
+	store.lockout = nil
+}
+
+// UnlockUser clears the failed authentications and lockout of the user, so it is able to authenticate right away.
+// Like the counting of failed authentications, it does not change the user's Version nor its history.
+func (store *CredentaDB) UnlockUser(ctx context.Context, realm, id string) error {
+	if realm == "" || id == "" {
+		return errors.New("in UnlockUser function. realm and id are required")
+	}
+	if err := store.resetFailedAuth(ctx, realm, id, true); err != nil {
+		return fmt.Errorf("in UnlockUser function : %w", err)
+	}
+	return nil
+}
+
+// keepLockout copy the failed authentication counters and lockout of the stored user into the user about to be
+// saved. They are changed without increasing the Version, so a copy loaded before would otherwise put them back.
+func (user *CUser) keepLockout(stored *CUser) {
+	user.FailedAttempts = stored.FailedAttempts
+	user.Lockouts = stored.Lockouts
+	user.LastFailedAt = stored.LastFailedAt
+	user.LockedUntil = stored.LockedUntil
+}
+
+// recordFailedAuth counts a failed authentication of the user, locking it out when the policy's MaxAttempts is
+// reached. The counters are not user changes, so the user's Version, update time and history are left untouched.
+func (store *CredentaDB) recordFailedAuth(ctx context.Context, realm, id string) error {
+	policy := store.lockout
+	unlock, err := store.lockUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	user, err := store.loadUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(user.LockedUntil) {
+		return nil
+	}
+	if policy.ResetAfter > 0 && now.Sub(user.LastFailedAt) > policy.ResetAfter {
+		user.FailedAttempts = 0
+		user.Lockouts = 0
+	}
+	user.FailedAttempts++
+	user.LastFailedAt = now
+	if user.FailedAttempts >= policy.MaxAttempts {
+		user.FailedAttempts = 0
+		user.Lockouts++
+		user.LockedUntil = now.Add(policy.lockDuration(user.Lockouts))
+	}
+	if err := store.putUserChecked(ctx, user, user.Version, false); err != nil {
+		return err
+	}
+	store.invalidateUser(realm, id)
+	return nil
+}
+
+// resetFailedAuth clears the failed authentications and lockouts of the user after a successful authentication, or
+// by UnlockUser when force is true. Without force, a user locked out since it was authenticated is left as is and
+// a *LockedError is returned.
+func (store *CredentaDB) resetFailedAuth(ctx context.Context, realm, id string, force bool) error {
+	unlock, err := store.lockUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	user, err := store.loadUser(ctx, realm, id)
+	if err != nil {
+		return err
+	}
+	if !force && user.IsLocked() {
+		return &LockedError{Realm: realm, Id: id, Until: user.LockedUntil}
+	}
+	if user.FailedAttempts == 0 && user.Lockouts == 0 && user.LockedUntil.IsZero() {
+		return nil
+	}
+	user.FailedAttempts = 0
+	user.Lockouts = 0
+	user.LastFailedAt = time.Time{}
+	user.LockedUntil = time.Time{}
+	if err := store.putUserChecked(ctx, user, user.Version, false); err != nil {
+		return err
+	}
+	store.invalidateUser(realm, id)
+	return nil
+}
@@ -0,0 +1,290 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCredentaDB_Lockout(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			cDB.EnableCache(DefaultCacheConfig())
+			assert.NoError(t, cDB.EnableLockout(FixedLockoutPolicy(3, time.Hour)))
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			user.Active = true
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+			// a successful authentication clears the failed ones.
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+			assert.EqualError(t, err, "invalid authentication")
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+				assert.EqualError(t, err, "invalid authentication")
+			}
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.True(t, errors.Is(err, ErrAccountLocked))
+			locked := &LockedError{}
+			if assert.True(t, errors.As(err, &locked)) {
+				assert.WithinDuration(t, time.Now().Add(time.Hour), locked.Until, time.Minute)
+			}
+			// a locked user can not be told apart from a wrong password nor an unknown user.
+			assert.EqualError(t, err, "invalid authentication")
+			assert.True(t, errors.Is(err, ErrInvalidCredentials))
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+			assert.EqualError(t, err, "invalid authentication")
+			_, _, unknownErr := cDB.GetUserWithAuth(ctx, "RA", "nobody", "password")
+			assert.Equal(t, unknownErr.Error(), err.Error())
+			assert.NotContains(t, locked.Error(), "john")
+
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.True(t, john.IsLocked())
+			assert.Equal(t, 1, john.Lockouts)
+			assert.Equal(t, uint64(1), john.Version, "counting failures must not change the version")
+			isLocked := true
+			page, err := cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Locked: &isLocked})
+			assert.NoError(t, err)
+			assert.Len(t, page.Users, 1)
+
+			assert.NoError(t, cDB.UnlockUser(ctx, "RA", "john"))
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+
+			// an expired lockout unlocks the user.
+			putLockoutState(t, cDB, "RA", "john", func(user *CUser) {
+				user.Lockouts = 1
+				user.LockedUntil = time.Now().Add(-time.Second)
+			})
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+			john, err = cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.Equal(t, 0, john.Lockouts)
+			assert.True(t, john.LockedUntil.IsZero())
+
+			// nothing is counted once the lockout is disabled.
+			cDB.DisableLockout()
+			for i := 0; i < 3; i++ {
+				_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+				assert.EqualError(t, err, "invalid authentication")
+			}
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// putLockoutState changes the lockout fields of the stored user the way the authentication does, as saving the user
+// keeps them.
+func putLockoutState(t *testing.T, cDB *CredentaDB, realm, id string, fn func(user *CUser)) {
+	ctx := context.Background()
+	user, err := cDB.loadUser(ctx, realm, id)
+	assert.NoError(t, err)
+	fn(user)
+	assert.NoError(t, cDB.putUser(ctx, user))
+	cDB.invalidateUser(realm, id)
+}
+
+func TestCredentaDB_LockoutStaleSave(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			assert.NoError(t, cDB.EnableLockout(FixedLockoutPolicy(1, time.Hour)))
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			user.Active = true
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+			stale, err := cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+			assert.Error(t, err)
+
+			// reloading a copy loaded before the lockout gets the lockout.
+			reloaded, err := cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			reloaded.LockedUntil = time.Time{}
+			assert.NoError(t, reloaded.ReloadFromFile(ctx))
+			assert.True(t, reloaded.IsLocked())
+			assert.Equal(t, 1, reloaded.Lockouts)
+
+			// saving a copy loaded before the lockout must not unlock the user.
+			stale.Enable = false
+			assert.NoError(t, stale.StoreOrSaveToFile(ctx))
+			assert.True(t, stale.IsLocked())
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.True(t, john.IsLocked())
+			assert.False(t, john.Enable)
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.True(t, errors.Is(err, ErrAccountLocked))
+
+			// nor changing the counters through Update.
+			assert.NoError(t, cDB.Update(ctx, "RA", "john", func(user *CUser) error {
+				user.LockedUntil = time.Time{}
+				return nil
+			}))
+			john, err = cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.True(t, john.IsLocked())
+		})
+	}
+}
+
+func TestCredentaDB_LockoutTx(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			assert.NoError(t, cDB.EnableLockout(FixedLockoutPolicy(1, time.Hour)))
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			user.Active = true
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+			// a lockout happening while a transaction has the user must not be lifted by its commit.
+			assert.NoError(t, cDB.Tx(ctx, func(tx *Tx) error {
+				if err := tx.Update(ctx, "RA", "john", func(user *CUser) error {
+					user.Active = true
+					return nil
+				}); err != nil {
+					return err
+				}
+				_, _, err := cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+				assert.ErrorIs(t, err, ErrInvalidCredentials)
+				return nil
+			}))
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.True(t, john.IsLocked())
+				assert.Equal(t, 1, john.Lockouts)
+			}
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.ErrorIs(t, err, ErrAccountLocked)
+
+			// nor can a transaction unlock the user by changing the counters.
+			assert.NoError(t, cDB.Tx(ctx, func(tx *Tx) error {
+				return tx.Update(ctx, "RA", "john", func(user *CUser) error {
+					user.LockedUntil = time.Time{}
+					user.Lockouts = 0
+					return nil
+				})
+			}))
+			john, err = cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.True(t, john.IsLocked())
+			}
+		})
+	}
+}
+
+// getUserHookStore calls afterGet once, when the next user is read.
+type getUserHookStore struct {
+	*MemoryStore
+	afterGet func()
+}
+
+func (s *getUserHookStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	user, err := s.MemoryStore.GetUser(ctx, realm, id)
+	if hook := s.afterGet; hook != nil {
+		s.afterGet = nil
+		hook()
+	}
+	return user, err
+}
+
+func TestCredentaDB_LockoutDuringAuth(t *testing.T) {
+	dataStore := &getUserHookStore{MemoryStore: NewMemoryStore()}
+	cDB := NewCredentaDBWithStore(dataStore)
+	assert.NoError(t, cDB.EnableLockout(FixedLockoutPolicy(3, time.Hour)))
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	user.Active = true
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+	// the user is locked out by another authentication once read, the successful one must not lift the lockout.
+	dataStore.afterGet = func() {
+		putLockoutState(t, cDB, "RA", "john", func(user *CUser) {
+			user.Lockouts = 1
+			user.LockedUntil = time.Now().Add(time.Hour)
+		})
+	}
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.ErrorIs(t, err, ErrAccountLocked)
+	assert.EqualError(t, err, "invalid authentication")
+	john, err := cDB.GetUser(ctx, "RA", "john")
+	if assert.NoError(t, err) {
+		assert.True(t, john.IsLocked())
+		assert.Equal(t, 1, john.Lockouts)
+	}
+
+	// while UnlockUser always does.
+	assert.NoError(t, cDB.UnlockUser(ctx, "RA", "john"))
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.NoError(t, err)
+}
+
+func TestLockoutPolicy_lockDuration(t *testing.T) {
+	fixed := FixedLockoutPolicy(5, time.Minute)
+	assert.Equal(t, time.Minute, fixed.lockDuration(1))
+	assert.Equal(t, time.Minute, fixed.lockDuration(4))
+
+	exponential := ExponentialLockoutPolicy(5, time.Minute, 10*time.Minute)
+	assert.Equal(t, time.Minute, exponential.lockDuration(1))
+	assert.Equal(t, 2*time.Minute, exponential.lockDuration(2))
+	assert.Equal(t, 8*time.Minute, exponential.lockDuration(4))
+	assert.Equal(t, 10*time.Minute, exponential.lockDuration(5))
+	assert.Equal(t, 10*time.Minute, exponential.lockDuration(100))
+
+	assert.Error(t, NewCredentaDBWithStore(NewMemoryStore()).EnableLockout(&LockoutPolicy{MaxAttempts: 3}))
+}
+
+func TestCredentaDB_LockoutReset(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	policy := ExponentialLockoutPolicy(2, time.Minute, time.Hour)
+	policy.ResetAfter = time.Hour
+	assert.NoError(t, cDB.EnableLockout(policy))
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+	// the second lockout in a row lasts twice as long.
+	putLockoutState(t, cDB, "RA", "john", func(user *CUser) {
+		user.Lockouts = 1
+		user.FailedAttempts = 1
+		user.LastFailedAt = time.Now()
+	})
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+	assert.EqualError(t, err, "invalid authentication")
+	john, err := cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, john.Lockouts)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), john.LockedUntil, 10*time.Second)
+
+	// failures older than ResetAfter are forgotten.
+	putLockoutState(t, cDB, "RA", "john", func(user *CUser) {
+		user.Lockouts = 2
+		user.FailedAttempts = 1
+		user.LastFailedAt = time.Now().Add(-2 * time.Hour)
+		user.LockedUntil = time.Time{}
+	})
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+	assert.EqualError(t, err, "invalid authentication")
+	john, err = cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, john.FailedAttempts)
+	assert.Equal(t, 0, john.Lockouts)
+	assert.False(t, john.IsLocked())
+}
@@ -0,0 +1,277 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// auxMemberBucket is the auxiliary record bucket of the group member index, keyed `realm, group, user id`.
+	auxMemberBucket = "member"
+	// auxChildBucket is the auxiliary record bucket of the child group index, keyed `realm, parent group, group`.
+	auxChildBucket = "child"
+)
+
+// ListGroupMembers returns the sorted ids of the users of the realm that are member of the group. When transitive is
+// true, it also returns the members of every child group, recursively, since they inherit the group's roles.
+// When the Store implements AuxStore the member index is used, otherwise every user of the realm is loaded.
+func (store *CredentaDB) ListGroupMembers(ctx context.Context, realm, group string, transitive bool) ([]string, error) {
+	if realm == "" || group == "" {
+		return nil, errors.New("in ListGroupMembers function. realm and group are required")
+	}
+	groups := []string{group}
+	if transitive {
+		children, err := store.ListChildGroups(ctx, realm, group, true)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, children...)
+	}
+
+	members := make(map[string]bool)
+	if aux, err := store.auxStore(); err == nil {
+		for _, g := range groups {
+			err := aux.ScanAux(ctx, auxMemberBucket, auxPrefix(realm, g), func(_ string, id []byte) error {
+				members[string(id)] = true
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("in ListGroupMembers function. error reading member index: %w", err)
+			}
+		}
+	} else {
+		wanted := make(map[string]bool)
+		for _, g := range groups {
+			wanted[g] = true
+		}
+		err := store.WalkUserIDs(ctx, func(userRealm, id string) error {
+			if userRealm != realm {
+				return nil
+			}
+			user, err := store.GetUser(ctx, realm, id)
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, g := range user.Groups {
+				if wanted[g] {
+					members[id] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("in ListGroupMembers function. error listing users: %w", err)
+		}
+	}
+	return sortedKeys(members), nil
+}
+
+// ListChildGroups returns the sorted names of the groups of the realm having the group as parent. When transitive is
+// true, it also returns the children of every child group, recursively.
+// When the Store implements AuxStore the child group index is used, otherwise every group of the realm is loaded.
+func (store *CredentaDB) ListChildGroups(ctx context.Context, realm, group string, transitive bool) ([]string, error) {
+	if realm == "" || group == "" {
+		return nil, errors.New("in ListChildGroups function. realm and group are required")
+	}
+	directChildren, err := store.childGroupsFunc(ctx, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string]bool)
+	pending := []string{group}
+	for len(pending) > 0 {
+		parent := pending[0]
+		pending = pending[1:]
+		direct, err := directChildren(parent)
+		if err != nil {
+			return nil, fmt.Errorf("in ListChildGroups function. error listing children of %s: %w", parent, err)
+		}
+		for _, child := range direct {
+			// a group never is its own child, even if the parent graph has a cycle.
+			if child == group || children[child] {
+				continue
+			}
+			children[child] = true
+			if transitive {
+				pending = append(pending, child)
+			}
+		}
+	}
+	return sortedKeys(children), nil
+}
+
+// childGroupsFunc returns a function listing the direct children of a group of the realm, using the child group index
+// when the Store implements AuxStore, or by loading every group of the realm once otherwise.
+func (store *CredentaDB) childGroupsFunc(ctx context.Context, realm string) (func(parent string) ([]string, error), error) {
+	if aux, err := store.auxStore(); err == nil {
+		return func(parent string) ([]string, error) {
+			children := make([]string, 0)
+			err := aux.ScanAux(ctx, auxChildBucket, auxPrefix(realm, parent), func(_ string, name []byte) error {
+				children = append(children, string(name))
+				return nil
+			})
+			return children, err
+		}, nil
+	}
+
+	childrenOf := make(map[string][]string)
+	err := store.WalkGroupNames(ctx, func(groupRealm, name string) error {
+		if groupRealm != realm {
+			return nil
+		}
+		group, err := store.GetGroup(ctx, realm, name)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, parent := range group.ParentGroups {
+			childrenOf[parent] = append(childrenOf[parent], name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in ListChildGroups function. error listing groups: %w", err)
+	}
+	return func(parent string) ([]string, error) {
+		return childrenOf[parent], nil
+	}, nil
+}
+
+// RebuildMemberIndex drop the group member and child group indexes and build them again from every stored user and
+// group. It is needed once for users and groups saved before the indexes existed, or saved by other means than
+// CredentaDB. It returns ErrAuxNotSupported if the Store does not implement AuxStore.
+func (store *CredentaDB) RebuildMemberIndex(ctx context.Context) error {
+	aux, err := store.auxStore()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range []string{auxMemberBucket, auxChildBucket} {
+		if err := dropAuxBucket(ctx, aux, bucket); err != nil {
+			return fmt.Errorf("in RebuildMemberIndex function. error dropping %s index: %w", bucket, err)
+		}
+	}
+	err = store.WalkUserIDs(ctx, func(realm, id string) error {
+		user, err := store.Store.GetUser(ctx, realm, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return updateMemberIndex(ctx, aux, nil, user)
+	})
+	if err != nil {
+		return fmt.Errorf("in RebuildMemberIndex function. error indexing users: %w", err)
+	}
+	err = store.WalkGroupNames(ctx, func(realm, name string) error {
+		group, err := store.Store.GetGroup(ctx, realm, name)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return updateChildIndex(ctx, aux, nil, group)
+	})
+	if err != nil {
+		return fmt.Errorf("in RebuildMemberIndex function. error indexing groups: %w", err)
+	}
+	return nil
+}
+
+// updateGroupIndexes bring the child group index entries of a group from its old version up to the new one. Either
+// may be nil, when the group is created or deleted. Nothing is indexed if the Store does not implement AuxStore.
+func (store *CredentaDB) updateGroupIndexes(ctx context.Context, oldGroup, newGroup *CGroup) error {
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil
+	}
+	return updateChildIndex(ctx, aux, oldGroup, newGroup)
+}
+
+// updateMemberIndex bring the member index entries of a user from its old version up to the new one. Either may be
+// nil, when the user is created or deleted.
+func updateMemberIndex(ctx context.Context, aux AuxStore, oldUser, newUser *CUser) error {
+	var oldGroups, newGroups []string
+	var realm, id string
+	if oldUser != nil {
+		oldGroups, realm, id = oldUser.Groups, oldUser.Realm, oldUser.Id
+	}
+	if newUser != nil {
+		newGroups, realm, id = newUser.Groups, newUser.Realm, newUser.Id
+	}
+	return updateAuxSet(ctx, aux, auxMemberBucket, realm, id, oldGroups, newGroups)
+}
+
+// updateChildIndex bring the child group index entries of a group from its old version up to the new one. Either may
+// be nil, when the group is created or deleted.
+func updateChildIndex(ctx context.Context, aux AuxStore, oldGroup, newGroup *CGroup) error {
+	var oldParents, newParents []string
+	var realm, name string
+	if oldGroup != nil {
+		oldParents, realm, name = oldGroup.ParentGroups, oldGroup.Realm, oldGroup.Name
+	}
+	if newGroup != nil {
+		newParents, realm, name = newGroup.ParentGroups, newGroup.Realm, newGroup.Name
+	}
+	return updateAuxSet(ctx, aux, auxChildBucket, realm, name, oldParents, newParents)
+}
+
+// updateAuxSet maintain the entries `realm, owner, member` of the bucket, where member belongs to every owner in
+// newOwners and no longer belongs to the owners only in oldOwners.
+func updateAuxSet(ctx context.Context, aux AuxStore, bucket, realm, member string, oldOwners, newOwners []string) error {
+	for _, owner := range oldOwners {
+		if owner == "" || containsString(newOwners, owner) {
+			continue
+		}
+		err := aux.DeleteAux(ctx, bucket, auxKey(realm, owner, member))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("in updateAuxSet function. error removing %s entry: %w", bucket, err)
+		}
+	}
+	for _, owner := range newOwners {
+		if owner == "" {
+			continue
+		}
+		// always put, so an entry lost by an interrupted save is restored.
+		if err := aux.PutAux(ctx, bucket, auxKey(realm, owner, member), []byte(member)); err != nil {
+			return fmt.Errorf("in updateAuxSet function. error adding %s entry: %w", bucket, err)
+		}
+	}
+	return nil
+}
+
+// dropAuxBucket delete every record of the auxiliary record bucket.
+func dropAuxBucket(ctx context.Context, aux AuxStore, bucket string) error {
+	keys := make([]string, 0)
+	err := aux.ScanAux(ctx, bucket, "", func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := aux.DeleteAux(ctx, bucket, key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,101 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCredentaDB_ListGroupMembers(t *testing.T) {
+	stores := newTestStores(t)
+	// a Store without AuxStore falls back to loading every user and group.
+	stores["NO_AUX"] = &struct{ Store }{NewMemoryStore()}
+	for name, dataStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+			for _, g := range []struct {
+				name    string
+				parents []string
+			}{{"Elder", nil}, {"Son", []string{"Elder"}}, {"GrandSon", []string{"Son"}}, {"Other", nil}} {
+				group, err := cDB.NewGroup(ctx, "RA", g.name, g.parents)
+				assert.NoError(t, err)
+				assert.NoError(t, group.StoreOrSaveToFile(ctx))
+			}
+			for id, groups := range map[string][]string{"alice": {"Elder"}, "bob": {"Son", "Other"}, "carol": {"GrandSon"}, "dave": nil} {
+				user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+				assert.NoError(t, err)
+				user.Groups = groups
+				assert.NoError(t, user.StoreOrSaveToFile(ctx))
+			}
+			// the same group name in another realm is unrelated.
+			stranger, err := cDB.NewUser(ctx, "RB", "eve", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			stranger.Groups = []string{"Elder"}
+			assert.NoError(t, stranger.StoreOrSaveToFile(ctx))
+
+			members, err := cDB.ListGroupMembers(ctx, "RA", "Elder", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"alice"}, members)
+			members, err = cDB.ListGroupMembers(ctx, "RA", "Elder", true)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"alice", "bob", "carol"}, members)
+
+			children, err := cDB.ListChildGroups(ctx, "RA", "Elder", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"Son"}, children)
+			children, err = cDB.ListChildGroups(ctx, "RA", "Elder", true)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"GrandSon", "Son"}, children)
+
+			// leaving a group and deleting a user remove the entries.
+			assert.NoError(t, cDB.Update(ctx, "RA", "bob", func(user *CUser) error {
+				user.Groups = []string{"Other"}
+				return nil
+			}))
+			assert.NoError(t, cDB.DeleteUser(ctx, "RA", "carol"))
+			members, err = cDB.ListGroupMembers(ctx, "RA", "Elder", true)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"alice"}, members)
+			members, err = cDB.ListGroupMembers(ctx, "RA", "Other", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"bob"}, members)
+
+			// a cycle in the parent groups does not loop forever.
+			assert.NoError(t, cDB.UpdateGroup(ctx, "RA", "Elder", func(group *CGroup) error {
+				group.ParentGroups = []string{"GrandSon"}
+				return nil
+			}))
+			children, err = cDB.ListChildGroups(ctx, "RA", "Son", true)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"Elder", "GrandSon"}, children)
+
+			assert.NoError(t, cDB.DeleteGroup(ctx, "RA", "GrandSon"))
+			children, err = cDB.ListChildGroups(ctx, "RA", "Son", true)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{}, children)
+		})
+	}
+}
+
+func TestCredentaDB_RebuildMemberIndex(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	// users and groups saved directly into the Store are not indexed.
+	assert.NoError(t, store.PutGroup(ctx, &CGroup{Realm: "RA", Name: "Son", ParentGroups: []string{"Elder"}, Version: 1}))
+	assert.NoError(t, store.PutUser(ctx, &CUser{Realm: "RA", Id: "alice", Groups: []string{"Son"}, Version: 1}))
+
+	cDB := NewCredentaDBWithStore(store)
+	members, err := cDB.ListGroupMembers(ctx, "RA", "Elder", true)
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+
+	assert.NoError(t, cDB.RebuildMemberIndex(ctx))
+	members, err = cDB.ListGroupMembers(ctx, "RA", "Elder", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, members)
+
+	assert.True(t, errors.Is(NewCredentaDBWithStore(&struct{ Store }{NewMemoryStore()}).RebuildMemberIndex(ctx), ErrAuxNotSupported))
+}
@@ -0,0 +1,284 @@
+package credenta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewMemoryStore creates a new empty Store that keep all users and groups in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:  make(map[string]map[string]*CUser),
+		groups: make(map[string]map[string]*CGroup),
+		aux:    make(map[string]map[string][]byte),
+	}
+}
+
+// MemoryStore is a Store implementation that keep all users and groups in memory. It is safe for concurrent use and
+// is intended for unit tests and ephemeral services. Every record is copied when stored and when retrieved,
+// so modifying a retrieved record will not change the stored one until it is put back.
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	users  map[string]map[string]*CUser
+	groups map[string]map[string]*CGroup
+	aux    map[string]map[string][]byte
+}
+
+// MemorySnapshot is the JSON representation of all records inside a MemoryStore.
+type MemorySnapshot struct {
+	Users  []*CUser  `json:"users"`
+	Groups []*CGroup `json:"groups"`
+}
+
+func (ms *MemoryStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if user, ok := ms.users[realm][id]; ok {
+		return user.clone(), nil
+	}
+	return nil, fmt.Errorf("in GetUser function, user %s in realm %s: %w", id, realm, ErrNotFound)
+}
+
+func (ms *MemoryStore) PutUser(ctx context.Context, user *CUser) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.putUser(user)
+	return nil
+}
+
+func (ms *MemoryStore) putUser(user *CUser) {
+	stored := user.clone()
+	stored.db = nil
+	if _, ok := ms.users[user.Realm]; !ok {
+		ms.users[user.Realm] = make(map[string]*CUser)
+	}
+	ms.users[user.Realm][user.Id] = stored
+}
+
+func (ms *MemoryStore) DeleteUser(ctx context.Context, realm, id string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.users[realm][id]; !ok {
+		return fmt.Errorf("in DeleteUser function, user %s in realm %s: %w", id, realm, ErrNotFound)
+	}
+	delete(ms.users[realm], id)
+	return nil
+}
+
+func (ms *MemoryStore) ListUserIDs(ctx context.Context) (map[string][]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	ret := make(map[string][]string)
+	for realm, users := range ms.users {
+		for id := range users {
+			appendToRealm(ret, realm, id)
+		}
+		sort.Strings(ret[realm])
+	}
+	return ret, nil
+}
+
+func (ms *MemoryStore) GetGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if group, ok := ms.groups[realm][name]; ok {
+		return group.clone(), nil
+	}
+	return nil, fmt.Errorf("in GetGroup function, group %s in realm %s: %w", name, realm, ErrNotFound)
+}
+
+func (ms *MemoryStore) PutGroup(ctx context.Context, group *CGroup) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.putGroup(group)
+	return nil
+}
+
+func (ms *MemoryStore) putGroup(group *CGroup) {
+	stored := group.clone()
+	stored.db = nil
+	if _, ok := ms.groups[group.Realm]; !ok {
+		ms.groups[group.Realm] = make(map[string]*CGroup)
+	}
+	ms.groups[group.Realm][group.Name] = stored
+}
+
+func (ms *MemoryStore) DeleteGroup(ctx context.Context, realm, name string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.groups[realm][name]; !ok {
+		return fmt.Errorf("in DeleteGroup function, group %s in realm %s: %w", name, realm, ErrNotFound)
+	}
+	delete(ms.groups[realm], name)
+	return nil
+}
+
+func (ms *MemoryStore) ListGroupNames(ctx context.Context) (map[string][]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	ret := make(map[string][]string)
+	for realm, groups := range ms.groups {
+		for name := range groups {
+			appendToRealm(ret, realm, name)
+		}
+		sort.Strings(ret[realm])
+	}
+	return ret, nil
+}
+
+// WriteBatch applies every write of the batch while holding the store's lock, so no reader sees a part of it.
+func (ms *MemoryStore) WriteBatch(ctx context.Context, batch *Batch) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, user := range batch.Users {
+		ms.putUser(user)
+	}
+	for _, ref := range batch.DeletedUsers {
+		delete(ms.users[ref.Realm], ref.Key)
+	}
+	for _, group := range batch.Groups {
+		ms.putGroup(group)
+	}
+	for _, ref := range batch.DeletedGroups {
+		delete(ms.groups[ref.Realm], ref.Key)
+	}
+	for _, record := range batch.Aux {
+		if record.Value == nil {
+			delete(ms.aux[record.Bucket], record.Key)
+			continue
+		}
+		if _, ok := ms.aux[record.Bucket]; !ok {
+			ms.aux[record.Bucket] = make(map[string][]byte)
+		}
+		ms.aux[record.Bucket][record.Key] = append([]byte{}, record.Value...)
+	}
+	return nil
+}
+
+// Snapshot writes every user and group currently in the store as JSON into the writer.
+// The written JSON can be loaded back using Load.
+func (ms *MemoryStore) Snapshot(w io.Writer) error {
+	ms.mutex.RLock()
+	snapshot := &MemorySnapshot{
+		Users:  make([]*CUser, 0),
+		Groups: make([]*CGroup, 0),
+	}
+	for _, users := range ms.users {
+		for _, user := range users {
+			snapshot.Users = append(snapshot.Users, user.clone())
+		}
+	}
+	for _, groups := range ms.groups {
+		for _, group := range groups {
+			snapshot.Groups = append(snapshot.Groups, group.clone())
+		}
+	}
+	ms.mutex.RUnlock()
+
+	sort.Slice(snapshot.Users, func(i, j int) bool {
+		if snapshot.Users[i].Realm != snapshot.Users[j].Realm {
+			return snapshot.Users[i].Realm < snapshot.Users[j].Realm
+		}
+		return snapshot.Users[i].Id < snapshot.Users[j].Id
+	})
+	sort.Slice(snapshot.Groups, func(i, j int) bool {
+		if snapshot.Groups[i].Realm != snapshot.Groups[j].Realm {
+			return snapshot.Groups[i].Realm < snapshot.Groups[j].Realm
+		}
+		return snapshot.Groups[i].Name < snapshot.Groups[j].Name
+	})
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(snapshot); err != nil {
+		return fmt.Errorf("in Snapshot function, error encoding snapshot: %w", err)
+	}
+	return nil
+}
+
+// Load reads a JSON snapshot as produced by Snapshot and replaces the whole content of the store with it.
+// Auxiliary records, such as indexes, are dropped. The store is left unchanged if the snapshot could not be read.
+func (ms *MemoryStore) Load(r io.Reader) error {
+	snapshot := &MemorySnapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return fmt.Errorf("in Load function, error decoding snapshot: %w", err)
+	}
+	for _, user := range snapshot.Users {
+		if user.Realm == "" || user.Id == "" {
+			return fmt.Errorf("in Load function, snapshot contains user without realm or id")
+		}
+	}
+	for _, group := range snapshot.Groups {
+		if group.Realm == "" || group.Name == "" {
+			return fmt.Errorf("in Load function, snapshot contains group without realm or name")
+		}
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.users = make(map[string]map[string]*CUser)
+	ms.groups = make(map[string]map[string]*CGroup)
+	ms.aux = make(map[string]map[string][]byte)
+	for _, user := range snapshot.Users {
+		ms.putUser(user)
+	}
+	for _, group := range snapshot.Groups {
+		ms.putGroup(group)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetAux(ctx context.Context, bucket, key string) ([]byte, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if value, ok := ms.aux[bucket][key]; ok {
+		return append([]byte{}, value...), nil
+	}
+	return nil, fmt.Errorf("in GetAux function, %s in bucket %s: %w", key, bucket, ErrNotFound)
+}
+
+func (ms *MemoryStore) PutAux(ctx context.Context, bucket, key string, value []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.aux[bucket]; !ok {
+		ms.aux[bucket] = make(map[string][]byte)
+	}
+	ms.aux[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (ms *MemoryStore) DeleteAux(ctx context.Context, bucket, key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.aux[bucket][key]; !ok {
+		return fmt.Errorf("in DeleteAux function, %s in bucket %s: %w", key, bucket, ErrNotFound)
+	}
+	delete(ms.aux[bucket], key)
+	return nil
+}
+
+func (ms *MemoryStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	ms.mutex.RLock()
+	keys := make([]string, 0)
+	values := make(map[string][]byte)
+	for key, value := range ms.aux[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			values[key] = append([]byte{}, value...)
+		}
+	}
+	ms.mutex.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package credenta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const memoryFixture = `{
+  "users": [
+    {"realm": "RA", "id": "alice", "idType": "USERID", "groups": ["Admin"], "attributes": {}, "roleMasks": [0,0,0,0,0,0,0,0,0,0], "method": "PLAIN", "hash": "password", "enable": true, "active": true}
+  ],
+  "groups": [
+    {"realm": "RA", "name": "Admin", "roleMasks": [5,0,0,0,0,0,0,0,0,0]}
+  ]
+}`
+
+func TestMemoryStore_LoadAndSnapshot(t *testing.T) {
+	ms := NewMemoryStore()
+	assert.NoError(t, ms.Load(strings.NewReader(memoryFixture)))
+
+	cDB := NewCredentaDBWithStore(ms)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	_, roles, err := cDB.GetUserWithAuth(ctx, "RA", "alice", "password")
+	assert.NoError(t, err)
+	assert.True(t, IsRoleFlagOn(roles, 0))
+	assert.False(t, IsRoleFlagOn(roles, 1))
+	assert.True(t, IsRoleFlagOn(roles, 2))
+
+	alice, err := cDB.GetUser(ctx, "RA", "alice")
+	assert.NoError(t, err)
+	alice.Enable = false
+	stored, err := ms.GetUser(ctx, "RA", "alice")
+	assert.NoError(t, err)
+	assert.True(t, stored.Enable, "modifying a retrieved record must not modify the stored one")
+	assert.NoError(t, alice.StoreOrSaveToFile(ctx))
+
+	buff := &bytes.Buffer{}
+	assert.NoError(t, ms.Snapshot(buff))
+
+	restored := NewMemoryStore()
+	assert.NoError(t, restored.Load(buff))
+	restoredAlice, err := restored.GetUser(ctx, "RA", "alice")
+	assert.NoError(t, err)
+	assert.False(t, restoredAlice.Enable)
+
+	assert.Error(t, restored.Load(strings.NewReader(`{"users":[{"id":"bob"}]}`)))
+	_, err = restored.GetUser(ctx, "RA", "alice")
+	assert.NoError(t, err, "a failed load must leave the store unchanged")
+}
+
+func TestMemoryStore_Concurrent(t *testing.T) {
+	ms := NewMemoryStore()
+	ctx := context.Background()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := string(rune('A' + i%26))
+			assert.NoError(t, ms.PutUser(ctx, &CUser{Realm: "RA", Id: id}))
+			_, err := ms.GetUser(ctx, "RA", id)
+			assert.NoError(t, err)
+			_, err = ms.ListUserIDs(ctx)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	ids, err := ms.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, ids["RA"], 26)
+	assert.True(t, errors.Is(ms.DeleteGroup(ctx, "RA", "none"), ErrNotFound))
+}
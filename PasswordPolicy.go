@@ -62,31 +62,40 @@ type PassphrasePolicy struct {
 }
 
 // IsPasswordValid test the supplied pass argument if valid according to the rules specified by the Policy.
+// When it is not, the returned error is a *PolicyError listing every rule the pass does not satisfy.
 func (policy *PassphrasePolicy) IsPasswordValid(pass string) (bool, error) {
+	violations := make([]PolicyViolation, 0)
+	violate := func(rule PolicyRule, message string) {
+		violations = append(violations, PolicyViolation{Rule: rule, Message: message})
+	}
 	realPass := strings.TrimSpace(pass)
 	if len(realPass) != len(pass) {
-		return false, fmt.Errorf("contain leading and trailing spaces")
+		violate(PolicyRuleSpaces, "contain leading and trailing spaces")
 	}
 	words := strings.Split(realPass, " ")
 	if len(words) != policy.WordCount {
-		return false, fmt.Errorf("different word count (%d != %d)", len(words), policy.WordCount)
+		violate(PolicyRuleWordCount, fmt.Sprintf("different word count (%d != %d)", len(words), policy.WordCount))
 	}
 	for _, w := range words {
 		if len(w) < policy.LetterCountPerWord {
-			return false, fmt.Errorf("need more letter in passphrase word")
+			violate(PolicyRuleWordLength, "need more letter in passphrase word")
+			break
 		}
 	}
 	if policy.LetterCountMinimumTotal > len(realPass) {
-		return false, fmt.Errorf("passphrase needs minimum %d letters", policy.LetterCountMinimumTotal)
+		violate(PolicyRuleLength, fmt.Sprintf("passphrase needs minimum %d letters", policy.LetterCountMinimumTotal))
 	}
 	if policy.MustHaveUpperAlphabet && !strings.ContainsAny(pass, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
-		return false, fmt.Errorf("passphrase requires upper alphabet")
+		violate(PolicyRuleUpperAlphabet, "passphrase requires upper alphabet")
 	}
 	if policy.MustHaveNumeric && !strings.ContainsAny(pass, "0123456789") {
-		return false, fmt.Errorf("passphrase requires number")
+		violate(PolicyRuleNumeric, "passphrase requires number")
 	}
 	if policy.MustHaveSymbol && !strings.ContainsAny(pass, "`'\"\\[]{},./;':!@#$%^&*()_+-=") {
-		return false, fmt.Errorf("passphrase requires number")
+		violate(PolicyRuleSymbol, "passphrase requires symbol")
+	}
+	if len(violations) > 0 {
+		return false, &PolicyError{Violations: violations}
 	}
 	return true, nil
 }
@@ -0,0 +1,95 @@
+package credenta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EnablePepper turn on the pepper of the hashes made by the digest verification methods (MD5, SHA1, SHA256 and
+// SHA512). Once enabled, the password is mixed with HMAC keyed by the primary pepper, a server-side secret that is
+// never stored along with the users. The hashes keep the id of the pepper they were made with, so they are still
+// verified once the pepper is rotated as long as the old one stays in the ring, and they are upgraded on login until
+// made again with the primary pepper (see EnableRehash). NewCredentaDB enables it when CREDENTA_PEPPER_FILE or
+// CREDENTA_PEPPER is set, see LoadPepperRing. It should be called before the CredentaDB is used concurrently.
+func (store *CredentaDB) EnablePepper(peppers *PepperRing) error {
+	if peppers == nil || peppers.keys[peppers.primary] == nil {
+		return errors.New("in EnablePepper function. pepper ring has no primary pepper")
+	}
+	store.peppers = peppers
+	return nil
+}
+
+// DisablePepper turn off the pepper, new digest hashes are made without pepper. Peppered hashes can no longer be
+// verified.
+func (store *CredentaDB) DisablePepper() {
+	store.peppers = nil
+}
+
+// minPepperLength is the minimum length of a pepper in bytes.
+const minPepperLength = 16
+
+// PepperRing holds the peppers identified by their key id. New hashes are made with the primary pepper, the other
+// peppers are only used to verify hashes made before the primary pepper was rotated.
+type PepperRing struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// NewPepperRing creates a PepperRing with the primary pepper, which must be at least 16 bytes long.
+func NewPepperRing(id string, key []byte) (*PepperRing, error) {
+	peppers := &PepperRing{primary: id, keys: make(map[string][]byte)}
+	if err := peppers.AddKey(id, key); err != nil {
+		return nil, err
+	}
+	return peppers, nil
+}
+
+// ParsePepperRing parse the peppers in the format of ParseKeyRing. The first pepper is the primary pepper.
+func ParsePepperRing(text string) (*PepperRing, error) {
+	var peppers *PepperRing
+	err := parseKeyList("ParsePepperRing", text, func(id string, key []byte) error {
+		if peppers != nil {
+			return peppers.AddKey(id, key)
+		}
+		var err error
+		peppers, err = NewPepperRing(id, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if peppers == nil {
+		return nil, errors.New("in ParsePepperRing function. no pepper found")
+	}
+	return peppers, nil
+}
+
+// LoadPepperRing loads the PepperRing from the file specified by CREDENTA_PEPPER_FILE environment variable, or from
+// the CREDENTA_PEPPER environment variable itself, both in the format of ParseKeyRing. It returns nil PepperRing
+// without error when neither is set.
+func LoadPepperRing() (*PepperRing, error) {
+	text, err := loadKeyText("LoadPepperRing", "CREDENTA_PEPPER")
+	if err != nil || text == "" {
+		return nil, err
+	}
+	return ParsePepperRing(text)
+}
+
+// AddKey adds a pepper that verifies the hashes made with the key id, replacing the existing pepper of the same id.
+// The key id is kept within the hashes, so it may only contain letters, digits, `.` and `-`.
+func (peppers *PepperRing) AddKey(id string, key []byte) error {
+	if id == "" || strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-") != "" {
+		return fmt.Errorf("in AddKey function. invalid pepper id %q", id)
+	}
+	if len(key) < minPepperLength {
+		return fmt.Errorf("in AddKey function. pepper %s must be at least %d bytes long", id, minPepperLength)
+	}
+	peppers.keys[id] = append([]byte{}, key...)
+	return nil
+}
+
+// PrimaryKeyID returns the id of the pepper new hashes are made with.
+func (peppers *PepperRing) PrimaryKeyID() string {
+	return peppers.primary
+}
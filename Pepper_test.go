@@ -0,0 +1,58 @@
+package credenta
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParsePepperRing(t *testing.T) {
+	for _, text := range []string{"", "# nothing", "p1:not base64", "p1:" + base64.StdEncoding.EncodeToString([]byte("short")), "p$1:" + testKey(1), "p,1:" + testKey(1)} {
+		_, err := ParsePepperRing(text)
+		assert.Error(t, err, text)
+	}
+	peppers, err := ParsePepperRing("p-2025.1:" + testKey(1) + "\np-2024:" + testKey(2))
+	assert.NoError(t, err)
+	assert.Equal(t, "p-2025.1", peppers.PrimaryKeyID())
+	assert.Len(t, peppers.keys, 2)
+}
+
+func TestLoadPepperRing(t *testing.T) {
+	t.Setenv("CREDENTA_PEPPER_FILE", "")
+	t.Setenv("CREDENTA_PEPPER", "")
+	peppers, err := LoadPepperRing()
+	assert.NoError(t, err)
+	assert.Nil(t, peppers)
+
+	t.Setenv("CREDENTA_PEPPER", "p1:"+testKey(1))
+	peppers, err = LoadPepperRing()
+	assert.NoError(t, err)
+	assert.Equal(t, "p1", peppers.PrimaryKeyID())
+}
+
+func TestCredentaDB_EnablePepper(t *testing.T) {
+	dataStore := NewMemoryStore()
+	cDB := NewCredentaDBWithStore(dataStore)
+	assert.Error(t, cDB.EnablePepper(nil))
+	peppers, err := ParsePepperRing("p1:" + testKey(1))
+	assert.NoError(t, err)
+	assert.NoError(t, cDB.EnablePepper(peppers))
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodSHA256)
+	assert.NoError(t, err)
+	user.Active = true
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	assert.True(t, strings.HasPrefix(user.VerificationHash, "$sha256$k=p1$"), user.VerificationHash)
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.NoError(t, err)
+
+	// the pepper belongs to the CredentaDB, another one sharing the store can not verify the hash without it.
+	other := NewCredentaDBWithStore(dataStore)
+	_, _, err = other.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	cDB.DisablePepper()
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
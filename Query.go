@@ -0,0 +1,348 @@
+package credenta
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrInvalidCursor is returned by QueryUsers and QueryGroups when the cursor is malformed, or it was issued for a
+// query with different realm or sorting.
+var ErrInvalidCursor = errors.New("invalid query cursor")
+
+const (
+	// DefaultQueryLimit is the page size used when the query does not specify its Limit.
+	DefaultQueryLimit = 100
+	// MaxQueryLimit is the largest page size a query may request.
+	MaxQueryLimit = 1000
+)
+
+const (
+	// SortByKey sort the records by user id or group name.
+	SortByKey SortField = "KEY"
+	// SortByCreatedAt sort the records by their creation time.
+	SortByCreatedAt SortField = "CREATED_AT"
+	// SortByUpdatedAt sort the records by their last update time.
+	SortByUpdatedAt SortField = "UPDATED_AT"
+)
+
+// SortField specify the field a query result is sorted by. Records with the same field value are sorted by their
+// user id or group name, so the order is always stable.
+type SortField string
+
+// UserQuery select the users of a realm to be returned by CredentaDB.QueryUsers. Filters that are not set (nil or
+// empty) match every user, while all the filters that are set must match.
+type UserQuery struct {
+	// Realm is the realm to list the users of, it is required.
+	Realm string `json:"realm"`
+	// IDType only match users of this id type.
+	IDType IdType `json:"idType,omitempty"`
+	// Enable only match users whose Enable flag is the same.
+	Enable *bool `json:"enable,omitempty"`
+	// Active only match users whose Active flag is the same.
+	Active *bool `json:"active,omitempty"`
+	// Locked only match users that are locked out at the moment, or that are not, see CUser.IsLocked.
+	Locked *bool `json:"locked,omitempty"`
+	// Group only match users that are direct member of this group.
+	Group string `json:"group,omitempty"`
+	// Role only match users having this role bit on.
+	Role *int `json:"role,omitempty"`
+	// IncludeGroupRoles makes Role also match users inheriting the role from their groups.
+	IncludeGroupRoles bool `json:"includeGroupRoles,omitempty"`
+	// Attributes only match users having every attribute name with the same value string.
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// SortBy is the sorting field, SortByKey if empty.
+	SortBy SortField `json:"sortBy,omitempty"`
+	// Descending reverse the sorting order.
+	Descending bool `json:"descending,omitempty"`
+	// Limit is the maximum number of users in a page, DefaultQueryLimit if zero.
+	Limit int `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page, empty for the first page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// UserPage is a page of users returned by CredentaDB.QueryUsers.
+type UserPage struct {
+	Users []*CUser `json:"users"`
+	// NextCursor is the cursor of the next page, empty if this is the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GroupQuery select the groups of a realm to be returned by CredentaDB.QueryGroups. Filters that are not set (nil or
+// empty) match every group, while all the filters that are set must match.
+type GroupQuery struct {
+	// Realm is the realm to list the groups of, it is required.
+	Realm string `json:"realm"`
+	// ParentGroup only match groups that are direct child of this group.
+	ParentGroup string `json:"parentGroup,omitempty"`
+	// Role only match groups having this role bit on, not counting the role inherited from their parents.
+	Role *int `json:"role,omitempty"`
+	// Attributes only match groups having every attribute name with the same value string.
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// SortBy is the sorting field, SortByKey if empty.
+	SortBy SortField `json:"sortBy,omitempty"`
+	// Descending reverse the sorting order.
+	Descending bool `json:"descending,omitempty"`
+	// Limit is the maximum number of groups in a page, DefaultQueryLimit if zero.
+	Limit int `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page, empty for the first page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// GroupPage is a page of groups returned by CredentaDB.QueryGroups.
+type GroupPage struct {
+	Groups []*CGroup `json:"groups"`
+	// NextCursor is the cursor of the next page, empty if this is the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// QueryUsers returns a page of the users of a realm matching the query, sorted as requested. Pagination is cursor
+// based, the next page starts right after the last user of this page, so users added or removed between the calls
+// never cause a user to be skipped or repeated. Every user of the realm is loaded to be filtered, thus the cost is
+// proportional to the realm size regardless of the page size.
+func (store *CredentaDB) QueryUsers(ctx context.Context, query *UserQuery) (*UserPage, error) {
+	if query.Realm == "" {
+		return nil, fmt.Errorf("in QueryUsers function. realm is required")
+	}
+	limit, after, err := preparePage(query.Realm, query.SortBy, query.Descending, query.Limit, query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]*CUser, 0)
+	err = store.WalkUserIDs(ctx, func(realm, id string) error {
+		if realm != query.Realm {
+			return nil
+		}
+		user, err := store.GetUser(ctx, realm, id)
+		if errors.Is(err, ErrNotFound) {
+			// deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !store.matchUser(ctx, user, query) {
+			return nil
+		}
+		if after == nil || after.before(sortValue(query.SortBy, user.Id, user.CreatedAt, user.UpdatedAt), user.Id, query.Descending) {
+			matches = append(matches, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in QueryUsers function. error listing users: %w", err)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a := pageCursor{Value: sortValue(query.SortBy, matches[i].Id, matches[i].CreatedAt, matches[i].UpdatedAt), Key: matches[i].Id}
+		return a.before(sortValue(query.SortBy, matches[j].Id, matches[j].CreatedAt, matches[j].UpdatedAt), matches[j].Id, query.Descending)
+	})
+	page := &UserPage{Users: matches}
+	if len(matches) > limit {
+		page.Users = matches[:limit]
+		last := page.Users[limit-1]
+		page.NextCursor = encodeCursor(query.Realm, query.SortBy, query.Descending, sortValue(query.SortBy, last.Id, last.CreatedAt, last.UpdatedAt), last.Id)
+	}
+	return page, nil
+}
+
+// QueryGroups returns a page of the groups of a realm matching the query, sorted as requested. Pagination works the
+// same way as QueryUsers.
+func (store *CredentaDB) QueryGroups(ctx context.Context, query *GroupQuery) (*GroupPage, error) {
+	if query.Realm == "" {
+		return nil, fmt.Errorf("in QueryGroups function. realm is required")
+	}
+	limit, after, err := preparePage(query.Realm, query.SortBy, query.Descending, query.Limit, query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]*CGroup, 0)
+	err = store.WalkGroupNames(ctx, func(realm, name string) error {
+		if realm != query.Realm {
+			return nil
+		}
+		group, err := store.GetGroup(ctx, realm, name)
+		if errors.Is(err, ErrNotFound) {
+			// deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !matchGroup(group, query) {
+			return nil
+		}
+		if after == nil || after.before(sortValue(query.SortBy, group.Name, group.CreatedAt, group.UpdatedAt), group.Name, query.Descending) {
+			matches = append(matches, group)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in QueryGroups function. error listing groups: %w", err)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a := pageCursor{Value: sortValue(query.SortBy, matches[i].Name, matches[i].CreatedAt, matches[i].UpdatedAt), Key: matches[i].Name}
+		return a.before(sortValue(query.SortBy, matches[j].Name, matches[j].CreatedAt, matches[j].UpdatedAt), matches[j].Name, query.Descending)
+	})
+	page := &GroupPage{Groups: matches}
+	if len(matches) > limit {
+		page.Groups = matches[:limit]
+		last := page.Groups[limit-1]
+		page.NextCursor = encodeCursor(query.Realm, query.SortBy, query.Descending, sortValue(query.SortBy, last.Name, last.CreatedAt, last.UpdatedAt), last.Name)
+	}
+	return page, nil
+}
+
+// matchUser returns true if the user satisfy every filter of the query.
+func (store *CredentaDB) matchUser(ctx context.Context, user *CUser, query *UserQuery) bool {
+	if query.IDType != "" && user.IDType != query.IDType {
+		return false
+	}
+	if query.Enable != nil && user.Enable != *query.Enable {
+		return false
+	}
+	if query.Active != nil && user.Active != *query.Active {
+		return false
+	}
+	if query.Locked != nil && user.IsLocked() != *query.Locked {
+		return false
+	}
+	if query.Group != "" && !containsString(user.Groups, query.Group) {
+		return false
+	}
+	for name, value := range query.Attributes {
+		attr, ok := user.Attributes[name]
+		if !ok || attr.ValueString != value {
+			return false
+		}
+	}
+	if query.Role != nil && !hasRoleBit(user.RoleMasks, *query.Role) {
+		if !query.IncludeGroupRoles {
+			return false
+		}
+		for _, group := range user.Groups {
+			if hasRoleBit(store.GetRoleMasksOfGroups(ctx, user.Realm, group), *query.Role) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchGroup returns true if the group satisfy every filter of the query.
+func matchGroup(group *CGroup, query *GroupQuery) bool {
+	if query.ParentGroup != "" && !containsString(group.ParentGroups, query.ParentGroup) {
+		return false
+	}
+	if query.Role != nil && !hasRoleBit(group.RoleMasks, *query.Role) {
+		return false
+	}
+	for name, value := range query.Attributes {
+		found := false
+		for _, attr := range group.Attributes {
+			if attr.Name == name && attr.ValueString == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasRoleBit is like IsRoleFlagOn but returns false instead of panicking when the masks are too short.
+func hasRoleBit(masks []uint64, role int) bool {
+	seq, bit := toUint64ByBit(role)
+	if role < 0 || seq >= len(masks) {
+		return false
+	}
+	return isBitFlagOn(masks[seq], bit)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortValue returns the value of the sorting field as a string whose lexical order is the field order.
+func sortValue(sortBy SortField, key string, createdAt, updatedAt time.Time) string {
+	switch sortBy {
+	case SortByCreatedAt:
+		return createdAt.UTC().Format(sortTimeLayout)
+	case SortByUpdatedAt:
+		return updatedAt.UTC().Format(sortTimeLayout)
+	default:
+		return key
+	}
+}
+
+// sortTimeLayout is a fixed width time layout, so times can be compared as strings.
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// pageCursor is the position of the last record of a page, encoded in the query cursor.
+type pageCursor struct {
+	Realm      string    `json:"r"`
+	SortBy     SortField `json:"s"`
+	Descending bool      `json:"d"`
+	Value      string    `json:"v"`
+	Key        string    `json:"k"`
+}
+
+// before returns true if the cursor position comes before the record with the sort value and key.
+func (c *pageCursor) before(value, key string, descending bool) bool {
+	if c.Value != value {
+		return (c.Value < value) != descending
+	}
+	return (c.Key < key) != descending
+}
+
+// preparePage validate the page limit and decode the cursor, returning nil cursor for the first page.
+func preparePage(realm string, sortBy SortField, descending bool, limit int, cursor string) (int, *pageCursor, error) {
+	switch sortBy {
+	case "", SortByKey, SortByCreatedAt, SortByUpdatedAt:
+	default:
+		return 0, nil, fmt.Errorf("unknown sort field %s", sortBy)
+	}
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		return 0, nil, fmt.Errorf("limit %d is more than %d", limit, MaxQueryLimit)
+	}
+	if cursor == "" {
+		return limit, nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, nil, ErrInvalidCursor
+	}
+	after := &pageCursor{}
+	if err := json.Unmarshal(data, after); err != nil {
+		return 0, nil, ErrInvalidCursor
+	}
+	if after.Realm != realm || after.SortBy != sortBy || after.Descending != descending {
+		return 0, nil, ErrInvalidCursor
+	}
+	return limit, after, nil
+}
+
+func encodeCursor(realm string, sortBy SortField, descending bool, value, key string) string {
+	data, _ := json.Marshal(&pageCursor{Realm: realm, SortBy: sortBy, Descending: descending, Value: value, Key: key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
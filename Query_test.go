@@ -0,0 +1,125 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestQueryDB(t *testing.T) (*CredentaDB, context.Context) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	parent, err := cDB.NewGroup(ctx, "RA", "Parent", nil)
+	assert.NoError(t, err)
+	parent.AddRole(7)
+	assert.NoError(t, parent.StoreOrSaveToFile(ctx))
+	child, err := cDB.NewGroup(ctx, "RA", "Child", []string{"Parent"})
+	assert.NoError(t, err)
+	assert.NoError(t, child.SetAttribute("dept", "string", "sales"))
+	child.CreatedAt = parent.CreatedAt.Add(-time.Second)
+	assert.NoError(t, child.StoreOrSaveToFile(ctx))
+
+	for i := 0; i < 25; i++ {
+		var groups []string
+		if i%5 == 0 {
+			groups = []string{"Child"}
+		}
+		user, err := cDB.NewUser(ctx, "RA", fmt.Sprintf("USER%02d", i), "password", groups, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		user.Active = i%2 == 0
+		if i == 3 {
+			user.IDType = IdTypeUserEmail
+			user.AddRole(70)
+			assert.NoError(t, user.SetAttribute("email", "string", "user03@mail.com"))
+		}
+		assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	}
+	other, err := cDB.NewUser(ctx, "RB", "USER00", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, other.StoreOrSaveToFile(ctx))
+	return cDB, ctx
+}
+
+func TestCredentaDB_QueryUsersPagination(t *testing.T) {
+	cDB, ctx := newTestQueryDB(t)
+
+	ids := make([]string, 0)
+	query := &UserQuery{Realm: "RA", Limit: 10}
+	for pages := 0; ; pages++ {
+		page, err := cDB.QueryUsers(ctx, query)
+		assert.NoError(t, err)
+		for _, user := range page.Users {
+			ids = append(ids, user.Id)
+		}
+		if page.NextCursor == "" {
+			assert.Equal(t, 2, pages)
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	assert.Len(t, ids, 25)
+	assert.Equal(t, "USER00", ids[0])
+	assert.Equal(t, "USER24", ids[24])
+
+	page, err := cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Limit: 3, Descending: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "USER24", page.Users[0].Id)
+	assert.Equal(t, "USER22", page.Users[2].Id)
+
+	_, err = cDB.QueryUsers(ctx, &UserQuery{Realm: "RB", Cursor: page.NextCursor})
+	assert.True(t, errors.Is(err, ErrInvalidCursor))
+	_, err = cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Cursor: "garbage"})
+	assert.True(t, errors.Is(err, ErrInvalidCursor))
+}
+
+func TestCredentaDB_QueryUsersFilter(t *testing.T) {
+	cDB, ctx := newTestQueryDB(t)
+	active, role, inheritedRole := true, 70, 7
+
+	page, err := cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Active: &active})
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 13)
+
+	page, err = cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", IDType: IdTypeUserEmail, Role: &role, Attributes: map[string]string{"email": "user03@mail.com"}})
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 1)
+	assert.Equal(t, "USER03", page.Users[0].Id)
+
+	page, err = cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Group: "Child", Active: &active})
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 3)
+
+	page, err = cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Role: &inheritedRole})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Users)
+	page, err = cDB.QueryUsers(ctx, &UserQuery{Realm: "RA", Role: &inheritedRole, IncludeGroupRoles: true})
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 5)
+}
+
+func TestCredentaDB_QueryGroups(t *testing.T) {
+	cDB, ctx := newTestQueryDB(t)
+	role := 7
+
+	page, err := cDB.QueryGroups(ctx, &GroupQuery{Realm: "RA", SortBy: SortByCreatedAt})
+	assert.NoError(t, err)
+	assert.Len(t, page.Groups, 2)
+	assert.Equal(t, "Child", page.Groups[0].Name)
+
+	page, err = cDB.QueryGroups(ctx, &GroupQuery{Realm: "RA", ParentGroup: "Parent", Attributes: map[string]string{"dept": "sales"}})
+	assert.NoError(t, err)
+	assert.Len(t, page.Groups, 1)
+	assert.Equal(t, "Child", page.Groups[0].Name)
+
+	page, err = cDB.QueryGroups(ctx, &GroupQuery{Realm: "RA", Role: &role})
+	assert.NoError(t, err)
+	assert.Len(t, page.Groups, 1)
+	assert.Equal(t, "Parent", page.Groups[0].Name)
+
+	_, err = cDB.QueryGroups(ctx, &GroupQuery{Realm: "RA", SortBy: "NAME"})
+	assert.Error(t, err)
+}
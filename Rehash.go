@@ -0,0 +1,102 @@
+package credenta
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// RehashEvent reports the upgrade of a user's verification hash after a successful authentication.
+type RehashEvent struct {
+	Realm string
+	Id    string
+	// From is the verification method the password was hashed with.
+	From VerificationMethod
+	// To is the preferred verification method the password is hashed with now.
+	To VerificationMethod
+	// Err is the reason the new hash could not be saved, nil when it was saved. The authentication succeeds either
+	// way, and the upgrade is attempted again on the next one.
+	Err error
+}
+
+// RehashHook is called after every upgrade of a verification hash, see CredentaDB.EnableRehash.
+type RehashHook func(ctx context.Context, event *RehashEvent)
+
+// EnableRehash turn on the hash upgrade on login. Once enabled, when GetUserWithAuth authenticates a user whose
+// password is hashed with another method than preferred, or with weaker parameters (see NeedsRehash), the password
+// is hashed again with the preferred method and saved, so users of a legacy system are moved to a stronger method
+// without resetting their password. The hook, if not nil, is called after every upgrade. It should be called
+// before the CredentaDB is used concurrently.
+func (store *CredentaDB) EnableRehash(preferred VerificationMethod, hook RehashHook) error {
+	if !knownVerificationMethod(preferred) {
+		return fmt.Errorf("in EnableRehash function. unknown verification method %q", preferred)
+	}
+	store.preferredMethod = preferred
+	store.rehashHook = hook
+	return nil
+}
+
+// SetHashParameters sets the parameters of the hashes made by NewUser, ChangeUserPassword, the imports and the hash
+// upgrade on login, nil to go back to the DefaultHashParameters. Changing them only applies to new hashes, the
+// existing ones made with weaker parameters are upgraded on login once EnableRehash is called. It should be called
+// before the CredentaDB is used concurrently.
+func (store *CredentaDB) SetHashParameters(params *HashParameters) error {
+	if params == nil {
+		store.hashParams = nil
+		return nil
+	}
+	if err := params.validate(); err != nil {
+		return fmt.Errorf("in SetHashParameters function : %w", err)
+	}
+	copied := *params
+	store.hashParams = &copied
+	return nil
+}
+
+// DisableRehash turn off the hash upgrade on login.
+func (store *CredentaDB) DisableRehash() {
+	store.preferredMethod = ""
+	store.rehashHook = nil
+}
+
+// rehash hashes the password of the authenticated user with the preferred method and saves it, unless the stored
+// hash was changed meanwhile. The user's Version is increased, so a copy loaded before can not put the old hash back,
+// while the new hash is not a change made by someone, so the update time and history are left untouched. The user is
+// updated with the new hash and Version once saved.
+func (store *CredentaDB) rehash(ctx context.Context, user *CUser, password string) {
+	event := &RehashEvent{Realm: user.Realm, Id: user.Id, From: user.VerificationMethod, To: store.preferredMethod}
+	event.Err = func() error {
+		hash, err := makeVerification(store.preferredMethod, password, store.peppers, store.hashParams)
+		if err != nil {
+			return err
+		}
+		unlock, err := store.lockUser(ctx, user.Realm, user.Id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		stored, err := store.loadUser(ctx, user.Realm, user.Id)
+		if err != nil {
+			return err
+		}
+		if stored.VerificationMethod != user.VerificationMethod || stored.VerificationHash != user.VerificationHash {
+			return fmt.Errorf("verification hash of user %s in realm %s was changed meanwhile: %w", user.Id, user.Realm, ErrConflict)
+		}
+		stored.VerificationMethod = store.preferredMethod
+		stored.VerificationHash = hash
+		stored.Version++
+		if err := store.putUserChecked(ctx, stored, stored.Version-1, false); err != nil {
+			return err
+		}
+		store.invalidateUser(user.Realm, user.Id)
+		user.VerificationMethod = stored.VerificationMethod
+		user.VerificationHash = stored.VerificationHash
+		user.Version = stored.Version
+		return nil
+	}()
+	if store.rehashHook != nil {
+		store.rehashHook(ctx, event)
+	} else if event.Err != nil {
+		log.Printf("credenta could not upgrade the verification hash of user %s in realm %s : %v\n", user.Id, user.Realm, event.Err)
+	}
+}
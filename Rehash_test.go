@@ -0,0 +1,146 @@
+package credenta
+
+import (
+	"context"
+	"github.com/alexedwards/argon2id"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCredentaDB_Rehash(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			cDB.EnableCache(DefaultCacheConfig())
+			events := make([]*RehashEvent, 0)
+			assert.NoError(t, cDB.EnableRehash(VerificationMethodARGON, func(ctx context.Context, event *RehashEvent) {
+				events = append(events, event)
+			}))
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodMD5)
+			assert.NoError(t, err)
+			user.Active = true
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+			assert.Error(t, err)
+			assert.Empty(t, events)
+			stale, err := cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+
+			authenticated, _, err := cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+			assert.Equal(t, []*RehashEvent{{Realm: "RA", Id: "john", From: VerificationMethodMD5, To: VerificationMethodARGON}}, events)
+			assert.Equal(t, VerificationMethodARGON, authenticated.VerificationMethod)
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.Equal(t, VerificationMethodARGON, john.VerificationMethod)
+			assert.True(t, MatchVerification(john.VerificationMethod, "password", john.VerificationHash))
+			assert.Equal(t, uint64(2), john.Version, "upgrading the hash must change the version")
+			assert.Equal(t, john.Version, authenticated.Version)
+
+			// a copy loaded before the upgrade can not put the legacy hash back.
+			stale.Active = false
+			assert.ErrorIs(t, cDB.SaveUser(ctx, stale), ErrConflict)
+			john, err = cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.Equal(t, VerificationMethodARGON, john.VerificationMethod)
+
+			// the upgraded hash is not upgraded again.
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+			assert.Len(t, events, 1)
+
+			// argon hashes with weaker parameters are upgraded too.
+			weak, err := argon2id.CreateHash("password", &argon2id.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+			assert.NoError(t, err)
+			assert.NoError(t, cDB.Update(ctx, "RA", "john", func(user *CUser) error {
+				user.VerificationHash = weak
+				return nil
+			}))
+			_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+			assert.NoError(t, err)
+			if assert.Len(t, events, 2) {
+				assert.Equal(t, VerificationMethodARGON, events[1].From)
+				assert.NoError(t, events[1].Err)
+			}
+			john, err = cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.False(t, NeedsRehash(john.VerificationMethod, john.VerificationHash, VerificationMethodARGON))
+		})
+	}
+}
+
+func TestCredentaDB_RehashLegacyDigest(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	assert.NoError(t, cDB.EnableRehash(VerificationMethodSHA1, nil))
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodSHA1)
+	assert.NoError(t, err)
+	user.Active = true
+	user.VerificationHash = "70617373776f7264da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "john", "password")
+	assert.NoError(t, err)
+	john, err := cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, VerificationMethodSHA1, john.VerificationMethod)
+	assert.True(t, strings.HasPrefix(john.VerificationHash, "$sha1$"), john.VerificationHash)
+	assert.True(t, MatchVerification(john.VerificationMethod, "password", john.VerificationHash))
+}
+
+func TestNeedsRehash(t *testing.T) {
+	md5Hash, err := MakeVerification(VerificationMethodMD5, "password")
+	assert.NoError(t, err)
+	assert.True(t, NeedsRehash(VerificationMethodMD5, md5Hash, VerificationMethodARGON))
+	assert.False(t, NeedsRehash(VerificationMethodMD5, md5Hash, VerificationMethodMD5))
+
+	argonHash, err := MakeVerification(VerificationMethodARGON, "password")
+	assert.NoError(t, err)
+	assert.False(t, NeedsRehash(VerificationMethodARGON, argonHash, VerificationMethodARGON))
+	assert.True(t, NeedsRehash(VerificationMethodARGON, "malformed", VerificationMethodARGON))
+
+	assert.Error(t, NewCredentaDBWithStore(NewMemoryStore()).EnableRehash("ROT13", nil))
+}
+
+func TestCredentaDB_SetHashParameters(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	params := DefaultHashParameters()
+	params.PBKDF2 = PBKDF2Parameters{Digest: DigestSHA512, Iterations: 1000, SaltLength: 8, KeyLength: 64}
+	assert.NoError(t, cDB.SetHashParameters(params))
+	// the parameters are copied, changing them afterwards has no effect.
+	params.PBKDF2.Iterations = 2000
+
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPBKDF2)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(user.VerificationHash, "$pbkdf2-sha512$i=1000,l=64$"), user.VerificationHash)
+	other, err := NewCredentaDBWithStore(NewMemoryStore()).NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPBKDF2)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(other.VerificationHash, "$pbkdf2-sha256$i=600000,l=32$"), other.VerificationHash)
+
+	params.PBKDF2.Digest = "md5"
+	assert.Error(t, cDB.SetHashParameters(params))
+	params = DefaultHashParameters()
+	params.BcryptCost = 99
+	assert.Error(t, cDB.SetHashParameters(params))
+	assert.NoError(t, cDB.SetHashParameters(nil))
+	user, err = cDB.NewUser(ctx, "RA", "jane", "password", nil, IdTypeUserId, VerificationMethodPBKDF2)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(user.VerificationHash, "$pbkdf2-sha256$i=600000,l=32$"), user.VerificationHash)
+
+	// the hashes are upgraded on login to the parameters of the CredentaDB.
+	params = DefaultHashParameters()
+	params.PBKDF2 = PBKDF2Parameters{Digest: DigestSHA512, Iterations: 1000, SaltLength: 8, KeyLength: 64}
+	assert.NoError(t, cDB.SetHashParameters(params))
+	assert.NoError(t, cDB.EnableRehash(VerificationMethodPBKDF2, nil))
+	user.Active = true
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	_, _, err = cDB.GetUserWithAuth(ctx, "RA", "jane", "password")
+	assert.NoError(t, err)
+	user, err = cDB.GetUser(ctx, "RA", "jane")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(user.VerificationHash, "$pbkdf2-sha512$i=1000,l=64$"), user.VerificationHash)
+}
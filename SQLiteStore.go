@@ -0,0 +1,909 @@
+package credenta
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"strings"
+	"time"
+)
+
+// sqliteMigrations are the schema migrations of SQLiteStore. The n-th element will bring the schema into version n+1.
+// Migrations are applied in order when the store is opened, never modify an already released migration,
+// always append a new one.
+var sqliteMigrations = []string{
+	`CREATE TABLE cusers (
+		realm      TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		id_type    TEXT NOT NULL,
+		method     TEXT NOT NULL,
+		hash       TEXT NOT NULL,
+		enable     INTEGER NOT NULL,
+		active     INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		updated_by TEXT NOT NULL,
+		PRIMARY KEY (realm, id)
+	);
+	CREATE TABLE cuser_groups (
+		realm      TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		seq        INTEGER NOT NULL,
+		group_name TEXT NOT NULL,
+		PRIMARY KEY (realm, user_id, seq),
+		FOREIGN KEY (realm, user_id) REFERENCES cusers (realm, id) ON DELETE CASCADE
+	);
+	CREATE INDEX cuser_groups_group ON cuser_groups (realm, group_name);
+	CREATE TABLE cuser_attributes (
+		realm        TEXT NOT NULL,
+		user_id      TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		seq          INTEGER NOT NULL,
+		value_type   TEXT NOT NULL,
+		value_string TEXT NOT NULL,
+		PRIMARY KEY (realm, user_id, name),
+		FOREIGN KEY (realm, user_id) REFERENCES cusers (realm, id) ON DELETE CASCADE
+	);
+	CREATE TABLE cuser_role_masks (
+		realm   TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		seq     INTEGER NOT NULL,
+		mask    INTEGER NOT NULL,
+		PRIMARY KEY (realm, user_id, seq),
+		FOREIGN KEY (realm, user_id) REFERENCES cusers (realm, id) ON DELETE CASCADE
+	);
+	CREATE TABLE cgroups (
+		realm      TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		updated_by TEXT NOT NULL,
+		PRIMARY KEY (realm, name)
+	);
+	CREATE TABLE cgroup_parents (
+		realm       TEXT NOT NULL,
+		group_name  TEXT NOT NULL,
+		seq         INTEGER NOT NULL,
+		parent_name TEXT NOT NULL,
+		PRIMARY KEY (realm, group_name, seq),
+		FOREIGN KEY (realm, group_name) REFERENCES cgroups (realm, name) ON DELETE CASCADE
+	);
+	CREATE TABLE cgroup_attributes (
+		realm        TEXT NOT NULL,
+		group_name   TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		seq          INTEGER NOT NULL,
+		value_type   TEXT NOT NULL,
+		value_string TEXT NOT NULL,
+		PRIMARY KEY (realm, group_name, name),
+		FOREIGN KEY (realm, group_name) REFERENCES cgroups (realm, name) ON DELETE CASCADE
+	);
+	CREATE TABLE cgroup_role_masks (
+		realm      TEXT NOT NULL,
+		group_name TEXT NOT NULL,
+		seq        INTEGER NOT NULL,
+		mask       INTEGER NOT NULL,
+		PRIMARY KEY (realm, group_name, seq),
+		FOREIGN KEY (realm, group_name) REFERENCES cgroups (realm, name) ON DELETE CASCADE
+	);`,
+	`ALTER TABLE cusers ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE cgroups ADD COLUMN version INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE aux_records (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		value  BLOB NOT NULL,
+		PRIMARY KEY (bucket, key)
+	);`,
+	`ALTER TABLE cusers ADD COLUMN sealed TEXT NOT NULL DEFAULT '';
+	ALTER TABLE cgroups ADD COLUMN sealed TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE cusers ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE cusers ADD COLUMN lockouts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE cusers ADD COLUMN last_failed_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE cusers ADD COLUMN locked_until TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE cuser_unique_values (
+		realm     TEXT NOT NULL,
+		attribute TEXT NOT NULL,
+		value     TEXT NOT NULL,
+		user_id   TEXT NOT NULL,
+		PRIMARY KEY (realm, attribute, value),
+		FOREIGN KEY (realm, user_id) REFERENCES cusers (realm, id) ON DELETE CASCADE
+	);
+	CREATE INDEX cuser_unique_values_user ON cuser_unique_values (realm, user_id);`,
+}
+
+// sqlExecutor is the common methods of *sql.DB and *sql.Tx used by SQLiteStore
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database file in the specified path and bring its schema
+// up to date by applying all pending migrations.
+// The SQLite driver used is a pure Go implementation, so no cgo is required.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("in NewSQLiteStore function, error opening database %s: %w", path, err)
+	}
+	sqliteStore := &SQLiteStore{
+		Path: path,
+		db:   db,
+	}
+	if err := sqliteStore.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqliteStore, nil
+}
+
+// SQLiteStore is a Store implementation that keep all users and groups in a single SQLite database file.
+// It implements CheckedWriter, so several processes may share the database file.
+type SQLiteStore struct {
+	Path string `json:"path"`
+
+	db *sql.DB
+}
+
+// Close closes the underlying database.
+func (ss *SQLiteStore) Close() error {
+	return ss.db.Close()
+}
+
+// SchemaVersion returns the current schema version of the database.
+func (ss *SQLiteStore) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := ss.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("in SchemaVersion function, error reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies every migration that have not been applied, each of them in its own transaction.
+func (ss *SQLiteStore) migrate(ctx context.Context) error {
+	_, err := ss.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("in migrate function, error creating schema_migrations: %w", err)
+	}
+	current, err := ss.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current > len(sqliteMigrations) {
+		return fmt.Errorf("in migrate function, database schema version %d is newer than supported version %d", current, len(sqliteMigrations))
+	}
+	for version := current + 1; version <= len(sqliteMigrations); version++ {
+		tx, err := ss.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("in migrate function, error starting transaction: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("in migrate function, error applying migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", version, formatSQLTime(time.Now())); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("in migrate function, error recording migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("in migrate function, error committing migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// inTx run fn within a database transaction, commit it when fn succeed or rollback otherwise.
+func (ss *SQLiteStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("in inTx function, error starting transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// inReadTx run fn within a read-only database transaction, so every query of fn reads the same snapshot even when
+// another connection writes meanwhile.
+func (ss *SQLiteStore) inReadTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := ss.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("in inReadTx function, error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+// GetUser reads the user and its groups, attributes and role masks within a single read transaction.
+func (ss *SQLiteStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	var user *CUser
+	err := ss.inReadTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = sqlGetUser(ctx, tx, realm, id)
+		return err
+	})
+	return user, err
+}
+
+func (ss *SQLiteStore) PutUser(ctx context.Context, user *CUser) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		return sqlPutUser(ctx, tx, user)
+	})
+}
+
+// PutUserChecked puts the user within a single transaction whose writes are conditioned on the stored version, and
+// claims the unique values through the primary key of cuser_unique_values, see CheckedWriter.
+func (ss *SQLiteStore) PutUserChecked(ctx context.Context, user *CUser, expected uint64, unique []UniqueValue) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		return sqlPutUserChecked(ctx, tx, user, expected, unique)
+	})
+}
+
+func (ss *SQLiteStore) DeleteUser(ctx context.Context, realm, id string) error {
+	return sqlDeleteUser(ctx, ss.db, realm, id)
+}
+
+func (ss *SQLiteStore) ListUserIDs(ctx context.Context) (map[string][]string, error) {
+	return sqlListKeys(ctx, ss.db, "SELECT realm, id FROM cusers ORDER BY realm, id")
+}
+
+// GetGroup reads the group and its attributes and role masks within a single read transaction.
+func (ss *SQLiteStore) GetGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	var group *CGroup
+	err := ss.inReadTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		group, err = sqlGetGroup(ctx, tx, realm, name)
+		return err
+	})
+	return group, err
+}
+
+func (ss *SQLiteStore) PutGroup(ctx context.Context, group *CGroup) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		return sqlPutGroup(ctx, tx, group)
+	})
+}
+
+// PutGroupChecked puts the group within a single transaction whose writes are conditioned on the stored version,
+// see CheckedWriter.
+func (ss *SQLiteStore) PutGroupChecked(ctx context.Context, group *CGroup, expected uint64) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		return sqlPutGroupChecked(ctx, tx, group, expected)
+	})
+}
+
+func (ss *SQLiteStore) DeleteGroup(ctx context.Context, realm, name string) error {
+	return sqlDeleteGroup(ctx, ss.db, realm, name)
+}
+
+func (ss *SQLiteStore) ListGroupNames(ctx context.Context) (map[string][]string, error) {
+	return sqlListKeys(ctx, ss.db, "SELECT realm, name FROM cgroups ORDER BY realm, name")
+}
+
+func (ss *SQLiteStore) GetAux(ctx context.Context, bucket, key string) ([]byte, error) {
+	return sqlGetAux(ctx, ss.db, bucket, key)
+}
+
+func (ss *SQLiteStore) PutAux(ctx context.Context, bucket, key string, value []byte) error {
+	return sqlPutAux(ctx, ss.db, bucket, key, value)
+}
+
+func (ss *SQLiteStore) DeleteAux(ctx context.Context, bucket, key string) error {
+	return sqlDeleteAux(ctx, ss.db, bucket, key)
+}
+
+func (ss *SQLiteStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	return sqlScanAux(ctx, ss.db, bucket, prefix, fn)
+}
+
+// WriteBatch applies every write of the batch within a single database transaction. The records whose version is
+// expected by the batch are written like PutUserChecked and PutGroupChecked.
+func (ss *SQLiteStore) WriteBatch(ctx context.Context, batch *Batch) error {
+	return ss.inTx(ctx, func(tx *sql.Tx) error {
+		for _, user := range batch.Users {
+			var err error
+			if expected, ok := batch.expectedVersion(RecordUser, user.Realm, user.Id); ok {
+				err = sqlPutUserChecked(ctx, tx, user, expected, batch.unique[recordKey{user.Realm, user.Id}])
+			} else {
+				err = sqlPutUser(ctx, tx, user)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, ref := range batch.DeletedUsers {
+			if expected, ok := batch.expectedVersion(RecordUser, ref.Realm, ref.Key); ok {
+				if err := sqlCheckVersion(ctx, tx, RecordUser, ref.Realm, ref.Key, expected); err != nil {
+					return err
+				}
+			}
+			if err := sqlDeleteUser(ctx, tx, ref.Realm, ref.Key); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		for _, group := range batch.Groups {
+			var err error
+			if expected, ok := batch.expectedVersion(RecordGroup, group.Realm, group.Name); ok {
+				err = sqlPutGroupChecked(ctx, tx, group, expected)
+			} else {
+				err = sqlPutGroup(ctx, tx, group)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, ref := range batch.DeletedGroups {
+			if expected, ok := batch.expectedVersion(RecordGroup, ref.Realm, ref.Key); ok {
+				if err := sqlCheckVersion(ctx, tx, RecordGroup, ref.Realm, ref.Key, expected); err != nil {
+					return err
+				}
+			}
+			if err := sqlDeleteGroup(ctx, tx, ref.Realm, ref.Key); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		for _, record := range batch.Aux {
+			var err error
+			if record.Value == nil {
+				err = sqlDeleteAux(ctx, tx, record.Bucket, record.Key)
+			} else {
+				err = sqlPutAux(ctx, tx, record.Bucket, record.Key, record.Value)
+			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sqlGetUser(ctx context.Context, ex sqlExecutor, realm, id string) (*CUser, error) {
+	user := &CUser{
+		Attributes: make(map[string]*Attribute),
+		RoleMasks:  make([]uint64, RoleMaskCount),
+	}
+	var idType, method, createdAt, updatedAt, sealed, lastFailedAt, lockedUntil string
+	var version int64
+	err := ex.QueryRowContext(ctx, `SELECT realm, id, id_type, method, hash, enable, active, created_at, created_by, updated_at, updated_by, version, sealed,
+		failed_attempts, lockouts, last_failed_at, locked_until
+		FROM cusers WHERE realm = ? AND id = ?`, realm, id).Scan(&user.Realm, &user.Id, &idType, &method, &user.VerificationHash,
+		&user.Enable, &user.Active, &createdAt, &user.CreatedBy, &updatedAt, &user.UpdatedBy, &version, &sealed,
+		&user.FailedAttempts, &user.Lockouts, &lastFailedAt, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("in GetUser function, user %s in realm %s: %w", id, realm, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("in GetUser function, error reading user %s in realm %s: %w", id, realm, err)
+	}
+	user.IDType = IdType(idType)
+	user.VerificationMethod = VerificationMethod(method)
+	user.CreatedAt = parseSQLTime(createdAt)
+	user.UpdatedAt = parseSQLTime(updatedAt)
+	user.Version = uint64(version)
+	user.LastFailedAt = parseSQLTime(lastFailedAt)
+	user.LockedUntil = parseSQLTime(lockedUntil)
+	if user.Sealed, err = parseSQLEnvelope(sealed); err != nil {
+		return nil, fmt.Errorf("in GetUser function, error reading user %s in realm %s: %w", id, realm, err)
+	}
+
+	if user.Groups, err = sqlListStrings(ctx, ex, "SELECT group_name FROM cuser_groups WHERE realm = ? AND user_id = ? ORDER BY seq", realm, id); err != nil {
+		return nil, err
+	}
+	if len(user.Groups) == 0 {
+		user.Groups = nil
+	}
+	attributes, err := sqlListAttributes(ctx, ex, "SELECT name, seq, value_type, value_string FROM cuser_attributes WHERE realm = ? AND user_id = ? ORDER BY seq", realm, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attributes {
+		user.Attributes[attr.Name] = attr
+	}
+	if err := sqlReadRoleMasks(ctx, ex, user.RoleMasks, "SELECT seq, mask FROM cuser_role_masks WHERE realm = ? AND user_id = ?", realm, id); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// sqlUserColumns are the columns of cusers written with every user, besides realm and id, and sqlLockoutColumns the
+// columns of the failed authentication counters and lockout, in the order of sqlUserValues.
+var (
+	sqlUserColumns    = []string{"id_type", "method", "hash", "enable", "active", "created_at", "created_by", "updated_at", "updated_by", "version", "sealed"}
+	sqlLockoutColumns = []string{"failed_attempts", "lockouts", "last_failed_at", "locked_until"}
+)
+
+// sqlUserValues returns the values of sqlUserColumns followed by the values of sqlLockoutColumns.
+func sqlUserValues(user *CUser) ([]any, error) {
+	sealed, err := formatSQLEnvelope(user.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	return []any{string(user.IDType), string(user.VerificationMethod), user.VerificationHash, user.Enable, user.Active,
+		formatSQLTime(user.CreatedAt), user.CreatedBy, formatSQLTime(user.UpdatedAt), user.UpdatedBy, int64(user.Version), sealed,
+		user.FailedAttempts, user.Lockouts, formatSQLTime(user.LastFailedAt), formatSQLTime(user.LockedUntil)}, nil
+}
+
+// sqlUpsert returns the statement inserting the columns into the table, or updating the updated columns of the row
+// of the same key, only when the condition on the existing row holds if not empty.
+func sqlUpsert(table string, keyColumns, columns, updated []string, condition string) string {
+	sets := make([]string, 0, len(updated))
+	for _, column := range updated {
+		sets = append(sets, column+" = excluded."+column)
+	}
+	all := append(append([]string{}, keyColumns...), columns...)
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s", table, strings.Join(all, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(all)), ", "), strings.Join(keyColumns, ", "), strings.Join(sets, ", "))
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+	return query
+}
+
+// sqlUpdate returns the statement updating the columns of the row of the key, only when the version is the expected
+// one, the last argument.
+func sqlUpdate(table string, keyColumns, columns []string) string {
+	sets := make([]string, 0, len(columns))
+	for _, column := range columns {
+		sets = append(sets, column+" = ?")
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s = ? AND version = ?", table, strings.Join(sets, ", "), strings.Join(keyColumns, " = ? AND "))
+}
+
+// sqlStoredVersion returns the version of the stored user or group, 0 when it does not exist.
+func sqlStoredVersion(ctx context.Context, ex sqlExecutor, kind RecordKind, realm, key string) (uint64, error) {
+	query := "SELECT version FROM cusers WHERE realm = ? AND id = ?"
+	if kind == RecordGroup {
+		query = "SELECT version FROM cgroups WHERE realm = ? AND name = ?"
+	}
+	var version int64
+	err := ex.QueryRowContext(ctx, query, realm, key).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading version of %s %s in realm %s: %w", kind, key, realm, err)
+	}
+	return uint64(version), nil
+}
+
+// sqlCheckVersion returns a *ConflictError unless the stored user or group has the expected version, 0 meaning it
+// does not exist.
+func sqlCheckVersion(ctx context.Context, ex sqlExecutor, kind RecordKind, realm, key string, expected uint64) error {
+	actual, err := sqlStoredVersion(ctx, ex, kind, realm, key)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return &ConflictError{Kind: kind, Realm: realm, Key: key, ExpectedVersion: expected, ActualVersion: actual}
+	}
+	return nil
+}
+
+// sqlConflict returns the *ConflictError of a checked write that did not change any row.
+func sqlConflict(ctx context.Context, ex sqlExecutor, result sql.Result, kind RecordKind, realm, key string, expected uint64) error {
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+	actual, err := sqlStoredVersion(ctx, ex, kind, realm, key)
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Kind: kind, Realm: realm, Key: key, ExpectedVersion: expected, ActualVersion: actual}
+}
+
+func sqlPutUser(ctx context.Context, ex sqlExecutor, user *CUser) error {
+	values, err := sqlUserValues(user)
+	if err != nil {
+		return fmt.Errorf("in PutUser function, error writing user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	// the claimed unique values are only kept by writes that keep the version, others might change the attributes.
+	_, err = ex.ExecContext(ctx, `DELETE FROM cuser_unique_values WHERE realm = ? AND user_id = ?
+		AND NOT EXISTS (SELECT 1 FROM cusers WHERE realm = ? AND id = ? AND version = ?)`, user.Realm, user.Id, user.Realm, user.Id, int64(user.Version))
+	if err != nil {
+		return fmt.Errorf("in PutUser function, error releasing unique values of user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	columns := append(append([]string{}, sqlUserColumns...), sqlLockoutColumns...)
+	_, err = ex.ExecContext(ctx, sqlUpsert("cusers", []string{"realm", "id"}, columns, columns, ""), append([]any{user.Realm, user.Id}, values...)...)
+	if err != nil {
+		return fmt.Errorf("in PutUser function, error writing user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	return sqlPutUserRelations(ctx, ex, user)
+}
+
+// sqlPutUserChecked writes the user if the stored one has the expected version, see CheckedWriter.
+func sqlPutUserChecked(ctx context.Context, ex sqlExecutor, user *CUser, expected uint64, unique []UniqueValue) error {
+	values, err := sqlUserValues(user)
+	if err != nil {
+		return fmt.Errorf("in PutUserChecked function, error writing user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	columns := append(append([]string{}, sqlUserColumns...), sqlLockoutColumns...)
+	updated := columns
+	if user.Version != expected {
+		updated = sqlUserColumns
+	}
+	var result sql.Result
+	if expected == 0 {
+		result, err = ex.ExecContext(ctx, sqlUpsert("cusers", []string{"realm", "id"}, columns, updated, "cusers.version = 0"),
+			append([]any{user.Realm, user.Id}, values...)...)
+	} else {
+		result, err = ex.ExecContext(ctx, sqlUpdate("cusers", []string{"realm", "id"}, updated),
+			append(values[:len(updated):len(updated)], user.Realm, user.Id, int64(expected))...)
+	}
+	if err != nil {
+		return fmt.Errorf("in PutUserChecked function, error writing user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	if err := sqlConflict(ctx, ex, result, RecordUser, user.Realm, user.Id, expected); err != nil {
+		return err
+	}
+	if err := sqlPutUserRelations(ctx, ex, user); err != nil {
+		return err
+	}
+	if unique == nil {
+		return nil
+	}
+	if _, err := ex.ExecContext(ctx, "DELETE FROM cuser_unique_values WHERE realm = ? AND user_id = ?", user.Realm, user.Id); err != nil {
+		return fmt.Errorf("in PutUserChecked function, error releasing unique values of user %s in realm %s: %w", user.Id, user.Realm, err)
+	}
+	for _, value := range unique {
+		result, err := ex.ExecContext(ctx, `INSERT INTO cuser_unique_values (realm, attribute, value, user_id) VALUES (?, ?, ?, ?)
+			ON CONFLICT (realm, attribute, value) DO NOTHING`, user.Realm, value.Attribute, value.Value, user.Id)
+		if err != nil {
+			return fmt.Errorf("in PutUserChecked function, error claiming %s of user %s in realm %s: %w", value.Attribute, user.Id, user.Realm, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected > 0 {
+			continue
+		}
+		var existing string
+		if err := ex.QueryRowContext(ctx, "SELECT user_id FROM cuser_unique_values WHERE realm = ? AND attribute = ? AND value = ?",
+			user.Realm, value.Attribute, value.Value).Scan(&existing); err != nil {
+			return fmt.Errorf("in PutUserChecked function, error reading claim of %s in realm %s: %w", value.Attribute, user.Realm, err)
+		}
+		return &DuplicateValueError{Realm: user.Realm, Attribute: value.Attribute, Value: value.Value, ExistingID: existing}
+	}
+	return nil
+}
+
+// sqlPutUserRelations replace the groups, attributes and role masks of the user.
+func sqlPutUserRelations(ctx context.Context, ex sqlExecutor, user *CUser) error {
+	for _, table := range []string{"cuser_groups", "cuser_attributes", "cuser_role_masks"} {
+		if _, err := ex.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE realm = ? AND user_id = ?", table), user.Realm, user.Id); err != nil {
+			return fmt.Errorf("in PutUser function, error clearing %s of user %s in realm %s: %w", table, user.Id, user.Realm, err)
+		}
+	}
+	for seq, group := range user.Groups {
+		if _, err := ex.ExecContext(ctx, "INSERT INTO cuser_groups (realm, user_id, seq, group_name) VALUES (?, ?, ?, ?)", user.Realm, user.Id, seq, group); err != nil {
+			return fmt.Errorf("in PutUser function, error writing groups of user %s in realm %s: %w", user.Id, user.Realm, err)
+		}
+	}
+	for _, attr := range user.Attributes {
+		if _, err := ex.ExecContext(ctx, "INSERT INTO cuser_attributes (realm, user_id, name, seq, value_type, value_string) VALUES (?, ?, ?, ?, ?, ?)",
+			user.Realm, user.Id, attr.Name, attr.Seq, attr.ValueType, attr.ValueString); err != nil {
+			return fmt.Errorf("in PutUser function, error writing attributes of user %s in realm %s: %w", user.Id, user.Realm, err)
+		}
+	}
+	for seq, mask := range user.RoleMasks {
+		if _, err := ex.ExecContext(ctx, "INSERT INTO cuser_role_masks (realm, user_id, seq, mask) VALUES (?, ?, ?, ?)", user.Realm, user.Id, seq, int64(mask)); err != nil {
+			return fmt.Errorf("in PutUser function, error writing role masks of user %s in realm %s: %w", user.Id, user.Realm, err)
+		}
+	}
+	return nil
+}
+
+func sqlDeleteUser(ctx context.Context, ex sqlExecutor, realm, id string) error {
+	result, err := ex.ExecContext(ctx, "DELETE FROM cusers WHERE realm = ? AND id = ?", realm, id)
+	if err != nil {
+		return fmt.Errorf("in DeleteUser function, error deleting user %s in realm %s: %w", id, realm, err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("in DeleteUser function, user %s in realm %s: %w", id, realm, ErrNotFound)
+	}
+	return nil
+}
+
+func sqlGetGroup(ctx context.Context, ex sqlExecutor, realm, name string) (*CGroup, error) {
+	group := &CGroup{
+		RoleMasks: make([]uint64, RoleMaskCount),
+	}
+	var createdAt, updatedAt, sealed string
+	var version int64
+	err := ex.QueryRowContext(ctx, `SELECT realm, name, created_at, created_by, updated_at, updated_by, version, sealed
+		FROM cgroups WHERE realm = ? AND name = ?`, realm, name).Scan(&group.Realm, &group.Name, &createdAt, &group.CreatedBy, &updatedAt, &group.UpdatedBy, &version, &sealed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("in GetGroup function, group %s in realm %s: %w", name, realm, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("in GetGroup function, error reading group %s in realm %s: %w", name, realm, err)
+	}
+	group.CreatedAt = parseSQLTime(createdAt)
+	group.UpdatedAt = parseSQLTime(updatedAt)
+	group.Version = uint64(version)
+	if group.Sealed, err = parseSQLEnvelope(sealed); err != nil {
+		return nil, fmt.Errorf("in GetGroup function, error reading group %s in realm %s: %w", name, realm, err)
+	}
+
+	if group.ParentGroups, err = sqlListStrings(ctx, ex, "SELECT parent_name FROM cgroup_parents WHERE realm = ? AND group_name = ? ORDER BY seq", realm, name); err != nil {
+		return nil, err
+	}
+	if len(group.ParentGroups) == 0 {
+		group.ParentGroups = nil
+	}
+	if group.Attributes, err = sqlListAttributes(ctx, ex, "SELECT name, seq, value_type, value_string FROM cgroup_attributes WHERE realm = ? AND group_name = ? ORDER BY seq", realm, name); err != nil {
+		return nil, err
+	}
+	if err := sqlReadRoleMasks(ctx, ex, group.RoleMasks, "SELECT seq, mask FROM cgroup_role_masks WHERE realm = ? AND group_name = ?", realm, name); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// sqlGroupColumns are the columns of cgroups written with every group, besides realm and name, in the order of
+// sqlGroupValues.
+var sqlGroupColumns = []string{"created_at", "created_by", "updated_at", "updated_by", "version", "sealed"}
+
+// sqlGroupValues returns the values of sqlGroupColumns.
+func sqlGroupValues(group *CGroup) ([]any, error) {
+	sealed, err := formatSQLEnvelope(group.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	return []any{formatSQLTime(group.CreatedAt), group.CreatedBy, formatSQLTime(group.UpdatedAt), group.UpdatedBy, int64(group.Version), sealed}, nil
+}
+
+func sqlPutGroup(ctx context.Context, ex sqlExecutor, group *CGroup) error {
+	values, err := sqlGroupValues(group)
+	if err != nil {
+		return fmt.Errorf("in PutGroup function, error writing group %s in realm %s: %w", group.Name, group.Realm, err)
+	}
+	_, err = ex.ExecContext(ctx, sqlUpsert("cgroups", []string{"realm", "name"}, sqlGroupColumns, sqlGroupColumns, ""), append([]any{group.Realm, group.Name}, values...)...)
+	if err != nil {
+		return fmt.Errorf("in PutGroup function, error writing group %s in realm %s: %w", group.Name, group.Realm, err)
+	}
+	return sqlPutGroupRelations(ctx, ex, group)
+}
+
+// sqlPutGroupChecked writes the group if the stored one has the expected version, see CheckedWriter.
+func sqlPutGroupChecked(ctx context.Context, ex sqlExecutor, group *CGroup, expected uint64) error {
+	values, err := sqlGroupValues(group)
+	if err != nil {
+		return fmt.Errorf("in PutGroupChecked function, error writing group %s in realm %s: %w", group.Name, group.Realm, err)
+	}
+	var result sql.Result
+	if expected == 0 {
+		result, err = ex.ExecContext(ctx, sqlUpsert("cgroups", []string{"realm", "name"}, sqlGroupColumns, sqlGroupColumns, "cgroups.version = 0"),
+			append([]any{group.Realm, group.Name}, values...)...)
+	} else {
+		result, err = ex.ExecContext(ctx, sqlUpdate("cgroups", []string{"realm", "name"}, sqlGroupColumns),
+			append(values, group.Realm, group.Name, int64(expected))...)
+	}
+	if err != nil {
+		return fmt.Errorf("in PutGroupChecked function, error writing group %s in realm %s: %w", group.Name, group.Realm, err)
+	}
+	if err := sqlConflict(ctx, ex, result, RecordGroup, group.Realm, group.Name, expected); err != nil {
+		return err
+	}
+	return sqlPutGroupRelations(ctx, ex, group)
+}
+
+// sqlPutGroupRelations replace the parents, attributes and role masks of the group.
+func sqlPutGroupRelations(ctx context.Context, ex sqlExecutor, group *CGroup) error {
+	for _, table := range []string{"cgroup_parents", "cgroup_attributes", "cgroup_role_masks"} {
+		if _, err := ex.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE realm = ? AND group_name = ?", table), group.Realm, group.Name); err != nil {
+			return fmt.Errorf("in PutGroup function, error clearing %s of group %s in realm %s: %w", table, group.Name, group.Realm, err)
+		}
+	}
+	for seq, parent := range group.ParentGroups {
+		if _, err := ex.ExecContext(ctx, "INSERT INTO cgroup_parents (realm, group_name, seq, parent_name) VALUES (?, ?, ?, ?)", group.Realm, group.Name, seq, parent); err != nil {
+			return fmt.Errorf("in PutGroup function, error writing parents of group %s in realm %s: %w", group.Name, group.Realm, err)
+		}
+	}
+	for _, attr := range group.Attributes {
+		if _, err := ex.ExecContext(ctx, "INSERT INTO cgroup_attributes (realm, group_name, name, seq, value_type, value_string) VALUES (?, ?, ?, ?, ?, ?)",
+			group.Realm, group.Name, attr.Name, attr.Seq, attr.ValueType, attr.ValueString); err != nil {
+			return fmt.Errorf("in PutGroup function, error writing attributes of group %s in realm %s: %w", group.Name, group.Realm, err)
+		}
+	}
+	for seq, mask := range group.RoleMasks {
+		if _, err := ex.ExecContext(ctx, "INSERT INTO cgroup_role_masks (realm, group_name, seq, mask) VALUES (?, ?, ?, ?)", group.Realm, group.Name, seq, int64(mask)); err != nil {
+			return fmt.Errorf("in PutGroup function, error writing role masks of group %s in realm %s: %w", group.Name, group.Realm, err)
+		}
+	}
+	return nil
+}
+
+func sqlDeleteGroup(ctx context.Context, ex sqlExecutor, realm, name string) error {
+	result, err := ex.ExecContext(ctx, "DELETE FROM cgroups WHERE realm = ? AND name = ?", realm, name)
+	if err != nil {
+		return fmt.Errorf("in DeleteGroup function, error deleting group %s in realm %s: %w", name, realm, err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("in DeleteGroup function, group %s in realm %s: %w", name, realm, ErrNotFound)
+	}
+	return nil
+}
+
+// sqlListKeys run the query that select (realm, key) pairs and collect them into a map of realm to array of key.
+func sqlListKeys(ctx context.Context, ex sqlExecutor, query string) (map[string][]string, error) {
+	rows, err := ex.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("in sqlListKeys function, error querying: %w", err)
+	}
+	defer rows.Close()
+	ret := make(map[string][]string)
+	for rows.Next() {
+		var realm, key string
+		if err := rows.Scan(&realm, &key); err != nil {
+			return nil, fmt.Errorf("in sqlListKeys function, error scanning row: %w", err)
+		}
+		appendToRealm(ret, realm, key)
+	}
+	return ret, rows.Err()
+}
+
+func sqlListStrings(ctx context.Context, ex sqlExecutor, query string, args ...any) ([]string, error) {
+	rows, err := ex.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("in sqlListStrings function, error querying: %w", err)
+	}
+	defer rows.Close()
+	ret := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("in sqlListStrings function, error scanning row: %w", err)
+		}
+		ret = append(ret, value)
+	}
+	return ret, rows.Err()
+}
+
+func sqlListAttributes(ctx context.Context, ex sqlExecutor, query string, args ...any) ([]*Attribute, error) {
+	rows, err := ex.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("in sqlListAttributes function, error querying: %w", err)
+	}
+	defer rows.Close()
+	ret := make([]*Attribute, 0)
+	for rows.Next() {
+		attr := &Attribute{}
+		if err := rows.Scan(&attr.Name, &attr.Seq, &attr.ValueType, &attr.ValueString); err != nil {
+			return nil, fmt.Errorf("in sqlListAttributes function, error scanning row: %w", err)
+		}
+		ret = append(ret, attr)
+	}
+	return ret, rows.Err()
+}
+
+// sqlReadRoleMasks read the (seq, mask) rows into the masks array. SQLite only knows signed 64 bit integer, so the
+// mask were stored as int64 and converted back bit by bit into uint64.
+func sqlReadRoleMasks(ctx context.Context, ex sqlExecutor, masks []uint64, query string, args ...any) error {
+	rows, err := ex.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("in sqlReadRoleMasks function, error querying: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq int
+		var mask int64
+		if err := rows.Scan(&seq, &mask); err != nil {
+			return fmt.Errorf("in sqlReadRoleMasks function, error scanning row: %w", err)
+		}
+		if seq >= 0 && seq < len(masks) {
+			masks[seq] = uint64(mask)
+		}
+	}
+	return rows.Err()
+}
+
+func formatSQLTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseSQLTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// formatSQLEnvelope returns the JSON of the envelope of a sealed record, or empty string if the record is not sealed.
+func formatSQLEnvelope(envelope *Envelope) (string, error) {
+	if envelope == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(envelope)
+	return string(data), err
+}
+
+// parseSQLEnvelope parse the envelope written by formatSQLEnvelope.
+func parseSQLEnvelope(s string) (*Envelope, error) {
+	if s == "" {
+		return nil, nil
+	}
+	envelope := &Envelope{}
+	if err := json.Unmarshal([]byte(s), envelope); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+func sqlGetAux(ctx context.Context, ex sqlExecutor, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := ex.QueryRowContext(ctx, "SELECT value FROM aux_records WHERE bucket = ? AND key = ?", bucket, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("in sqlGetAux function, %s in bucket %s: %w", key, bucket, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("in sqlGetAux function, error reading %s in bucket %s: %w", key, bucket, err)
+	}
+	return value, nil
+}
+
+func sqlPutAux(ctx context.Context, ex sqlExecutor, bucket, key string, value []byte) error {
+	_, err := ex.ExecContext(ctx, `INSERT INTO aux_records (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`, bucket, key, value)
+	if err != nil {
+		return fmt.Errorf("in sqlPutAux function, error writing %s in bucket %s: %w", key, bucket, err)
+	}
+	return nil
+}
+
+func sqlDeleteAux(ctx context.Context, ex sqlExecutor, bucket, key string) error {
+	result, err := ex.ExecContext(ctx, "DELETE FROM aux_records WHERE bucket = ? AND key = ?", bucket, key)
+	if err != nil {
+		return fmt.Errorf("in sqlDeleteAux function, error deleting %s in bucket %s: %w", key, bucket, err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("in sqlDeleteAux function, %s in bucket %s: %w", key, bucket, ErrNotFound)
+	}
+	return nil
+}
+
+// sqlScanAux reads every matching record before calling fn, so fn is free to use the database.
+func sqlScanAux(ctx context.Context, ex sqlExecutor, bucket, prefix string, fn func(key string, value []byte) error) error {
+	rows, err := ex.QueryContext(ctx, "SELECT key, value FROM aux_records WHERE bucket = ? AND key >= ? ORDER BY key", bucket, prefix)
+	if err != nil {
+		return fmt.Errorf("in sqlScanAux function, error querying bucket %s: %w", bucket, err)
+	}
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return fmt.Errorf("in sqlScanAux function, error scanning row: %w", err)
+		}
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("in sqlScanAux function, error scanning bucket %s: %w", bucket, err)
+	}
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestSQLiteStore_Migrate(t *testing.T) {
+	path := t.TempDir() + "/credenta.db"
+	ss, err := NewSQLiteStore(path)
+	assert.NoError(t, err)
+	version, err := ss.SchemaVersion(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, len(sqliteMigrations), version)
+	assert.NoError(t, ss.Close())
+
+	// reopening an up to date database must not re-apply any migration.
+	ss, err = NewSQLiteStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ss.Close())
+}
+
+func TestSQLiteStore_CredentaDB(t *testing.T) {
+	ss, err := NewSQLiteStore(t.TempDir() + "/credenta.db")
+	assert.NoError(t, err)
+	defer ss.Close()
+
+	cDB := NewCredentaDBWithStore(ss)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+
+	elder, err := cDB.NewGroup(ctx, "RA", "GroupElder", nil)
+	assert.NoError(t, err)
+	elder.AddRole(63)
+	assert.NoError(t, elder.SetAttribute("color", "string", "red"))
+	assert.NoError(t, elder.StoreOrSaveToFile(ctx))
+
+	son, err := cDB.NewGroup(ctx, "RA", "GroupSon", []string{"GroupElder"})
+	assert.NoError(t, err)
+	son.AddRole(1)
+	assert.NoError(t, son.StoreOrSaveToFile(ctx))
+
+	usr, err := cDB.NewUser(ctx, "RA", "user@example.com", "password", []string{"GroupSon"}, IdTypeUserEmail, VerificationMethodSHA256)
+	assert.NoError(t, err)
+	usr.Active = true
+	usr.AddRole(64)
+	assert.NoError(t, usr.SetAttribute("phone", "string", "+6281234"))
+	assert.NoError(t, usr.StoreOrSaveToFile(ctx))
+
+	loaded, err := cDB.GetUser(ctx, "RA", "user@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GroupSon"}, loaded.Groups)
+	assert.True(t, loaded.HasRole(64))
+	assert.True(t, loaded.HasAttribute("phone"))
+
+	grp, err := cDB.GetGroup(ctx, "RA", "GroupElder")
+	assert.NoError(t, err)
+	assert.True(t, grp.HasRole(63))
+	assert.True(t, grp.HasAttribute("color"))
+
+	_, roles, err := cDB.GetUserWithAuth(ctx, "RA", "user@example.com", "password")
+	assert.NoError(t, err)
+	assert.True(t, IsRoleFlagOn(roles, 1))
+	assert.True(t, IsRoleFlagOn(roles, 63))
+	assert.True(t, IsRoleFlagOn(roles, 64))
+
+	ids, err := cDB.ListUserIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user@example.com"}, ids["RA"])
+	names, err := cDB.ListGroupNames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GroupElder", "GroupSon"}, names["RA"])
+
+	assert.NoError(t, usr.DeleteFile(ctx))
+	_, err = cDB.GetUser(ctx, "RA", "user@example.com")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, errors.Is(cDB.DeleteUser(ctx, "RA", "user@example.com"), ErrNotFound))
+}
+
+func TestSQLiteStore_ConsistentRead(t *testing.T) {
+	sqliteStore, err := NewSQLiteStore(t.TempDir() + "/credenta.db")
+	assert.NoError(t, err)
+	defer sqliteStore.Close()
+	ctx := context.Background()
+	newUser := func(n int) *CUser {
+		value := strconv.Itoa(n)
+		return &CUser{Realm: "RA", Id: "john", Groups: []string{"g" + value},
+			Attributes: map[string]*Attribute{"n": {Name: "n", ValueType: "string", ValueString: value}}}
+	}
+	assert.NoError(t, sqliteStore.PutUser(ctx, newUser(0)))
+
+	// the record row and its side tables are always read from the same version.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 1; n <= 200; n++ {
+			assert.NoError(t, sqliteStore.PutUser(ctx, newUser(n)))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		user, err := sqliteStore.GetUser(ctx, "RA", "john")
+		if assert.NoError(t, err) && assert.Len(t, user.Groups, 1) && assert.Contains(t, user.Attributes, "n") {
+			assert.Equal(t, "g"+user.Attributes["n"].ValueString, user.Groups[0])
+		}
+	}
+}
+
+// sqliteHookStore calls afterGet once when the next user is read, and afterScan once when the next auxiliary records
+// are scanned, to run another process's writes in between.
+type sqliteHookStore struct {
+	*SQLiteStore
+	afterGet  func()
+	afterScan func()
+}
+
+func (s *sqliteHookStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	user, err := s.SQLiteStore.GetUser(ctx, realm, id)
+	if hook := s.afterGet; hook != nil {
+		s.afterGet = nil
+		hook()
+	}
+	return user, err
+}
+
+func (s *sqliteHookStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	err := s.SQLiteStore.ScanAux(ctx, bucket, prefix, fn)
+	if hook := s.afterScan; hook != nil {
+		s.afterScan = nil
+		hook()
+	}
+	return err
+}
+
+// newSharedSQLiteDBs returns two CredentaDB using the same SQLite file, like two processes would, the first one
+// with hooks.
+func newSharedSQLiteDBs(t *testing.T) (*sqliteHookStore, *CredentaDB, *CredentaDB) {
+	path := t.TempDir() + "/credenta.db"
+	first, err := NewSQLiteStore(path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { first.Close() })
+	second, err := NewSQLiteStore(path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { second.Close() })
+	hooked := &sqliteHookStore{SQLiteStore: first}
+	return hooked, NewCredentaDBWithStore(hooked), NewCredentaDBWithStore(second)
+}
+
+func TestSQLiteStore_CheckedVersion(t *testing.T) {
+	hooked, cDB, other := newSharedSQLiteDBs(t)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	group, err := cDB.NewGroup(ctx, "RA", "GroupA", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, group.StoreOrSaveToFile(ctx))
+
+	// the other process saves the user once it was read for the version check, the stale write must fail.
+	hooked.afterGet = func() {
+		assert.NoError(t, other.Update(ctx, "RA", "john", func(user *CUser) error {
+			return user.SetAttribute("phone", "string", "+6281234")
+		}))
+	}
+	assert.NoError(t, user.SetAttribute("phone", "string", "+6289999"))
+	assert.True(t, errors.Is(cDB.SaveUser(ctx, user), ErrConflict))
+	loaded, err := other.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), loaded.Version)
+	assert.Equal(t, "+6281234", loaded.Attributes["phone"].ValueString)
+
+	// so is the commit of a transaction.
+	err = cDB.Tx(ctx, func(tx *Tx) error {
+		err := tx.Update(ctx, "RA", "john", func(user *CUser) error {
+			user.AddRole(1)
+			return nil
+		})
+		hooked.afterGet = func() {
+			assert.NoError(t, other.Update(ctx, "RA", "john", func(user *CUser) error {
+				user.AddRole(2)
+				return nil
+			}))
+		}
+		return err
+	})
+	assert.True(t, errors.Is(err, ErrConflict))
+	loaded, err = other.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.False(t, loaded.HasRole(1))
+	assert.True(t, loaded.HasRole(2))
+
+	// a group is checked the same way.
+	assert.NoError(t, other.UpdateGroup(ctx, "RA", "GroupA", func(group *CGroup) error {
+		group.AddRole(1)
+		return nil
+	}))
+	assert.True(t, errors.Is(hooked.PutGroupChecked(ctx, group, group.Version), ErrConflict))
+
+	// creating a user that another process created meanwhile fails as well.
+	created, err := cDB.NewUser(ctx, "RA", "jane", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	hooked.afterGet = func() {
+		jane, err := other.NewUser(ctx, "RA", "jane", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, jane.StoreOrSaveToFile(ctx))
+	}
+	assert.True(t, errors.Is(cDB.SaveUser(ctx, created), ErrConflict))
+}
+
+func TestSQLiteStore_CheckedUniqueValue(t *testing.T) {
+	hooked, cDB, other := newSharedSQLiteDBs(t)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	for _, db := range []*CredentaDB{cDB, other} {
+		assert.NoError(t, db.DeclareIndex(UserIndex{Attribute: "email", Unique: true, IgnoreCase: true}))
+	}
+	john, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, john.SetAttribute("email", "string", "Shared@Example.com"))
+
+	// the other process takes the value once it was checked within this process, the write must still fail.
+	hooked.afterScan = func() {
+		jane, err := other.NewUser(ctx, "RA", "jane", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, jane.SetAttribute("email", "string", "shared@example.com"))
+		assert.NoError(t, jane.StoreOrSaveToFile(ctx))
+	}
+	err = cDB.SaveUser(ctx, john)
+	var duplicate *DuplicateValueError
+	if assert.True(t, errors.As(err, &duplicate)) {
+		assert.Equal(t, "jane", duplicate.ExistingID)
+		assert.Equal(t, "shared@example.com", duplicate.Value)
+	}
+	_, err = cDB.GetUser(ctx, "RA", "john")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// the value is released once the other user changes it.
+	assert.NoError(t, other.Update(ctx, "RA", "jane", func(user *CUser) error {
+		user.Attributes["email"].ValueString = "jane@example.com"
+		return nil
+	}))
+	john, err = cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, john.SetAttribute("email", "string", "shared@example.com"))
+	assert.NoError(t, cDB.SaveUser(ctx, john))
+}
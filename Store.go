@@ -0,0 +1,104 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned (possibly wrapped) by a Store when the requested user or group does not exist.
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned (possibly wrapped) when saving a user or group that have been modified by someone else
+// since it was loaded. The returned error is a *ConflictError.
+var ErrConflict = errors.New("record was modified concurrently")
+
+const (
+	// RecordUser is the kind of record holding a CUser
+	RecordUser RecordKind = "user"
+	// RecordGroup is the kind of record holding a CGroup
+	RecordGroup RecordKind = "group"
+)
+
+// RecordKind specify the kind of entity a stored record holds.
+type RecordKind string
+
+// ConflictError describe a stale save, the saved record carry ExpectedVersion while the stored one is at
+// ActualVersion. It satisfies errors.Is(err, ErrConflict).
+type ConflictError struct {
+	Kind            RecordKind
+	Realm           string
+	Key             string
+	ExpectedVersion uint64
+	ActualVersion   uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s in realm %s is at version %d but version %d was saved: %v", e.Kind, e.Key, e.Realm, e.ActualVersion, e.ExpectedVersion, ErrConflict)
+}
+
+// Is makes errors.Is(err, ErrConflict) returns true.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ParseETag parse an HTTP entity tag as returned by CUser.ETag or CGroup.ETag back into the record Version.
+// Weak tags (W/"1") are accepted too. A user or group whose Version is set from the If-Match header of a request
+// will fail to be saved with ErrConflict if it has been modified since the tag was issued.
+func ParseETag(etag string) (uint64, error) {
+	tag := strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(tag) < 2 || !strings.HasPrefix(tag, "\"") || !strings.HasSuffix(tag, "\"") {
+		return 0, fmt.Errorf("malformed etag %s", etag)
+	}
+	version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed etag %s", etag)
+	}
+	return version, nil
+}
+
+func formatETag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// Store defines the persistence backend used by CredentaDB to keep its users and groups.
+// Every user is keyed by its realm and id, while every group is keyed by its realm and name.
+// Implementations must return an error that satisfy errors.Is(err, ErrNotFound) when a record is not exist.
+type Store interface {
+	// GetUser load a user identified by realm and id.
+	GetUser(ctx context.Context, realm, id string) (*CUser, error)
+	// PutUser create or replace the stored user.
+	PutUser(ctx context.Context, user *CUser) error
+	// DeleteUser remove the user identified by realm and id.
+	DeleteUser(ctx context.Context, realm, id string) error
+	// ListUserIDs returns a map of realm name to array of user id.
+	ListUserIDs(ctx context.Context) (map[string][]string, error)
+
+	// GetGroup load a group identified by realm and name.
+	GetGroup(ctx context.Context, realm, name string) (*CGroup, error)
+	// PutGroup create or replace the stored group.
+	PutGroup(ctx context.Context, group *CGroup) error
+	// DeleteGroup remove the group identified by realm and name.
+	DeleteGroup(ctx context.Context, realm, name string) error
+	// ListGroupNames returns a map of realm name to array of group name.
+	ListGroupNames(ctx context.Context) (map[string][]string, error)
+}
+
+// Walker is implemented by Store that is able to list its records incrementally, without holding every id or name
+// in memory at once.
+type Walker interface {
+	// WalkUserIDs call fn with the realm and id of every stored user, stopping at the first error returned by fn.
+	WalkUserIDs(ctx context.Context, fn func(realm, id string) error) error
+	// WalkGroupNames call fn with the realm and name of every stored group, stopping at the first error returned by fn.
+	WalkGroupNames(ctx context.Context, fn func(realm, name string) error) error
+}
+
+// appendToRealm add the value into the array of the specified realm within the realm map.
+func appendToRealm(ret map[string][]string, realm, value string) {
+	if _, ok := ret[realm]; !ok {
+		ret[realm] = make([]string, 0)
+	}
+	ret[realm] = append(ret[realm], value)
+}
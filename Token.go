@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/SermoDigital/jose/crypto"
 	"github.com/SermoDigital/jose/jws"
+	"github.com/SermoDigital/jose/jwt"
 	"os"
 	"strings"
 	"time"
@@ -127,7 +128,7 @@ func RefreshNewAccessToken(refreshToken string, accessTokenAge time.Duration, pu
 		return "", err
 	}
 	if tokenType != RefreshTokenType {
-		return "", errors.New("refresh token does not match")
+		return "", fmt.Errorf("in RefreshNewAccessToken function. %w, %s is not a refresh token", ErrTokenType, tokenType)
 	}
 	at, err := GenerateJWTToken(realm, issuer, subject, audiences, AccessTokenType, additional, time.Now(), time.Now(), time.Now().Add(accessTokenAge), privateKey, signMethod)
 	if err != nil {
@@ -138,20 +139,24 @@ func RefreshNewAccessToken(refreshToken string, accessTokenAge time.Duration, pu
 
 // ReadJWTToken will read the supplied Token string suplied in the token argument.
 // It will return all information pertaining the token. such as issuer, subject, audiences, tokenType, etc.
-// If something wrong with the token, e.g. expired token or wrong certificate, it will return an error.
+// If something wrong with the token, e.g. expired token or wrong certificate, it will return an error satisfying
+// errors.Is(err, ErrTokenExpired) when the token is expired, or errors.Is(err, ErrInvalidToken) otherwise.
 func ReadJWTToken(token string, publicKey *rsa.PublicKey, signMethod *crypto.SigningMethodRSA) (realm, issuer, subject string, audiences []string, tokenType TokenType, additional map[string]interface{}, err error) {
-	jwt, err := jws.ParseJWT([]byte(token))
+	theJWT, err := jws.ParseJWT([]byte(token))
 	if err != nil {
-		return "", "", "", nil, "", nil, fmt.Errorf("malformed jwt token")
+		return "", "", "", nil, "", nil, fmt.Errorf("in ReadJWTToken function. malformed jwt token: %w", ErrInvalidToken)
 	}
 
-	if err := jwt.Validate(publicKey, signMethod); err != nil {
-		return "", "", "", nil, "", nil, err
+	if err := theJWT.Validate(publicKey, signMethod); err != nil {
+		if errors.Is(err, jwt.ErrTokenIsExpired) {
+			return "", "", "", nil, "", nil, fmt.Errorf("in ReadJWTToken function. %w", ErrTokenExpired)
+		}
+		return "", "", "", nil, "", nil, fmt.Errorf("in ReadJWTToken function. %w: %w", ErrInvalidToken, err)
 	}
 
 	var ttype TokenType
 	realm = ""
-	claims := jwt.Claims()
+	claims := theJWT.Claims()
 	additional = make(map[string]interface{})
 	for k, v := range claims {
 		kup := strings.ToUpper(k)
@@ -0,0 +1,310 @@
+package credenta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// auxTrashBucket is the auxiliary record bucket of the trash, keyed `realm, kind, key`.
+const auxTrashBucket = "trash"
+
+// ErrTrashed is returned (possibly wrapped) when creating a user or group whose id or name belongs to a record still
+// in the trash, it can only be reused once the record is restored or purged.
+var ErrTrashed = errors.New("record is in trash")
+
+// TrashEntry is a deleted user or group kept in the trash until it is restored or purged.
+type TrashEntry struct {
+	Kind  RecordKind `json:"kind"`
+	Realm string     `json:"realm"`
+	// Key is the user id or the group name.
+	Key       string    `json:"key"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	// User is the deleted user, when Kind is RecordUser.
+	User *CUser `json:"user,omitempty"`
+	// Group is the deleted group, when Kind is RecordGroup.
+	Group *CGroup `json:"group,omitempty"`
+}
+
+// EnableTrash turn on soft deletion. Once enabled, DeleteUser and DeleteGroup move the record into the trash of its
+// realm, from where it can be restored using RestoreUser or RestoreGroup until it is purged by PurgeTrash after the
+// retention. Meanwhile, the id or name can not be used by a new record. It should be called before the CredentaDB
+// is used concurrently. It returns ErrAuxNotSupported if the Store does not implement AuxStore.
+func (store *CredentaDB) EnableTrash(retention time.Duration) error {
+	if _, err := store.auxStore(); err != nil {
+		return err
+	}
+	if retention <= 0 {
+		return fmt.Errorf("in EnableTrash function. retention must be positive, got %s", retention)
+	}
+	store.trashRetention = retention
+	return nil
+}
+
+// DisableTrash turn off soft deletion, records are deleted right away. Records already in the trash are kept until
+// they are restored or purged, but no longer prevent their id or name from being reused.
+func (store *CredentaDB) DisableTrash() {
+	store.trashRetention = 0
+}
+
+// ListTrash returns the entries of the realm's trash, ordered by kind and key.
+func (store *CredentaDB) ListTrash(ctx context.Context, realm string) ([]*TrashEntry, error) {
+	if realm == "" {
+		return nil, errors.New("in ListTrash function. realm is required")
+	}
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*TrashEntry, 0)
+	err = aux.ScanAux(ctx, auxTrashBucket, auxPrefix(realm), func(key string, data []byte) error {
+		entry := &TrashEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return fmt.Errorf("error unmarshalling trash entry %q: %w", key, err)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in ListTrash function. error reading trash of realm %s: %w", realm, err)
+	}
+	return entries, nil
+}
+
+// RestoreUser move the user back from the trash. It fails if a user with the same id exists again, or if the user
+// would violate a unique index.
+func (store *CredentaDB) RestoreUser(ctx context.Context, realm, id string) (*CUser, error) {
+	if realm == "" || id == "" {
+		return nil, errors.New("in RestoreUser function. realm and id are required")
+	}
+	unlock, err := store.lockUser(ctx, realm, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	aux, entry, err := store.getTrashEntry(ctx, RecordUser, realm, id)
+	if err != nil {
+		return nil, fmt.Errorf("in RestoreUser function. %w", err)
+	}
+	if _, err := store.Store.GetUser(ctx, realm, id); err == nil {
+		return nil, fmt.Errorf("in RestoreUser function. user %s in realm %s: %w", id, realm, ErrAlreadyExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	user := entry.User
+	if err := store.checkIndexedValues(user); err != nil {
+		return nil, fmt.Errorf("in RestoreUser function. %w", err)
+	}
+	unlockValues, err := store.lockUniqueValues(ctx, []*CUser{user}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockValues()
+
+	// the version keeps going on from the deleted one.
+	user.UpdatedBy = ctx.Value(ETX_USER).(string)
+	user.UpdatedAt = time.Now()
+	user.Version++
+	if err := store.putUserChecked(ctx, user, 0, true); err != nil {
+		return nil, err
+	}
+	store.invalidateUser(realm, id)
+	user.db = store
+	if err := store.updateUserIndexes(ctx, nil, user); err != nil {
+		return nil, err
+	}
+	if err := store.recordUserHistory(ctx, nil, user); err != nil {
+		return nil, err
+	}
+	if err := aux.DeleteAux(ctx, auxTrashBucket, auxKey(realm, string(RecordUser), id)); err != nil {
+		return nil, fmt.Errorf("in RestoreUser function. error removing trash entry: %w", err)
+	}
+	return user, nil
+}
+
+// RestoreGroup move the group back from the trash. It fails if a group with the same name exists again.
+func (store *CredentaDB) RestoreGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	if realm == "" || name == "" {
+		return nil, errors.New("in RestoreGroup function. realm and name are required")
+	}
+	unlock, err := store.lockGroup(ctx, realm, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	aux, entry, err := store.getTrashEntry(ctx, RecordGroup, realm, name)
+	if err != nil {
+		return nil, fmt.Errorf("in RestoreGroup function. %w", err)
+	}
+	if _, err := store.Store.GetGroup(ctx, realm, name); err == nil {
+		return nil, fmt.Errorf("in RestoreGroup function. group %s in realm %s: %w", name, realm, ErrAlreadyExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	group := entry.Group
+	group.UpdatedBy = ctx.Value(ETX_USER).(string)
+	group.UpdatedAt = time.Now()
+	group.Version++
+	if err := store.putGroupChecked(ctx, group, 0); err != nil {
+		return nil, err
+	}
+	store.invalidateGroup(realm, name)
+	group.db = store
+	if err := store.updateGroupIndexes(ctx, nil, group); err != nil {
+		return nil, err
+	}
+	if err := store.recordGroupHistory(ctx, nil, group); err != nil {
+		return nil, err
+	}
+	if err := aux.DeleteAux(ctx, auxTrashBucket, auxKey(realm, string(RecordGroup), name)); err != nil {
+		return nil, fmt.Errorf("in RestoreGroup function. error removing trash entry: %w", err)
+	}
+	return group, nil
+}
+
+// PurgeTrash permanently remove every trash entry deleted longer than the retention ago, and returns how many were
+// removed. When the trash is disabled, every entry is removed. Every entry is checked again while holding the lock of
+// its record, so an entry restored or replaced meanwhile is left alone and not counted.
+func (store *CredentaDB) PurgeTrash(ctx context.Context) (int, error) {
+	aux, err := store.auxStore()
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(-store.trashRetention)
+	expired := make([]*TrashEntry, 0)
+	err = aux.ScanAux(ctx, auxTrashBucket, "", func(key string, data []byte) error {
+		entry := &TrashEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return fmt.Errorf("error unmarshalling trash entry %q: %w", key, err)
+		}
+		if !entry.DeletedAt.After(deadline) {
+			expired = append(expired, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("in PurgeTrash function. error reading trash: %w", err)
+	}
+	purged := 0
+	for _, expiredEntry := range expired {
+		err := store.restoreRecord(ctx, expiredEntry.Kind, expiredEntry.Realm, expiredEntry.Key, func() error {
+			_, entry, err := store.getTrashEntry(ctx, expiredEntry.Kind, expiredEntry.Realm, expiredEntry.Key)
+			if errors.Is(err, ErrNotFound) || (err == nil && entry.DeletedAt.After(deadline)) {
+				// already gone, or deleted again since.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = aux.DeleteAux(ctx, auxTrashBucket, auxKey(expiredEntry.Realm, string(expiredEntry.Kind), expiredEntry.Key))
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			purged++
+			return nil
+		})
+		if err != nil {
+			return purged, fmt.Errorf("in PurgeTrash function. error removing trash entry: %w", err)
+		}
+	}
+	return purged, nil
+}
+
+// StartTrashPurge starts calling PurgeTrash in background every interval, until ctx is done. Errors are logged.
+func (store *CredentaDB) StartTrashPurge(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if purged, err := store.PurgeTrash(ctx); err != nil {
+					log.Printf("error purging trash: %v", err)
+				} else if purged > 0 {
+					log.Printf("purged %d trash entries", purged)
+				}
+			}
+		}
+	}()
+}
+
+// trashEnabled returns the AuxStore holding the trash, or false when the trash is not enabled.
+func (store *CredentaDB) trashEnabled() (AuxStore, bool) {
+	if store.trashRetention <= 0 {
+		return nil, false
+	}
+	aux, err := store.auxStore()
+	return aux, err == nil
+}
+
+// moveToTrash put the deleted user or group into the trash.
+func (store *CredentaDB) moveToTrash(ctx context.Context, aux AuxStore, entry *TrashEntry) error {
+	entry.DeletedAt = time.Now()
+	entry.DeletedBy = ctx.Value(ETX_USER).(string)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("in moveToTrash function. error marshalling trash entry: %w", err)
+	}
+	if err := aux.PutAux(ctx, auxTrashBucket, auxKey(entry.Realm, string(entry.Kind), entry.Key), data); err != nil {
+		return fmt.Errorf("in moveToTrash function. error writing trash entry: %w", err)
+	}
+	return nil
+}
+
+// getTrashEntry returns the trash entry of the record, or an error that satisfy errors.Is(err, ErrNotFound).
+func (store *CredentaDB) getTrashEntry(ctx context.Context, kind RecordKind, realm, key string) (AuxStore, *TrashEntry, error) {
+	aux, err := store.auxStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := aux.GetAux(ctx, auxTrashBucket, auxKey(realm, string(kind), key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s %s of realm %s is not in trash: %w", kind, key, realm, err)
+	}
+	entry := &TrashEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling trash entry of %s %s: %w", kind, key, err)
+	}
+	if (kind == RecordUser && entry.User == nil) || (kind == RecordGroup && entry.Group == nil) {
+		return nil, nil, fmt.Errorf("trash entry of %s %s has no record", kind, key)
+	}
+	return aux, entry, nil
+}
+
+// checkNotTrashed returns an error satisfying errors.Is(err, ErrTrashed) if the trash is enabled and the record is
+// in the trash within the retention.
+func (store *CredentaDB) checkNotTrashed(ctx context.Context, kind RecordKind, realm, key string) error {
+	aux, ok := store.trashEnabled()
+	if !ok {
+		return nil
+	}
+	data, err := aux.GetAux(ctx, auxTrashBucket, auxKey(realm, string(kind), key))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entry := &TrashEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return fmt.Errorf("error unmarshalling trash entry of %s %s: %w", kind, key, err)
+	}
+	if time.Since(entry.DeletedAt) >= store.trashRetention {
+		// expired, only waiting to be purged.
+		return nil
+	}
+	return fmt.Errorf("%s %s of realm %s deleted at %s: %w", kind, key, realm, entry.DeletedAt.Format(time.RFC3339), ErrTrashed)
+}
@@ -0,0 +1,156 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCredentaDB_Trash(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			assert.NoError(t, cDB.EnableTrash(time.Hour))
+			assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true}))
+
+			group, err := cDB.NewGroup(ctx, "RA", "Admin", nil)
+			assert.NoError(t, err)
+			assert.NoError(t, group.StoreOrSaveToFile(ctx))
+			john, err := cDB.NewUser(ctx, "RA", "john", "password", []string{"Admin"}, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			assert.NoError(t, john.SetAttribute("email", "string", "john@mail.com"))
+			assert.NoError(t, john.StoreOrSaveToFile(ctx))
+
+			assert.NoError(t, john.DeleteFile(ctx))
+			assert.NoError(t, group.DeleteFile(ctx))
+			_, err = cDB.GetUser(ctx, "RA", "john")
+			assert.True(t, errors.Is(err, ErrNotFound))
+			members, err := cDB.ListGroupMembers(ctx, "RA", "Admin", false)
+			assert.NoError(t, err)
+			assert.Empty(t, members)
+
+			entries, err := cDB.ListTrash(ctx, "RA")
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 2) {
+				assert.Equal(t, RecordGroup, entries[0].Kind)
+				assert.Equal(t, RecordUser, entries[1].Kind)
+				assert.Equal(t, "john", entries[1].Key)
+				assert.Equal(t, "TestUser", entries[1].DeletedBy)
+			}
+
+			// the id can not be registered again while in the trash.
+			_, err = cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.True(t, errors.Is(err, ErrTrashed))
+			_, err = cDB.NewGroup(ctx, "RA", "Admin", nil)
+			assert.True(t, errors.Is(err, ErrTrashed))
+			err = cDB.SaveUser(ctx, &CUser{Realm: "RA", Id: "john"})
+			assert.True(t, errors.Is(err, ErrTrashed))
+			// but it can in another realm.
+			_, err = cDB.NewUser(ctx, "RB", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+
+			restored, err := cDB.RestoreUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(3), restored.Version)
+			_, err = cDB.RestoreGroup(ctx, "RA", "Admin")
+			assert.NoError(t, err)
+			user, err := cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{"Admin"}, user.Groups)
+			}
+			found, err := cDB.FindUserByAttribute(ctx, "RA", "email", "john@mail.com")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "john", found.Id)
+			}
+			members, err = cDB.ListGroupMembers(ctx, "RA", "Admin", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"john"}, members)
+			_, err = cDB.RestoreUser(ctx, "RA", "john")
+			assert.True(t, errors.Is(err, ErrNotFound))
+
+			// nothing expired yet.
+			assert.NoError(t, cDB.DeleteUser(ctx, "RA", "john"))
+			purged, err := cDB.PurgeTrash(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, purged)
+
+			assert.NoError(t, cDB.EnableTrash(time.Nanosecond))
+			_, err = cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			purged, err = cDB.PurgeTrash(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, purged)
+			entries, err = cDB.ListTrash(ctx, "RA")
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+// trashScanHookStore calls afterScan once, when the next scan of the trash is done.
+type trashScanHookStore struct {
+	*MemoryStore
+	afterScan func()
+}
+
+func (s *trashScanHookStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	err := s.MemoryStore.ScanAux(ctx, bucket, prefix, fn)
+	if hook := s.afterScan; bucket == auxTrashBucket && hook != nil {
+		s.afterScan = nil
+		hook()
+	}
+	return err
+}
+
+func TestCredentaDB_PurgeTrashConcurrentChange(t *testing.T) {
+	dataStore := &trashScanHookStore{MemoryStore: NewMemoryStore()}
+	cDB := NewCredentaDBWithStore(dataStore)
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	assert.NoError(t, cDB.EnableTrash(time.Nanosecond))
+	for _, id := range []string{"jack", "jane", "john"} {
+		user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, user.StoreOrSaveToFile(ctx))
+		assert.NoError(t, cDB.DeleteUser(ctx, "RA", id))
+	}
+
+	// once scanned, john is restored and jack is restored then deleted again.
+	dataStore.afterScan = func() {
+		_, err := cDB.RestoreUser(ctx, "RA", "john")
+		assert.NoError(t, err)
+		_, err = cDB.RestoreUser(ctx, "RA", "jack")
+		assert.NoError(t, err)
+		assert.NoError(t, cDB.DeleteUser(ctx, "RA", "jack"))
+	}
+	purged, err := cDB.PurgeTrash(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	entries, err := cDB.ListTrash(ctx, "RA")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "jack", entries[0].Key)
+	}
+}
+
+func TestCredentaDB_TrashDisabled(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+	assert.NoError(t, err)
+	assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	assert.NoError(t, user.DeleteFile(ctx))
+
+	entries, err := cDB.ListTrash(ctx, "RA")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = cDB.RestoreUser(ctx, "RA", "john")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	assert.Error(t, cDB.EnableTrash(0))
+	assert.True(t, errors.Is(NewCredentaDBWithStore(&struct{ Store }{NewMemoryStore()}).EnableTrash(time.Hour), ErrAuxNotSupported))
+}
@@ -0,0 +1,574 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrTxFinished is returned when writing through a Tx, or a user or group obtained from it, after the function
+// passed into CredentaDB.Tx has returned.
+var ErrTxFinished = errors.New("transaction is already finished")
+
+// Tx is a set of changes of users and groups made within CredentaDB.Tx. The changes are only visible through the
+// Tx until it is committed. Users and groups obtained from a Tx are saved into it when StoreOrSaveToFile is called.
+// A Tx must not be used concurrently.
+type Tx struct {
+	db    *CredentaDB
+	store *txStore
+}
+
+// Tx calls fn with a new transaction, and commits the changes made through it once fn returns without error.
+// Either every change is written into the Store or none is, using Batcher when the Store implements it (natively
+// by the SQLITE and BOLT stores, using a journal by the FILE store). Nothing is written if fn returns an error,
+// which is returned as is.
+//
+// Every user and group read or written within the transaction is locked while committing, and the commit fails
+// with ErrConflict if any of them have been modified since it was read, or with ErrDuplicateValue if a unique
+// attribute value of a written user has been taken by another user meanwhile.
+func (store *CredentaDB) Tx(ctx context.Context, fn func(tx *Tx) error) error {
+	ts := &txStore{
+		base:   store.Store,
+		users:  make(map[recordKey]*CUser),
+		groups: make(map[recordKey]*CGroup),
+		aux:    make(map[string]map[string][]byte),
+		reads:  make(map[txRead]txVersion),
+	}
+	var txView Store = ts
+	if _, ok := store.Store.(AuxStore); ok {
+		txView = &txAuxStore{ts}
+	}
+	err := fn(&Tx{db: store.withStore(txView), store: ts})
+	ts.done = true
+	if err != nil {
+		return err
+	}
+	return store.commit(ctx, ts)
+}
+
+// withStore returns a copy of the CredentaDB configuration using the Store, without cache.
+func (store *CredentaDB) withStore(dataStore Store) *CredentaDB {
+	return &CredentaDB{
+		DefaultRealm:    store.DefaultRealm,
+		PassPolicy:      store.PassPolicy,
+		BaseFolder:      store.BaseFolder,
+		UserFolder:      store.UserFolder,
+		GroupFolder:     store.GroupFolder,
+		Store:           dataStore,
+		indexes:         store.indexes,
+		trashRetention:  store.trashRetention,
+		history:         store.history,
+		keys:            store.keys,
+		peppers:         store.peppers,
+		hashParams:      store.hashParams,
+		lockout:         store.lockout,
+		preferredMethod: store.preferredMethod,
+		rehashHook:      store.rehashHook,
+	}
+}
+
+// commit locks every record read or written by the transaction, check they have not been modified since read and
+// writes the changes.
+func (store *CredentaDB) commit(ctx context.Context, ts *txStore) error {
+	batch := ts.batch()
+	if batch.isEmpty() {
+		return nil
+	}
+	reads := make([]txRead, 0, len(ts.reads))
+	for read := range ts.reads {
+		reads = append(reads, read)
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		return auxKey(string(reads[i].kind), reads[i].realm, reads[i].key) < auxKey(string(reads[j].kind), reads[j].realm, reads[j].key)
+	})
+	unlocks := make([]func(), 0, len(reads))
+	defer func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}()
+	for _, read := range reads {
+		lock := store.lockUser
+		if read.kind == RecordGroup {
+			lock = store.lockGroup
+		}
+		unlock, err := lock(ctx, read.realm, read.key)
+		if err != nil {
+			return fmt.Errorf("in Tx function. error locking %s %s: %w", read.kind, read.key, err)
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	for _, read := range reads {
+		actual, err := readVersion(ctx, store.Store, read)
+		if err != nil {
+			return fmt.Errorf("in Tx function. error reading %s %s: %w", read.kind, read.key, err)
+		}
+		if expected := ts.reads[read]; actual != expected {
+			return &ConflictError{Kind: read.kind, Realm: read.realm, Key: read.key, ExpectedVersion: expected.version, ActualVersion: actual.version}
+		}
+	}
+	if err := store.keepTxLockout(ctx, ts); err != nil {
+		return fmt.Errorf("in Tx function : %w", err)
+	}
+	// the unique values were checked against the Store as it was when saved within the transaction.
+	unlockValues, err := store.lockTxUniqueValues(ctx, ts)
+	if err != nil {
+		return fmt.Errorf("in Tx function : %w", err)
+	}
+	defer unlockValues()
+	written, err := store.checkTxWrites(ts, batch)
+	if err != nil {
+		return fmt.Errorf("in Tx function : %w", err)
+	}
+	if err := writeBatch(ctx, store.Store, batch); err != nil {
+		return fmt.Errorf("in Tx function. error writing changes: %w", store.checkedWriteError(err, written...))
+	}
+	for key := range ts.users {
+		store.invalidateUser(key.realm, key.key)
+	}
+	for key := range ts.groups {
+		store.invalidateGroup(key.realm, key.key)
+	}
+	return nil
+}
+
+// keepTxLockout copy the failed authentication counters and lockout of the stored users into the users written by
+// the transaction, like saveUser, since authentications made meanwhile do not change the Version checked when
+// committing. The written users are the ones of the batch, and the caller must hold their locks.
+func (store *CredentaDB) keepTxLockout(ctx context.Context, ts *txStore) error {
+	for key, user := range ts.users {
+		if user == nil {
+			continue
+		}
+		stored, err := store.Store.GetUser(ctx, key.realm, key.key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		user.keepLockout(stored)
+	}
+	return nil
+}
+
+// checkTxWrites makes the writes of the batch expect the versions read by the transaction, and the written users
+// claim their unique values, when the Store implements CheckedWriter so it rejects the commit if another process
+// changed them meanwhile. It returns the written users, opened.
+func (store *CredentaDB) checkTxWrites(ts *txStore, batch *Batch) ([]*CUser, error) {
+	if _, ok := store.Store.(CheckedWriter); !ok {
+		return nil, nil
+	}
+	batch.expected = make(map[txRead]uint64, len(ts.reads))
+	for read, version := range ts.reads {
+		batch.expected[read] = version.version
+	}
+	batch.unique = make(map[recordKey][]UniqueValue, len(ts.users))
+	written := make([]*CUser, 0, len(ts.users))
+	for key, user := range ts.users {
+		if user == nil {
+			continue
+		}
+		opened, err := store.openUser(user.clone())
+		if err != nil {
+			return nil, err
+		}
+		batch.unique[key] = store.uniqueValues(opened)
+		written = append(written, opened)
+	}
+	return written, nil
+}
+
+// lockTxUniqueValues check that the users written by the transaction do not violate any unique index once committed,
+// and lock the checked values until the returned function is called, see lockUniqueValues.
+func (store *CredentaDB) lockTxUniqueValues(ctx context.Context, ts *txStore) (func(), error) {
+	if len(store.indexes) == 0 {
+		return func() {}, nil
+	}
+	written := make(map[recordKey]*CUser, len(ts.users))
+	users := make([]*CUser, 0, len(ts.users))
+	for key, user := range ts.users {
+		if user == nil {
+			written[key] = nil
+			continue
+		}
+		opened, err := store.openUser(user.clone())
+		if err != nil {
+			return nil, err
+		}
+		written[key] = opened
+		users = append(users, opened)
+	}
+	return store.lockUniqueValues(ctx, users, written)
+}
+
+// NewUser creates a new user like CredentaDB.NewUser, it is created once saved.
+func (tx *Tx) NewUser(ctx context.Context, realm, id, password string, groups []string, idType IdType, vMethod VerificationMethod) (*CUser, error) {
+	return tx.db.NewUser(ctx, realm, id, password, groups, idType, vMethod)
+}
+
+// NewGroup creates a new group like CredentaDB.NewGroup, it is created once saved.
+func (tx *Tx) NewGroup(ctx context.Context, realm, name string, parentGroup []string) (*CGroup, error) {
+	return tx.db.NewGroup(ctx, realm, name, parentGroup)
+}
+
+// GetUser returns the user as changed within the transaction.
+func (tx *Tx) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	return tx.db.GetUser(ctx, realm, id)
+}
+
+// GetGroup returns the group as changed within the transaction.
+func (tx *Tx) GetGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	return tx.db.GetGroup(ctx, realm, name)
+}
+
+// SaveUser saves the user within the transaction, see CredentaDB.SaveUser.
+func (tx *Tx) SaveUser(ctx context.Context, user *CUser) error {
+	return tx.db.SaveUser(ctx, user)
+}
+
+// SaveGroup saves the group within the transaction, see CredentaDB.SaveGroup.
+func (tx *Tx) SaveGroup(ctx context.Context, group *CGroup) error {
+	return tx.db.SaveGroup(ctx, group)
+}
+
+// Update modifies the user within the transaction, see CredentaDB.Update.
+func (tx *Tx) Update(ctx context.Context, realm, id string, fn func(user *CUser) error) error {
+	return tx.db.Update(ctx, realm, id, fn)
+}
+
+// UpdateGroup modifies the group within the transaction, see CredentaDB.UpdateGroup.
+func (tx *Tx) UpdateGroup(ctx context.Context, realm, name string, fn func(group *CGroup) error) error {
+	return tx.db.UpdateGroup(ctx, realm, name, fn)
+}
+
+// DeleteUser deletes the user within the transaction, see CredentaDB.DeleteUser.
+func (tx *Tx) DeleteUser(ctx context.Context, realm, id string) error {
+	return tx.db.DeleteUser(ctx, realm, id)
+}
+
+// DeleteGroup deletes the group within the transaction, see CredentaDB.DeleteGroup.
+func (tx *Tx) DeleteGroup(ctx context.Context, realm, name string) error {
+	return tx.db.DeleteGroup(ctx, realm, name)
+}
+
+// recordKey identify a user or group within its kind.
+type recordKey struct {
+	realm string
+	key   string
+}
+
+// txRead identify a record read by a transaction.
+type txRead struct {
+	kind  RecordKind
+	realm string
+	key   string
+}
+
+// txVersion is the state of a record when a transaction read it.
+type txVersion struct {
+	found   bool
+	version uint64
+}
+
+// readVersion returns the state of the record in the Store.
+func readVersion(ctx context.Context, dataStore Store, read txRead) (txVersion, error) {
+	var version uint64
+	var err error
+	if read.kind == RecordGroup {
+		var group *CGroup
+		if group, err = dataStore.GetGroup(ctx, read.realm, read.key); err == nil {
+			version = group.Version
+		}
+	} else {
+		var user *CUser
+		if user, err = dataStore.GetUser(ctx, read.realm, read.key); err == nil {
+			version = user.Version
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		return txVersion{}, nil
+	}
+	if err != nil {
+		return txVersion{}, err
+	}
+	return txVersion{found: true, version: version}, nil
+}
+
+// txStore is the Store of a transaction. Writes are kept in memory until committed, reads see them first and fall
+// back to the base Store, remembering the version of every record read so it can be checked when committing.
+type txStore struct {
+	base Store
+	// users are the written users, nil when deleted.
+	users map[recordKey]*CUser
+	// groups are the written groups, nil when deleted.
+	groups map[recordKey]*CGroup
+	// aux are the written auxiliary records by bucket and key, nil when deleted.
+	aux map[string]map[string][]byte
+	// reads are the state of the base records when they were first read.
+	reads map[txRead]txVersion
+	// done is true once the transaction is over.
+	done bool
+}
+
+// read gets the record from the base Store, remembering its version the first time.
+func (ts *txStore) read(ctx context.Context, kind RecordKind, realm, key string) (*CUser, *CGroup, error) {
+	var user *CUser
+	var group *CGroup
+	var err error
+	version := txVersion{}
+	if kind == RecordGroup {
+		if group, err = ts.base.GetGroup(ctx, realm, key); err == nil {
+			version = txVersion{found: true, version: group.Version}
+		}
+	} else {
+		if user, err = ts.base.GetUser(ctx, realm, key); err == nil {
+			version = txVersion{found: true, version: user.Version}
+		}
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, nil, err
+	}
+	read := txRead{kind: kind, realm: realm, key: key}
+	if _, ok := ts.reads[read]; !ok {
+		ts.reads[read] = version
+	}
+	return user, group, err
+}
+
+func (ts *txStore) GetUser(ctx context.Context, realm, id string) (*CUser, error) {
+	if user, ok := ts.users[recordKey{realm, id}]; ok {
+		if user == nil {
+			return nil, fmt.Errorf("in GetUser function, user %s in realm %s is deleted: %w", id, realm, ErrNotFound)
+		}
+		return user.clone(), nil
+	}
+	user, _, err := ts.read(ctx, RecordUser, realm, id)
+	return user, err
+}
+
+func (ts *txStore) PutUser(ctx context.Context, user *CUser) error {
+	if ts.done {
+		return ErrTxFinished
+	}
+	if _, _, err := ts.read(ctx, RecordUser, user.Realm, user.Id); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	stored := user.clone()
+	stored.db = nil
+	ts.users[recordKey{user.Realm, user.Id}] = stored
+	return nil
+}
+
+func (ts *txStore) DeleteUser(ctx context.Context, realm, id string) error {
+	if ts.done {
+		return ErrTxFinished
+	}
+	if _, err := ts.GetUser(ctx, realm, id); err != nil {
+		return err
+	}
+	ts.users[recordKey{realm, id}] = nil
+	return nil
+}
+
+func (ts *txStore) ListUserIDs(ctx context.Context) (map[string][]string, error) {
+	ret, err := ts.base.ListUserIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	written := make(map[recordKey]bool, len(ts.users))
+	for key, user := range ts.users {
+		written[key] = user != nil
+	}
+	return mergeWritten(ret, written), nil
+}
+
+func (ts *txStore) GetGroup(ctx context.Context, realm, name string) (*CGroup, error) {
+	if group, ok := ts.groups[recordKey{realm, name}]; ok {
+		if group == nil {
+			return nil, fmt.Errorf("in GetGroup function, group %s in realm %s is deleted: %w", name, realm, ErrNotFound)
+		}
+		return group.clone(), nil
+	}
+	_, group, err := ts.read(ctx, RecordGroup, realm, name)
+	return group, err
+}
+
+func (ts *txStore) PutGroup(ctx context.Context, group *CGroup) error {
+	if ts.done {
+		return ErrTxFinished
+	}
+	if _, _, err := ts.read(ctx, RecordGroup, group.Realm, group.Name); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	stored := group.clone()
+	stored.db = nil
+	ts.groups[recordKey{group.Realm, group.Name}] = stored
+	return nil
+}
+
+func (ts *txStore) DeleteGroup(ctx context.Context, realm, name string) error {
+	if ts.done {
+		return ErrTxFinished
+	}
+	if _, err := ts.GetGroup(ctx, realm, name); err != nil {
+		return err
+	}
+	ts.groups[recordKey{realm, name}] = nil
+	return nil
+}
+
+func (ts *txStore) ListGroupNames(ctx context.Context) (map[string][]string, error) {
+	ret, err := ts.base.ListGroupNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	written := make(map[recordKey]bool, len(ts.groups))
+	for key, group := range ts.groups {
+		written[key] = group != nil
+	}
+	return mergeWritten(ret, written), nil
+}
+
+// LockUser does nothing, the records of a transaction are locked when it is committed.
+func (ts *txStore) LockUser(ctx context.Context, realm, id string) (func(), error) {
+	return func() {}, nil
+}
+
+// LockGroup does nothing, the records of a transaction are locked when it is committed.
+func (ts *txStore) LockGroup(ctx context.Context, realm, name string) (func(), error) {
+	return func() {}, nil
+}
+
+// batch returns the writes of the transaction.
+func (ts *txStore) batch() *Batch {
+	batch := &Batch{}
+	for key, user := range ts.users {
+		if user == nil {
+			batch.DeletedUsers = append(batch.DeletedUsers, RecordRef{Realm: key.realm, Key: key.key})
+		} else {
+			batch.Users = append(batch.Users, user)
+		}
+	}
+	for key, group := range ts.groups {
+		if group == nil {
+			batch.DeletedGroups = append(batch.DeletedGroups, RecordRef{Realm: key.realm, Key: key.key})
+		} else {
+			batch.Groups = append(batch.Groups, group)
+		}
+	}
+	for bucket, records := range ts.aux {
+		for key, value := range records {
+			batch.Aux = append(batch.Aux, &AuxRecord{Bucket: bucket, Key: key, Value: value})
+		}
+	}
+	sort.Slice(batch.Aux, func(i, j int) bool {
+		return auxKey(batch.Aux[i].Bucket, batch.Aux[i].Key) < auxKey(batch.Aux[j].Bucket, batch.Aux[j].Key)
+	})
+	return batch
+}
+
+// mergeWritten adds the written keys into the map of realm to keys, and removes the deleted ones.
+func mergeWritten(ret map[string][]string, written map[recordKey]bool) map[string][]string {
+	if len(written) == 0 {
+		return ret
+	}
+	realms := make(map[string]bool)
+	for key := range written {
+		realms[key.realm] = true
+	}
+	for realm := range realms {
+		keys := make([]string, 0, len(ret[realm]))
+		for _, key := range ret[realm] {
+			if _, ok := written[recordKey{realm, key}]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		for key, exists := range written {
+			if key.realm == realm && exists {
+				keys = append(keys, key.key)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) == 0 {
+			delete(ret, realm)
+		} else {
+			ret[realm] = keys
+		}
+	}
+	return ret
+}
+
+// txAuxStore is the txStore of a transaction whose base Store implements AuxStore.
+type txAuxStore struct {
+	*txStore
+}
+
+func (ts *txAuxStore) GetAux(ctx context.Context, bucket, key string) ([]byte, error) {
+	if value, ok := ts.aux[bucket][key]; ok {
+		if value == nil {
+			return nil, fmt.Errorf("in GetAux function, %s in bucket %s is deleted: %w", key, bucket, ErrNotFound)
+		}
+		return append([]byte{}, value...), nil
+	}
+	return ts.base.(AuxStore).GetAux(ctx, bucket, key)
+}
+
+func (ts *txAuxStore) PutAux(ctx context.Context, bucket, key string, value []byte) error {
+	if ts.done {
+		return ErrTxFinished
+	}
+	if _, ok := ts.aux[bucket]; !ok {
+		ts.aux[bucket] = make(map[string][]byte)
+	}
+	ts.aux[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (ts *txAuxStore) DeleteAux(ctx context.Context, bucket, key string) error {
+	if ts.done {
+		return ErrTxFinished
+	}
+	if _, err := ts.GetAux(ctx, bucket, key); err != nil {
+		return err
+	}
+	if _, ok := ts.aux[bucket]; !ok {
+		ts.aux[bucket] = make(map[string][]byte)
+	}
+	ts.aux[bucket][key] = nil
+	return nil
+}
+
+func (ts *txAuxStore) ScanAux(ctx context.Context, bucket, prefix string, fn func(key string, value []byte) error) error {
+	values := make(map[string][]byte)
+	err := ts.base.(AuxStore).ScanAux(ctx, bucket, prefix, func(key string, value []byte) error {
+		values[key] = value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range ts.aux[bucket] {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if value == nil {
+			delete(values, key)
+		} else {
+			values[key] = append([]byte{}, value...)
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package credenta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStore is a Store without Batcher whose PutGroup always fails.
+type failingStore struct {
+	Store
+}
+
+func (fs *failingStore) PutGroup(ctx context.Context, group *CGroup) error {
+	return errors.New("disk full")
+}
+
+func TestCredentaDB_Tx(t *testing.T) {
+	stores := newTestStores(t)
+	stores["NO_BATCH"] = &struct{ Store }{NewMemoryStore()}
+	for name, dataStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			for _, id := range []string{"john", "jane", "jack"} {
+				user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+				assert.NoError(t, err)
+				assert.NoError(t, user.StoreOrSaveToFile(ctx))
+			}
+
+			var kept *CUser
+			err := cDB.Tx(ctx, func(tx *Tx) error {
+				group, err := tx.NewGroup(ctx, "RA", "Admin", nil)
+				if err != nil {
+					return err
+				}
+				group.AddRole(5)
+				if err := group.StoreOrSaveToFile(ctx); err != nil {
+					return err
+				}
+				for _, id := range []string{"john", "jane"} {
+					if err := tx.Update(ctx, "RA", id, func(user *CUser) error {
+						user.Groups = append(user.Groups, "Admin")
+						return nil
+					}); err != nil {
+						return err
+					}
+				}
+				if err := tx.DeleteUser(ctx, "RA", "jack"); err != nil {
+					return err
+				}
+				// the changes are only visible within the transaction.
+				john, err := tx.GetUser(ctx, "RA", "john")
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"Admin"}, john.Groups)
+				_, err = tx.GetUser(ctx, "RA", "jack")
+				assert.True(t, errors.Is(err, ErrNotFound))
+				_, err = cDB.GetGroup(ctx, "RA", "Admin")
+				assert.True(t, errors.Is(err, ErrNotFound))
+				kept = john
+				return nil
+			})
+			assert.NoError(t, err)
+
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{"Admin"}, john.Groups)
+				assert.Equal(t, uint64(2), john.Version)
+			}
+			_, err = cDB.GetUser(ctx, "RA", "jack")
+			assert.True(t, errors.Is(err, ErrNotFound))
+			assert.True(t, IsRoleFlagOn(cDB.GetRoleMasksOfGroups(ctx, "RA", "Admin"), 5))
+			if _, ok := dataStore.(AuxStore); ok {
+				members, err := cDB.ListGroupMembers(ctx, "RA", "Admin", false)
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"jane", "john"}, members)
+			}
+
+			// users obtained within the transaction can not be saved into it afterward.
+			kept.Enable = false
+			assert.True(t, errors.Is(kept.StoreOrSaveToFile(ctx), ErrTxFinished))
+
+			// nothing is written when fn fails.
+			err = cDB.Tx(ctx, func(tx *Tx) error {
+				if err := tx.DeleteUser(ctx, "RA", "john"); err != nil {
+					return err
+				}
+				return errors.New("changed my mind")
+			})
+			assert.EqualError(t, err, "changed my mind")
+			_, err = cDB.GetUser(ctx, "RA", "john")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCredentaDB_TxConflict(t *testing.T) {
+	cDB := NewCredentaDBWithStore(NewMemoryStore())
+	ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+	for _, id := range []string{"john", "jane"} {
+		user, err := cDB.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+		assert.NoError(t, err)
+		assert.NoError(t, user.StoreOrSaveToFile(ctx))
+	}
+
+	err := cDB.Tx(ctx, func(tx *Tx) error {
+		if _, err := tx.GetUser(ctx, "RA", "jane"); err != nil {
+			return err
+		}
+		if err := tx.Update(ctx, "RA", "john", func(user *CUser) error {
+			user.Active = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		// jane is modified outside of the transaction after it was read.
+		return cDB.Update(ctx, "RA", "jane", func(user *CUser) error {
+			user.Enable = false
+			return nil
+		})
+	})
+	assert.True(t, errors.Is(err, ErrConflict))
+	conflict := &ConflictError{}
+	if assert.True(t, errors.As(err, &conflict)) {
+		assert.Equal(t, "jane", conflict.Key)
+	}
+	john, err := cDB.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.False(t, john.Active)
+}
+
+func TestCredentaDB_TxFailedAuth(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			assert.NoError(t, cDB.EnableLockout(FixedLockoutPolicy(5, time.Hour)))
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			user, err := cDB.NewUser(ctx, "RA", "john", "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+			assert.NoError(t, err)
+			user.Active = true
+			assert.NoError(t, user.StoreOrSaveToFile(ctx))
+
+			err = cDB.Tx(ctx, func(tx *Tx) error {
+				if err := tx.Update(ctx, "RA", "john", func(user *CUser) error {
+					user.Enable = false
+					return nil
+				}); err != nil {
+					return err
+				}
+				// the failed authentications are counted outside of the transaction meanwhile.
+				for i := 0; i < 2; i++ {
+					_, _, err := cDB.GetUserWithAuth(ctx, "RA", "john", "wrong")
+					assert.ErrorIs(t, err, ErrInvalidCredentials)
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+			john, err := cDB.GetUser(ctx, "RA", "john")
+			if assert.NoError(t, err) {
+				assert.False(t, john.Enable)
+				assert.Equal(t, 2, john.FailedAttempts)
+				assert.False(t, john.LastFailedAt.IsZero())
+			}
+		})
+	}
+}
+
+func TestCredentaDB_TxUniqueValue(t *testing.T) {
+	for name, dataStore := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cDB := NewCredentaDBWithStore(dataStore)
+			ctx := context.WithValue(context.Background(), ETX_USER, "TestUser")
+			assert.NoError(t, cDB.DeclareIndex(UserIndex{Attribute: "email", Unique: true}))
+			newUser := func(db interface {
+				NewUser(context.Context, string, string, string, []string, IdType, VerificationMethod) (*CUser, error)
+			}, id, email string) error {
+				user, err := db.NewUser(ctx, "RA", id, "password", nil, IdTypeUserId, VerificationMethodPLAIN)
+				if err != nil {
+					return err
+				}
+				if err := user.SetAttribute("email", "string", email); err != nil {
+					return err
+				}
+				return user.StoreOrSaveToFile(ctx)
+			}
+
+			// two overlapping transactions take the same value.
+			err := cDB.Tx(ctx, func(tx *Tx) error {
+				if err := newUser(tx, "a", "same@mail.com"); err != nil {
+					return err
+				}
+				return cDB.Tx(ctx, func(other *Tx) error {
+					return newUser(other, "b", "same@mail.com")
+				})
+			})
+			assert.True(t, errors.Is(err, ErrDuplicateValue), "%v", err)
+			users, err := cDB.FindUsersByAttribute(ctx, "RA", "email", "same@mail.com")
+			assert.NoError(t, err)
+			if assert.Len(t, users, 1) {
+				assert.Equal(t, "b", users[0].Id)
+			}
+
+			// a value released within the transaction can be taken by another user of it.
+			err = cDB.Tx(ctx, func(tx *Tx) error {
+				if err := tx.Update(ctx, "RA", "b", func(user *CUser) error {
+					user.RemoveAttribute("email")
+					return user.SetAttribute("email", "string", "b@mail.com")
+				}); err != nil {
+					return err
+				}
+				return newUser(tx, "c", "same@mail.com")
+			})
+			assert.NoError(t, err)
+			found, err := cDB.FindUserByAttribute(ctx, "RA", "email", "same@mail.com")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "c", found.Id)
+			}
+		})
+	}
+}
+
+func TestWriteBatch_Revert(t *testing.T) {
+	memStore := NewMemoryStore()
+	ctx := context.Background()
+	assert.NoError(t, memStore.PutUser(ctx, &CUser{Realm: "RA", Id: "john", Version: 1}))
+	err := writeBatch(ctx, &failingStore{memStore}, &Batch{
+		Users:        []*CUser{{Realm: "RA", Id: "john", Version: 2}, {Realm: "RA", Id: "jane", Version: 1}},
+		DeletedUsers: []RecordRef{{Realm: "RA", Key: "jack"}},
+		Groups:       []*CGroup{{Realm: "RA", Name: "Admin"}},
+	})
+	assert.EqualError(t, err, "disk full")
+	john, err := memStore.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), john.Version)
+	_, err = memStore.GetUser(ctx, "RA", "jane")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestFileStore_RecoverJournal(t *testing.T) {
+	fs := newTestFileStore(t)
+	ctx := context.Background()
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "john", Version: 1}))
+	assert.NoError(t, fs.WriteBatch(ctx, &Batch{Users: []*CUser{{Realm: "RA", Id: "john", Version: 2}}}))
+	entries, err := os.ReadDir(fs.BaseFolder + fs.JournalFolder)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "journal must be removed once the batch is written")
+
+	// a process stopped in the middle of a batch creating jane, updating john and jack and indexing jane.
+	marshal := func(user *CUser) []byte {
+		data, err := json.Marshal(user)
+		assert.NoError(t, err)
+		return data
+	}
+	before, err := os.ReadFile(fs.UserFilePath("RA", "john"))
+	assert.NoError(t, err)
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "jack", Version: 1}))
+	jackBefore, err := os.ReadFile(fs.UserFilePath("RA", "jack"))
+	assert.NoError(t, err)
+	indexKey := auxKey("RA", "email", "jane@mail.com", "jane")
+	journal := &fileJournal{Files: []*journalFile{
+		{Kind: RecordUser, Realm: "RA", Key: "jane", Path: strings.TrimPrefix(fs.UserFilePath("RA", "jane"), fs.BaseFolder),
+			After: marshal(&CUser{Realm: "RA", Id: "jane", Version: 1})},
+		{Kind: RecordUser, Realm: "RA", Key: "john", Path: strings.TrimPrefix(fs.UserFilePath("RA", "john"), fs.BaseFolder), Data: before,
+			After: marshal(&CUser{Realm: "RA", Id: "john", Version: 3})},
+		{Kind: RecordUser, Realm: "RA", Key: "jack", Path: strings.TrimPrefix(fs.UserFilePath("RA", "jack"), fs.BaseFolder), Data: jackBefore,
+			After: marshal(&CUser{Realm: "RA", Id: "jack", Version: 2})},
+		{Bucket: auxIndexBucket, Key: indexKey, Path: strings.TrimPrefix(fs.auxPath(auxIndexBucket, indexKey), fs.BaseFolder), After: []byte("jane")},
+	}}
+	data, err := json.Marshal(journal)
+	assert.NoError(t, err)
+	journalPath := fs.BaseFolder + fs.JournalFolder + "/1" + journalFileSuffix
+	assert.NoError(t, os.WriteFile(journalPath, data, 0644))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "jane", Version: 1}))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "john", Version: 3}))
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "jack", Version: 2}))
+	assert.NoError(t, fs.PutAux(ctx, auxIndexBucket, indexKey, []byte("jane")))
+	// jack was updated again by another process after the batch stopped.
+	assert.NoError(t, fs.PutUser(ctx, &CUser{Realm: "RA", Id: "jack", Version: 5}))
+
+	reopened, err := NewFileStore(fs.BaseFolder, fs.UserFolder, fs.GroupFolder)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{journalPath}, reopened.LastRecovery.RolledBackJournals)
+	assert.False(t, pathExists(journalPath))
+	john, err := reopened.GetUser(ctx, "RA", "john")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), john.Version)
+	_, err = reopened.GetUser(ctx, "RA", "jane")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	_, err = reopened.GetAux(ctx, auxIndexBucket, indexKey)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	jack, err := reopened.GetUser(ctx, "RA", "jack")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), jack.Version, "a record written after the batch must be kept")
+	locks, err := os.ReadDir(reopened.BaseFolder + reopened.AuxFolder + auxLockFolder)
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+}
@@ -0,0 +1,62 @@
+package credenta
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrWatchNotSupported is returned by CredentaDB.Watch when the Store does not implement Watcher.
+var ErrWatchNotSupported = errors.New("store does not support watching")
+
+const (
+	// ChangeAdded means a record that was not known before appeared in the store.
+	ChangeAdded ChangeOp = "ADDED"
+	// ChangeModified means an existing record have been modified.
+	ChangeModified ChangeOp = "MODIFIED"
+	// ChangeDeleted means an existing record have been removed from the store.
+	ChangeDeleted ChangeOp = "DELETED"
+)
+
+// ChangeOp specify what happened to a record in a ChangeEvent.
+type ChangeOp string
+
+// ChangeEvent describe a change of a user or group record made outside of credenta, for example by editing
+// the record file by hand.
+type ChangeEvent struct {
+	Kind  RecordKind `json:"kind"`
+	Op    ChangeOp   `json:"op"`
+	Realm string     `json:"realm"`
+	// Key is the user id or the group name.
+	Key  string `json:"key"`
+	Path string `json:"path,omitempty"`
+	// Err is not nil if the added or modified record is not valid, e.g. it is not a valid JSON.
+	Err error `json:"-"`
+}
+
+// Watcher is implemented by Store that is able to notice changes of its records made outside of credenta.
+type Watcher interface {
+	// Watch starts watching the store in background and call handler for every change, until the ctx is done.
+	// It returns an error if the watch could not be started.
+	Watch(ctx context.Context, handler func(event ChangeEvent)) error
+}
+
+// Watch starts watching the Store for changes made outside of credenta, until ctx is done. Every change invalidates
+// the cached record (see EnableCache) and then passed into handler, which may be nil.
+// It returns an error if the Store does not implement Watcher.
+func (store *CredentaDB) Watch(ctx context.Context, handler func(event ChangeEvent)) error {
+	watcher, ok := store.Store.(Watcher)
+	if !ok {
+		return ErrWatchNotSupported
+	}
+	return watcher.Watch(ctx, func(event ChangeEvent) {
+		switch event.Kind {
+		case RecordUser:
+			store.invalidateUser(event.Realm, event.Key)
+		case RecordGroup:
+			store.invalidateGroup(event.Realm, event.Key)
+		}
+		if handler != nil {
+			handler(event)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+// Command credenta is the maintenance tool of credenta data stores.
+//
+// Usage:
+//
+//	credenta <command> [flags]
+//
+// The store is configured using the same environment variables as credenta.NewCredentaDB.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/newm4n/credenta"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a credenta sub command.
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {
+		usage: "write the users, groups and auxiliary records into a backup archive",
+		run:   backup,
+	},
+	"export": {
+		usage: "write the users or groups into stdout as JSON Lines or CSV",
+		run:   export,
+	},
+	"import": {
+		usage: "create or update users or groups from a JSON Lines or CSV file",
+		run:   importRows,
+	},
+	"migrate-filenames": {
+		usage: "rename file store records created by older version into the current file name encoding",
+		run:   migrateFileNames,
+	},
+	"migrate-layout": {
+		usage: "move file store records into the flat or sharded layout of the specified depth",
+		run:   migrateLayout,
+	},
+	"purge-trash": {
+		usage: "permanently remove the deleted users and groups kept in the trash longer than the retention",
+		run:   purgeTrash,
+	},
+	"reencrypt": {
+		usage: "seal every record with the primary key of CREDENTA_KEK_FILE or CREDENTA_KEK, after a key rotation",
+		run:   reEncrypt,
+	},
+	"restore": {
+		usage: "replace the content of the store by a backup archive, once verified",
+		run:   restore,
+	},
+	"unlock": {
+		usage: "clear the failed authentications and lockout of a user",
+		run:   unlockUser,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(context.Background(), os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: credenta <command> [flags]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, commands[name].usage)
+	}
+}
+
+// printJSON writes v as indented JSON into stdout.
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func migrateFileNames(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-filenames", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be renamed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	fileStore, err := credenta.NewFileStoreFromEnv()
+	if err != nil {
+		return err
+	}
+	report, err := fileStore.MigrateFileNames(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d record files could not be renamed", len(report.Failed))
+	}
+	return nil
+}
+
+func migrateLayout(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	depth := flags.Int("depth", 2, "the new shard depth, 0 for the flat layout")
+	dryRun := flags.Bool("dry-run", false, "only report what would be moved")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	fileStore, err := credenta.NewFileStoreFromEnv()
+	if err != nil {
+		return err
+	}
+	report, err := fileStore.MigrateLayout(ctx, *depth, *dryRun)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d record files could not be moved", len(report.Failed))
+	}
+	if !*dryRun {
+		fmt.Fprintf(os.Stderr, "set CREDENTA_SHARD_DEPTH=%d before starting credenta\n", *depth)
+	}
+	return nil
+}
+
+func purgeTrash(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("purge-trash", flag.ExitOnError)
+	retention := flags.Duration("retention", 30*24*time.Hour, "how long deleted records are kept in the trash")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	if err := cDB.EnableTrash(*retention); err != nil {
+		return err
+	}
+	purged, err := cDB.PurgeTrash(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]int{"purged": purged})
+}
+
+func reEncrypt(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	sealed, err := cDB.ReEncrypt(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]int{"sealed": sealed})
+}
+
+func unlockUser(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("unlock", flag.ExitOnError)
+	realm := flags.String("realm", "", "the realm of the user, CREDENTA_REALM_DEFAULT if empty")
+	id := flags.String("id", "", "the id of the user to unlock")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	if *realm == "" {
+		*realm = cDB.DefaultRealm
+	}
+	return cDB.UnlockUser(context.WithValue(ctx, credenta.ETX_USER, "credenta"), *realm, *id)
+}
+
+// realmList split the comma separated list of a flag.
+func realmList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+func backup(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "credenta-backup.gz", "the archive file to write")
+	realms := flags.String("realms", "", "comma separated realms to back up, every realm if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	manifest, err := cDB.Backup(context.WithValue(ctx, credenta.ETX_USER, "credenta"), file, realmList(*realms)...)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return printJSON(manifest)
+}
+
+func restore(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("i", "credenta-backup.gz", "the archive file to read")
+	realms := flags.String("realms", "", "comma separated realms to restore, every realm of the archive if empty")
+	verifyOnly := flags.Bool("verify", false, "only verify the archive")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	file, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if *verifyOnly {
+		manifest, err := credenta.VerifyBackup(file)
+		if err != nil {
+			return err
+		}
+		return printJSON(manifest)
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	manifest, err := cDB.Restore(ctx, file, realmList(*realms)...)
+	if err != nil {
+		return err
+	}
+	return printJSON(manifest)
+}
+
+func export(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	kind := flags.String("kind", "users", "what to export, users or groups")
+	format := flags.String("format", "JSONL", "the output format, JSONL or CSV")
+	realms := flags.String("realms", "", "comma separated realms to export, every realm if empty")
+	columns := flags.String("columns", "", "comma separated CSV columns, the default columns if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	options := credenta.ExportOptions{Format: credenta.BulkFormat(strings.ToUpper(*format)), Realms: realmList(*realms)}
+	if *columns != "" {
+		options.Columns = strings.Split(*columns, ",")
+	}
+	var count int
+	switch *kind {
+	case "users":
+		count, err = cDB.ExportUsers(ctx, os.Stdout, options)
+	case "groups":
+		count, err = cDB.ExportGroups(ctx, os.Stdout, options)
+	default:
+		return fmt.Errorf("unknown kind %s", *kind)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d %s\n", count, *kind)
+	return nil
+}
+
+func importRows(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	kind := flags.String("kind", "users", "what to import, users or groups")
+	input := flags.String("i", "", "the file to import, stdin if empty")
+	format := flags.String("format", "JSONL", "the input format, JSONL or CSV")
+	realm := flags.String("realm", "", "the realm of the rows without one")
+	columns := flags.String("columns", "", "comma separated column=field renames, e.g. Login=id,E-Mail=attribute.email")
+	method := flags.String("method", "ARGON", "the verification method of plain passwords")
+	dryRun := flags.Bool("dry-run", false, "only validate the rows and report what would be done")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	options := credenta.ImportOptions{
+		Format:  credenta.BulkFormat(strings.ToUpper(*format)),
+		Realm:   *realm,
+		Columns: make(map[string]string),
+		Method:  credenta.VerificationMethod(*method),
+		DryRun:  *dryRun,
+	}
+	for _, rename := range realmList(*columns) {
+		column, field, ok := strings.Cut(rename, "=")
+		if !ok {
+			return fmt.Errorf("invalid column rename %q", rename)
+		}
+		options.Columns[column] = field
+	}
+	reader := os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	cDB, err := credenta.NewCredentaDB()
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, credenta.ETX_USER, "credenta")
+	var report *credenta.ImportReport
+	switch *kind {
+	case "users":
+		report, err = cDB.ImportUsers(ctx, reader, options)
+	case "groups":
+		report, err = cDB.ImportGroups(ctx, reader, options)
+	default:
+		return fmt.Errorf("unknown kind %s", *kind)
+	}
+	if err != nil {
+		return err
+	}
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d rows could not be imported", report.Failed)
+	}
+	return nil
+}